@@ -19,6 +19,7 @@ import (
 	"github.com/zalando/skipper"
 	"github.com/zalando/skipper/dataclients/kubernetes"
 	"github.com/zalando/skipper/eskip"
+	ratelimitfilters "github.com/zalando/skipper/filters/ratelimit"
 	"github.com/zalando/skipper/proxy"
 	"github.com/zalando/skipper/ratelimit"
 	"github.com/zalando/skipper/swarm"
@@ -51,10 +52,20 @@ type Config struct {
 	RemoveHopHeaders                bool           `yaml:"remove-hop-headers"`
 	RfcPatchPath                    bool           `yaml:"rfc-patch-path"`
 	MaxAuditBody                    int            `yaml:"max-audit-body"`
+	AuditLogClaimValues             bool           `yaml:"audit-log-claim-values"`
 	EnableBreakers                  bool           `yaml:"enable-breakers"`
 	Breakers                        breakerFlags   `yaml:"breaker"`
 	EnableRatelimiters              bool           `yaml:"enable-ratelimits"`
 	Ratelimits                      ratelimitFlags `yaml:"ratelimits"`
+	InMemoryClusterRatelimits       bool           `yaml:"in-memory-cluster-ratelimits"`
+	RatelimitCostHeader             string         `yaml:"ratelimit-cost-header"`
+	RatelimitMaxCost                int            `yaml:"ratelimit-max-cost"`
+	RatelimitSoftLimit              float64        `yaml:"ratelimit-soft-limit"`
+	RatelimitRetryAfterDate         bool           `yaml:"ratelimit-retry-after-date"`
+	RatelimitNormalizeKeys          bool           `yaml:"ratelimit-normalize-keys"`
+	RatelimitBypassCIDRs            *listFlag      `yaml:"ratelimit-bypass-cidrs"`
+	RatelimitTrustedProxies         int            `yaml:"ratelimit-trusted-proxies"`
+	RatelimitBackendErrorStatus     int            `yaml:"ratelimit-backend-error-status"`
 	EnableRouteLIFOMetrics          bool           `yaml:"enable-route-lifo-metrics"`
 	MetricsFlavour                  *listFlag      `yaml:"metrics-flavour"`
 	FilterPlugins                   *pluginFlag    `yaml:"filter-plugin"`
@@ -147,6 +158,10 @@ type Config struct {
 	Oauth2TokenURL                  string        `yaml:"oauth2-token-url"`
 	Oauth2TokeninfoURL              string        `yaml:"oauth2-tokeninfo-url"`
 	Oauth2TokeninfoTimeout          time.Duration `yaml:"oauth2-tokeninfo-timeout"`
+	Oauth2TokeninfoScopesIgnoreCase bool          `yaml:"oauth2-tokeninfo-scopes-ignore-case"`
+	Oauth2TokeninfoUserKeys         *listFlag     `yaml:"oauth2-tokeninfo-user-keys"`
+	Oauth2TokenDenylistURL          string        `yaml:"oauth2-token-denylist-url"`
+	Oauth2TokenDenylistRefresh      time.Duration `yaml:"oauth2-token-denylist-refresh-interval"`
 	Oauth2SecretFile                string        `yaml:"oauth2-secret-file"`
 	Oauth2ClientID                  string        `yaml:"oauth2-client-id"`
 	Oauth2ClientSecret              string        `yaml:"oauth2-client-secret"`
@@ -155,14 +170,44 @@ type Config struct {
 	Oauth2AuthURLParameters         mapFlags      `yaml:"oauth2-auth-url-parameters"`
 	Oauth2CallbackPath              string        `yaml:"oauth2-callback-path"`
 	Oauth2TokenintrospectionTimeout time.Duration `yaml:"oauth2-tokenintrospect-timeout"`
+	Oauth2BreakerFailures           int           `yaml:"oauth2-breaker-failures"`
+	Oauth2BreakerWindow             time.Duration `yaml:"oauth2-breaker-window"`
+	Oauth2BreakerTimeout            time.Duration `yaml:"oauth2-breaker-timeout"`
+	Oauth2BreakerFailOpen           bool          `yaml:"oauth2-breaker-fail-open"`
+	Oauth2MaxInflight               int           `yaml:"oauth2-max-inflight"`
+	Oauth2InflightMaxWait           time.Duration `yaml:"oauth2-inflight-max-wait"`
+	Oauth2InflightFailOpen          bool          `yaml:"oauth2-inflight-fail-open"`
+	Oauth2JWKSMaxResponseSize       int           `yaml:"oauth2-jwks-max-response-size"`
+	Oauth2JWKSTimeout               time.Duration `yaml:"oauth2-jwks-timeout"`
+	Oauth2MaxIdleConns              int           `yaml:"oauth2-max-idle-conns"`
+	Oauth2IdleConnTimeout           time.Duration `yaml:"oauth2-idle-conn-timeout"`
+	Oauth2DialTimeout               time.Duration `yaml:"oauth2-dial-timeout"`
+	Oauth2TLSHandshakeTimeout       time.Duration `yaml:"oauth2-tls-handshake-timeout"`
+	Oauth2ForceHTTP2                bool          `yaml:"oauth2-force-http2"`
 	Oauth2AccessTokenHeaderName     string        `yaml:"oauth2-access-token-header-name"`
 	Oauth2TokeninfoSubjectKey       string        `yaml:"oauth2-tokeninfo-subject-key"`
 	Oauth2TokenCookieName           string        `yaml:"oauth2-token-cookie-name"`
 	WebhookTimeout                  time.Duration `yaml:"webhook-timeout"`
+	Oauth2PolicyTimeout             time.Duration `yaml:"oauth2-policy-timeout"`
+	Oauth2PolicyCacheTTL            time.Duration `yaml:"oauth2-policy-cache-ttl"`
+	Oauth2PolicyFailOpen            bool          `yaml:"oauth2-policy-fail-open"`
 	OidcSecretsFile                 string        `yaml:"oidc-secrets-file"`
 	CredentialPaths                 *listFlag     `yaml:"credentials-paths"`
 	CredentialsUpdateInterval       time.Duration `yaml:"credentials-update-interval"`
 
+	Oauth2TokenintrospectionActiveField      string        `yaml:"oauth2-tokenintrospect-active-field"`
+	Oauth2TokenintrospectionActiveValues     *listFlag     `yaml:"oauth2-tokenintrospect-active-values"`
+	Oauth2TokenintrospectionTokenStyle       string        `yaml:"oauth2-tokenintrospect-token-style"`
+	Oauth2TokenintrospectionCredentialStyle  string        `yaml:"oauth2-tokenintrospect-credential-style"`
+	Oauth2TokenintrospectionNegativeCacheTTL time.Duration `yaml:"oauth2-tokenintrospect-negative-cache-ttl"`
+	Oauth2TokenintrospectionClientSecretFile string        `yaml:"oauth2-tokenintrospect-client-secret-file"`
+	Oauth2TokenintrospectionClaimsPath       string        `yaml:"oauth2-tokenintrospect-claims-path"`
+
+	Oauth2TokenintrospectionFreshnessSampleRate float64       `yaml:"oauth2-tokenintrospect-freshness-sample-rate"`
+	Oauth2TokenintrospectionFreshnessInterval   time.Duration `yaml:"oauth2-tokenintrospect-freshness-interval"`
+
+	Oauth2DPoPTrustForwardedProto bool `yaml:"oauth2-dpop-trust-forwarded-proto"`
+
 	// TLS client certs
 	ClientKeyFile  string            `yaml:"client-tls-key"`
 	ClientCertFile string            `yaml:"client-tls-cert"`
@@ -203,12 +248,49 @@ type Config struct {
 	// swarm:
 	EnableSwarm bool `yaml:"enable-swarm"`
 	// redis based
-	SwarmRedisURLs         *listFlag     `yaml:"swarm-redis-urls"`
-	SwarmRedisReadTimeout  time.Duration `yaml:"swarm-redis-read-timeout"`
-	SwarmRedisWriteTimeout time.Duration `yaml:"swarm-redis-write-timeout"`
-	SwarmRedisPoolTimeout  time.Duration `yaml:"swarm-redis-pool-timeout"`
-	SwarmRedisMinConns     int           `yaml:"swarm-redis-min-conns"`
-	SwarmRedisMaxConns     int           `yaml:"swarm-redis-max-conns"`
+	SwarmRedisURLs         *listFlag      `yaml:"swarm-redis-urls"`
+	SwarmRedisReadTimeout  time.Duration  `yaml:"swarm-redis-read-timeout"`
+	SwarmRedisWriteTimeout time.Duration  `yaml:"swarm-redis-write-timeout"`
+	SwarmRedisAddrTimeouts mapFlags       `yaml:"swarm-redis-addr-timeouts"`
+	SwarmRedisPoolTimeout  time.Duration  `yaml:"swarm-redis-pool-timeout"`
+	SwarmRedisMinConns     int            `yaml:"swarm-redis-min-conns"`
+	SwarmRedisMaxConns     int            `yaml:"swarm-redis-max-conns"`
+	SwarmRedisRings        *listFlag      `yaml:"swarm-redis-rings"`
+	SwarmRedisGroupRings   mapFlags       `yaml:"swarm-redis-group-rings"`
+	SwarmRedisGroupRingIdx map[string]int `yaml:"-"`
+	SwarmRedisTraceSample  float64        `yaml:"swarm-redis-trace-sample-rate"`
+	SwarmRedisTraceByKey   bool           `yaml:"swarm-redis-trace-sample-by-key"`
+	SwarmRedisSpanPrefix   string         `yaml:"swarm-redis-trace-span-prefix"`
+	SwarmRedisSpanNames    mapFlags       `yaml:"swarm-redis-trace-span-names"`
+	SwarmRedisTraceTags    mapFlags       `yaml:"swarm-redis-trace-tags"`
+	SwarmRedisZAddRetries  int            `yaml:"swarm-redis-zadd-retries"`
+	SwarmRedisZAddDelay    time.Duration  `yaml:"swarm-redis-zadd-retry-delay"`
+
+	SwarmRedisAddrTimeoutMap map[string]ratelimit.RedisTimeouts `yaml:"-"`
+
+	SwarmRedisTLS             bool      `yaml:"swarm-redis-tls"`
+	SwarmRedisTLSMinVersion   string    `yaml:"swarm-redis-tls-min-version"`
+	SwarmRedisTLSCipherSuites *listFlag `yaml:"swarm-redis-tls-cipher-suites"`
+
+	SwarmRedisGroupMetrics bool `yaml:"swarm-redis-group-metrics"`
+
+	SwarmRedisBatchWindow time.Duration `yaml:"swarm-redis-batch-window"`
+	SwarmRedisBatchSize   int           `yaml:"swarm-redis-batch-size"`
+
+	SwarmRedisRetryAfterCacheTTL time.Duration `yaml:"swarm-redis-retry-after-cache-ttl"`
+
+	SwarmRedisOverridesRefreshInterval time.Duration `yaml:"swarm-redis-overrides-refresh-interval"`
+
+	SwarmRedisKillSwitchRefreshInterval time.Duration `yaml:"swarm-redis-kill-switch-refresh-interval"`
+
+	SwarmRedisLimitsFile            string        `yaml:"swarm-redis-limits-file"`
+	SwarmRedisLimitsRefreshInterval time.Duration `yaml:"swarm-redis-limits-refresh-interval"`
+
+	SwarmRedisUseServerTime bool `yaml:"swarm-redis-use-server-time"`
+
+	SwarmRedisFailClosed bool `yaml:"swarm-redis-fail-closed"`
+
+	SwarmRedisDrainTimeout time.Duration `yaml:"swarm-redis-drain-timeout"`
 	// swim based
 	SwarmKubernetesNamespace          string        `yaml:"swarm-namespace"`
 	SwarmKubernetesLabelSelectorKey   string        `yaml:"swarm-label-selector-key"`
@@ -253,8 +335,10 @@ const (
 
 	// Auth:
 	defaultOAuthTokeninfoTimeout          = 2 * time.Second
+	defaultOAuthTokenDenylistRefresh      = time.Minute
 	defaultOAuthTokenintrospectionTimeout = 2 * time.Second
 	defaultWebhookTimeout                 = 2 * time.Second
+	defaultOAuthIdleConnTimeout           = 90 * time.Second
 	defaultCredentialsUpdateInterval      = 10 * time.Minute
 
 	// API Monitoring
@@ -292,6 +376,7 @@ const (
 	enableHopHeadersRemovalUsage         = "enables removal of Hop-Headers according to RFC-2616"
 	rfcPatchPathUsage                    = "patches the incoming request path to preserve uncoded reserved characters according to RFC 2616 and RFC 3986"
 	maxAuditBodyUsage                    = "sets the max body to read to log in the audit log body"
+	auditLogClaimValuesUsage             = "enables logging the values of the claims checked by the auth filters in the audit log, by default only the claim keys are logged"
 	enableRouteLIFOMetricsUsage          = "enable metrics for the individual route LIFO queues"
 
 	// logging, metrics, tracing:
@@ -372,6 +457,10 @@ const (
 	oauth2TokenURLUsage                  = "the url where the access code should be exchanged for the access token"
 	oauth2TokeninfoURLUsage              = "sets the default tokeninfo URL to query information about an incoming OAuth2 token in oauth2Tokeninfo filters"
 	oauth2TokeninfoTimeoutUsage          = "sets the default tokeninfo request timeout duration to 2000ms"
+	oauth2TokeninfoScopesIgnoreCaseUsage = "compare the scopes in oauthTokeninfoAnyScope and oauthTokeninfoAllScope filters case-insensitively"
+	oauth2TokeninfoUserKeysUsage         = "comma separated, prioritized list of keys in the tokeninfo map, whose first available value is logged as the user of the request, defaults to uid"
+	oauth2TokenDenylistURLUsage          = "sets the URL of the JSON document listing the revoked token IDs (jti) and subjects (sub), enables the oauthTokenDenylist filter"
+	oauth2TokenDenylistRefreshUsage      = "sets the interval of fetching the token denylist"
 	oauth2SecretFileUsage                = "sets the filename with the encryption key for the authentication cookie and grant flow state stored in secrets registry"
 	oauth2ClientIDUsage                  = "sets the OAuth2 client id of the current service, used to exchange the access code"
 	oauth2ClientSecretUsage              = "sets the OAuth2 client secret associated with the oauth2-client-id, used to exchange the access code"
@@ -379,15 +468,44 @@ const (
 	oauth2ClientSecretFileUsage          = "sets the path of the file containing the OAuth2 client secret associated with the oauth2-client-id, used to exchange the access code"
 	oauth2CallbackPathUsage              = "sets the path where the OAuth2 callback requests with the authorization code should be redirected to"
 	oauth2TokenintrospectionTimeoutUsage = "sets the default tokenintrospection request timeout duration to 2000ms"
+	oauth2BreakerFailuresUsage           = "number of consecutive failed calls to the tokeninfo or tokenintrospection endpoint, that open the circuit breaker, 0 disables the breaker"
+	oauth2BreakerWindowUsage             = "interval after which the failure counts of the closed tokeninfo and tokenintrospection circuit breakers are cleared"
+	oauth2BreakerTimeoutUsage            = "duration of the open state of the tokeninfo and tokenintrospection circuit breakers, before a probe call is allowed, defaults to 10s"
+	oauth2BreakerFailOpenUsage           = "when set, requests pass without token validation while the tokeninfo or tokenintrospection circuit breaker is open, otherwise they are rejected"
+	oauth2MaxInflightUsage               = "maximum number of concurrent calls to each tokeninfo or tokenintrospection endpoint, 0 means no limit"
+	oauth2InflightMaxWaitUsage           = "maximum duration a call to the tokeninfo or tokenintrospection endpoint waits for a free slot, when -oauth2-max-inflight is reached, 0 means the calls fail fast"
+	oauth2InflightFailOpenUsage          = "when set, requests pass without token validation, when no slot is available for the call to the tokeninfo or tokenintrospection endpoint, otherwise they are rejected"
+	oauth2JWKSMaxResponseSizeUsage       = "maximum size in bytes of the JWKS responses used to validate tokens locally, larger responses are rejected, defaults to 1MiB"
+	oauth2JWKSTimeoutUsage               = "timeout of fetching the JWKS used to validate tokens locally, defaults to 2s"
+	oauth2MaxIdleConnsUsage              = "limits the idle connections of the tokeninfo, tokenintrospection and webhook clients to all hosts, 0 means no limit, the limit per host is set by -idle-conns-num"
+	oauth2IdleConnTimeoutUsage           = "sets how long the idle connections to the tokeninfo, tokenintrospection and webhook endpoints are kept open"
+	oauth2DialTimeoutUsage               = "sets the timeout of new connections to the tokeninfo, tokenintrospection and webhook endpoints, defaults to the timeout of the filters"
+	oauth2TLSHandshakeTimeoutUsage       = "sets the timeout of the TLS handshakes with the tokeninfo, tokenintrospection and webhook endpoints, defaults to the timeout of the filters"
+	oauth2ForceHTTP2Usage                = "attempts to use HTTP/2 for the TLS connections to the tokeninfo, tokenintrospection and webhook endpoints"
 	oauth2AuthURLParametersUsage         = "sets additional parameters to send when calling the OAuth2 authorize or token endpoints as key-value pairs"
 	oauth2AccessTokenHeaderNameUsage     = "sets the access token to a header on the request with this name"
 	oauth2TokeninfoSubjectKeyUsage       = "the key containing the subject ID in the tokeninfo map"
 	oauth2TokenCookieNameUsage           = "sets the name of the cookie where the encrypted token is stored"
 	webhookTimeoutUsage                  = "sets the webhook request timeout duration, defaults to 2s"
+	oauth2PolicyTimeoutUsage             = "sets the timeout of the calls of the oauthPolicy filter to the policy service, defaults to 2s"
+	oauth2PolicyCacheTTLUsage            = "sets how long the decisions of the policy service are cached per subject, resource and action, defaults to 10s, a negative value disables the cache"
+	oauth2PolicyFailOpenUsage            = "when set, requests pass the oauthPolicy filter, when the policy service fails, otherwise they are rejected"
 	oidcSecretsFileUsage                 = "file storing the encryption key of the OID Connect token"
 	credentialPathsUsage                 = "directories or files to watch for credentials to use by bearerinjector filter"
 	credentialsUpdateIntervalUsage       = "sets the interval to update secrets"
 
+	oauth2TokenintrospectionActiveFieldUsage      = "sets the field of the tokenintrospection response, that tells whether the token is active, defaults to active"
+	oauth2TokenintrospectionActiveValuesUsage     = "comma separated list of the values of the tokenintrospection active field, that mark the token active, e.g. true,valid, by default the field has to be the boolean true"
+	oauth2TokenintrospectionTokenStyleUsage       = "sets how the token is sent to the tokenintrospection endpoint, body or query, defaults to body"
+	oauth2TokenintrospectionCredentialStyleUsage  = "sets how the secure tokenintrospection filters send the client credentials, client_secret_basic or client_secret_post, defaults to client_secret_basic"
+	oauth2TokenintrospectionClientSecretFileUsage = "path to the file containing the client secret of the secure tokenintrospection filters, that don't set the secret, the file is reloaded every -credentials-update-interval to pick up rotated secrets"
+	oauth2TokenintrospectionClaimsPathUsage       = "sets the dot separated path of the object in the tokenintrospection response, that contains the claims, defaults to the top-level of the response"
+	oauth2TokenintrospectionNegativeCacheTTLUsage = "when set, tokens reported inactive by the tokenintrospection endpoint are rejected without calling the endpoint for this duration, should be a few seconds, limited to 1m, 0 disables the cache"
+
+	oauth2TokenintrospectionFreshnessSampleRateUsage = "fraction of the requests, between 0 and 1, with tokens validated locally by the hybrid tokenintrospection filters, that are re-validated against the tokenintrospection endpoint to reject revoked tokens, 0 disables the sampling"
+	oauth2DPoPTrustForwardedProtoUsage               = "when set, the oauthDPoP filter takes the scheme of the request URL, that the proofs are bound to, from the X-Forwarded-Proto header, enable only behind proxies, that set the header"
+	oauth2TokenintrospectionFreshnessIntervalUsage   = "when set, the tokens validated locally by the hybrid tokenintrospection filters are re-validated against the tokenintrospection endpoint at most this long after their last validation, 0 disables the periodic re-validation"
+
 	// TLS client certs
 	clientKeyFileUsage  = "TLS Key file for backend connections, multiple keys may be given comma separated - the order must match the certs"
 	clientCertFileUsage = "TLS certificate files for backend connections, multiple keys may be given comma separated - the order must match the keys"
@@ -442,7 +560,41 @@ const (
 	swarmRedisWriteTimeoutUsage            = "set redis socket write timeout"
 	swarmRedisPoolTimeoutUsage             = "set redis get connection from pool timeout"
 	swarmRedisMaxConnsUsage                = "set max number of connections to redis"
+	swarmRedisRingsUsage                   = "additional Redis rings as semicolon separated list of comma separated Redis URLs, cluster ratelimit groups are distributed across all rings"
+	swarmRedisAddrTimeoutsUsage            = "overrides the read and write timeouts of Redis shards as comma separated address=duration pairs, e.g. for shards in a remote region"
+	swarmRedisGroupRingsUsage              = "assigns cluster ratelimit groups to Redis rings as comma separated group=index pairs, 0 is the ring of -swarm-redis-urls and 1 to N the rings of -swarm-redis-rings"
 	swarmRedisMinConnsUsage                = "set min number of connections to redis"
+	swarmRedisTraceSampleRateUsage         = "fraction of the cluster ratelimit calls between 0 and 1, that create tracing spans for the Redis queries"
+	swarmRedisTraceSampleByKeyUsage        = "samples the cluster ratelimit calls for tracing by the ratelimit key instead of randomly"
+	swarmRedisTraceSpanPrefixUsage         = "prefix of the names of the tracing spans of the Redis queries, e.g. skipper. makes redis_allow_check_card skipper.redis_allow_check_card"
+	swarmRedisTraceSpanNamesUsage          = "replaces the names of the tracing spans of the Redis queries as comma separated name=replacement pairs, e.g. redis_allow_check_card=ratelimit.check, the replacements are not prefixed"
+	swarmRedisTraceTagsUsage               = "static tags of the tracing spans of the Redis queries as comma separated key=value pairs, e.g. environment=production,cluster=eu-1"
+	swarmRedisZAddRetriesUsage             = "number of retries of a failed ZADD, that records a hit of a cluster ratelimit, negative values disable the retries"
+	swarmRedisZAddRetryDelayUsage          = "delay before retrying a failed ZADD of a cluster ratelimit"
+
+	swarmRedisTLSUsage             = "enables TLS for the connections to Redis"
+	swarmRedisTLSMinVersionUsage   = "minimum TLS version of the connections to Redis, 1.2 or 1.3, enables TLS"
+	swarmRedisTLSCipherSuitesUsage = "comma separated list of the allowed TLS 1.2 cipher suites of the connections to Redis, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, enables TLS"
+
+	swarmRedisGroupMetricsUsage = "enables the allows and forbids counters of the Redis based cluster ratelimits per group, e.g. swarm.redis.allows.<group>, with a metric per group"
+
+	swarmRedisBatchWindowUsage = "enables batching the checks of concurrent cluster ratelimit calls into a single Redis pipeline, sent after the window, e.g. 500us, 0 disables batching"
+	swarmRedisBatchSizeUsage   = "maximum number of checks of a Redis batch, a full batch is sent before the end of the window"
+
+	swarmRedisRetryAfterCacheTTLUsage = "enables caching the result of the Retry-After query of the Redis based cluster ratelimits per key for the TTL, e.g. 200ms, 0 disables the cache"
+
+	swarmRedisOverridesRefreshIntervalUsage = "enables the per key max hits overrides of the Redis based cluster ratelimits, loaded from the Redis hash ratelimit.overrides.<group>, and refreshed after the interval, 0 disables the overrides"
+
+	swarmRedisKillSwitchRefreshIntervalUsage = "enables the kill switches of the Redis based cluster ratelimits, read from the Redis key ratelimit.killswitch.<group>, and refreshed after the interval, when a key is set to true, the ratelimit of the group allows all requests, 0 disables the kill switches"
+
+	swarmRedisLimitsFileUsage            = "path of a YAML file with the max hits and the time windows of the Redis based cluster ratelimit groups, e.g. 'my-group: {maxHits: 100, timeWindow: 1m}', that replace the limits of the routes, the file is watched for changes, and the groups use the limits of the routes, when it is invalid"
+	swarmRedisLimitsRefreshIntervalUsage = "enables the max hits and time windows of the Redis based cluster ratelimit groups, loaded from the fields maxHits and timeWindow of the Redis hash ratelimit.limits.<group>, and refreshed after the interval, takes precedence over -swarm-redis-limits-file, 0 disables the limits stored in Redis"
+
+	swarmRedisUseServerTimeUsage = "use the clock of the Redis shards instead of the local clock for the Redis based cluster ratelimits, so skewed clocks of the Skipper instances don't evict each others hits, costs a TIME roundtrip per shard every 10s"
+
+	swarmRedisFailClosedUsage = "deny the requests of the Redis based cluster ratelimits, when Redis fails, instead of allowing them, the denied requests get the status of -ratelimit-backend-error-status"
+
+	swarmRedisDrainTimeoutUsage = "maximum time to wait for the in-flight Redis based cluster ratelimit calls on shutdown, before closing the Redis connections, negative values disable the waiting"
 )
 
 func NewConfig() *Config {
@@ -454,7 +606,12 @@ func NewConfig() *Config {
 	cfg.DataclientPlugins = newPluginFlag()
 	cfg.MultiPlugins = newPluginFlag()
 	cfg.CredentialPaths = commaListFlag()
+	cfg.Oauth2TokeninfoUserKeys = commaListFlag()
+	cfg.Oauth2TokenintrospectionActiveValues = commaListFlag()
 	cfg.SwarmRedisURLs = commaListFlag()
+	cfg.SwarmRedisRings = newListFlag(";")
+	cfg.SwarmRedisTLSCipherSuites = commaListFlag()
+	cfg.RatelimitBypassCIDRs = commaListFlag()
 	cfg.AppendFilters = &defaultFiltersFlags{}
 	cfg.PrependFilters = &defaultFiltersFlags{}
 
@@ -484,9 +641,19 @@ func NewConfig() *Config {
 	flag.BoolVar(&cfg.RemoveHopHeaders, "remove-hop-headers", false, enableHopHeadersRemovalUsage)
 	flag.BoolVar(&cfg.RfcPatchPath, "rfc-patch-path", false, rfcPatchPathUsage)
 	flag.IntVar(&cfg.MaxAuditBody, "max-audit-body", defaultMaxAuditBody, maxAuditBodyUsage)
+	flag.BoolVar(&cfg.AuditLogClaimValues, "audit-log-claim-values", false, auditLogClaimValuesUsage)
 	flag.BoolVar(&cfg.EnableBreakers, "enable-breakers", false, enableBreakersUsage)
 	flag.Var(&cfg.Breakers, "breaker", breakerUsage)
 	flag.BoolVar(&cfg.EnableRatelimiters, "enable-ratelimits", false, enableRatelimitsUsage)
+	flag.BoolVar(&cfg.InMemoryClusterRatelimits, "in-memory-cluster-ratelimits", false, inMemoryClusterRatelimitsUsage)
+	flag.StringVar(&cfg.RatelimitCostHeader, "ratelimit-cost-header", "", ratelimitCostHeaderUsage)
+	flag.IntVar(&cfg.RatelimitMaxCost, "ratelimit-max-cost", ratelimitfilters.DefaultMaxCost, ratelimitMaxCostUsage)
+	flag.Float64Var(&cfg.RatelimitSoftLimit, "ratelimit-soft-limit", 0, ratelimitSoftLimitUsage)
+	flag.BoolVar(&cfg.RatelimitRetryAfterDate, "ratelimit-retry-after-date", false, ratelimitRetryAfterDateUsage)
+	flag.BoolVar(&cfg.RatelimitNormalizeKeys, "ratelimit-normalize-keys", false, ratelimitNormalizeKeysUsage)
+	flag.Var(cfg.RatelimitBypassCIDRs, "ratelimit-bypass-cidrs", ratelimitBypassCIDRsUsage)
+	flag.IntVar(&cfg.RatelimitTrustedProxies, "ratelimit-trusted-proxies", 0, ratelimitTrustedProxiesUsage)
+	flag.IntVar(&cfg.RatelimitBackendErrorStatus, "ratelimit-backend-error-status", http.StatusServiceUnavailable, ratelimitBackendErrorStatusUsage)
 	flag.Var(&cfg.Ratelimits, "ratelimits", ratelimitsUsage)
 	flag.BoolVar(&cfg.EnableRouteLIFOMetrics, "enable-route-lifo-metrics", false, enableRouteLIFOMetricsUsage)
 	flag.Var(cfg.MetricsFlavour, "metrics-flavour", metricsFlavourUsage)
@@ -580,12 +747,43 @@ func NewConfig() *Config {
 	flag.StringVar(&cfg.Oauth2ClientSecretFile, "oauth2-client-secret-file", "", oauth2ClientSecretFileUsage)
 	flag.StringVar(&cfg.Oauth2CallbackPath, "oauth2-callback-path", "", oauth2CallbackPathUsage)
 	flag.DurationVar(&cfg.Oauth2TokeninfoTimeout, "oauth2-tokeninfo-timeout", defaultOAuthTokeninfoTimeout, oauth2TokeninfoTimeoutUsage)
+	flag.BoolVar(&cfg.Oauth2TokeninfoScopesIgnoreCase, "oauth2-tokeninfo-scopes-ignore-case", false, oauth2TokeninfoScopesIgnoreCaseUsage)
+	flag.Var(cfg.Oauth2TokeninfoUserKeys, "oauth2-tokeninfo-user-keys", oauth2TokeninfoUserKeysUsage)
+	flag.StringVar(&cfg.Oauth2TokenDenylistURL, "oauth2-token-denylist-url", "", oauth2TokenDenylistURLUsage)
+	flag.DurationVar(&cfg.Oauth2TokenDenylistRefresh, "oauth2-token-denylist-refresh-interval", defaultOAuthTokenDenylistRefresh, oauth2TokenDenylistRefreshUsage)
 	flag.DurationVar(&cfg.Oauth2TokenintrospectionTimeout, "oauth2-tokenintrospect-timeout", defaultOAuthTokenintrospectionTimeout, oauth2TokenintrospectionTimeoutUsage)
+	flag.IntVar(&cfg.Oauth2BreakerFailures, "oauth2-breaker-failures", 0, oauth2BreakerFailuresUsage)
+	flag.DurationVar(&cfg.Oauth2BreakerWindow, "oauth2-breaker-window", 0, oauth2BreakerWindowUsage)
+	flag.DurationVar(&cfg.Oauth2BreakerTimeout, "oauth2-breaker-timeout", 0, oauth2BreakerTimeoutUsage)
+	flag.BoolVar(&cfg.Oauth2BreakerFailOpen, "oauth2-breaker-fail-open", false, oauth2BreakerFailOpenUsage)
+	flag.IntVar(&cfg.Oauth2MaxInflight, "oauth2-max-inflight", 0, oauth2MaxInflightUsage)
+	flag.DurationVar(&cfg.Oauth2InflightMaxWait, "oauth2-inflight-max-wait", 0, oauth2InflightMaxWaitUsage)
+	flag.BoolVar(&cfg.Oauth2InflightFailOpen, "oauth2-inflight-fail-open", false, oauth2InflightFailOpenUsage)
+	flag.IntVar(&cfg.Oauth2JWKSMaxResponseSize, "oauth2-jwks-max-response-size", 0, oauth2JWKSMaxResponseSizeUsage)
+	flag.DurationVar(&cfg.Oauth2JWKSTimeout, "oauth2-jwks-timeout", 0, oauth2JWKSTimeoutUsage)
+	flag.IntVar(&cfg.Oauth2MaxIdleConns, "oauth2-max-idle-conns", 0, oauth2MaxIdleConnsUsage)
+	flag.DurationVar(&cfg.Oauth2IdleConnTimeout, "oauth2-idle-conn-timeout", defaultOAuthIdleConnTimeout, oauth2IdleConnTimeoutUsage)
+	flag.DurationVar(&cfg.Oauth2DialTimeout, "oauth2-dial-timeout", 0, oauth2DialTimeoutUsage)
+	flag.DurationVar(&cfg.Oauth2TLSHandshakeTimeout, "oauth2-tls-handshake-timeout", 0, oauth2TLSHandshakeTimeoutUsage)
+	flag.BoolVar(&cfg.Oauth2ForceHTTP2, "oauth2-force-http2", false, oauth2ForceHTTP2Usage)
+	flag.StringVar(&cfg.Oauth2TokenintrospectionActiveField, "oauth2-tokenintrospect-active-field", "", oauth2TokenintrospectionActiveFieldUsage)
+	flag.Var(cfg.Oauth2TokenintrospectionActiveValues, "oauth2-tokenintrospect-active-values", oauth2TokenintrospectionActiveValuesUsage)
+	flag.StringVar(&cfg.Oauth2TokenintrospectionTokenStyle, "oauth2-tokenintrospect-token-style", "", oauth2TokenintrospectionTokenStyleUsage)
+	flag.StringVar(&cfg.Oauth2TokenintrospectionCredentialStyle, "oauth2-tokenintrospect-credential-style", "", oauth2TokenintrospectionCredentialStyleUsage)
+	flag.DurationVar(&cfg.Oauth2TokenintrospectionNegativeCacheTTL, "oauth2-tokenintrospect-negative-cache-ttl", 0, oauth2TokenintrospectionNegativeCacheTTLUsage)
+	flag.StringVar(&cfg.Oauth2TokenintrospectionClientSecretFile, "oauth2-tokenintrospect-client-secret-file", "", oauth2TokenintrospectionClientSecretFileUsage)
+	flag.StringVar(&cfg.Oauth2TokenintrospectionClaimsPath, "oauth2-tokenintrospect-claims-path", "", oauth2TokenintrospectionClaimsPathUsage)
+	flag.Float64Var(&cfg.Oauth2TokenintrospectionFreshnessSampleRate, "oauth2-tokenintrospect-freshness-sample-rate", 0, oauth2TokenintrospectionFreshnessSampleRateUsage)
+	flag.DurationVar(&cfg.Oauth2TokenintrospectionFreshnessInterval, "oauth2-tokenintrospect-freshness-interval", 0, oauth2TokenintrospectionFreshnessIntervalUsage)
+	flag.BoolVar(&cfg.Oauth2DPoPTrustForwardedProto, "oauth2-dpop-trust-forwarded-proto", false, oauth2DPoPTrustForwardedProtoUsage)
 	flag.Var(&cfg.Oauth2AuthURLParameters, "oauth2-auth-url-parameters", oauth2AuthURLParametersUsage)
 	flag.StringVar(&cfg.Oauth2AccessTokenHeaderName, "oauth2-access-token-header-name", "", oauth2AccessTokenHeaderNameUsage)
 	flag.StringVar(&cfg.Oauth2TokeninfoSubjectKey, "oauth2-tokeninfo-subject-key", "uid", oauth2AccessTokenHeaderNameUsage)
 	flag.StringVar(&cfg.Oauth2TokenCookieName, "oauth2-token-cookie-name", "oauth2-grant", oauth2TokenCookieNameUsage)
 	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", defaultWebhookTimeout, webhookTimeoutUsage)
+	flag.DurationVar(&cfg.Oauth2PolicyTimeout, "oauth2-policy-timeout", 0, oauth2PolicyTimeoutUsage)
+	flag.DurationVar(&cfg.Oauth2PolicyCacheTTL, "oauth2-policy-cache-ttl", 0, oauth2PolicyCacheTTLUsage)
+	flag.BoolVar(&cfg.Oauth2PolicyFailOpen, "oauth2-policy-fail-open", false, oauth2PolicyFailOpenUsage)
 	flag.StringVar(&cfg.OidcSecretsFile, "oidc-secrets-file", "", oidcSecretsFileUsage)
 	flag.Var(cfg.CredentialPaths, "credentials-paths", credentialPathsUsage)
 	flag.DurationVar(&cfg.CredentialsUpdateInterval, "credentials-update-interval", defaultCredentialsUpdateInterval, credentialsUpdateIntervalUsage)
@@ -634,9 +832,33 @@ func NewConfig() *Config {
 	flag.Var(cfg.SwarmRedisURLs, "swarm-redis-urls", swarmRedisURLsUsage)
 	flag.DurationVar(&cfg.SwarmRedisReadTimeout, "swarm-redis-read-timeout", ratelimit.DefaultReadTimeout, swarmRedisReadTimeoutUsage)
 	flag.DurationVar(&cfg.SwarmRedisWriteTimeout, "swarm-redis-write-timeout", ratelimit.DefaultWriteTimeout, swarmRedisWriteTimeoutUsage)
+	flag.Var(&cfg.SwarmRedisAddrTimeouts, "swarm-redis-addr-timeouts", swarmRedisAddrTimeoutsUsage)
 	flag.DurationVar(&cfg.SwarmRedisPoolTimeout, "swarm-redis-pool-timeout", ratelimit.DefaultPoolTimeout, swarmRedisPoolTimeoutUsage)
 	flag.IntVar(&cfg.SwarmRedisMinConns, "swarm-redis-min-conns", ratelimit.DefaultMinConns, swarmRedisMinConnsUsage)
 	flag.IntVar(&cfg.SwarmRedisMaxConns, "swarm-redis-max-conns", ratelimit.DefaultMaxConns, swarmRedisMaxConnsUsage)
+	flag.Var(cfg.SwarmRedisRings, "swarm-redis-rings", swarmRedisRingsUsage)
+	flag.Var(&cfg.SwarmRedisGroupRings, "swarm-redis-group-rings", swarmRedisGroupRingsUsage)
+	flag.Float64Var(&cfg.SwarmRedisTraceSample, "swarm-redis-trace-sample-rate", 1, swarmRedisTraceSampleRateUsage)
+	flag.BoolVar(&cfg.SwarmRedisTraceByKey, "swarm-redis-trace-sample-by-key", false, swarmRedisTraceSampleByKeyUsage)
+	flag.StringVar(&cfg.SwarmRedisSpanPrefix, "swarm-redis-trace-span-prefix", "", swarmRedisTraceSpanPrefixUsage)
+	flag.Var(&cfg.SwarmRedisSpanNames, "swarm-redis-trace-span-names", swarmRedisTraceSpanNamesUsage)
+	flag.Var(&cfg.SwarmRedisTraceTags, "swarm-redis-trace-tags", swarmRedisTraceTagsUsage)
+	flag.IntVar(&cfg.SwarmRedisZAddRetries, "swarm-redis-zadd-retries", ratelimit.DefaultZAddRetries, swarmRedisZAddRetriesUsage)
+	flag.DurationVar(&cfg.SwarmRedisZAddDelay, "swarm-redis-zadd-retry-delay", ratelimit.DefaultZAddRetryDelay, swarmRedisZAddRetryDelayUsage)
+	flag.BoolVar(&cfg.SwarmRedisTLS, "swarm-redis-tls", false, swarmRedisTLSUsage)
+	flag.StringVar(&cfg.SwarmRedisTLSMinVersion, "swarm-redis-tls-min-version", "", swarmRedisTLSMinVersionUsage)
+	flag.Var(cfg.SwarmRedisTLSCipherSuites, "swarm-redis-tls-cipher-suites", swarmRedisTLSCipherSuitesUsage)
+	flag.BoolVar(&cfg.SwarmRedisGroupMetrics, "swarm-redis-group-metrics", false, swarmRedisGroupMetricsUsage)
+	flag.DurationVar(&cfg.SwarmRedisBatchWindow, "swarm-redis-batch-window", 0, swarmRedisBatchWindowUsage)
+	flag.IntVar(&cfg.SwarmRedisBatchSize, "swarm-redis-batch-size", ratelimit.DefaultBatchSize, swarmRedisBatchSizeUsage)
+	flag.DurationVar(&cfg.SwarmRedisRetryAfterCacheTTL, "swarm-redis-retry-after-cache-ttl", 0, swarmRedisRetryAfterCacheTTLUsage)
+	flag.DurationVar(&cfg.SwarmRedisOverridesRefreshInterval, "swarm-redis-overrides-refresh-interval", 0, swarmRedisOverridesRefreshIntervalUsage)
+	flag.DurationVar(&cfg.SwarmRedisKillSwitchRefreshInterval, "swarm-redis-kill-switch-refresh-interval", 0, swarmRedisKillSwitchRefreshIntervalUsage)
+	flag.StringVar(&cfg.SwarmRedisLimitsFile, "swarm-redis-limits-file", "", swarmRedisLimitsFileUsage)
+	flag.DurationVar(&cfg.SwarmRedisLimitsRefreshInterval, "swarm-redis-limits-refresh-interval", 0, swarmRedisLimitsRefreshIntervalUsage)
+	flag.BoolVar(&cfg.SwarmRedisUseServerTime, "swarm-redis-use-server-time", false, swarmRedisUseServerTimeUsage)
+	flag.BoolVar(&cfg.SwarmRedisFailClosed, "swarm-redis-fail-closed", false, swarmRedisFailClosedUsage)
+	flag.DurationVar(&cfg.SwarmRedisDrainTimeout, "swarm-redis-drain-timeout", ratelimit.DefaultDrainTimeout, swarmRedisDrainTimeoutUsage)
 	flag.StringVar(&cfg.SwarmKubernetesNamespace, "swarm-namespace", swarm.DefaultNamespace, swarmKubernetesNamespaceUsage)
 	flag.StringVar(&cfg.SwarmKubernetesLabelSelectorKey, "swarm-label-selector-key", swarm.DefaultLabelSelectorKey, swarmKubernetesLabelSelectorKeyUsage)
 	flag.StringVar(&cfg.SwarmKubernetesLabelSelectorValue, "swarm-label-selector-value", swarm.DefaultLabelSelectorValue, swarmKubernetesLabelSelectorValueUsage)
@@ -691,7 +913,23 @@ func (c *Config) Parse() error {
 	}
 
 	c.ApplicationLogLevel = logLevel
+	swarmRedisGroupRings, err := c.parseSwarmRedisGroupRings()
+	if err != nil {
+		return err
+	}
+
+	swarmRedisAddrTimeouts, err := c.parseSwarmRedisAddrTimeouts()
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.swarmRedisTLSOptions().TLSClientConfig(); err != nil {
+		return err
+	}
+
 	c.KubernetesPathMode = kubernetesPathMode
+	c.SwarmRedisGroupRingIdx = swarmRedisGroupRings
+	c.SwarmRedisAddrTimeoutMap = swarmRedisAddrTimeouts
 	c.HistogramMetricBuckets = histogramBuckets
 
 	if c.ClientKeyFile != "" && c.ClientCertFile != "" {
@@ -744,9 +982,19 @@ func (c *Config) ToOptions() skipper.Options {
 		LoadBalancerHealthCheckInterval: c.LoadBalancerHealthCheckInterval,
 		ReverseSourcePredicate:          c.ReverseSourcePredicate,
 		MaxAuditBody:                    c.MaxAuditBody,
+		AuditLogClaimValues:             c.AuditLogClaimValues,
 		EnableBreakers:                  c.EnableBreakers,
 		BreakerSettings:                 c.Breakers,
 		EnableRatelimiters:              c.EnableRatelimiters,
+		InMemoryClusterRatelimits:       c.InMemoryClusterRatelimits,
+		RatelimitCostHeader:             c.RatelimitCostHeader,
+		RatelimitMaxCost:                c.RatelimitMaxCost,
+		RatelimitSoftLimit:              c.RatelimitSoftLimit,
+		RatelimitRetryAfterDate:         c.RatelimitRetryAfterDate,
+		RatelimitNormalizeKeys:          c.RatelimitNormalizeKeys,
+		RatelimitBypassCIDRs:            c.RatelimitBypassCIDRs.values,
+		RatelimitTrustedProxies:         c.RatelimitTrustedProxies,
+		RatelimitBackendErrorStatus:     c.RatelimitBackendErrorStatus,
 		RatelimitSettings:               c.Ratelimits,
 		EnableRouteLIFOMetrics:          c.EnableRouteLIFOMetrics,
 		MetricsFlavours:                 c.MetricsFlavour.values,
@@ -844,6 +1092,10 @@ func (c *Config) ToOptions() skipper.Options {
 		OAuth2TokenURL:                 c.Oauth2TokenURL,
 		OAuthTokeninfoURL:              c.Oauth2TokeninfoURL,
 		OAuthTokeninfoTimeout:          c.Oauth2TokeninfoTimeout,
+		OAuthTokeninfoScopesIgnoreCase: c.Oauth2TokeninfoScopesIgnoreCase,
+		OAuthTokeninfoUserKeys:         c.Oauth2TokeninfoUserKeys.values,
+		OAuthTokenDenylistURL:          c.Oauth2TokenDenylistURL,
+		OAuthTokenDenylistRefresh:      c.Oauth2TokenDenylistRefresh,
 		OAuth2SecretFile:               c.Oauth2SecretFile,
 		OAuth2ClientID:                 c.Oauth2ClientID,
 		OAuth2ClientSecret:             c.Oauth2ClientSecret,
@@ -851,15 +1103,45 @@ func (c *Config) ToOptions() skipper.Options {
 		OAuth2ClientSecretFile:         c.Oauth2ClientSecretFile,
 		OAuth2CallbackPath:             c.Oauth2CallbackPath,
 		OAuthTokenintrospectionTimeout: c.Oauth2TokenintrospectionTimeout,
+		OAuthBreakerFailures:           c.Oauth2BreakerFailures,
+		OAuthBreakerWindow:             c.Oauth2BreakerWindow,
+		OAuthBreakerTimeout:            c.Oauth2BreakerTimeout,
+		OAuthBreakerFailOpen:           c.Oauth2BreakerFailOpen,
+		OAuthMaxInflight:               c.Oauth2MaxInflight,
+		OAuthInflightMaxWait:           c.Oauth2InflightMaxWait,
+		OAuthInflightFailOpen:          c.Oauth2InflightFailOpen,
+		OAuthJWKSMaxResponseSize:       c.Oauth2JWKSMaxResponseSize,
+		OAuthJWKSTimeout:               c.Oauth2JWKSTimeout,
+		OAuthMaxIdleConns:              c.Oauth2MaxIdleConns,
+		OAuthIdleConnTimeout:           c.Oauth2IdleConnTimeout,
+		OAuthDialTimeout:               c.Oauth2DialTimeout,
+		OAuthTLSHandshakeTimeout:       c.Oauth2TLSHandshakeTimeout,
+		OAuthForceHTTP2:                c.Oauth2ForceHTTP2,
 		OAuth2AuthURLParameters:        c.Oauth2AuthURLParameters.values,
 		OAuth2AccessTokenHeaderName:    c.Oauth2AccessTokenHeaderName,
 		OAuth2TokeninfoSubjectKey:      c.Oauth2TokeninfoSubjectKey,
 		OAuth2TokenCookieName:          c.Oauth2TokenCookieName,
 		WebhookTimeout:                 c.WebhookTimeout,
+		OAuthPolicyTimeout:             c.Oauth2PolicyTimeout,
+		OAuthPolicyCacheTTL:            c.Oauth2PolicyCacheTTL,
+		OAuthPolicyFailOpen:            c.Oauth2PolicyFailOpen,
 		OIDCSecretsFile:                c.OidcSecretsFile,
 		CredentialsPaths:               c.CredentialPaths.values,
 		CredentialsUpdateInterval:      c.CredentialsUpdateInterval,
 
+		OAuthTokenintrospectionActiveField:      c.Oauth2TokenintrospectionActiveField,
+		OAuthTokenintrospectionActiveValues:     c.Oauth2TokenintrospectionActiveValues.values,
+		OAuthTokenintrospectionTokenStyle:       c.Oauth2TokenintrospectionTokenStyle,
+		OAuthTokenintrospectionCredentialStyle:  c.Oauth2TokenintrospectionCredentialStyle,
+		OAuthTokenintrospectionNegativeCacheTTL: c.Oauth2TokenintrospectionNegativeCacheTTL,
+		OAuthTokenintrospectionClientSecretFile: c.Oauth2TokenintrospectionClientSecretFile,
+		OAuthTokenintrospectionClaimsPath:       c.Oauth2TokenintrospectionClaimsPath,
+
+		OAuthTokenintrospectionFreshnessSampleRate: c.Oauth2TokenintrospectionFreshnessSampleRate,
+		OAuthTokenintrospectionFreshnessInterval:   c.Oauth2TokenintrospectionFreshnessInterval,
+
+		OAuthDPoPTrustForwardedProto: c.Oauth2DPoPTrustForwardedProto,
+
 		// connections, timeouts:
 		WaitForHealthcheckInterval:   c.WaitForHealthcheckInterval,
 		IdleConnectionsPerHost:       c.IdleConnsPerHost,
@@ -888,9 +1170,41 @@ func (c *Config) ToOptions() skipper.Options {
 		SwarmRedisURLs:         c.SwarmRedisURLs.values,
 		SwarmRedisReadTimeout:  c.SwarmRedisReadTimeout,
 		SwarmRedisWriteTimeout: c.SwarmRedisWriteTimeout,
+		SwarmRedisAddrTimeouts: c.SwarmRedisAddrTimeoutMap,
 		SwarmRedisPoolTimeout:  c.SwarmRedisPoolTimeout,
 		SwarmRedisMinIdleConns: c.SwarmRedisMinConns,
 		SwarmRedisMaxIdleConns: c.SwarmRedisMaxConns,
+		SwarmRedisRings:        c.swarmRedisRings(),
+		SwarmRedisGroupRings:   c.SwarmRedisGroupRingIdx,
+		SwarmRedisTraceSample:  c.SwarmRedisTraceSample,
+		SwarmRedisTraceByKey:   c.SwarmRedisTraceByKey,
+		SwarmRedisSpanPrefix:   c.SwarmRedisSpanPrefix,
+		SwarmRedisSpanNames:    c.SwarmRedisSpanNames.values,
+		SwarmRedisTraceTags:    c.SwarmRedisTraceTags.values,
+		SwarmRedisZAddRetries:  c.SwarmRedisZAddRetries,
+		SwarmRedisZAddDelay:    c.SwarmRedisZAddDelay,
+
+		SwarmRedisTLS:             c.SwarmRedisTLS,
+		SwarmRedisTLSMinVersion:   c.SwarmRedisTLSMinVersion,
+		SwarmRedisTLSCipherSuites: c.SwarmRedisTLSCipherSuites.values,
+
+		SwarmRedisGroupMetrics: c.SwarmRedisGroupMetrics,
+
+		SwarmRedisBatchWindow: c.SwarmRedisBatchWindow,
+		SwarmRedisBatchSize:   c.SwarmRedisBatchSize,
+
+		SwarmRedisRetryAfterCacheTTL: c.SwarmRedisRetryAfterCacheTTL,
+
+		SwarmRedisOverridesRefreshInterval: c.SwarmRedisOverridesRefreshInterval,
+
+		SwarmRedisKillSwitchRefreshInterval: c.SwarmRedisKillSwitchRefreshInterval,
+		SwarmRedisLimitsFile:                c.SwarmRedisLimitsFile,
+		SwarmRedisLimitsRefreshInterval:     c.SwarmRedisLimitsRefreshInterval,
+		SwarmRedisUseServerTime:             c.SwarmRedisUseServerTime,
+		SwarmRedisFailClosed:                c.SwarmRedisFailClosed,
+
+		SwarmRedisDrainTimeout: c.SwarmRedisDrainTimeout,
+
 		// swim based
 		SwarmKubernetesNamespace:          c.SwarmKubernetesNamespace,
 		SwarmKubernetesLabelSelectorKey:   c.SwarmKubernetesLabelSelectorKey,
@@ -951,6 +1265,61 @@ func (c *Config) ToOptions() skipper.Options {
 	return options
 }
 
+func (c *Config) swarmRedisRings() [][]string {
+	var rings [][]string
+	for _, r := range c.SwarmRedisRings.values {
+		rings = append(rings, strings.Split(r, ","))
+	}
+
+	return rings
+}
+
+// swarmRedisTLSOptions returns the TLS related Redis options to
+// validate the flags.
+func (c *Config) swarmRedisTLSOptions() *ratelimit.RedisOptions {
+	return &ratelimit.RedisOptions{
+		EnableTLS:       c.SwarmRedisTLS,
+		TLSMinVersion:   c.SwarmRedisTLSMinVersion,
+		TLSCipherSuites: c.SwarmRedisTLSCipherSuites.values,
+	}
+}
+
+func (c *Config) parseSwarmRedisGroupRings() (map[string]int, error) {
+	if len(c.SwarmRedisGroupRings.values) == 0 {
+		return nil, nil
+	}
+
+	groupRings := make(map[string]int)
+	for group, v := range c.SwarmRedisGroupRings.values {
+		idx, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis ring index for group %s: %v", group, err)
+		}
+
+		groupRings[group] = idx
+	}
+
+	return groupRings, nil
+}
+
+func (c *Config) parseSwarmRedisAddrTimeouts() (map[string]ratelimit.RedisTimeouts, error) {
+	if len(c.SwarmRedisAddrTimeouts.values) == 0 {
+		return nil, nil
+	}
+
+	timeouts := make(map[string]ratelimit.RedisTimeouts)
+	for addr, v := range c.SwarmRedisAddrTimeouts.values {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis timeout for address %s: %v", addr, err)
+		}
+
+		timeouts[addr] = ratelimit.RedisTimeouts{ReadTimeout: d, WriteTimeout: d}
+	}
+
+	return timeouts, nil
+}
+
 func (c *Config) parseHistogramBuckets() ([]float64, error) {
 	if c.HistogramMetricBucketsString == "" {
 		return prometheus.DefBuckets, nil
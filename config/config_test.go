@@ -68,11 +68,15 @@ func Test_NewConfig(t *testing.T) {
 				KubernetesHTTPSRedirectCode:             308,
 				KubernetesPathModeString:                "kubernetes-ingress",
 				Oauth2TokeninfoTimeout:                  2 * time.Second,
+				Oauth2TokenDenylistRefresh:              time.Minute,
 				Oauth2TokenintrospectionTimeout:         2 * time.Second,
 				Oauth2TokeninfoSubjectKey:               "uid",
 				Oauth2TokenCookieName:                   "oauth2-grant",
 				WebhookTimeout:                          2 * time.Second,
+				Oauth2IdleConnTimeout:                   90 * time.Second,
 				CredentialPaths:                         commaListFlag(),
+				Oauth2TokeninfoUserKeys:                 commaListFlag(),
+				Oauth2TokenintrospectionActiveValues:    commaListFlag(),
 				CredentialsUpdateInterval:               10 * time.Minute,
 				ApiUsageMonitoringClientKeys:            "sub",
 				ApiUsageMonitoringRealmsTrackingPattern: "services",
@@ -92,11 +96,21 @@ func Test_NewConfig(t *testing.T) {
 				ResponseHeaderTimeoutBackend:            1 * time.Minute,
 				ExpectContinueTimeoutBackend:            30 * time.Second,
 				SwarmRedisURLs:                          commaListFlag(),
+				SwarmRedisRings:                         newListFlag(";"),
+				SwarmRedisTLSCipherSuites:               commaListFlag(),
+				RatelimitBypassCIDRs:                    commaListFlag(),
 				SwarmRedisReadTimeout:                   25 * time.Millisecond,
 				SwarmRedisWriteTimeout:                  25 * time.Millisecond,
 				SwarmRedisPoolTimeout:                   25 * time.Millisecond,
 				SwarmRedisMinConns:                      100,
 				SwarmRedisMaxConns:                      100,
+				SwarmRedisTraceSample:                   1,
+				SwarmRedisZAddRetries:                   1,
+				RatelimitMaxCost:                        10,
+				RatelimitBackendErrorStatus:             503,
+				SwarmRedisZAddDelay:                     2 * time.Millisecond,
+				SwarmRedisBatchSize:                     128,
+				SwarmRedisDrainTimeout:                  time.Second,
 				SwarmKubernetesNamespace:                "kube-system",
 				SwarmKubernetesLabelSelectorKey:         "application",
 				SwarmKubernetesLabelSelectorValue:       "skipper-ingress",
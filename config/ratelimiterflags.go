@@ -17,10 +17,27 @@ const ratelimitsUsage = `set global rate limit settings, e.g. -ratelimits type=c
 	max-hits: the number of hits a ratelimiter can get
 	time-window: the duration of the sliding window for the rate limiter
 	group: defines the ratelimit group, which can be the same for different routes.
+	in-memory: calculate the cluster ratelimits in the memory of the instance (true/false)
+	retry-after-multiplier: scale the retry after of the cluster ratelimits by how far the denied requests exceed max-hits
+	expire-margin: the duration added to the time-window for the expiry of the Redis keys of the cluster ratelimits (defaults to 1s)
+	normalize-keys: lowercase the keys and strip the surrounding whitespace and a trailing dot before hashing them (true/false)
 	(see also: https://godoc.org/github.com/zalando/skipper/ratelimit)`
 
 const enableRatelimitsUsage = `enable ratelimits`
 
+const inMemoryClusterRatelimitsUsage = `calculate the cluster ratelimits in the memory of the instance instead of the swarm, for single instance deployments`
+
+const (
+	ratelimitCostHeaderUsage         = `header declaring the cost of a request as positive integer, e.g. X-RateLimit-Cost, the cluster ratelimits count the cost as hits, should be set only by trusted backends or clients`
+	ratelimitMaxCostUsage            = `maximum of the request cost declared by -ratelimit-cost-header`
+	ratelimitSoftLimitUsage          = `fraction of the max hits of the cluster ratelimit filters, e.g. 0.8, after which the allowed requests get the X-RateLimit-Warning response header, 0 disables the soft limit`
+	ratelimitRetryAfterDateUsage     = `sets the Retry-After header of the responses ratelimited by the ratelimit filters as HTTP-date instead of delta-seconds`
+	ratelimitNormalizeKeysUsage      = `lowercase the keys of the ratelimit filters and strip the surrounding whitespace and a trailing dot before hashing them, so e.g. the keys of Host headers differing only in case share a bucket`
+	ratelimitBypassCIDRsUsage        = `comma separated list of CIDRs, e.g. of health checkers and internal services, whose requests are not ratelimited by the ratelimit filters`
+	ratelimitTrustedProxiesUsage     = `number of the proxies in front of skipper, that append to the X-Forwarded-For header, used to find the client address checked against -ratelimit-bypass-cidrs, 0 means the remote address is checked`
+	ratelimitBackendErrorStatusUsage = `status code of the requests denied by the ratelimit filters, because the cluster ratelimit failed closed, see -swarm-redis-fail-closed`
+)
+
 type ratelimitFlags []ratelimit.Settings
 
 var errInvalidRatelimitConfig = errors.New("invalid ratelimit config (allowed values are: client, service or disabled)")
@@ -78,6 +95,30 @@ func (r *ratelimitFlags) Set(value string) error {
 			s.CleanInterval = d * 10
 		case "group":
 			s.Group = kv[1]
+		case "in-memory":
+			b, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return err
+			}
+			s.InMemory = b
+		case "retry-after-multiplier":
+			f, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return err
+			}
+			s.RetryAfterMultiplier = f
+		case "expire-margin":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return err
+			}
+			s.ExpireMargin = d
+		case "normalize-keys":
+			b, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return err
+			}
+			s.NormalizeKeys = b
 		default:
 			return errInvalidRatelimitConfig
 		}
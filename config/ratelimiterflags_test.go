@@ -68,6 +68,54 @@ func Test_ratelimitFlags_Set(t *testing.T) {
 				CleanInterval: 2 * time.Minute * 10,
 			},
 		},
+		{
+			name:    "test in-memory cluster ratelimit",
+			args:    "type=clusterClient,max-hits=50,time-window=1m,in-memory=true",
+			wantErr: false,
+			want: ratelimit.Settings{
+				Type:          ratelimit.ClusterClientRatelimit,
+				MaxHits:       50,
+				TimeWindow:    time.Minute,
+				CleanInterval: time.Minute * 10,
+				InMemory:      true,
+			},
+		},
+		{
+			name:    "test weighted retry after",
+			args:    "type=clusterClient,max-hits=50,time-window=1m,retry-after-multiplier=2.5",
+			wantErr: false,
+			want: ratelimit.Settings{
+				Type:                 ratelimit.ClusterClientRatelimit,
+				MaxHits:              50,
+				TimeWindow:           time.Minute,
+				CleanInterval:        time.Minute * 10,
+				RetryAfterMultiplier: 2.5,
+			},
+		},
+		{
+			name:    "test expire margin",
+			args:    "type=clusterClient,max-hits=50,time-window=200ms,expire-margin=20ms",
+			wantErr: false,
+			want: ratelimit.Settings{
+				Type:          ratelimit.ClusterClientRatelimit,
+				MaxHits:       50,
+				TimeWindow:    200 * time.Millisecond,
+				CleanInterval: 2 * time.Second,
+				ExpireMargin:  20 * time.Millisecond,
+			},
+		},
+		{
+			name:    "test normalize keys",
+			args:    "type=clusterClient,max-hits=50,time-window=1m,normalize-keys=true",
+			wantErr: false,
+			want: ratelimit.Settings{
+				Type:          ratelimit.ClusterClientRatelimit,
+				MaxHits:       50,
+				TimeWindow:    time.Minute,
+				CleanInterval: time.Minute * 10,
+				NormalizeKeys: true,
+			},
+		},
 		{
 			name:    "test disabled ratelimit",
 			args:    "type=disabled,max-hits=50,time-window=2m",
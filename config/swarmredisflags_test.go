@@ -2,6 +2,9 @@ package config
 
 import (
 	"testing"
+	"time"
+
+	"github.com/zalando/skipper/ratelimit"
 )
 
 func Test_swarmRedisFlags_Set(t *testing.T) {
@@ -57,3 +60,85 @@ func Test_swarmRedisFlags_Set(t *testing.T) {
 		})
 	}
 }
+
+func Test_swarmRedisRings(t *testing.T) {
+	c := &Config{SwarmRedisRings: newListFlag(";")}
+	if err := c.SwarmRedisRings.Set("127.0.0.1:6379,127.0.0.1:6380;127.0.0.1:6381"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SwarmRedisGroupRings.Set("groupA=1,groupB=2"); err != nil {
+		t.Fatal(err)
+	}
+
+	rings := c.swarmRedisRings()
+	if len(rings) != 2 || len(rings[0]) != 2 || rings[1][0] != "127.0.0.1:6381" {
+		t.Errorf("unexpected rings: %v", rings)
+	}
+
+	groupRings, err := c.parseSwarmRedisGroupRings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if groupRings["groupA"] != 1 || groupRings["groupB"] != 2 {
+		t.Errorf("unexpected group rings: %v", groupRings)
+	}
+
+	if err := c.SwarmRedisGroupRings.Set("groupA=first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.parseSwarmRedisGroupRings(); err == nil {
+		t.Error("expected error for invalid ring index")
+	}
+}
+
+func Test_swarmRedisAddrTimeouts(t *testing.T) {
+	c := &Config{}
+	if err := c.SwarmRedisAddrTimeouts.Set("redis-eu:6379=25ms,redis-us:6379=150ms"); err != nil {
+		t.Fatal(err)
+	}
+
+	timeouts, err := c.parseSwarmRedisAddrTimeouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := timeouts["redis-us:6379"]; got != (ratelimit.RedisTimeouts{ReadTimeout: 150 * time.Millisecond, WriteTimeout: 150 * time.Millisecond}) {
+		t.Errorf("unexpected timeouts: %v", got)
+	}
+
+	if len(timeouts) != 2 {
+		t.Errorf("unexpected number of addresses: %d", len(timeouts))
+	}
+
+	if err := c.SwarmRedisAddrTimeouts.Set("redis-us:6379=slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.parseSwarmRedisAddrTimeouts(); err == nil {
+		t.Error("expected error for invalid timeout")
+	}
+}
+
+func Test_swarmRedisTLS(t *testing.T) {
+	c := &Config{SwarmRedisTLSCipherSuites: commaListFlag(), SwarmRedisTLSMinVersion: "1.2"}
+	if err := c.SwarmRedisTLSCipherSuites.Set("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"); err != nil {
+		t.Fatal(err)
+	}
+
+	tc, err := c.swarmRedisTLSOptions().TLSClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tc.CipherSuites) != 2 {
+		t.Errorf("unexpected cipher suites: %v", tc.CipherSuites)
+	}
+
+	c.SwarmRedisTLSMinVersion = "1.0"
+	if _, err := c.swarmRedisTLSOptions().TLSClientConfig(); err == nil {
+		t.Error("expected error for unsupported TLS version")
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthAudienceName = "oauthAudience"
+
+	// audKey defined at https://tools.ietf.org/html/rfc7519#section-4.1.3
+	audKey = "aud"
+
+	audMatchAny = "any"
+	audMatchAll = "all"
+)
+
+type (
+	audienceSpec struct{}
+
+	audienceFilter struct {
+		mode      string
+		audiences []string
+	}
+)
+
+// NewOAuthAudience creates a filter spec, which rejects the requests,
+// when the aud claim of the token doesn't contain any, or in all mode,
+// all of the expected audiences. The filter has to be placed after
+// one of the oauthTokeninfo*, oauthTokenintrospection* or oauthOidc*
+// filters.
+//
+// Example:
+//
+//	oauthTokenintrospectionAnyClaims("https://idp.example.org", "uid") -> oauthAudience("any", "orders", "payments") -> "https://internal.example.org";
+func NewOAuthAudience() filters.Spec {
+	return &audienceSpec{}
+}
+
+func (*audienceSpec) Name() string { return OAuthAudienceName }
+
+// CreateFilter accepts the match mode, any or all, and one or more
+// expected audiences.
+func (*audienceSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) < 2 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	if sargs[0] != audMatchAny && sargs[0] != audMatchAll {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return &audienceFilter{mode: sargs[0], audiences: sargs[1:]}, nil
+}
+
+// tokenAudiences returns the aud claim as list, the single string
+// value is handled as list with one element.
+func tokenAudiences(claims map[string]interface{}) []string {
+	switch v := claims[audKey].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var a []string
+		for _, vi := range v {
+			if s, ok := vi.(string); ok {
+				a = append(a, s)
+			}
+		}
+
+		return a
+	default:
+		return nil
+	}
+}
+
+func (f *audienceFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "no validated token available for audience validation")
+		return
+	}
+
+	presented := tokenAudiences(claims)
+
+	var valid bool
+	if f.mode == audMatchAll {
+		valid = all(f.audiences, presented)
+	} else {
+		valid = intersect(f.audiences, presented)
+	}
+
+	if !valid {
+		log.Debugf(
+			"Invalid audience, presented: %s, required %s of: %s.",
+			strings.Join(presented, ","), f.mode, strings.Join(f.audiences, ","),
+		)
+
+		unauthorized(ctx, "", invalidAudience, r.Host, "")
+	}
+}
+
+func (*audienceFilter) Response(filters.FilterContext) {}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestAudience(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		claims   map[string]interface{}
+		expected int
+	}{{
+		msg:      "no validated token",
+		args:     []interface{}{"any", "orders"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "missing aud",
+		args:     []interface{}{"any", "orders"},
+		claims:   map[string]interface{}{"sub": "jdoe"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "any with string aud",
+		args:     []interface{}{"any", "orders", "payments"},
+		claims:   map[string]interface{}{"aud": "payments"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "any with aud array",
+		args:     []interface{}{"any", "orders", "payments"},
+		claims:   map[string]interface{}{"aud": []interface{}{"shipping", "orders"}},
+		expected: http.StatusOK,
+	}, {
+		msg:      "any without match",
+		args:     []interface{}{"any", "orders", "payments"},
+		claims:   map[string]interface{}{"aud": []interface{}{"shipping"}},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "all with aud array",
+		args:     []interface{}{"all", "orders", "payments"},
+		claims:   map[string]interface{}{"aud": []interface{}{"payments", "shipping", "orders"}},
+		expected: http.StatusOK,
+	}, {
+		msg:      "all with missing audience",
+		args:     []interface{}{"all", "orders", "payments"},
+		claims:   map[string]interface{}{"aud": []interface{}{"orders"}},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "all with string aud",
+		args:     []interface{}{"all", "orders"},
+		claims:   map[string]interface{}{"aud": "orders"},
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthAudience().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokenintrospectionCacheKey] = tokenIntrospectionInfo(ti.claims)
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.claims != nil && status == http.StatusUnauthorized && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(invalidAudience) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestAudienceCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{"any"},
+		{"some", "orders"},
+		{"all", 42},
+	} {
+		if _, err := NewOAuthAudience().CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zalando/skipper/filters"
 	logfilter "github.com/zalando/skipper/filters/log"
+	"github.com/zalando/skipper/metrics"
 )
 
 type roleCheckType int
@@ -30,32 +32,53 @@ const (
 	checkOIDCAnyClaims
 	checkOIDCAllClaims
 	checkOIDCQueryClaims
+	checkOAuthTokenintrospectionHybrid
+	checkSecureOAuthTokenintrospectionHybrid
+	checkOAuthTokeninfoExactScopes
 )
 
 type rejectReason string
 
 const (
-	missingBearerToken rejectReason = "missing-bearer-token"
-	missingToken       rejectReason = "missing-token"
-	authServiceAccess  rejectReason = "auth-service-access"
-	invalidSub         rejectReason = "invalid-sub-in-token"
-	inactiveToken      rejectReason = "inactive-token"
-	invalidToken       rejectReason = "invalid-token"
-	invalidScope       rejectReason = "invalid-scope"
-	invalidClaim       rejectReason = "invalid-claim"
-	invalidFilter      rejectReason = "invalid-filter"
-	invalidAccess      rejectReason = "invalid-access"
+	missingBearerToken  rejectReason = "missing-bearer-token"
+	missingToken        rejectReason = "missing-token"
+	authServiceAccess   rejectReason = "auth-service-access"
+	invalidSub          rejectReason = "invalid-sub-in-token"
+	inactiveToken       rejectReason = "inactive-token"
+	invalidToken        rejectReason = "invalid-token"
+	invalidScope        rejectReason = "invalid-scope"
+	invalidClaim        rejectReason = "invalid-claim"
+	invalidFilter       rejectReason = "invalid-filter"
+	invalidAccess       rejectReason = "invalid-access"
+	dpopInvalid         rejectReason = "dpop-invalid"
+	revokedToken        rejectReason = "revoked-token"
+	tokenIPMismatch     rejectReason = "token-ip-mismatch"
+	invalidATHash       rejectReason = "invalid-access-token-hash"
+	staleToken          rejectReason = "stale-token"
+	wrongTokenType      rejectReason = "wrong-token-type"
+	replayedNonce       rejectReason = "replayed-nonce"
+	invalidAudience     rejectReason = "invalid-audience"
+	certBindingMismatch rejectReason = "cert-binding-mismatch"
+	suspiciousToken     rejectReason = "suspicious-token"
+	lockedOut           rejectReason = "locked-out"
 )
 
 const (
 	AuthUnknown = "authUnknown"
 
-	authHeaderName   = "Authorization"
-	authHeaderPrefix = "Bearer "
+	authHeaderName       = "Authorization"
+	authHeaderPrefix     = "Bearer "
+	dpopAuthHeaderPrefix = "DPoP "
 	// tokenKey defined at https://tools.ietf.org/html/rfc7662#section-2.1
 	tokenKey = "token"
-	scopeKey = "scope"
-	uidKey   = "uid"
+	// clientIDKey and clientSecretKey defined at https://tools.ietf.org/html/rfc6749#section-2.3.1
+	clientIDKey     = "client_id"
+	clientSecretKey = "client_secret"
+	scopeKey        = "scope"
+	scpKey          = "scp"
+	uidKey          = "uid"
+
+	rejectMetricsPrefix = "auth.reject."
 )
 
 type kv map[string][]string
@@ -68,6 +91,11 @@ var (
 	errUnsupportedClaimSpecified     = errors.New("unsupported claim specified in filter")
 	errInvalidToken                  = errors.New("invalid token")
 	errInvalidTokenintrospectionData = errors.New("invalid tokenintrospection data")
+	errAuthServiceStatus             = errors.New("auth service responded with server error")
+	errAuthServiceRejected           = errors.New("auth service rejected the request")
+	errAuthServiceResponse           = errors.New("auth service responded with invalid content")
+	errInvalidATHash                 = errors.New("access token does not match the at_hash of the id token")
+	errReplayedNonce                 = errors.New("nonce of the id token was used before")
 )
 
 func (kv kv) String() string {
@@ -82,6 +110,10 @@ func (err *requestError) Error() string {
 	return err.err.Error()
 }
 
+func (err *requestError) Unwrap() error {
+	return err.err
+}
+
 func requestErrorf(f string, args ...interface{}) error {
 	return &requestError{
 		err: fmt.Errorf(f, args...),
@@ -97,6 +129,25 @@ func getToken(r *http.Request) (string, bool) {
 	return h[len(authHeaderPrefix):], true
 }
 
+// tokenClaims returns the claims of the token validated by one of the
+// preceding auth filters in the filter chain.
+func tokenClaims(ctx filters.FilterContext) (map[string]interface{}, bool) {
+	sb := ctx.StateBag()
+	if m, ok := sb[tokeninfoCacheKey].(map[string]interface{}); ok {
+		return m, true
+	}
+
+	if info, ok := sb[tokenintrospectionCacheKey].(tokenIntrospectionInfo); ok {
+		return info, true
+	}
+
+	if c, ok := sb[oidcClaimsCacheKey].(tokenContainer); ok && c.Claims != nil {
+		return c.Claims, true
+	}
+
+	return nil, false
+}
+
 func reject(
 	ctx filters.FilterContext,
 	status int,
@@ -117,11 +168,28 @@ func reject(
 		)
 	}
 
+	metrics.Default.IncCounter(rejectMetricsPrefix + string(reason))
+
 	ctx.StateBag()[logfilter.AuthUserKey] = username
 	ctx.StateBag()[logfilter.AuthRejectReasonKey] = string(reason)
-	rsp := &http.Response{
-		StatusCode: status,
-		Header:     make(map[string][]string),
+	tagUser(ctx, username)
+	if grpc, _ := ctx.StateBag()[grpcStatusKey].(bool); grpc {
+		ctx.Serve(grpcRejectResponse(status, reason))
+		return
+	}
+
+	if d, ok := ctx.StateBag()[denyStatusKey].(*denyStatusFilter); ok && status == http.StatusForbidden {
+		status = d.denyStatus(reason)
+	}
+
+	var rsp *http.Response
+	if p, ok := ctx.StateBag()[problemResponseKey].(*problemResponseFilter); ok {
+		rsp = p.response(status, reason, debuginfo)
+	} else {
+		rsp = &http.Response{
+			StatusCode: status,
+			Header:     make(map[string][]string),
+		}
 	}
 
 	if hostname != "" {
@@ -142,6 +210,54 @@ func forbidden(ctx filters.FilterContext, username string, reason rejectReason,
 
 func authorized(ctx filters.FilterContext, username string) {
 	ctx.StateBag()[logfilter.AuthUserKey] = username
+	tagUser(ctx, username)
+}
+
+// setAuthDecision stores the details of the authorization decision in
+// the state bag, to be logged by the auditLog filter.
+func setAuthDecision(ctx filters.FilterContext, d *logfilter.AuthDecision) {
+	ctx.StateBag()[logfilter.AuthDecisionKey] = d
+}
+
+// kvDecision returns the details of checking the key value pairs
+// against the claims, where a key matches with any, or when matchAll
+// is set, with all of its values.
+func kvDecision(claims map[string]interface{}, kv kv, matchAll bool) *logfilter.AuthDecision {
+	d := &logfilter.AuthDecision{ClaimValues: make(map[string]interface{})}
+	for k, v := range kv {
+		d.RequiredClaims = append(d.RequiredClaims, k)
+		v2, ok := claimStringValues(claims, k)
+		if !ok {
+			continue
+		}
+
+		d.ClaimValues[k] = v2
+		if matchAll && all(v, v2) || !matchAll && intersect(v, v2) {
+			d.MatchedClaims = append(d.MatchedClaims, k)
+		}
+	}
+
+	sort.Strings(d.RequiredClaims)
+	sort.Strings(d.MatchedClaims)
+	return d
+}
+
+// claimsDecision returns the details of checking the presence of the
+// keys in the claims.
+func claimsDecision(claims map[string]interface{}, keys []string) *logfilter.AuthDecision {
+	d := &logfilter.AuthDecision{
+		RequiredClaims: keys,
+		ClaimValues:    make(map[string]interface{}),
+	}
+
+	for _, k := range keys {
+		if v, ok := claimValue(claims, k); ok {
+			d.MatchedClaims = append(d.MatchedClaims, k)
+			d.ClaimValues[k] = v
+		}
+	}
+
+	return d
 }
 
 func getStrings(args []interface{}) ([]string, error) {
@@ -187,3 +303,106 @@ func intersect(left, right []string) bool {
 
 	return false
 }
+
+// claimUser returns the first non-empty string value of the keys, to
+// be logged as the user of the request.
+func claimUser(claims map[string]interface{}, keys []string) string {
+	for _, k := range keys {
+		if u, ok := claims[k].(string); ok && u != "" {
+			return u
+		}
+	}
+
+	return ""
+}
+
+func toLower(s []string) []string {
+	l := make([]string, len(s))
+	for i := range s {
+		l[i] = strings.ToLower(s[i])
+	}
+
+	return l
+}
+
+// claimValue looks up a claim by key. If the key is not found as is
+// and it contains dots, it is used as a path into the nested JSON
+// structure of the claims, e.g. "realm_access.roles". Arrays of
+// objects along the path are traversed element-wise and the results
+// are collected.
+func claimValue(claims map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := claims[key]; ok {
+		return v, true
+	}
+
+	if !strings.Contains(key, ".") {
+		return nil, false
+	}
+
+	return lookupClaimPath(claims, strings.Split(key, "."))
+}
+
+func lookupClaimPath(v interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return v, true
+	}
+
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		next, ok := vt[path[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookupClaimPath(next, path[1:])
+	case []interface{}:
+		var res []interface{}
+		for _, e := range vt {
+			r, ok := lookupClaimPath(e, path)
+			if !ok {
+				continue
+			}
+			if ra, ok := r.([]interface{}); ok {
+				res = append(res, ra...)
+			} else {
+				res = append(res, r)
+			}
+		}
+		return res, len(res) > 0
+	}
+
+	return nil, false
+}
+
+// claimStrings flattens a claim value into a string slice. It returns
+// false if the value is neither a string nor an array of strings.
+func claimStrings(v interface{}) ([]string, bool) {
+	switch vt := v.(type) {
+	case string:
+		return []string{vt}, true
+	case []string:
+		return vt, true
+	case []interface{}:
+		s := make([]string, 0, len(vt))
+		for _, e := range vt {
+			es, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			s = append(s, es)
+		}
+		return s, true
+	}
+
+	return nil, false
+}
+
+// claimStringValues resolves the claim by key and flattens it into a
+// string slice.
+func claimStringValues(claims map[string]interface{}, key string) ([]string, bool) {
+	v, ok := claimValue(claims, key)
+	if !ok {
+		return nil, false
+	}
+
+	return claimStrings(v)
+}
@@ -1,7 +1,12 @@
 package auth
 
 import (
+	"net/http/httptest"
 	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
 )
 
 const (
@@ -98,3 +103,98 @@ func Test_all(t *testing.T) {
 
 	}
 }
+
+func Test_claimStringValues(t *testing.T) {
+	claims := map[string]interface{}{
+		"uid":                  "jdoe",
+		"https://example.org/": "dotted",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin", "user"},
+		},
+		"groups": []interface{}{
+			map[string]interface{}{"name": "g1"},
+			map[string]interface{}{"name": "g2"},
+			map[string]interface{}{"id": 3},
+		},
+		"nested": map[string]interface{}{
+			"number": 42.0,
+		},
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		key      string
+		expected []string
+		ok       bool
+	}{{
+		msg:      "flat string claim",
+		key:      "uid",
+		expected: []string{"jdoe"},
+		ok:       true,
+	}, {
+		msg:      "key containing dots is looked up as is first",
+		key:      "https://example.org/",
+		expected: []string{"dotted"},
+		ok:       true,
+	}, {
+		msg:      "nested array claim",
+		key:      "realm_access.roles",
+		expected: []string{"admin", "user"},
+		ok:       true,
+	}, {
+		msg:      "array of objects",
+		key:      "groups.name",
+		expected: []string{"g1", "g2"},
+		ok:       true,
+	}, {
+		msg: "missing intermediate key",
+		key: "resource_access.roles",
+	}, {
+		msg: "missing leaf key",
+		key: "realm_access.groups",
+	}, {
+		msg: "path through a scalar",
+		key: "uid.name",
+	}, {
+		msg: "non string value",
+		key: "nested.number",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			v, ok := claimStringValues(claims, ti.key)
+			if ok != ti.ok {
+				t.Fatalf("unexpected lookup result: %v != %v", ok, ti.ok)
+			}
+
+			if len(v) != len(ti.expected) || !all(ti.expected, v) {
+				t.Errorf("unexpected values: %v != %v", v, ti.expected)
+			}
+		})
+	}
+}
+
+func TestRejectMetrics(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	newContext := func() *filtertest.Context {
+		return &filtertest.Context{
+			FRequest:  httptest.NewRequest("GET", "/", nil),
+			FStateBag: make(map[string]interface{}),
+		}
+	}
+
+	unauthorized(newContext(), "", missingToken, "", "")
+	forbidden(newContext(), "jdoe", invalidScope, "")
+	forbidden(newContext(), "jdoe", invalidScope, "")
+
+	m.WithCounters(func(counters map[string]int64) {
+		if c := counters["auth.reject.missing-token"]; c != 1 {
+			t.Errorf("unexpected missing token counter: %d", c)
+		}
+
+		if c := counters["auth.reject.invalid-scope"]; c != 2 {
+			t.Errorf("unexpected invalid scope counter: %d", c)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+	"github.com/zalando/skipper/metrics"
+)
+
+const (
+	defaultBreakerTimeout = 10 * time.Second
+	breakerMetricsPrefix  = "auth.breaker."
+)
+
+var errAuthServiceUnavailable = errors.New("auth service circuit breaker is open")
+
+// BreakerOptions configures the circuit breaker around the calls to
+// the tokeninfo or tokenintrospection endpoints.
+type BreakerOptions struct {
+	// Failures is the number of consecutive failures, connection
+	// errors or 5xx responses, that open the breaker. 0 disables the
+	// breaker.
+	Failures int
+
+	// Window is the interval, after which the failure counts are
+	// cleared while the breaker is closed. 0 means the counts are
+	// only cleared by successful calls.
+	Window time.Duration
+
+	// Timeout is the duration of the open state, before a probe call
+	// is allowed in half-open state. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// FailOpen passes requests without validation while the breaker
+	// is open, instead of rejecting them with auth-service-access.
+	FailOpen bool
+}
+
+type authBreaker struct {
+	gb       *gobreaker.TwoStepCircuitBreaker
+	failOpen bool
+}
+
+func newAuthBreaker(name string, o BreakerOptions) *authBreaker {
+	if o.Failures <= 0 {
+		return nil
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = defaultBreakerTimeout
+	}
+
+	return &authBreaker{
+		failOpen: o.FailOpen,
+		gb: gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+			Name:        name,
+			MaxRequests: 1,
+			Interval:    o.Window,
+			Timeout:     o.Timeout,
+			ReadyToTrip: func(c gobreaker.Counts) bool {
+				return int(c.ConsecutiveFailures) >= o.Failures
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				log.Infof("auth circuit breaker %s went from %v to %v", name, from, to)
+				metrics.Default.IncCounter(breakerMetricsPrefix + name + "." + to.String())
+			},
+		}),
+	}
+}
+
+// allow returns the callback to report the outcome of the call, or
+// errAuthServiceUnavailable, when the breaker is open.
+func (b *authBreaker) allow() (func(bool), error) {
+	if b == nil {
+		return func(bool) {}, nil
+	}
+
+	done, err := b.gb.Allow()
+	if err != nil {
+		return nil, errAuthServiceUnavailable
+	}
+
+	return done, nil
+}
+
+// passes tells whether a request should be passed without validation,
+// because the call to the auth service failed on the open breaker and
+// the fail-open policy is configured.
+func (b *authBreaker) passes(err error) bool {
+	return b != nil && b.failOpen && err == errAuthServiceUnavailable
+}
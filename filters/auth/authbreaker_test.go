@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
+)
+
+func TestAuthBreaker(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	var failing, calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "scope": ["read"]}`))
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		failOpen bool
+		expected int
+	}{{
+		msg:      "fail closed",
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "fail open",
+		failOpen: true,
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			delete(tokeninfoAuthClient, backend.URL)
+			spec := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{
+				URL:     backend.URL,
+				Timeout: time.Second,
+				Breaker: BreakerOptions{Failures: 2, Timeout: 50 * time.Millisecond, FailOpen: ti.failOpen},
+			})
+
+			f, err := spec.CreateFilter([]interface{}{"read"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokeninfoFilter).Close()
+
+			request := func() int {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(authHeaderName, authHeaderPrefix+"token")
+				ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+				f.Request(ctx)
+				if ctx.FServed {
+					return ctx.FResponse.StatusCode
+				}
+
+				return http.StatusOK
+			}
+
+			atomic.StoreInt32(&failing, 1)
+			atomic.StoreInt32(&calls, 0)
+			for i := 0; i < 2; i++ {
+				if status := request(); status != http.StatusUnauthorized {
+					t.Fatalf("unexpected status code while failing: %d", status)
+				}
+			}
+
+			if status := request(); status != ti.expected {
+				t.Errorf("unexpected status code with open breaker: %d != %d", status, ti.expected)
+			}
+
+			if c := atomic.LoadInt32(&calls); c != 2 {
+				t.Errorf("unexpected number of calls with open breaker: %d", c)
+			}
+
+			atomic.StoreInt32(&failing, 0)
+			time.Sleep(100 * time.Millisecond)
+			if status := request(); status != http.StatusOK {
+				t.Errorf("unexpected status code after the probe: %d", status)
+			}
+		})
+	}
+
+	m.WithCounters(func(counters map[string]int64) {
+		for _, state := range []string{"open", "half-open", "closed"} {
+			if counters["auth.breaker.tokeninfo."+state] != 2 {
+				t.Errorf("unexpected count of transitions to %s: %d", state, counters["auth.breaker.tokeninfo."+state])
+			}
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,8 +16,12 @@ import (
 	"time"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/metrics"
 	"github.com/zalando/skipper/net"
+	"github.com/zalando/skipper/secrets"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -22,38 +30,111 @@ const (
 	tokenIntrospectionSpanName = "tokenintrospection"
 )
 
+const sharedIntrospectionMetricsKey = "auth.tokenintrospection.shared"
+
 const (
-	defaultMaxIdleConns = 64
+	defaultMaxIdleConns    = 64
+	defaultIdleConnTimeout = 90 * time.Second
+
+	// maxAuthResponseSize limits the responses of the auth services,
+	// after they were decompressed
+	maxAuthResponseSize = 1 << 20
 )
 
+// TransportOptions tunes the connections of the auth filters to the
+// identity provider. The connections of the filters using the same
+// endpoint are shared.
+type TransportOptions struct {
+	// MaxIdleConns limits the idle connections to all the hosts of
+	// a client. Defaults to no limit, the idle connections per host
+	// are limited by the MaxIdleConns of the filter options.
+	MaxIdleConns int
+
+	// IdleConnTimeout defines how long the idle connections are kept
+	// open. Defaults to 90 seconds.
+	IdleConnTimeout time.Duration
+
+	// DialTimeout is the timeout of establishing new connections.
+	// Defaults to the timeout of the filter options.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout is the timeout of the TLS handshakes.
+	// Defaults to the timeout of the filter options.
+	TLSHandshakeTimeout time.Duration
+
+	// ForceHTTP2 attempts to use HTTP/2 for the TLS connections.
+	ForceHTTP2 bool
+}
+
 type authClient struct {
-	url *url.URL
-	cli *net.Client
+	url      *url.URL
+	cli      *net.Client
+	tracer   opentracing.Tracer
+	spanName string
+	timeout  time.Duration
+	breaker  *authBreaker
+	inflight *authSemaphore
+
+	// the style of the introspection requests
+	tokenInQuery     bool
+	clientSecretPost bool
+
+	// when set, the client secret is read from the secret file on
+	// every introspection request, to pick up rotated secrets
+	secrets    secrets.SecretsReader
+	secretFile string
+
+	// concurrent introspection calls of the same token share a
+	// single call to the endpoint
+	flights singleflight.Group
 }
 
-func newAuthClient(baseURL, spanName string, timeout time.Duration, maxIdleConns int, tracer opentracing.Tracer) (*authClient, error) {
+// detachedContext keeps the values, e.g. the span, of the parent
+// context, but not its cancellation, so a shared call is not
+// cancelled together with the request, that started it. The shared
+// call is bounded by the timeout of the client instead.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func newAuthClient(baseURL, spanName string, timeout time.Duration, maxIdleConns int, tracer opentracing.Tracer, to TransportOptions) (*authClient, error) {
 	if tracer == nil {
 		tracer = opentracing.NoopTracer{}
 	}
 	if maxIdleConns <= 0 {
 		maxIdleConns = defaultMaxIdleConns
 	}
+	if to.IdleConnTimeout <= 0 {
+		to.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if to.DialTimeout <= 0 {
+		to.DialTimeout = timeout
+	}
+	if to.TLSHandshakeTimeout <= 0 {
+		to.TLSHandshakeTimeout = timeout
+	}
 
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, err
 	}
 
+	// spans are created by the authClient, to be able to tag them
+	// with the result of the auth request
 	cli := net.NewClient(net.Options{
-		ResponseHeaderTimeout:   timeout,
-		TLSHandshakeTimeout:     timeout,
-		MaxIdleConnsPerHost:     maxIdleConns,
-		Tracer:                  tracer,
-		OpentracingComponentTag: "skipper",
-		OpentracingSpanName:     spanName,
+		ResponseHeaderTimeout: timeout,
+		TLSHandshakeTimeout:   to.TLSHandshakeTimeout,
+		DialTimeout:           to.DialTimeout,
+		IdleConnTimeout:       to.IdleConnTimeout,
+		MaxIdleConns:          to.MaxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		ForceAttemptHTTP2:     to.ForceHTTP2,
+		Tracer:                tracer,
 	})
 
-	return &authClient{url: u, cli: cli}, nil
+	return &authClient{url: u, cli: cli, tracer: tracer, spanName: spanName, timeout: timeout}, nil
 }
 
 func (ac *authClient) Close() {
@@ -64,40 +145,242 @@ func bindContext(ctx filters.FilterContext, req *http.Request) *http.Request {
 	return req.WithContext(ctx.Request().Context())
 }
 
+// startSpan creates a client span for the request to the auth
+// endpoint, if the request context has a parent span. The returned
+// function finishes the span, tagging it with the response status, or
+// marking it as failed.
+func (ac *authClient) startSpan(req *http.Request) (*http.Request, func(*http.Response, bool)) {
+	nop := func(*http.Response, bool) {}
+	parentSpan := opentracing.SpanFromContext(req.Context())
+	if parentSpan == nil {
+		return req, nop
+	}
+
+	span := ac.tracer.StartSpan(ac.spanName, opentracing.ChildOf(parentSpan.Context()))
+	ext.Component.Set(span, "skipper")
+	ext.SpanKindRPCClient.Set(span)
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.PeerHostname.Set(span, req.URL.Hostname())
+
+	_ = ac.tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	req = net.InjectClientTrace(req, span)
+
+	return req, func(rsp *http.Response, failed bool) {
+		if rsp != nil {
+			ext.HTTPStatusCode.Set(span, uint16(rsp.StatusCode))
+		}
+
+		if failed {
+			ext.Error.Set(span, true)
+		}
+
+		span.Finish()
+	}
+}
+
+// do executes the request within a client span. Non-200 responses
+// mark the span as failed, when failOnStatus is true. When the circuit
+// breaker is open, the request is not executed and
+// errAuthServiceUnavailable is returned. When the concurrency limit is
+// reached, and no slot is available in time, errAuthServiceSaturated
+// is returned.
+func (ac *authClient) do(req *http.Request, failOnStatus bool) (*http.Response, error) {
+	release, err := ac.inflight.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	done, err := ac.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	req, finishSpan := ac.startSpan(req)
+	rsp, err := ac.cli.Do(req)
+	finishSpan(rsp, err != nil || failOnStatus && rsp.StatusCode != 200)
+	done(err == nil && rsp.StatusCode < 500)
+	return rsp, err
+}
+
+// passes tells whether a request should be passed without validation,
+// because the call failed on the open breaker or on the concurrency
+// limit, and the related fail-open policy is configured.
+func (ac *authClient) passes(err error) bool {
+	return ac.breaker.passes(err) || ac.inflight.passes(err)
+}
+
+// credentials returns the client credentials of the introspection
+// requests, with the current secret from the secret file, when
+// configured.
+func (ac *authClient) credentials() *url.Userinfo {
+	if ac.secrets == nil || ac.url.User == nil {
+		return ac.url.User
+	}
+
+	if secret, ok := ac.secrets.GetSecret(ac.secretFile); ok {
+		return url.UserPassword(ac.url.User.Username(), string(secret))
+	}
+
+	return ac.url.User
+}
+
+// getTokenintrospect calls the introspection endpoint. Concurrent
+// calls with the same token share a single call, keyed by the hash of
+// the token, and each caller decodes its own copy of the response.
+// The errors are not shared beyond the concurrent callers, and a
+// cancelled caller doesn't cancel the shared call.
 func (ac *authClient) getTokenintrospect(token string, ctx filters.FilterContext) (tokenIntrospectionInfo, error) {
+	rctx := ctx.Request().Context()
+	key := sha256.Sum256([]byte(token))
+	ch := ac.flights.DoChan(string(key[:]), func() (interface{}, error) {
+		var dctx context.Context = detachedContext{rctx}
+		if ac.timeout > 0 {
+			var cancel context.CancelFunc
+			dctx, cancel = context.WithTimeout(dctx, ac.timeout)
+			defer cancel()
+		}
+
+		return ac.introspectionResponse(dctx, token)
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-rctx.Done():
+		return nil, rctx.Err()
+	}
+
+	if res.Shared {
+		metrics.Default.IncCounter(sharedIntrospectionMetricsKey)
+	}
+
+	if res.Err != nil {
+		return nil, res.Err
+	}
+
+	info := make(tokenIntrospectionInfo)
+	if err := json.Unmarshal(res.Val.([]byte), &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthServiceResponse, err)
+	}
+
+	return info, nil
+}
+
+// introspectionResponse calls the introspection endpoint and returns
+// the body of the response. The token is sent in the form body, or as
+// query parameter, and the client credentials as Basic auth, or in the
+// form body, depending on the style of the client.
+func (ac *authClient) introspectionResponse(ctx context.Context, token string) ([]byte, error) {
+	u := *ac.url
+	u.User = nil
+	user := ac.credentials()
+
 	body := url.Values{}
-	body.Add(tokenKey, token)
-	req, err := http.NewRequest("POST", ac.url.String(), strings.NewReader(body.Encode()))
+	if ac.tokenInQuery {
+		q := u.Query()
+		q.Set(tokenKey, token)
+		u.RawQuery = q.Encode()
+	} else {
+		body.Add(tokenKey, token)
+	}
+
+	if user != nil && ac.clientSecretPost {
+		secret, _ := user.Password()
+		body.Add(clientIDKey, user.Username())
+		body.Add(clientSecretKey, secret)
+	}
+
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(body.Encode()))
 	if err != nil {
 		return nil, err
 	}
 
-	req = bindContext(ctx, req)
+	req = req.WithContext(ctx)
 
-	if ac.url.User != nil {
-		authorization := base64.StdEncoding.EncodeToString([]byte(ac.url.User.String()))
+	if user != nil && !ac.clientSecretPost {
+		authorization := base64.StdEncoding.EncodeToString([]byte(user.String()))
 		req.Header.Add("Authorization", fmt.Sprintf("Basic %s", authorization))
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	rsp, err := ac.cli.Do(req)
+	rsp, err := ac.do(req, true)
 	if err != nil {
 		return nil, err
 	}
 	defer rsp.Body.Close()
 
+	if rsp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return nil, errAuthServiceStatus
+	}
+
+	// inactive tokens are responded with 200, see
+	// https://tools.ietf.org/html/rfc7662#section-2.2, the client
+	// errors, e.g. 401 for invalid client credentials or 429, are
+	// not about the token
 	if rsp.StatusCode != 200 {
 		io.Copy(ioutil.Discard, rsp.Body)
-		return nil, errInvalidToken
+		return nil, fmt.Errorf("%w: %d", errAuthServiceRejected, rsp.StatusCode)
+	}
+
+	return readResponse(rsp)
+}
+
+// responseBody returns the body of the response. Gzip encoded bodies
+// are decompressed, when the transport didn't decompress them, e.g.
+// because the auth service compresses the responses without the
+// client asking for it.
+func responseBody(rsp *http.Response) (io.Reader, error) {
+	if rsp.Uncompressed || !strings.EqualFold(rsp.Header.Get("Content-Encoding"), "gzip") {
+		return rsp.Body, nil
 	}
 
-	buf, err := ioutil.ReadAll(rsp.Body)
+	body, err := gzip.NewReader(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthServiceResponse, err)
+	}
+
+	return body, nil
+}
+
+// readResponse reads the, possibly decompressed, body of the response.
+// The bodies larger than maxAuthResponseSize are reported as
+// errAuthServiceResponse.
+func readResponse(rsp *http.Response) ([]byte, error) {
+	body, err := responseBody(rsp)
 	if err != nil {
 		return nil, err
 	}
-	info := make(tokenIntrospectionInfo)
-	err = json.Unmarshal(buf, &info)
-	return info, err
+
+	// reading one more byte than allowed detects the bodies, that
+	// exceed the limit
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxAuthResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthServiceResponse, err)
+	}
+
+	if len(b) > maxAuthResponseSize {
+		return nil, fmt.Errorf("%w: response exceeds the max response size", errAuthServiceResponse)
+	}
+
+	return b, nil
+}
+
+// decodeJSON decodes the JSON body of the response. Invalid bodies are
+// reported as errAuthServiceResponse, so they are not mistaken for
+// invalid tokens.
+func decodeJSON(rsp *http.Response, v interface{}) error {
+	b, err := readResponse(rsp)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", errAuthServiceResponse, err)
+	}
+
+	return nil
 }
 
 func (ac *authClient) getTokeninfo(token string, ctx filters.FilterContext) (map[string]interface{}, error) {
@@ -114,7 +397,7 @@ func (ac *authClient) getTokeninfo(token string, ctx filters.FilterContext) (map
 		req.Header.Set(authHeaderName, authHeaderPrefix+token)
 	}
 
-	rsp, err := ac.cli.Do(req)
+	rsp, err := ac.do(req, true)
 	if err != nil {
 		return doc, err
 	}
@@ -125,8 +408,7 @@ func (ac *authClient) getTokeninfo(token string, ctx filters.FilterContext) (map
 		return doc, errInvalidToken
 	}
 
-	d := json.NewDecoder(rsp.Body)
-	err = d.Decode(&doc)
+	err = decodeJSON(rsp, &doc)
 	return doc, err
 }
 
@@ -139,7 +421,7 @@ func (ac *authClient) getWebhook(ctx filters.FilterContext) (*http.Response, err
 	req = bindContext(ctx, req)
 	copyHeader(req.Header, ctx.Request().Header)
 
-	rsp, err := ac.cli.Do(req)
+	rsp, err := ac.do(req, false)
 	if err != nil {
 		return nil, err
 	}
@@ -147,3 +429,39 @@ func (ac *authClient) getWebhook(ctx filters.FilterContext) (*http.Response, err
 
 	return rsp, nil
 }
+
+// getPolicyDecision posts the input to the policy service, and returns
+// its allow or deny decision. Other than 200 responses are returned as
+// errPolicyServiceStatus.
+func (ac *authClient) getPolicyDecision(input policyInput, ctx filters.FilterContext) (bool, error) {
+	body, err := json.Marshal(policyRequest{Input: input})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", ac.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req = bindContext(ctx, req)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := ac.do(req, true)
+	if err != nil {
+		return false, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return false, errPolicyServiceStatus
+	}
+
+	var d policyResponse
+	if err := decodeJSON(rsp, &d); err != nil {
+		return false, err
+	}
+
+	return d.allowed()
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestAuthClientSpan(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authHeaderName) != authHeaderPrefix+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"uid": "jdoe"}`))
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		token    string
+		status   uint16
+		hasError bool
+	}{{
+		msg:    "valid token",
+		token:  testToken,
+		status: http.StatusOK,
+	}, {
+		msg:      "invalid token",
+		token:    "invalid-token",
+		status:   http.StatusUnauthorized,
+		hasError: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			tracer := mocktracer.New()
+			ac, err := newAuthClient(backend.URL, tokenInfoSpanName, testAuthTimeout, 0, tracer, TransportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ac.Close()
+
+			parent := tracer.StartSpan("parent")
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(opentracing.ContextWithSpan(req.Context(), parent))
+			ctx := &filtertest.Context{FRequest: req}
+
+			ac.getTokeninfo(ti.token, ctx)
+			parent.Finish()
+
+			spans := tracer.FinishedSpans()
+			if len(spans) != 2 {
+				t.Fatalf("unexpected number of spans: %d", len(spans))
+			}
+
+			span := spans[0]
+			if span.OperationName != tokenInfoSpanName {
+				t.Errorf("unexpected span name: %s", span.OperationName)
+			}
+
+			if span.ParentID != parent.Context().(mocktracer.MockSpanContext).SpanID {
+				t.Error("auth span is not a child of the request span")
+			}
+
+			if span.Tag("component") != "skipper" || span.Tag("span.kind") != ext.SpanKindRPCClientEnum {
+				t.Errorf("unexpected tags: %v", span.Tags())
+			}
+
+			if span.Tag("peer.hostname") != "127.0.0.1" {
+				t.Errorf("unexpected peer hostname: %v", span.Tag("peer.hostname"))
+			}
+
+			if span.Tag("http.status_code") != ti.status {
+				t.Errorf("unexpected status: %v", span.Tag("http.status_code"))
+			}
+
+			if hasError, _ := span.Tag("error").(bool); hasError != ti.hasError {
+				t.Errorf("unexpected error tag: %v", span.Tag("error"))
+			}
+		})
+	}
+}
+
+func TestAuthClientConnectionReuse(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid": "jdoe"}`))
+	}))
+	backend.Config.ConnState = func(_ stdnet.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	ac, err := newAuthClient(backend.URL, tokenInfoSpanName, testAuthTimeout, 0, nil, TransportOptions{
+		IdleConnTimeout: time.Minute,
+		DialTimeout:     time.Second,
+		ForceHTTP2:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	for i := 0; i < 10; i++ {
+		ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil)}
+		if _, err := ac.getTokeninfo(testToken, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("connections to the identity provider not reused: %d", conns)
+	}
+}
+
+func TestAuthClientGzipResponse(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(s))
+		w.Close()
+		return b.Bytes()
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		encoding string
+		body     []byte
+		expected int
+		reason   rejectReason
+	}{{
+		msg:      "plain",
+		body:     []byte(`{"uid": "jdoe", "scope": ["read"]}`),
+		expected: http.StatusOK,
+	}, {
+		msg:      "gzip",
+		encoding: "gzip",
+		body:     gzipped(`{"uid": "jdoe", "scope": ["read"]}`),
+		expected: http.StatusOK,
+	}, {
+		msg:      "invalid gzip",
+		encoding: "gzip",
+		body:     []byte(`{"uid": "jdoe", "scope": ["read"]}`),
+		expected: http.StatusUnauthorized,
+		reason:   authServiceAccess,
+	}, {
+		msg:      "invalid json",
+		body:     []byte(`uid=jdoe`),
+		expected: http.StatusUnauthorized,
+		reason:   authServiceAccess,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if ti.encoding != "" {
+					w.Header().Set("Content-Encoding", ti.encoding)
+				}
+
+				w.Write(ti.body)
+			}))
+			defer backend.Close()
+
+			spec := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{URL: backend.URL, Timeout: time.Second})
+			f, err := spec.CreateFilter([]interface{}{"read"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokeninfoFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Fatalf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.reason != "" && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(ti.reason) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestAuthClientSharedCallTimeout(t *testing.T) {
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the headers are sent in time, but the body is stalled
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(done)
+
+	ac, err := newAuthClient(backend.URL, "introspection", 100*time.Millisecond, 0, nil, TransportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	// the request context has no deadline, the shared call is
+	// bounded by the timeout of the client
+	ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil)}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ac.getTokenintrospect(testToken, ctx)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected timeout error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("shared call was not bounded by the client timeout")
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(`{"active": true}`))
+	w.Close()
+
+	// compressed without the transport asking for it
+	rsp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   ioutil.NopCloser(&b),
+	}
+
+	var info tokenIntrospectionInfo
+	if err := decodeJSON(rsp, &info); err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.Active() {
+		t.Errorf("failed to decode the gzip encoded body: %v", info)
+	}
+
+	rsp = &http.Response{Body: ioutil.NopCloser(strings.NewReader("active"))}
+	if err := decodeJSON(rsp, &info); !errors.Is(err, errAuthServiceResponse) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	gzipped := func(size int) *http.Response {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(`"`))
+		w.Write(bytes.Repeat([]byte("a"), size-2))
+		w.Write([]byte(`"`))
+		w.Close()
+		return &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:   ioutil.NopCloser(&b),
+		}
+	}
+
+	var s string
+	if err := decodeJSON(gzipped(maxAuthResponseSize), &s); err != nil {
+		t.Errorf("failed to decode the body of the max size: %v", err)
+	}
+
+	if err := decodeJSON(gzipped(maxAuthResponseSize+1), &s); !errors.Is(err, errAuthServiceResponse) {
+		t.Errorf("unexpected error of the body over the max size: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/zalando/skipper/metrics"
+)
+
+const concurrencyMetricsPrefix = "auth.concurrency."
+
+var errAuthServiceSaturated = errors.New("auth service concurrency limit reached")
+
+// ConcurrencyOptions limits the concurrent calls to the tokeninfo or
+// tokenintrospection endpoints, to protect the authorization service
+// from a burst of calls, e.g. with many unknown tokens.
+type ConcurrencyOptions struct {
+	// MaxInflight is the maximum number of calls in flight to the
+	// same endpoint. 0 disables the limit.
+	MaxInflight int
+
+	// MaxWait is the maximum duration a call waits for a free slot,
+	// when the limit is reached. 0 means the calls fail fast.
+	MaxWait time.Duration
+
+	// FailOpen passes requests without validation, when no slot is
+	// available, instead of rejecting them with auth-service-access.
+	FailOpen bool
+}
+
+type authSemaphore struct {
+	slots      chan struct{}
+	maxWait    time.Duration
+	failOpen   bool
+	inflight   int64
+	metricsKey string
+}
+
+func newAuthSemaphore(name string, o ConcurrencyOptions) *authSemaphore {
+	if o.MaxInflight <= 0 {
+		return nil
+	}
+
+	return &authSemaphore{
+		slots:      make(chan struct{}, o.MaxInflight),
+		maxWait:    o.MaxWait,
+		failOpen:   o.FailOpen,
+		metricsKey: concurrencyMetricsPrefix + name,
+	}
+}
+
+// acquire takes a slot and returns the callback to release it. When
+// no slot becomes available within the max wait, or before the
+// context is done, it returns errAuthServiceSaturated.
+func (s *authSemaphore) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		if s.maxWait <= 0 {
+			return nil, s.saturated()
+		}
+
+		t := time.NewTimer(s.maxWait)
+		defer t.Stop()
+
+		select {
+		case s.slots <- struct{}{}:
+		case <-t.C:
+			return nil, s.saturated()
+		case <-ctx.Done():
+			return nil, s.saturated()
+		}
+	}
+
+	s.updateInflight(1)
+	return func() {
+		<-s.slots
+		s.updateInflight(-1)
+	}, nil
+}
+
+func (s *authSemaphore) saturated() error {
+	metrics.Default.IncCounter(s.metricsKey + ".saturated")
+	return errAuthServiceSaturated
+}
+
+func (s *authSemaphore) updateInflight(delta int64) {
+	metrics.Default.UpdateGauge(s.metricsKey+".inflight", float64(atomic.AddInt64(&s.inflight, delta)))
+}
+
+// passes tells whether a request should be passed without validation,
+// because no slot was available for the call to the auth service and
+// the fail-open policy is configured.
+func (s *authSemaphore) passes(err error) bool {
+	return s != nil && s.failOpen && err == errAuthServiceSaturated
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
+)
+
+func TestAuthSemaphore(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authHeaderName) == authHeaderPrefix+"slow" {
+			blocked <- struct{}{}
+			<-unblock
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "scope": ["read"]}`))
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		maxWait  time.Duration
+		failOpen bool
+		expected int
+	}{{
+		msg:      "fail fast",
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "wait bounded",
+		maxWait:  30 * time.Millisecond,
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "fail open",
+		failOpen: true,
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			delete(tokeninfoAuthClient, backend.URL)
+			spec := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{
+				URL:         backend.URL,
+				Timeout:     time.Second,
+				Concurrency: ConcurrencyOptions{MaxInflight: 1, MaxWait: ti.maxWait, FailOpen: ti.failOpen},
+			})
+
+			f, err := spec.CreateFilter([]interface{}{"read"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokeninfoFilter).Close()
+
+			request := func(token string) int {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(authHeaderName, authHeaderPrefix+token)
+				ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+				f.Request(ctx)
+				if ctx.FServed {
+					return ctx.FResponse.StatusCode
+				}
+
+				return http.StatusOK
+			}
+
+			slow := make(chan int)
+			go func() { slow <- request("slow") }()
+			<-blocked
+
+			if status := request("token"); status != ti.expected {
+				t.Errorf("unexpected status code while saturated: %d != %d", status, ti.expected)
+			}
+
+			close(unblock)
+			if status := <-slow; status != http.StatusOK {
+				t.Errorf("unexpected status code of the slow call: %d", status)
+			}
+
+			unblock = make(chan struct{})
+			if status := request("token"); status != http.StatusOK {
+				t.Errorf("unexpected status code after the release: %d", status)
+			}
+		})
+	}
+
+	m.WithCounters(func(counters map[string]int64) {
+		if c := counters["auth.concurrency.tokeninfo.saturated"]; c != 3 {
+			t.Errorf("unexpected count of saturated calls: %d", c)
+		}
+	})
+
+	m.WithGauges(func(gauges map[string]float64) {
+		if g := gauges["auth.concurrency.tokeninfo.inflight"]; g != 0 {
+			t.Errorf("unexpected calls in flight: %v", g)
+		}
+	})
+}
+
+func TestAuthSemaphoreWait(t *testing.T) {
+	s := newAuthSemaphore("test", ConcurrencyOptions{MaxInflight: 1, MaxWait: time.Second})
+	release, err := s.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+
+	if _, err := s.acquire(context.Background()); err != nil {
+		t.Errorf("failed to wait for the released slot: %v", err)
+	}
+}
@@ -29,6 +29,10 @@ func (a *basic) Response(filters.FilterContext) {}
 
 // check basic auth
 func (a *basic) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
 	username := a.authenticator.CheckAuth(ctx.Request())
 
 	if username == "" {
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/metrics"
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	OAuthBypassName = "oauthBypass"
+
+	authBypassKey       = "auth.bypass"
+	bypassMetricsPrefix = "auth.bypass."
+)
+
+type (
+	bypassSpec struct{}
+
+	bypassRule struct {
+		method string
+		path   string
+	}
+
+	bypassFilter struct {
+		rules []bypassRule
+	}
+)
+
+// NewOAuthBypass creates a filter spec, which makes the auth filters
+// of the route skip the authentication of the requests with the listed
+// methods, e.g. CORS preflight requests. The arguments are either HTTP
+// methods, or a method and an exact path separated by a space, to
+// bypass the authentication only for the path, e.g. of a health check.
+// The Authorization header of a bypassed request is removed, so the
+// backend never receives credentials, that were not validated. The
+// rest of the filter chain is applied as usual. The filter has to be
+// placed before the auth filters.
+//
+// Example:
+//
+//	oauthBypass("OPTIONS", "GET /healthz") -> oauthTokeninfoAnyScope("read") -> "https://internal.example.org";
+func NewOAuthBypass() filters.Spec {
+	return &bypassSpec{}
+}
+
+func (*bypassSpec) Name() string { return OAuthBypassName }
+
+func (*bypassSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) == 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &bypassFilter{}
+	for _, s := range sargs {
+		var r bypassRule
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			r.method, r.path = s[:i], s[i+1:]
+			if !strings.HasPrefix(r.path, "/") {
+				return nil, filters.ErrInvalidFilterParameters
+			}
+		} else {
+			r.method = s
+		}
+
+		if r.method != strings.ToUpper(r.method) || !httpguts.ValidHeaderFieldName(r.method) {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.rules = append(f.rules, r)
+	}
+
+	return f, nil
+}
+
+func (f *bypassFilter) matches(r *http.Request) bool {
+	for _, rule := range f.rules {
+		if rule.method == r.Method && (rule.path == "" || rule.path == r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *bypassFilter) Request(ctx filters.FilterContext) {
+	r := ctx.Request()
+	if !f.matches(r) {
+		return
+	}
+
+	log.Debugf("Authentication bypassed: method: %s, path: %s.", r.Method, r.URL.Path)
+	metrics.Default.IncCounter(bypassMetricsPrefix + r.Method)
+
+	r.Header.Del(authHeaderName)
+	ctx.StateBag()[authBypassKey] = true
+}
+
+func (*bypassFilter) Response(filters.FilterContext) {}
+
+// authBypassed tells whether the authentication of the request is
+// bypassed by the oauthBypass filter.
+func authBypassed(ctx filters.FilterContext) bool {
+	bypassed, _ := ctx.StateBag()[authBypassKey].(bool)
+	return bypassed
+}
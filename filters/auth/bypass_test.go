@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestBypass(t *testing.T) {
+	bypass, err := NewOAuthBypass().CreateFilter([]interface{}{"OPTIONS", "GET /healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist := NewOAuthSubjectAllowlist(SubjectListOptions{})
+	defer allowlist.Close()
+
+	f, err := allowlist.CreateFilter([]interface{}{"admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		method   string
+		path     string
+		bypassed bool
+	}{{
+		msg:      "preflight",
+		method:   "OPTIONS",
+		path:     "/api",
+		bypassed: true,
+	}, {
+		msg:      "health check",
+		method:   "GET",
+		path:     "/healthz",
+		bypassed: true,
+	}, {
+		msg:    "get of another path",
+		method: "GET",
+		path:   "/api",
+	}, {
+		msg:    "other method of the path",
+		method: "POST",
+		path:   "/healthz",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			req := httptest.NewRequest(ti.method, ti.path, nil)
+			req.Header.Set(authHeaderName, "Bearer foo")
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+
+			bypass.Request(ctx)
+			f.Request(ctx)
+
+			if ctx.FServed == ti.bypassed {
+				t.Errorf("unexpected rejection: %v", ctx.FServed)
+			}
+
+			if h := req.Header.Get(authHeaderName); (h == "") != ti.bypassed {
+				t.Errorf("unexpected authorization header: %q", h)
+			}
+		})
+	}
+}
+
+func TestBypassCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{""},
+		{"options"},
+		{"GET healthz"},
+		{"GET /healthz", 42},
+	} {
+		if _, err := NewOAuthBypass().CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
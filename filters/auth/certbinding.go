@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthCertBindingName = "oauthCertBinding"
+
+	// cnfKey defined at https://tools.ietf.org/html/rfc7800#section-3.1
+	cnfKey = "cnf"
+	// x5tS256Key defined at https://tools.ietf.org/html/rfc8705#section-3.1
+	x5tS256Key = "x5t#S256"
+
+	allowUnboundToken = "allow-unbound-token"
+)
+
+type (
+	certBindingSpec struct{}
+
+	certBindingFilter struct {
+		allowUnbound bool
+	}
+)
+
+// NewOAuthCertBinding creates a filter spec, which rejects the
+// requests with certificate-bound access tokens, when the SHA-256
+// thumbprint of the client certificate of the mTLS connection doesn't
+// match the cnf.x5t#S256 claim of the token, as defined by RFC 8705.
+// Skipper has to terminate the mTLS connections, and the filter has to
+// be placed after one of the oauthTokeninfo*, oauthTokenintrospection*
+// or oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokenintrospectionAnyClaims("https://idp.example.org", "uid") -> oauthCertBinding() -> "https://internal.example.org";
+func NewOAuthCertBinding() filters.Spec {
+	return &certBindingSpec{}
+}
+
+func (*certBindingSpec) Name() string { return OAuthCertBindingName }
+
+// CreateFilter accepts optionally "allow-unbound-token" to accept the
+// tokens without cnf.x5t#S256 claim.
+func (*certBindingSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &certBindingFilter{}
+	switch {
+	case len(sargs) == 0:
+	case len(sargs) == 1 && sargs[0] == allowUnboundToken:
+		f.allowUnbound = true
+	default:
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return f, nil
+}
+
+// certThumbprint returns the x5t#S256 claim of the token.
+func certThumbprint(claims map[string]interface{}) (string, bool) {
+	cnf, ok := claims[cnfKey].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+
+	x5t, ok := cnf[x5tS256Key].(string)
+	return x5t, ok && x5t != ""
+}
+
+func (f *certBindingFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "no validated token available for certificate binding validation")
+		return
+	}
+
+	x5t, ok := certThumbprint(claims)
+	if !ok {
+		if !f.allowUnbound {
+			unauthorized(ctx, "", certBindingMismatch, r.Host, "missing cnf.x5t#S256 claim")
+		}
+
+		return
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		unauthorized(ctx, "", certBindingMismatch, r.Host, "no client certificate presented")
+		return
+	}
+
+	// the first certificate is the leaf, that the client authenticated with
+	h := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	presented := base64.RawURLEncoding.EncodeToString(h[:])
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(x5t)) != 1 {
+		unauthorized(ctx, "", certBindingMismatch, r.Host, "client certificate doesn't match the token")
+	}
+}
+
+func (*certBindingFilter) Response(filters.FilterContext) {}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestCertBinding(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("client certificate")}
+	other := &x509.Certificate{Raw: []byte("other certificate")}
+	h := sha256.Sum256(cert.Raw)
+	x5t := base64.RawURLEncoding.EncodeToString(h[:])
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		key      string
+		claims   interface{}
+		certs    []*x509.Certificate
+		expected int
+		reason   rejectReason
+	}{{
+		msg:      "no validated token",
+		certs:    []*x509.Certificate{cert},
+		expected: http.StatusUnauthorized,
+		reason:   missingToken,
+	}, {
+		msg:      "matching certificate",
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"cnf": map[string]interface{}{"x5t#S256": x5t}},
+		certs:    []*x509.Certificate{cert, other},
+		expected: http.StatusOK,
+	}, {
+		msg:      "matching certificate of tokeninfo",
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"cnf": map[string]interface{}{"x5t#S256": x5t}},
+		certs:    []*x509.Certificate{cert},
+		expected: http.StatusOK,
+	}, {
+		msg:      "different certificate",
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"cnf": map[string]interface{}{"x5t#S256": x5t}},
+		certs:    []*x509.Certificate{other, cert},
+		expected: http.StatusUnauthorized,
+		reason:   certBindingMismatch,
+	}, {
+		msg:      "no client certificate",
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"cnf": map[string]interface{}{"x5t#S256": x5t}},
+		expected: http.StatusUnauthorized,
+		reason:   certBindingMismatch,
+	}, {
+		msg:      "unbound token rejected",
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"sub": "foo"},
+		certs:    []*x509.Certificate{cert},
+		expected: http.StatusUnauthorized,
+		reason:   certBindingMismatch,
+	}, {
+		msg:      "unbound token allowed",
+		args:     []interface{}{"allow-unbound-token"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"sub": "foo"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "bound token with allowed unbound tokens",
+		args:     []interface{}{"allow-unbound-token"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"cnf": map[string]interface{}{"x5t#S256": x5t}},
+		certs:    []*x509.Certificate{other},
+		expected: http.StatusUnauthorized,
+		reason:   certBindingMismatch,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthCertBinding().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "https://www.example.org/", nil)
+			if ti.certs != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: ti.certs}
+			}
+
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			if ti.key != "" {
+				ctx.FStateBag[ti.key] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.reason != "" && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(ti.reason) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestCertBindingCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{"invalid"}, {"allow-unbound-token", "x"}, {8}} {
+		if _, err := NewOAuthCertBinding().CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
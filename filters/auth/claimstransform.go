@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthClaimsTransformName = "oauthClaimsTransform"
+
+	claimsTransformKey = "auth.claimsTransform"
+	splitTransform     = "split"
+)
+
+var claimSeparators = map[string]string{
+	"comma":     ",",
+	"semicolon": ";",
+	"space":     " ",
+}
+
+type (
+	claimsTransformSpec struct{}
+
+	// claimTransform splits a string claim into its values.
+	claimTransform struct {
+		claim     string
+		separator string
+	}
+
+	claimsTransformFilter struct {
+		transforms []claimTransform
+	}
+)
+
+// NewOAuthClaimsTransform creates a filter spec, which normalizes
+// claims of the token into a list of strings, before the claims are
+// checked, e.g. roles delimited by comma or space instead of an
+// array. The filter has to be placed before the oauthTokeninfo*,
+// oauthTokenintrospection* or oauthOidc* filters, that check the
+// claims.
+//
+// Example:
+//
+//	oauthClaimsTransform("split:roles:comma") -> oauthTokenintrospectionAnyKV("https://idp.example.org", "roles", "admin") -> "https://internal.example.org";
+func NewOAuthClaimsTransform() filters.Spec {
+	return &claimsTransformSpec{}
+}
+
+func (*claimsTransformSpec) Name() string { return OAuthClaimsTransformName }
+
+// CreateFilter accepts one or more transformations in the format of
+// split:<claim>:<separator>, where the separator is one of comma,
+// semicolon or space. The claim can be a path of nested claims, e.g.
+// realm_access.roles.
+func (*claimsTransformSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) == 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &claimsTransformFilter{}
+	for _, s := range sargs {
+		p := strings.Split(s, ":")
+		if len(p) != 3 || p[0] != splitTransform || p[1] == "" {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		sep, ok := claimSeparators[p[2]]
+		if !ok {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.transforms = append(f.transforms, claimTransform{claim: p[1], separator: sep})
+	}
+
+	return f, nil
+}
+
+// apply replaces the string value of the claim with its values. Claims,
+// that are not strings, are left unchanged, so applying it again is a
+// noop.
+func (t claimTransform) apply(claims map[string]interface{}) {
+	v, ok := claimValue(claims, t.claim)
+	if !ok {
+		return
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return
+	}
+
+	var values []string
+	if t.separator == " " {
+		values = strings.Fields(s)
+	} else {
+		for _, vi := range strings.Split(s, t.separator) {
+			if vi = strings.TrimSpace(vi); vi != "" {
+				values = append(values, vi)
+			}
+		}
+	}
+
+	claims[t.claim] = values
+}
+
+// transformClaims applies the transformations of the preceding
+// oauthClaimsTransform filters to the claims of the resolved token.
+func transformClaims(ctx filters.FilterContext, claims map[string]interface{}) {
+	transforms, _ := ctx.StateBag()[claimsTransformKey].([]claimTransform)
+	for _, t := range transforms {
+		t.apply(claims)
+	}
+}
+
+func (f *claimsTransformFilter) Request(ctx filters.FilterContext) {
+	sb := ctx.StateBag()
+	transforms, _ := sb[claimsTransformKey].([]claimTransform)
+	sb[claimsTransformKey] = append(transforms[:len(transforms):len(transforms)], f.transforms...)
+}
+
+func (*claimsTransformFilter) Response(filters.FilterContext) {}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestClaimsTransform(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		claims   map[string]interface{}
+		claim    string
+		expected interface{}
+	}{{
+		msg:      "comma separated",
+		args:     []interface{}{"split:roles:comma"},
+		claims:   map[string]interface{}{"roles": "admin, reader,,writer"},
+		claim:    "roles",
+		expected: []string{"admin", "reader", "writer"},
+	}, {
+		msg:      "space delimited",
+		args:     []interface{}{"split:roles:space"},
+		claims:   map[string]interface{}{"roles": " admin  reader writer"},
+		claim:    "roles",
+		expected: []string{"admin", "reader", "writer"},
+	}, {
+		msg:      "nested claim",
+		args:     []interface{}{"split:realm_access.roles:semicolon"},
+		claims:   map[string]interface{}{"realm_access": map[string]interface{}{"roles": "admin;reader"}},
+		claim:    "realm_access.roles",
+		expected: []string{"admin", "reader"},
+	}, {
+		msg:      "array unchanged",
+		args:     []interface{}{"split:roles:comma"},
+		claims:   map[string]interface{}{"roles": []interface{}{"admin,reader"}},
+		claim:    "roles",
+		expected: []interface{}{"admin,reader"},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthClaimsTransform().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			// applying twice is a noop
+			transformClaims(ctx, ti.claims)
+			transformClaims(ctx, ti.claims)
+
+			if got := ti.claims[ti.claim]; !reflect.DeepEqual(got, ti.expected) {
+				t.Errorf("unexpected claim value: %#v, expected: %#v", got, ti.expected)
+			}
+		})
+	}
+}
+
+func TestClaimsTransformKV(t *testing.T) {
+	transform, err := NewOAuthClaimsTransform().CreateFilter([]interface{}{"split:roles:comma"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg       string
+		spec      filters.Spec
+		transform bool
+		expected  int
+	}{{
+		msg:      "all kv without transform",
+		spec:     NewOAuthTokeninfoAllKV("https://tokeninfo.example.org", time.Second),
+		expected: http.StatusForbidden,
+	}, {
+		msg:       "all kv",
+		spec:      NewOAuthTokeninfoAllKV("https://tokeninfo.example.org", time.Second),
+		transform: true,
+		expected:  http.StatusOK,
+	}, {
+		msg:       "any kv",
+		spec:      NewOAuthTokeninfoAnyKV("https://tokeninfo.example.org", time.Second),
+		transform: true,
+		expected:  http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := ti.spec.CreateFilter([]interface{}{"roles", "admin", "roles", "reader"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{
+				tokeninfoCacheKey: map[string]interface{}{"uid": "jdoe", "roles": "admin,reader"},
+			}}
+
+			if ti.transform {
+				transform.Request(ctx)
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestClaimsTransformCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{}, {1}, {"split:roles"}, {"split::comma"}, {"join:roles:comma"}, {"split:roles:tab"}} {
+		if _, err := NewOAuthClaimsTransform().CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/net"
+)
+
+const (
+	OAuthTokenDenylistName = "oauthTokenDenylist"
+
+	defaultDenylistRefreshInterval = time.Minute
+	defaultDenylistTimeout         = 2 * time.Second
+	jtiKey                         = "jti"
+	subKey                         = "sub"
+)
+
+// DenylistOptions configures the source of the token denylist.
+type DenylistOptions struct {
+	// URL of the denylist document. The document is a JSON object
+	// with the revoked token IDs and subjects:
+	//
+	//	{"jti": ["id1", "id2"], "sub": ["user1"]}
+	URL string
+
+	// RefreshInterval defines how often the denylist is fetched.
+	// Defaults to 1 minute.
+	RefreshInterval time.Duration
+
+	// Timeout of the requests fetching the denylist. Defaults to 2
+	// seconds.
+	Timeout time.Duration
+}
+
+type (
+	// TokenDenylistSpec is the filter spec of the oauthTokenDenylist
+	// filter. It refreshes the denylist in the background, so on
+	// tear down make sure to Close() it.
+	TokenDenylistSpec struct {
+		options DenylistOptions
+		client  *net.Client
+		current atomic.Value // *denylist
+		quit    chan struct{}
+	}
+
+	denylistFilter struct {
+		spec *TokenDenylistSpec
+	}
+
+	denylistDocument struct {
+		JTI []string `json:"jti"`
+		Sub []string `json:"sub"`
+	}
+
+	denylist struct {
+		jti map[string]struct{}
+		sub map[string]struct{}
+	}
+)
+
+// NewOAuthTokenDenylist creates a filter spec, which rejects tokens
+// whose jti or sub claim is on the denylist fetched from the
+// configured URL. The filter has to be placed after one of the
+// oauthTokeninfo*, oauthTokenintrospection* or oauthOidc* filters,
+// because it checks the claims of the already validated token.
+//
+// Until the denylist was fetched successfully for the first time, no
+// token is rejected. If a refresh fails, the last fetched denylist is
+// kept.
+//
+// Example:
+//
+//	oauthTokeninfoAnyScope("read") -> oauthTokenDenylist() -> "https://internal.example.org";
+func NewOAuthTokenDenylist(o DenylistOptions) *TokenDenylistSpec {
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = defaultDenylistRefreshInterval
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = defaultDenylistTimeout
+	}
+
+	s := &TokenDenylistSpec{
+		options: o,
+		client: net.NewClient(net.Options{
+			ResponseHeaderTimeout: o.Timeout,
+			TLSHandshakeTimeout:   o.Timeout,
+		}),
+		quit: make(chan struct{}),
+	}
+
+	s.current.Store(&denylist{})
+	go s.runRefresher()
+	return s
+}
+
+func (s *TokenDenylistSpec) runRefresher() {
+	var d time.Duration
+	for {
+		select {
+		case <-time.After(d):
+			if err := s.refresh(); err != nil {
+				log.Errorf("Failed to refresh token denylist: %v.", err)
+			}
+		case <-s.quit:
+			return
+		}
+
+		d = s.options.RefreshInterval
+	}
+}
+
+func (s *TokenDenylistSpec) refresh() error {
+	rsp, err := s.client.Get(s.options.URL)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return fmt.Errorf("unexpected status code: %d", rsp.StatusCode)
+	}
+
+	var doc denylistDocument
+	if err := json.NewDecoder(rsp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	s.current.Store(newDenylist(doc))
+	return nil
+}
+
+func newDenylist(doc denylistDocument) *denylist {
+	dl := &denylist{
+		jti: make(map[string]struct{}, len(doc.JTI)),
+		sub: make(map[string]struct{}, len(doc.Sub)),
+	}
+
+	for _, jti := range doc.JTI {
+		dl.jti[jti] = struct{}{}
+	}
+
+	for _, sub := range doc.Sub {
+		dl.sub[sub] = struct{}{}
+	}
+
+	return dl
+}
+
+// revoked checks if the jti or the sub claim is on the denylist.
+func (dl *denylist) revoked(claims map[string]interface{}) bool {
+	if jti, ok := claims[jtiKey].(string); ok {
+		if _, ok := dl.jti[jti]; ok {
+			return true
+		}
+	}
+
+	if sub, ok := claims[subKey].(string); ok {
+		if _, ok := dl.sub[sub]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close stops the background refresh of the denylist.
+func (s *TokenDenylistSpec) Close() {
+	close(s.quit)
+	s.client.Close()
+}
+
+func (*TokenDenylistSpec) Name() string { return OAuthTokenDenylistName }
+
+// CreateFilter creates an oauthTokenDenylist filter. It doesn't accept
+// arguments.
+func (s *TokenDenylistSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return &denylistFilter{spec: s}, nil
+}
+
+func (f *denylistFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, "", "")
+		return
+	}
+
+	dl := f.spec.current.Load().(*denylist)
+	if dl.revoked(claims) {
+		uid, _ := claims[uidKey].(string)
+		unauthorized(ctx, uid, revokedToken, "", "")
+	}
+}
+
+func (*denylistFilter) Response(filters.FilterContext) {}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestTokenDenylist(t *testing.T) {
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte(`{"jti": ["revoked-id"], "sub": ["revoked-sub"]}`))
+	}))
+	defer backend.Close()
+
+	spec := NewOAuthTokenDenylist(DenylistOptions{URL: backend.URL, RefreshInterval: time.Hour})
+	defer spec.Close()
+
+	if err := spec.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed refresh keeps the last denylist
+	atomic.StoreInt32(&failing, 1)
+	if err := spec.refresh(); err == nil {
+		t.Fatal("expected refresh error")
+	}
+
+	f, err := spec.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		claims   map[string]interface{}
+		expected int
+	}{{
+		msg:      "no validated token",
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "token not on denylist",
+		claims:   map[string]interface{}{"jti": "some-id", "sub": "some-sub"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "revoked jti",
+		claims:   map[string]interface{}{"jti": "revoked-id", "sub": "some-sub"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "revoked sub",
+		claims:   map[string]interface{}{"sub": "revoked-sub"},
+		expected: http.StatusUnauthorized,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			ctx := &filtertest.Context{
+				FRequest:  httptest.NewRequest("GET", "/", nil),
+				FStateBag: map[string]interface{}{},
+			}
+
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestTokenDenylistCreateFilter(t *testing.T) {
+	spec := NewOAuthTokenDenylist(DenylistOptions{URL: "http://denylist.invalid", RefreshInterval: time.Hour})
+	defer spec.Close()
+
+	if _, err := spec.CreateFilter([]interface{}{"foo"}); err == nil {
+		t.Error("expected error for arguments")
+	}
+}
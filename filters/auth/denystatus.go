@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthDenyStatusName = "oauthDenyStatus"
+
+	denyStatusKey = "auth.denyStatus"
+)
+
+type (
+	denyStatusSpec   struct{}
+	denyStatusFilter struct {
+		status  int
+		reasons map[rejectReason]int
+	}
+)
+
+// NewOAuthDenyStatus creates a filter spec, which overrides the status
+// code of the authorization failures of the auth filters, the requests
+// rejected by default with 403, e.g. to respond with 429 for policy
+// throttling. The first argument is the status code of all the
+// authorization failures, the optional pairs of reject reason and
+// status code following it override the status code of single reject
+// reasons. The authentication failures, rejected with 401 and the
+// WWW-Authenticate header, are not affected. Only 4xx status codes are
+// accepted, except 401 and 407, which require an authentication
+// challenge. The filter has to be placed before the auth filters.
+//
+// Example:
+//
+//	oauthDenyStatus(404) -> oauthTokeninfoAnyScope("read") -> "https://api.example.org";
+//	oauthDenyStatus(403, "invalid-scope", 429) -> oauthTokeninfoAnyScope("read") -> "https://api.example.org";
+func NewOAuthDenyStatus() filters.Spec {
+	return &denyStatusSpec{}
+}
+
+func (*denyStatusSpec) Name() string { return OAuthDenyStatusName }
+
+func denyStatusArg(arg interface{}) (int, bool) {
+	var status int
+	switch a := arg.(type) {
+	case float64:
+		status = int(a)
+		if float64(status) != a {
+			return 0, false
+		}
+	case int:
+		status = a
+	default:
+		return 0, false
+	}
+
+	if status < 400 || status > 499 ||
+		status == http.StatusUnauthorized ||
+		status == http.StatusProxyAuthRequired {
+		return 0, false
+	}
+
+	return status, true
+}
+
+func (*denyStatusSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	status, ok := denyStatusArg(args[0])
+	if !ok {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &denyStatusFilter{status: status, reasons: make(map[rejectReason]int)}
+	for i := 1; i < len(args); i += 2 {
+		reason, ok := args[i].(string)
+		if !ok || reason == "" {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		status, ok := denyStatusArg(args[i+1])
+		if !ok {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.reasons[rejectReason(reason)] = status
+	}
+
+	return f, nil
+}
+
+func (f *denyStatusFilter) Request(ctx filters.FilterContext) {
+	ctx.StateBag()[denyStatusKey] = f
+}
+
+func (*denyStatusFilter) Response(filters.FilterContext) {}
+
+// denyStatus returns the status code of the authorization failure with
+// the reason.
+func (f *denyStatusFilter) denyStatus(reason rejectReason) int {
+	if status, ok := f.reasons[reason]; ok {
+		return status
+	}
+
+	return f.status
+}
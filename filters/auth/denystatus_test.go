@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestDenyStatus(t *testing.T) {
+	for _, ti := range []struct {
+		msg            string
+		args           []interface{}
+		reject         func(*filtertest.Context)
+		expectedStatus int
+		expectedAuth   string
+	}{{
+		msg:  "forbidden",
+		args: []interface{}{float64(http.StatusNotFound)},
+		reject: func(ctx *filtertest.Context) {
+			forbidden(ctx, "jdoe", invalidScope, "missing scope write")
+		},
+		expectedStatus: http.StatusNotFound,
+	}, {
+		msg:  "forbidden with the status of the reason",
+		args: []interface{}{float64(http.StatusForbidden), string(invalidScope), float64(http.StatusTooManyRequests)},
+		reject: func(ctx *filtertest.Context) {
+			forbidden(ctx, "jdoe", invalidScope, "missing scope write")
+		},
+		expectedStatus: http.StatusTooManyRequests,
+	}, {
+		msg:  "forbidden with another reason",
+		args: []interface{}{float64(http.StatusForbidden), string(invalidScope), float64(http.StatusTooManyRequests)},
+		reject: func(ctx *filtertest.Context) {
+			forbidden(ctx, "jdoe", invalidSub, "")
+		},
+		expectedStatus: http.StatusForbidden,
+	}, {
+		msg:  "unauthorized is not affected",
+		args: []interface{}{float64(http.StatusNotFound), string(inactiveToken), float64(http.StatusTooManyRequests)},
+		reject: func(ctx *filtertest.Context) {
+			unauthorized(ctx, "", inactiveToken, "www.example.org", "token expired")
+		},
+		expectedStatus: http.StatusUnauthorized,
+		expectedAuth:   "www.example.org",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthDenyStatus().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{
+				FRequest:  httptest.NewRequest("GET", "/", nil),
+				FStateBag: map[string]interface{}{},
+			}
+
+			f.Request(ctx)
+			ti.reject(ctx)
+
+			if ctx.FResponse.StatusCode != ti.expectedStatus {
+				t.Errorf("unexpected status code: %d != %d", ctx.FResponse.StatusCode, ti.expectedStatus)
+			}
+
+			if h := ctx.FResponse.Header.Get("WWW-Authenticate"); h != ti.expectedAuth {
+				t.Errorf("unexpected WWW-Authenticate header: %q != %q", h, ti.expectedAuth)
+			}
+		})
+	}
+}
+
+func TestDenyStatusCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{"429"},
+		{float64(200)},
+		{float64(401)},
+		{float64(407)},
+		{float64(500)},
+		{float64(429.5)},
+		{float64(403), "invalid-scope"},
+		{float64(403), "", float64(429)},
+		{float64(403), "invalid-scope", float64(302)},
+	} {
+		if _, err := NewOAuthDenyStatus().CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	OAuthDPoPName = "oauthDPoP"
+
+	dpopHeaderName             = "DPoP"
+	dpopProofType              = "dpop+jwt"
+	dpopProofKey               = "auth.dpopProof"
+	defaultDPoPMaxAge          = 5 * time.Minute
+	defaultDPoPReplayCacheSize = 10000
+)
+
+// DPoPOptions configures the validation of DPoP proofs.
+type DPoPOptions struct {
+	// MaxAge is the maximum accepted age of a proof based on its iat
+	// claim. Defaults to 5 minutes.
+	MaxAge time.Duration
+
+	// ReplayCacheSize is the maximum number of proof jti values
+	// remembered to detect replays. Defaults to 10000.
+	ReplayCacheSize int
+
+	// TrustForwardedProto takes the scheme of the URL, that the htu
+	// claim of the proofs has to match, from the X-Forwarded-Proto
+	// header. Enable it only, when skipper runs behind proxies, that
+	// set the header, because clients can forge it otherwise.
+	TrustForwardedProto bool
+}
+
+type (
+	dpopSpec struct {
+		options DPoPOptions
+		replays *replayCache
+	}
+
+	dpopFilter struct {
+		maxAge         time.Duration
+		replays        *replayCache
+		forwardedProto bool
+	}
+
+	// dpopProof is the validated proof of the request, whose key has
+	// to be bound to the access token by its cnf.jkt claim
+	dpopProof struct {
+		token string
+		jkt   string
+	}
+
+	dpopClaims struct {
+		JTI string `json:"jti"`
+		HTM string `json:"htm"`
+		HTU string `json:"htu"`
+		IAT int64  `json:"iat"`
+		ATH string `json:"ath"`
+	}
+)
+
+var errInvalidDPoPProof = errors.New("invalid DPoP proof")
+
+// NewOAuthDPoP creates a filter spec which validates DPoP proofs
+// (RFC 9449) of sender-constrained access tokens with the default
+// options.
+func NewOAuthDPoP() filters.Spec {
+	return NewOAuthDPoPWithOptions(DPoPOptions{})
+}
+
+// NewOAuthDPoPWithOptions creates a filter spec which validates DPoP
+// proofs (RFC 9449) of sender-constrained access tokens. The filter
+// has to be placed before one of the oauthTokeninfo* or
+// oauthTokenintrospection* filters, which accept the token of the
+// DPoP authorization scheme only after the proof was validated, and
+// reject the tokens, whose cnf.jkt claim doesn't bind the key of the
+// proof.
+//
+// Example:
+//
+//	oauthDPoP() -> oauthTokeninfoAnyScope("read") -> "https://internal.example.org";
+func NewOAuthDPoPWithOptions(o DPoPOptions) filters.Spec {
+	if o.MaxAge <= 0 {
+		o.MaxAge = defaultDPoPMaxAge
+	}
+
+	if o.ReplayCacheSize <= 0 {
+		o.ReplayCacheSize = defaultDPoPReplayCacheSize
+	}
+
+	return &dpopSpec{
+		options: o,
+		replays: newReplayCache(o.ReplayCacheSize),
+	}
+}
+
+func (*dpopSpec) Name() string { return OAuthDPoPName }
+
+// CreateFilter accepts an optional argument, the maximum age of the
+// proof as a duration string, e.g. "1m".
+func (s *dpopSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) > 1 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &dpopFilter{
+		maxAge:         s.options.MaxAge,
+		replays:        s.replays,
+		forwardedProto: s.options.TrustForwardedProto,
+	}
+
+	if len(sargs) == 1 {
+		f.maxAge, err = time.ParseDuration(sargs[0])
+		if err != nil || f.maxAge <= 0 {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	return f, nil
+}
+
+func (f *dpopFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+	token, ok := dpopToken(r)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "")
+		return
+	}
+
+	jkt, err := f.validate(r, token, time.Now())
+	if err != nil {
+		unauthorized(ctx, "", dpopInvalid, r.Host, err.Error())
+		return
+	}
+
+	ctx.StateBag()[dpopProofKey] = &dpopProof{token: token, jkt: jkt}
+}
+
+func (*dpopFilter) Response(filters.FilterContext) {}
+
+// validate validates the proof of the request for the access token,
+// and returns the thumbprint of its key.
+func (f *dpopFilter) validate(r *http.Request, token string, now time.Time) (string, error) {
+	proofs := r.Header.Values(dpopHeaderName)
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("%w: expected one proof, got %d", errInvalidDPoPProof, len(proofs))
+	}
+
+	jws, err := jose.ParseSigned(proofs[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidDPoPProof, err)
+	}
+
+	if len(jws.Signatures) != 1 {
+		return "", fmt.Errorf("%w: expected one signature", errInvalidDPoPProof)
+	}
+
+	header := jws.Signatures[0].Protected
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", fmt.Errorf("%w: invalid typ %q", errInvalidDPoPProof, typ)
+	}
+
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return "", fmt.Errorf("%w: missing or invalid public jwk", errInvalidDPoPProof)
+	}
+
+	payload, err := jws.Verify(jwk)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidDPoPProof, err)
+	}
+
+	var pc dpopClaims
+	if err := json.Unmarshal(payload, &pc); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidDPoPProof, err)
+	}
+
+	if pc.JTI == "" {
+		return "", fmt.Errorf("%w: missing jti", errInvalidDPoPProof)
+	}
+
+	if pc.HTM != r.Method {
+		return "", fmt.Errorf("%w: htm %q does not match %q", errInvalidDPoPProof, pc.HTM, r.Method)
+	}
+
+	if !f.matchURI(r, pc.HTU) {
+		return "", fmt.Errorf("%w: htu %q does not match the request", errInvalidDPoPProof, pc.HTU)
+	}
+
+	iat := time.Unix(pc.IAT, 0)
+	if now.Sub(iat) > f.maxAge || iat.Sub(now) > f.maxAge {
+		return "", fmt.Errorf("%w: iat out of the accepted range", errInvalidDPoPProof)
+	}
+
+	// the proofs presented with an access token have to contain its
+	// hash, https://tools.ietf.org/html/rfc9449#section-4.3
+	h := sha256.Sum256([]byte(token))
+	if pc.ATH != base64.RawURLEncoding.EncodeToString(h[:]) {
+		return "", fmt.Errorf("%w: missing ath or it does not match the access token", errInvalidDPoPProof)
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidDPoPProof, err)
+	}
+
+	if f.replays.checkAndStore(pc.JTI, iat.Add(f.maxAge), now) {
+		log.Debugf("Replayed DPoP proof jti: %s", pc.JTI)
+		return "", fmt.Errorf("%w: replayed jti", errInvalidDPoPProof)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// matchURI tells whether the htu claim matches the URL of the request,
+// as seen by the client, ignoring the query and the fragment. The
+// scheme and the host are compared case-insensitively, and the path
+// exactly.
+func (f *dpopFilter) matchURI(r *http.Request, htu string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if p := r.Header.Get("X-Forwarded-Proto"); f.forwardedProto && p != "" {
+		scheme = p
+	}
+
+	path, htuPath := r.URL.Path, u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	if htuPath == "" {
+		htuPath = "/"
+	}
+
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, r.Host) && htuPath == path
+}
+
+// dpopToken returns the access token of the DPoP or of the Bearer
+// authorization scheme.
+func dpopToken(r *http.Request) (string, bool) {
+	if h := r.Header.Get(authHeaderName); strings.HasPrefix(h, dpopAuthHeaderPrefix) {
+		return h[len(dpopAuthHeaderPrefix):], true
+	}
+
+	return getToken(r)
+}
+
+// requestToken returns the access token of the request. The token of
+// the DPoP authorization scheme is only accepted, when the oauthDPoP
+// filter validated the proof of the request.
+func requestToken(ctx filters.FilterContext) (string, bool) {
+	if p, ok := ctx.StateBag()[dpopProofKey].(*dpopProof); ok {
+		return p.token, true
+	}
+
+	return getToken(ctx.Request())
+}
+
+// dpopBound tells whether the claims of the validated access token
+// bind the key of the DPoP proof, when the oauthDPoP filter validated
+// one.
+func dpopBound(ctx filters.FilterContext, claims map[string]interface{}) bool {
+	p, ok := ctx.StateBag()[dpopProofKey].(*dpopProof)
+	if !ok {
+		return true
+	}
+
+	jkt, ok := claimStringValues(claims, "cnf.jkt")
+	return ok && len(jkt) == 1 && jkt[0] == p.jkt
+}
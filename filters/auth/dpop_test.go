@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func newDPoPKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp, err := (&jose.JSONWebKey{Key: k.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k, base64.RawURLEncoding.EncodeToString(tp)
+}
+
+func newDPoPProof(t *testing.T, k *ecdsa.PrivateKey, typ string, claims dpopClaims) string {
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ))
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proof
+}
+
+func TestDPoP(t *testing.T) {
+	key, jkt := newDPoPKey(t)
+	otherKey, _ := newDPoPKey(t)
+
+	ath := sha256.Sum256([]byte(testToken))
+	valid := dpopClaims{
+		JTI: "jti",
+		HTM: "GET",
+		HTU: "https://www.example.org/resource",
+		IAT: time.Now().Unix(),
+		ATH: base64.RawURLEncoding.EncodeToString(ath[:]),
+	}
+
+	tokeninfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authHeaderName) != authHeaderPrefix+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"uid": testUID, "scope": []string{"read"}, "cnf": map[string]interface{}{"jkt": jkt}})
+	}))
+	defer tokeninfo.Close()
+
+	spec := NewOAuthDPoP()
+	with := func(f func(*dpopClaims)) dpopClaims {
+		c := valid
+		f(&c)
+		return c
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		url      string
+		proof    string
+		scheme   string
+		options  DPoPOptions
+		header   http.Header
+		expected int
+	}{{
+		msg:      "valid proof",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "valid" })),
+		expected: http.StatusOK,
+	}, {
+		msg:      "valid proof with the bearer scheme",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "bearer" })),
+		scheme:   authHeaderPrefix,
+		expected: http.StatusOK,
+	}, {
+		msg:      "case-insensitive scheme and host",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "host"; c.HTU = "HTTPS://WWW.example.org/resource" })),
+		expected: http.StatusOK,
+	}, {
+		msg:      "missing proof",
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "wrong typ",
+		proof:    newDPoPProof(t, key, "JWT", with(func(c *dpopClaims) { c.JTI = "typ" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "wrong method",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "htm"; c.HTM = "POST" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "wrong url",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "htu"; c.HTU = "https://www.example.org/other" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "case of the path",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "path"; c.HTU = "https://www.example.org/Resource" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "untrusted forwarded proto",
+		url:      "http://www.example.org/resource",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "proto" })),
+		header:   http.Header{"X-Forwarded-Proto": []string{"https"}},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "trusted forwarded proto",
+		url:      "http://www.example.org/resource",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "trusted-proto" })),
+		options:  DPoPOptions{TrustForwardedProto: true},
+		header:   http.Header{"X-Forwarded-Proto": []string{"https"}},
+		expected: http.StatusOK,
+	}, {
+		msg:      "too old",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "iat"; c.IAT = time.Now().Add(-time.Hour).Unix() })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "missing access token hash",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "no-ath"; c.ATH = "" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "wrong access token hash",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "ath"; c.ATH = "foo" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "key not bound to the token",
+		proof:    newDPoPProof(t, otherKey, dpopProofType, with(func(c *dpopClaims) { c.JTI = "jkt" })),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "replayed proof",
+		proof:    newDPoPProof(t, key, dpopProofType, with(func(c *dpopClaims) { c.JTI = "valid" })),
+		expected: http.StatusUnauthorized,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			s := spec
+			if ti.options != (DPoPOptions{}) {
+				s = NewOAuthDPoPWithOptions(ti.options)
+			}
+
+			f, err := s.CreateFilter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts, err := NewOAuthTokeninfoAnyScope(tokeninfo.URL, time.Second).CreateFilter([]interface{}{"read"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ts.(*tokeninfoFilter).Close()
+
+			url := ti.url
+			if url == "" {
+				url = "https://www.example.org/resource?q=1"
+			}
+
+			req := httptest.NewRequest("GET", url, nil)
+			for k, v := range ti.header {
+				req.Header[k] = v
+			}
+
+			scheme := ti.scheme
+			if scheme == "" {
+				scheme = dpopAuthHeaderPrefix
+			}
+
+			req.Header.Set(authHeaderName, scheme+testToken)
+			if ti.proof != "" {
+				req.Header.Set(dpopHeaderName, ti.proof)
+			}
+
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+			if !ctx.FServed {
+				ts.Request(ctx)
+			}
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestDPoPSchemeWithoutProof(t *testing.T) {
+	tokeninfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"uid": testUID, "scope": []string{"read"}})
+	}))
+	defer tokeninfo.Close()
+
+	f, err := NewOAuthTokeninfoAnyScope(tokeninfo.URL, time.Second).CreateFilter([]interface{}{"read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*tokeninfoFilter).Close()
+
+	req := httptest.NewRequest("GET", "https://www.example.org/resource", nil)
+	req.Header.Set(authHeaderName, dpopAuthHeaderPrefix+testToken)
+	ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+	f.Request(ctx)
+
+	if !ctx.FServed || ctx.FResponse.StatusCode != http.StatusUnauthorized {
+		t.Error("DPoP token accepted without the oauthDPoP filter")
+	}
+}
+
+func TestDPoPCreateFilter(t *testing.T) {
+	spec := NewOAuthDPoP()
+	if _, err := spec.CreateFilter([]interface{}{"1m"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, args := range [][]interface{}{{"foo"}, {"-1m"}, {1}, {"1m", "2m"}} {
+		if _, err := spec.CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
@@ -146,6 +146,10 @@ func (f *grantFilter) createTokenContainer(token *oauth2.Token, tokeninfo map[st
 }
 
 func (f *grantFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
 	req := ctx.Request()
 
 	c, err := extractCookie(req, f.config)
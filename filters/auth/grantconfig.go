@@ -157,6 +157,7 @@ func (c *OAuthConfig) Init() error {
 			c.ConnectionTimeout,
 			c.MaxIdleConnectionsPerHost,
 			c.Tracer,
+			TransportOptions{},
 		)
 		if err != nil {
 			return err
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthGrpcStatusName = "oauthGrpcStatus"
+
+	grpcStatusKey   = "auth.grpcStatus"
+	grpcContentType = "application/grpc"
+
+	// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+	grpcPermissionDenied = 7
+	grpcUnauthenticated  = 16
+)
+
+type (
+	grpcStatusSpec   struct{}
+	grpcStatusFilter struct{}
+)
+
+// NewOAuthGrpcStatus creates a filter spec, which makes the auth
+// filters reject gRPC requests with gRPC status codes instead of HTTP
+// status codes, so gRPC clients can interpret the failure. A rejected
+// gRPC request gets a trailers-only response with the grpc-status
+// UNAUTHENTICATED instead of 401, and PERMISSION_DENIED instead of 403.
+// Requests are detected as gRPC by the application/grpc content type,
+// other requests are rejected as before. The filter has to be placed
+// before the auth filters.
+//
+// Example:
+//
+//	oauthGrpcStatus() -> oauthTokeninfoAnyScope("read") -> "https://grpc.example.org";
+func NewOAuthGrpcStatus() filters.Spec {
+	return &grpcStatusSpec{}
+}
+
+func (*grpcStatusSpec) Name() string { return OAuthGrpcStatusName }
+
+func (*grpcStatusSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return &grpcStatusFilter{}, nil
+}
+
+func isGrpc(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == grpcContentType ||
+		strings.HasPrefix(ct, grpcContentType+"+") ||
+		strings.HasPrefix(ct, grpcContentType+";")
+}
+
+func (*grpcStatusFilter) Request(ctx filters.FilterContext) {
+	if isGrpc(ctx.Request()) {
+		ctx.StateBag()[grpcStatusKey] = true
+	}
+}
+
+func (*grpcStatusFilter) Response(filters.FilterContext) {}
+
+// grpcRejectResponse returns the trailers-only gRPC response for the
+// HTTP status of the rejected request.
+func grpcRejectResponse(status int, reason rejectReason) *http.Response {
+	code := grpcUnauthenticated
+	if status == http.StatusForbidden {
+		code = grpcPermissionDenied
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{grpcContentType},
+			"Grpc-Status":  []string{strconv.Itoa(code)},
+			"Grpc-Message": []string{string(reason)},
+		},
+	}
+}
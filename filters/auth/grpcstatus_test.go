@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestGrpcStatus(t *testing.T) {
+	grpcStatus, err := NewOAuthGrpcStatus().CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist := NewOAuthSubjectAllowlist(SubjectListOptions{})
+	defer allowlist.Close()
+
+	f, err := allowlist.CreateFilter([]interface{}{"admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg             string
+		claims          map[string]interface{}
+		contentType     string
+		grpcStatus      bool
+		expectedStatus  int
+		expectedGrpc    string
+		expectedMessage string
+	}{{
+		msg:            "http request",
+		contentType:    "application/json",
+		grpcStatus:     true,
+		expectedStatus: http.StatusUnauthorized,
+	}, {
+		msg:            "grpc request without the filter",
+		contentType:    "application/grpc",
+		expectedStatus: http.StatusUnauthorized,
+	}, {
+		msg:             "unauthenticated grpc request",
+		contentType:     "application/grpc",
+		grpcStatus:      true,
+		expectedStatus:  http.StatusOK,
+		expectedGrpc:    "16",
+		expectedMessage: string(missingToken),
+	}, {
+		msg:             "permission denied grpc request",
+		claims:          map[string]interface{}{"sub": "jdoe"},
+		contentType:     "application/grpc+proto",
+		grpcStatus:      true,
+		expectedStatus:  http.StatusOK,
+		expectedGrpc:    "7",
+		expectedMessage: string(invalidSub),
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Header.Set("Content-Type", ti.contentType)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			if ti.grpcStatus {
+				grpcStatus.Request(ctx)
+			}
+
+			f.Request(ctx)
+			if !ctx.FServed {
+				t.Fatal("request not rejected")
+			}
+
+			rsp := ctx.FResponse
+			if rsp.StatusCode != ti.expectedStatus {
+				t.Errorf("unexpected status code: %d != %d", rsp.StatusCode, ti.expectedStatus)
+			}
+
+			if got := rsp.Header.Get("Grpc-Status"); got != ti.expectedGrpc {
+				t.Errorf("unexpected grpc status: %q != %q", got, ti.expectedGrpc)
+			}
+
+			if got := rsp.Header.Get("Grpc-Message"); got != ti.expectedMessage {
+				t.Errorf("unexpected grpc message: %q != %q", got, ti.expectedMessage)
+			}
+		})
+	}
+}
+
+func TestGrpcStatusCreateFilter(t *testing.T) {
+	if _, err := NewOAuthGrpcStatus().CreateFilter([]interface{}{"foo"}); err == nil {
+		t.Error("expected error for arguments")
+	}
+}
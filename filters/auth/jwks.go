@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/metrics"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	jwksMetricsPrefix      = "auth.jwks."
+	jwksMetricsInterval    = 10 * time.Second
+	jwksMaxAge             = time.Hour
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksTimeout            = 2 * time.Second
+	jwksMaxResponseSize    = 1 << 20
+)
+
+var (
+	errJWKSSignature = errors.New("failed to verify signature with the keys of the jwks")
+	errJWKSTooLarge  = errors.New("jwks response exceeds the max response size")
+)
+
+// JWKSOptions bounds the fetches of the JWKS documents, that are used
+// to verify the signatures of the tokens locally, to protect against a
+// misbehaving or compromised identity provider.
+type JWKSOptions struct {
+	// MaxResponseSize is the maximum size of a JWKS response in
+	// bytes. Larger responses are rejected, without buffering them.
+	// Defaults to 1MiB.
+	MaxResponseSize int
+
+	// Timeout of a JWKS fetch, independent of the timeouts of the
+	// filters. Defaults to 2s.
+	Timeout time.Duration
+}
+
+// jwksKeySet caches the keys of the JWKS of an issuer, and verifies the
+// signatures of the tokens with them. It implements oidc.KeySet.
+//
+// The keys are refreshed when they are older than jwksMaxAge, and when
+// a token is signed with an unknown key id, but at most once in
+// jwksMinRefreshInterval.
+type jwksKeySet struct {
+	url             string
+	metricsKey      string
+	client          *http.Client
+	maxResponseSize int64
+
+	mu          sync.Mutex
+	keys        []jose.JSONWebKey
+	lastRefresh time.Time
+	lastAttempt time.Time
+
+	// fetching is closed, when the refresh in flight is done
+	fetching chan struct{}
+}
+
+var (
+	jwksMu          sync.Mutex
+	jwksKeySets     = make(map[string]*jwksKeySet)
+	jwksMetricsOnce sync.Once
+
+	// jwksPreloadBackOff is the backoff of the retries of the preload,
+	// replaced by the tests.
+	jwksPreloadBackOff = func() backoff.BackOff {
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0
+		return b
+	}
+)
+
+// getJWKSKeySet returns the shared key set of the JWKS URL. The metrics
+// of the key set are reported with the hostname of the issuer. The keys
+// of a new key set are preloaded in the background, so they are present
+// before the first request, and the filters can be created while the
+// issuer is unreachable. The key sets are shared, so the options of
+// the first filter creating the key set of a URL apply.
+func getJWKSKeySet(issuer, jwksURL string, o JWKSOptions) *jwksKeySet {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	if ks, ok := jwksKeySets[jwksURL]; ok {
+		return ks
+	}
+
+	metricsKey := issuer
+	if u, err := url.Parse(issuer); err == nil && u.Hostname() != "" {
+		metricsKey = u.Hostname()
+	}
+
+	if o.MaxResponseSize <= 0 {
+		o.MaxResponseSize = jwksMaxResponseSize
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = jwksTimeout
+	}
+
+	ks := &jwksKeySet{
+		url:             jwksURL,
+		metricsKey:      metricsKey,
+		client:          &http.Client{Timeout: o.Timeout},
+		maxResponseSize: int64(o.MaxResponseSize),
+	}
+
+	jwksKeySets[jwksURL] = ks
+	jwksMetricsOnce.Do(func() { go jwksMetricsLoop() })
+	go ks.preload(jwksPreloadBackOff())
+	return ks
+}
+
+// JWKSReadinessHandler responds with 200, when the keys of the JWKS of
+// all issuers used by the filters are loaded, otherwise with 503 and
+// the list of the JWKS URLs, that are not loaded yet. It can be used as
+// readiness check, so the instance receives traffic only after the
+// keys are present.
+func JWKSReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if missing := jwksNotLoaded(); len(missing) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "jwks not loaded: %s\n", strings.Join(missing, ", "))
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// jwksNotLoaded returns the sorted URLs of the key sets without keys.
+func jwksNotLoaded() []string {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	var missing []string
+	for u, ks := range jwksKeySets {
+		if !ks.loaded() {
+			missing = append(missing, u)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+func jwksMetricsLoop() {
+	for range time.Tick(jwksMetricsInterval) {
+		updateJWKSMetrics()
+	}
+}
+
+// updateJWKSMetrics updates the age of the keys of all the key sets.
+func updateJWKSMetrics() {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	for _, ks := range jwksKeySets {
+		ks.updateAge()
+	}
+}
+
+func (ks *jwksKeySet) updateAge() {
+	ks.mu.Lock()
+	lastRefresh := ks.lastRefresh
+	ks.mu.Unlock()
+
+	if !lastRefresh.IsZero() {
+		metrics.Default.UpdateGauge(jwksMetricsPrefix+ks.metricsKey+".age", time.Since(lastRefresh).Seconds())
+	}
+}
+
+func (ks *jwksKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := ks.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get jwks, status code: %d", rsp.StatusCode)
+	}
+
+	if rsp.ContentLength > ks.maxResponseSize {
+		return nil, errJWKSTooLarge
+	}
+
+	// reading one more byte than allowed detects the responses
+	// without content length, that exceed the limit
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, ks.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > ks.maxResponseSize {
+		return nil, errJWKSTooLarge
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, err
+	}
+
+	return jwks.Keys, nil
+}
+
+// refresh fetches the keys, when they are older than jwksMaxAge or
+// force is set, and returns the cached keys. Failed refreshes keep the
+// cached keys. The keys are fetched without the lock, so the requests
+// are not blocked by the fetch, only the forced refreshes wait for the
+// fetch in flight, because they need the new keys.
+func (ks *jwksKeySet) refresh(ctx context.Context, force bool) []jose.JSONWebKey {
+	ks.mu.Lock()
+	now := time.Now()
+	if !force && now.Sub(ks.lastRefresh) < jwksMaxAge || now.Sub(ks.lastAttempt) < jwksMinRefreshInterval {
+		keys, fetching := ks.keys, ks.fetching
+		ks.mu.Unlock()
+		if !force || fetching == nil {
+			return keys
+		}
+
+		select {
+		case <-fetching:
+			return ks.cachedKeys()
+		case <-ctx.Done():
+			return keys
+		}
+	}
+
+	ks.lastAttempt = now
+	fetching := make(chan struct{})
+	ks.fetching = fetching
+	ks.mu.Unlock()
+
+	keys, err := ks.fetch(ctx)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.fetching = nil
+	close(fetching)
+	if err != nil {
+		log.Errorf("Failed to refresh the jwks %s: %v.", ks.url, err)
+		return ks.keys
+	}
+
+	ks.update(keys, now)
+	return keys
+}
+
+func (ks *jwksKeySet) cachedKeys() []jose.JSONWebKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.keys
+}
+
+// update stores the fetched keys. It must be called with the lock.
+func (ks *jwksKeySet) update(keys []jose.JSONWebKey, now time.Time) {
+	ks.keys = keys
+	ks.lastRefresh = now
+	metrics.Default.UpdateGauge(jwksMetricsPrefix+ks.metricsKey+".keys", float64(len(keys)))
+	metrics.Default.UpdateGauge(jwksMetricsPrefix+ks.metricsKey+".age", 0)
+}
+
+// preload fetches the keys with retries, until they are loaded by it or
+// by a refresh of a request. Unlike the refresh, the retries are not
+// limited by jwksMinRefreshInterval.
+func (ks *jwksKeySet) preload(b backoff.BackOff) {
+	err := backoff.Retry(func() error {
+		if ks.loaded() {
+			return nil
+		}
+
+		// the keys are fetched without the lock, so the requests
+		// are not blocked by the retries
+		keys, err := ks.fetch(context.Background())
+		if err != nil {
+			log.Infof("Failed to preload the jwks %s, retry with backoff: %v", ks.url, err)
+			return err
+		}
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+
+		// keep the keys of a refresh, that completed meanwhile
+		if ks.lastRefresh.IsZero() {
+			ks.update(keys, time.Now())
+			log.Debugf("Preloaded the jwks %s", ks.url)
+		}
+
+		return nil
+	}, b)
+
+	if err != nil {
+		log.Errorf("Failed to preload the jwks %s: %v", ks.url, err)
+	}
+}
+
+func (ks *jwksKeySet) loaded() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return !ks.lastRefresh.IsZero()
+}
+
+func lookupKeys(keys []jose.JSONWebKey, kid string) []jose.JSONWebKey {
+	var found []jose.JSONWebKey
+	for _, k := range keys {
+		if kid == "" || k.KeyID == kid {
+			found = append(found, k)
+		}
+	}
+
+	return found
+}
+
+// knownKeyID tells whether the cached keys contain the key id. Unlike
+// VerifySignature, it doesn't force a refresh for unknown key ids.
+func (ks *jwksKeySet) knownKeyID(ctx context.Context, kid string) bool {
+	return len(lookupKeys(ks.refresh(ctx, false), kid)) > 0
+}
+
+// VerifySignature verifies the signature of the jwt with the key of
+// the matching key id, and returns the payload.
+func (ks *jwksKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+
+	var kid string
+	if len(jws.Signatures) > 0 {
+		kid = jws.Signatures[0].Header.KeyID
+	}
+
+	keys := lookupKeys(ks.refresh(ctx, false), kid)
+	if len(keys) == 0 {
+		if ks.loaded() {
+			metrics.Default.IncCounter(jwksMetricsPrefix + ks.metricsKey + ".unknown_kid")
+		}
+
+		keys = lookupKeys(ks.refresh(ctx, true), kid)
+	}
+
+	for _, k := range keys {
+		if payload, err := jws.Verify(&k); err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, errJWKSSignature
+}
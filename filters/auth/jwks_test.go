@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestJWKSKeySet(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	newKey := func(kid string) jose.JSONWebKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return jose.JSONWebKey{Key: k, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	}
+
+	sign := func(k jose.JSONWebKey) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := signer.Sign([]byte(`{"sub": "jdoe"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	var mu sync.Mutex
+	current := []jose.JSONWebKey{newKey("k1")}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var jwks jose.JSONWebKeySet
+		for _, k := range current {
+			jwks.Keys = append(jwks.Keys, k.Public())
+		}
+
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer jwksServer.Close()
+
+	ks := getJWKSKeySet("https://issuer.example.org", jwksServer.URL, JWKSOptions{})
+	if _, err := ks.VerifySignature(context.Background(), sign(current[0])); err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+
+	if _, err := ks.VerifySignature(context.Background(), sign(newKey("k1"))); err == nil {
+		t.Error("expected signature error for a different key with a known kid")
+	}
+
+	m.WithGauges(func(gauges map[string]float64) {
+		if gauges["auth.jwks.issuer.example.org.keys"] != 1 {
+			t.Errorf("unexpected number of keys: %v", gauges["auth.jwks.issuer.example.org.keys"])
+		}
+	})
+
+	// the forced refresh is allowed once in jwksMinRefreshInterval
+	ks.lastAttempt = time.Now().Add(-jwksMinRefreshInterval)
+
+	mu.Lock()
+	current = append(current, newKey("k2"))
+	rotated := current[1]
+	mu.Unlock()
+
+	if _, err := ks.VerifySignature(context.Background(), sign(rotated)); err != nil {
+		t.Fatalf("failed to verify signature after key rotation: %v", err)
+	}
+
+	if _, err := ks.VerifySignature(context.Background(), sign(newKey("k3"))); err == nil {
+		t.Error("expected signature error for unknown kid")
+	}
+
+	ks.lastRefresh = time.Now().Add(-time.Minute)
+	updateJWKSMetrics()
+
+	m.WithCounters(func(counters map[string]int64) {
+		if counters["auth.jwks.issuer.example.org.unknown_kid"] != 2 {
+			t.Errorf("unexpected count of unknown kids: %d", counters["auth.jwks.issuer.example.org.unknown_kid"])
+		}
+	})
+
+	m.WithGauges(func(gauges map[string]float64) {
+		if gauges["auth.jwks.issuer.example.org.keys"] != 2 {
+			t.Errorf("unexpected number of keys: %v", gauges["auth.jwks.issuer.example.org.keys"])
+		}
+
+		if age := gauges["auth.jwks.issuer.example.org.age"]; age < 60 || age > 70 {
+			t.Errorf("unexpected age of the keys: %v", age)
+		}
+	})
+}
+
+func TestJWKSPreload(t *testing.T) {
+	defer func(b func() backoff.BackOff) { jwksPreloadBackOff = b }(jwksPreloadBackOff)
+	jwksPreloadBackOff = func() backoff.BackOff { return backoff.NewConstantBackOff(10 * time.Millisecond) }
+
+	// readiness reflects only the key set of the test
+	jwksMu.Lock()
+	keySets := jwksKeySets
+	jwksKeySets = make(map[string]*jwksKeySet)
+	jwksMu.Unlock()
+	defer func() {
+		jwksMu.Lock()
+		jwksKeySets = keySets
+		jwksMu.Unlock()
+	}()
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the issuer is slow and fails the first requests after the start
+	var mu sync.Mutex
+	var requests int
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+
+		if n <= 3 {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		key := jose.JSONWebKey{Key: k, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer jwksServer.Close()
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		JWKSReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	start := time.Now()
+	ks := getJWKSKeySet("https://slow.example.org", jwksServer.URL, JWKSOptions{})
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("key set creation blocked by the issuer: %v", d)
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readiness before the keys are loaded: %d", code)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for !ks.loaded() {
+		select {
+		case <-timeout:
+			t.Fatal("failed to preload the keys")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("unexpected readiness after the keys are loaded: %d", code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 4 {
+		t.Errorf("unexpected number of requests to the issuer: %d", requests)
+	}
+}
+
+func TestJWKSRefreshWithoutLock(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := jose.JSONWebKey{Key: k, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-release
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer jwksServer.Close()
+
+	// the keys are loaded, but older than the max age
+	ks := &jwksKeySet{
+		url:             jwksServer.URL,
+		client:          &http.Client{Timeout: time.Second},
+		maxResponseSize: jwksMaxResponseSize,
+		keys:            []jose.JSONWebKey{key.Public()},
+		lastRefresh:     time.Now().Add(-2 * jwksMaxAge),
+	}
+
+	refreshed := make(chan []jose.JSONWebKey, 1)
+	go func() { refreshed <- ks.refresh(context.Background(), false) }()
+	<-requested
+
+	// the requests with the cached keys are not blocked by the fetch
+	done := make(chan bool, 1)
+	go func() { done <- ks.knownKeyID(context.Background(), "k1") }()
+	select {
+	case known := <-done:
+		if !known {
+			t.Error("failed to find the cached key")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("request blocked by the refresh in flight")
+	}
+
+	// the forced refreshes wait for the fetch in flight
+	forced := make(chan []jose.JSONWebKey, 1)
+	go func() { forced <- ks.refresh(context.Background(), true) }()
+	select {
+	case <-forced:
+		t.Fatal("forced refresh didn't wait for the fetch in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if keys := <-refreshed; len(keys) != 1 {
+		t.Errorf("unexpected number of refreshed keys: %d", len(keys))
+	}
+
+	if keys := <-forced; len(keys) != 1 {
+		t.Errorf("unexpected number of keys of the forced refresh: %d", len(keys))
+	}
+}
+
+func TestJWKSFetchLimits(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := jose.JSONWebKey{Key: k, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write(append(jwks, make([]byte, 4096)...))
+		case "/large-chunked":
+			// flushing before the end omits the content length
+			w.Write(jwks)
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 4096))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			w.Write(jwks)
+		default:
+			w.Write(jwks)
+		}
+	}))
+	defer jwksServer.Close()
+
+	for _, ti := range []struct {
+		path     string
+		expected error
+		timeout  bool
+	}{
+		{path: "/"},
+		{path: "/large", expected: errJWKSTooLarge},
+		{path: "/large-chunked", expected: errJWKSTooLarge},
+		{path: "/slow", timeout: true},
+	} {
+		t.Run(ti.path, func(t *testing.T) {
+			ks := &jwksKeySet{
+				url:             jwksServer.URL + ti.path,
+				client:          &http.Client{Timeout: 30 * time.Millisecond},
+				maxResponseSize: int64(len(jwks) + 1024),
+			}
+
+			keys, err := ks.fetch(context.Background())
+			if ti.timeout {
+				if err, ok := err.(net.Error); !ok || !err.Timeout() {
+					t.Errorf("expected timeout error, got: %v", err)
+				}
+
+				return
+			}
+
+			if err != ti.expected {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err == nil && len(keys) != 1 {
+				t.Errorf("unexpected number of keys: %d", len(keys))
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	stdnet "net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	logfilter "github.com/zalando/skipper/filters/log"
+	"github.com/zalando/skipper/jwt"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/net"
+	"github.com/zalando/skipper/ratelimit"
+)
+
+const (
+	AuthLockoutName = "authLockout"
+
+	lockoutSourceIP  = "ip"
+	lockoutSourceSub = "sub"
+
+	lockoutGroupPrefix    = "authlockout-"
+	lockoutCooldownSuffix = "-cooldown"
+	lockoutMetricsPrefix  = "auth.lockout."
+)
+
+type (
+	lockoutSpec struct {
+		registry *ratelimit.Registry
+	}
+
+	lockoutFilter struct {
+		group    string
+		ip       bool
+		sub      bool
+		proxies  []*stdnet.IPNet
+		failures *ratelimit.Ratelimit
+		cooldown *ratelimit.Ratelimit
+	}
+)
+
+// NewAuthLockout creates a filter spec, which locks out the sources of
+// repeated auth failures, the client IP or the sub, to stop
+// brute-force attempts. The auth failures of the following auth
+// filters, and the 401 responses, are counted in the cluster
+// ratelimits of the registry, and when a source has more than the max
+// failures within the time window, all its requests are rejected with
+// status 429 and reason locked-out for the cooldown, even if they
+// present a valid token. Only the failures of the validated subs, or
+// of the basic auth users, whose password was rejected, are counted,
+// so forged tokens can't lock out other users. It requires the cluster
+// ratelimits, without redis or swarm, nothing is locked out.
+//
+// The arguments are the group, the sources, "ip", "sub" or "ip,sub",
+// the max failures, the time window, the cooldown, and optionally the
+// IPs or CIDR ranges of the trusted proxies, that are skipped in the
+// X-Forwarded-For header to find the client IP:
+//
+//	authLockout("login", "ip,sub", 10, "1m", "15m", "10.0.0.0/8") -> oauthTokeninfoAnyScope("read") -> "https://internal.example.org";
+func NewAuthLockout(registry *ratelimit.Registry) filters.Spec {
+	return &lockoutSpec{registry: registry}
+}
+
+func (*lockoutSpec) Name() string { return AuthLockoutName }
+
+func (s *lockoutSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) < 5 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	maxFailures, err := lockoutMaxFailures(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	sargs, err := getStrings(args[:2])
+	if err != nil {
+		return nil, err
+	}
+
+	group := sargs[0]
+	if group == "" {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &lockoutFilter{group: group}
+	for _, source := range strings.Split(sargs[1], ",") {
+		switch strings.TrimSpace(source) {
+		case lockoutSourceIP:
+			f.ip = true
+		case lockoutSourceSub:
+			f.sub = true
+		default:
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	sargs, err = getStrings(args[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	window, err := time.ParseDuration(sargs[0])
+	if err != nil || window <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	cooldown, err := time.ParseDuration(sargs[1])
+	if err != nil || cooldown <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	if f.proxies, err = parseProxies(sargs[2:]); err != nil {
+		return nil, err
+	}
+
+	f.failures = s.registry.Get(ratelimit.Settings{
+		Type:          ratelimit.ClusterClientRatelimit,
+		MaxHits:       maxFailures,
+		TimeWindow:    window,
+		CleanInterval: 10 * window,
+		Group:         lockoutGroupPrefix + group,
+	})
+
+	f.cooldown = s.registry.Get(ratelimit.Settings{
+		Type:          ratelimit.ClusterClientRatelimit,
+		MaxHits:       1,
+		TimeWindow:    cooldown,
+		CleanInterval: 10 * cooldown,
+		Group:         lockoutGroupPrefix + group + lockoutCooldownSuffix,
+	})
+
+	return f, nil
+}
+
+func lockoutMaxFailures(a interface{}) (int, error) {
+	var n int
+	switch v := a.(type) {
+	case int:
+		n = v
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, filters.ErrInvalidFilterParameters
+		}
+
+		n = int(v)
+	case string:
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			return 0, filters.ErrInvalidFilterParameters
+		}
+	default:
+		return 0, filters.ErrInvalidFilterParameters
+	}
+
+	if n <= 0 {
+		return 0, filters.ErrInvalidFilterParameters
+	}
+
+	return n, nil
+}
+
+// attemptedSub returns the sub, that the request attempts to
+// authenticate as, taken from the unverified claims of a JWT bearer
+// token, or the basic auth credentials. It is used only to check the
+// lockout, which rejects only the requests presenting the sub.
+func attemptedSub(ctx filters.FilterContext) string {
+	r := ctx.Request()
+	if token, ok := getToken(r); ok {
+		if t, err := jwt.Parse(token); err == nil {
+			if sub, ok := t.Claims[subKey].(string); ok {
+				return sub
+			}
+		}
+
+		return ""
+	}
+
+	if u, _, ok := r.BasicAuth(); ok {
+		return u
+	}
+
+	return ""
+}
+
+// failedSub returns the sub, that is tied to the failed credentials of
+// the request, to count the failure: the username of the rejection,
+// that the auth filters take from the validated token, or the basic
+// auth user, whose password was rejected. The unverified claims of the
+// bearer tokens are never counted, otherwise forged tokens could lock
+// out other users.
+func failedSub(ctx filters.FilterContext) string {
+	if u, _ := ctx.StateBag()[logfilter.AuthUserKey].(string); u != "" {
+		return u
+	}
+
+	r := ctx.Request()
+	if _, ok := getToken(r); ok {
+		return ""
+	}
+
+	if u, _, ok := r.BasicAuth(); ok {
+		return u
+	}
+
+	return ""
+}
+
+// keys returns the ratelimit keys of the sources of the request, with
+// the sub returned by the sub function.
+func (f *lockoutFilter) keys(ctx filters.FilterContext, sub func(filters.FilterContext) string) []string {
+	var keys []string
+	if f.ip {
+		if ip := net.RemoteHostBehindProxies(ctx.Request(), f.proxies); ip != nil {
+			keys = append(keys, lockoutSourceIP+":"+ip.String())
+		}
+	}
+
+	if f.sub {
+		if s := sub(ctx); s != "" {
+			keys = append(keys, lockoutSourceSub+":"+s)
+		}
+	}
+
+	return keys
+}
+
+func (f *lockoutFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	rctx := ctx.Request().Context()
+	for _, key := range f.keys(ctx, attemptedSub) {
+		d := f.cooldown.DurationUntilAllowed(rctx, key)
+		if d <= 0 {
+			continue
+		}
+
+		reject(ctx, http.StatusTooManyRequests, "", lockedOut, "", fmt.Sprintf("%s locked out", key))
+		if rsp := ctx.Response(); rsp != nil && rsp.Header != nil {
+			rsp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+		}
+
+		return
+	}
+}
+
+// lockoutCountable tells whether the response is an auth failure of
+// the client, and not a lockout or an outage of the auth service. The
+// 401 responses without reject reason, e.g. of the basicAuth filter or
+// of the backend, are failures, too.
+func lockoutCountable(ctx filters.FilterContext) bool {
+	reason, _ := ctx.StateBag()[logfilter.AuthRejectReasonKey].(string)
+	switch rejectReason(reason) {
+	case lockedOut, authServiceAccess:
+		return false
+	case "":
+		rsp := ctx.Response()
+		return rsp != nil && rsp.StatusCode == http.StatusUnauthorized
+	default:
+		return true
+	}
+}
+
+func (f *lockoutFilter) Response(ctx filters.FilterContext) {
+	if !lockoutCountable(ctx) {
+		return
+	}
+
+	metrics.Default.IncCounter(lockoutMetricsPrefix + f.group + ".failures")
+	rctx := ctx.Request().Context()
+	for _, key := range f.keys(ctx, failedSub) {
+		if f.failures.AllowContext(rctx, key) {
+			continue
+		}
+
+		if f.cooldown.AllowContext(rctx, key) {
+			metrics.Default.IncCounter(lockoutMetricsPrefix + f.group + ".lockouts")
+			log.Infof("Auth lockout of %s in group %s after repeated auth failures.", key, f.group)
+		}
+	}
+}
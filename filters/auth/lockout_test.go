@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
+	"github.com/zalando/skipper/ratelimit"
+)
+
+func TestAuthLockout(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	f, err := NewAuthLockout(registry).CreateFilter([]interface{}{"login", "ip,sub", float64(2), "1m", "1h", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request runs the lockout filter around an auth filter, that
+	// rejects the request with the reason, or accepts it, when the
+	// reason is empty
+	request := func(remoteAddr, xff, user string, reason rejectReason) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if !ctx.FServed {
+			if reason != "" {
+				unauthorized(ctx, "", reason, "", "")
+			} else {
+				ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+			}
+		}
+
+		f.Response(ctx)
+		return ctx.FResponse.StatusCode
+	}
+
+	t.Run("failures below the threshold", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if status := request("1.2.3.4:1234", "", "", invalidToken); status != http.StatusUnauthorized {
+				t.Errorf("unexpected status code: %d", status)
+			}
+		}
+
+		if status := request("1.2.3.4:1234", "", "", ""); status != http.StatusOK {
+			t.Errorf("unexpected status code: %d", status)
+		}
+	})
+
+	t.Run("outages of the auth service are not counted", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			request("5.6.7.8:1234", "", "", authServiceAccess)
+		}
+
+		if status := request("5.6.7.8:1234", "", "", ""); status != http.StatusOK {
+			t.Errorf("unexpected status code: %d", status)
+		}
+	})
+
+	t.Run("locked out IP", func(t *testing.T) {
+		request("1.2.3.4:1234", "", "", invalidToken)
+
+		ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+		ctx.FRequest.RemoteAddr = "1.2.3.4:1234"
+		f.Request(ctx)
+		if !ctx.FServed || ctx.FResponse.StatusCode != http.StatusTooManyRequests {
+			t.Fatal("request of a locked out IP not rejected")
+		}
+
+		if reason := ctx.FStateBag[logfilter.AuthRejectReasonKey]; reason != string(lockedOut) {
+			t.Errorf("unexpected reject reason: %v", reason)
+		}
+
+		if ctx.FResponse.Header.Get("Retry-After") == "" {
+			t.Error("missing Retry-After header")
+		}
+
+		// even with valid credentials
+		if status := request("1.2.3.4:1234", "", "", ""); status != http.StatusTooManyRequests {
+			t.Errorf("unexpected status code with valid credentials: %d", status)
+		}
+
+		// the client IP behind a trusted proxy
+		if status := request("10.0.0.1:1234", "1.2.3.4", "", ""); status != http.StatusTooManyRequests {
+			t.Errorf("unexpected status code behind a proxy: %d", status)
+		}
+
+		if status := request("9.9.9.9:1234", "", "", ""); status != http.StatusOK {
+			t.Errorf("unexpected status code of another IP: %d", status)
+		}
+	})
+
+	t.Run("locked out sub", func(t *testing.T) {
+		for i, ip := range []string{"2.0.0.1:1234", "2.0.0.2:1234", "2.0.0.3:1234"} {
+			if status := request(ip, "", "jdoe", invalidToken); status != http.StatusUnauthorized {
+				t.Errorf("unexpected status code of failure %d: %d", i, status)
+			}
+		}
+
+		if status := request("2.0.0.4:1234", "", "jdoe", ""); status != http.StatusTooManyRequests {
+			t.Errorf("unexpected status code of a locked out sub: %d", status)
+		}
+
+		if status := request("2.0.0.4:1234", "", "jane", ""); status != http.StatusOK {
+			t.Errorf("unexpected status code of another sub: %d", status)
+		}
+	})
+
+	t.Run("401 responses", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "3.0.0.1:1234"
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+			ctx.FResponse = &http.Response{StatusCode: http.StatusUnauthorized}
+			f.Response(ctx)
+		}
+
+		if status := request("3.0.0.1:1234", "", "", ""); status != http.StatusTooManyRequests {
+			t.Errorf("unexpected status code: %d", status)
+		}
+	})
+
+	m.WithCounters(func(counters map[string]int64) {
+		if c := counters["auth.lockout.login.failures"]; c != 9 {
+			t.Errorf("unexpected count of failures: %d", c)
+		}
+
+		if c := counters["auth.lockout.login.lockouts"]; c != 3 {
+			t.Errorf("unexpected count of lockouts: %d", c)
+		}
+	})
+}
+
+func TestAuthLockoutForgedSub(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	f, err := NewAuthLockout(registry).CreateFilter([]interface{}{"forged", "sub", 2, "1m", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the JWT is not signed, the lockout filter doesn't verify it
+	unverifiedJWT := func(sub string) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(`{"sub":"`+sub+`"}`)) + ".sig"
+	}
+
+	// request runs the lockout filter around an auth filter, that
+	// rejects the request with the validated user, or accepts it,
+	// when the user is empty
+	request := func(token, validatedUser string, reject bool) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+token)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if !ctx.FServed {
+			if reject {
+				unauthorized(ctx, validatedUser, invalidToken, "", "")
+			} else {
+				ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+			}
+		}
+
+		f.Response(ctx)
+		return ctx.FResponse.StatusCode
+	}
+
+	for i := 0; i < 5; i++ {
+		if status := request(unverifiedJWT("victim"), "", true); status != http.StatusUnauthorized {
+			t.Errorf("unexpected status code of forged token %d: %d", i, status)
+		}
+	}
+
+	if status := request(unverifiedJWT("victim"), "", false); status != http.StatusOK {
+		t.Errorf("user locked out by forged tokens: %d", status)
+	}
+
+	// the failures of the validated sub are counted
+	for i := 0; i < 3; i++ {
+		request(unverifiedJWT("jdoe"), "jdoe", true)
+	}
+
+	if status := request(unverifiedJWT("jdoe"), "", false); status != http.StatusTooManyRequests {
+		t.Errorf("unexpected status code of a locked out sub: %d", status)
+	}
+}
+
+func TestAuthLockoutCreateFilter(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	for _, args := range [][]interface{}{
+		{},
+		{"login", "ip", 3, "1m"},
+		{"", "ip", 3, "1m", "1h"},
+		{"login", "host", 3, "1m", "1h"},
+		{"login", "ip", 0, "1m", "1h"},
+		{"login", "ip", 1.5, "1m", "1h"},
+		{"login", "ip", 3, "invalid", "1h"},
+		{"login", "ip", 3, "1m", "-1h"},
+		{"login", "ip", 3, "1m", "1h", "invalid"},
+	} {
+		if _, err := NewAuthLockout(registry).CreateFilter(args); err != filters.ErrInvalidFilterParameters {
+			t.Errorf("expected error for args %v: %v", args, err)
+		}
+	}
+
+	if _, err := NewAuthLockout(registry).CreateFilter([]interface{}{"login", "sub", "3", "1m", "1h"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthMaxTokenAgeName = "oauthMaxTokenAge"
+
+	iatKey          = "iat"
+	allowMissingIAT = "allow-missing-iat"
+)
+
+type (
+	maxTokenAgeSpec struct{}
+
+	maxTokenAgeFilter struct {
+		maxAge       time.Duration
+		allowMissing bool
+	}
+)
+
+// NewOAuthMaxTokenAge creates a filter spec, which rejects tokens
+// issued longer ago than the maximum age based on their iat claim,
+// even if they are not expired yet. The filter has to be placed after
+// one of the oauthTokeninfo*, oauthTokenintrospection* or oauthOidc*
+// filters.
+//
+// Example:
+//
+//	oauthTokenintrospectionAnyClaims("https://idp.example.org", "uid") -> oauthMaxTokenAge("8h") -> "https://internal.example.org";
+func NewOAuthMaxTokenAge() filters.Spec {
+	return &maxTokenAgeSpec{}
+}
+
+func (*maxTokenAgeSpec) Name() string { return OAuthMaxTokenAgeName }
+
+// CreateFilter accepts the maximum age of the tokens as a duration
+// string, e.g. "8h", and optionally "allow-missing-iat" to accept
+// tokens without iat claim.
+func (*maxTokenAgeSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) < 1 || len(sargs) > 2 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	maxAge, err := time.ParseDuration(sargs[0])
+	if err != nil || maxAge <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &maxTokenAgeFilter{maxAge: maxAge}
+	if len(sargs) == 2 {
+		if sargs[1] != allowMissingIAT {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.allowMissing = true
+	}
+
+	return f, nil
+}
+
+// issuedAt returns the time of the iat claim.
+func issuedAt(claims map[string]interface{}) (time.Time, bool) {
+	return numericDate(claims, iatKey)
+}
+
+// numericDate returns the time of a claim, which is a number of seconds
+// in all the supported token sources.
+func numericDate(claims map[string]interface{}, key string) (time.Time, bool) {
+	switch v := claims[key].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		return time.Unix(i, 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (f *maxTokenAgeFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "no validated token available for max token age validation")
+		return
+	}
+
+	iat, ok := issuedAt(claims)
+	if !ok {
+		if !f.allowMissing {
+			unauthorized(ctx, "", staleToken, r.Host, "missing iat claim")
+		}
+
+		return
+	}
+
+	if age := time.Since(iat); age > f.maxAge {
+		unauthorized(ctx, "", staleToken, r.Host, fmt.Sprintf("token age %s exceeds %s", age.Truncate(time.Second), f.maxAge))
+	}
+}
+
+func (*maxTokenAgeFilter) Response(filters.FilterContext) {}
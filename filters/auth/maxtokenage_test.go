@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestMaxTokenAge(t *testing.T) {
+	fresh := time.Now().Add(-time.Hour).Unix()
+	stale := time.Now().Add(-9 * time.Hour).Unix()
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		key      string
+		claims   interface{}
+		expected int
+	}{{
+		msg:      "no validated token",
+		args:     []interface{}{"8h"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "fresh tokeninfo token",
+		args:     []interface{}{"8h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(fresh)},
+		expected: http.StatusOK,
+	}, {
+		msg:      "stale tokeninfo token",
+		args:     []interface{}{"8h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(stale)},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "stale introspected token",
+		args:     []interface{}{"8h"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"iat": json.Number(strconv.FormatInt(stale, 10))},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "fresh oidc token",
+		args:     []interface{}{"8h"},
+		key:      oidcClaimsCacheKey,
+		claims:   tokenContainer{Claims: map[string]interface{}{"iat": float64(fresh)}},
+		expected: http.StatusOK,
+	}, {
+		msg:      "missing iat rejected",
+		args:     []interface{}{"8h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "missing iat allowed",
+		args:     []interface{}{"8h", "allow-missing-iat"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{},
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthMaxTokenAge().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+			if ti.key != "" {
+				ctx.FStateBag[ti.key] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.key != "" && status != http.StatusOK && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(staleToken) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestMaxTokenAgeCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{}, {"invalid"}, {"-1h"}, {"8h", "invalid"}, {"8h", "allow-missing-iat", "x"}, {8}} {
+		if _, err := NewOAuthMaxTokenAge().CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
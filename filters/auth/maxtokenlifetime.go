@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const OAuthMaxTokenLifetimeName = "oauthMaxTokenLifetime"
+
+type (
+	maxTokenLifetimeSpec struct{}
+
+	maxTokenLifetimeFilter struct {
+		maxLifetime  time.Duration
+		allowMissing bool
+	}
+)
+
+// NewOAuthMaxTokenLifetime creates a filter spec, which rejects tokens
+// whose lifetime, the difference of their exp and iat claims, exceeds
+// the maximum lifetime. Abnormally long-lived tokens may be forged or
+// misissued, so this is a defense in depth against accepting tokens,
+// that the identity provider shouldn't have issued. The filter has to
+// be placed after one of the oauthTokeninfo*, oauthTokenintrospection*
+// or oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokenintrospectionAnyClaims("https://idp.example.org", "uid") -> oauthMaxTokenLifetime("24h") -> "https://internal.example.org";
+func NewOAuthMaxTokenLifetime() filters.Spec {
+	return &maxTokenLifetimeSpec{}
+}
+
+func (*maxTokenLifetimeSpec) Name() string { return OAuthMaxTokenLifetimeName }
+
+// CreateFilter accepts the maximum lifetime of the tokens as a duration
+// string, e.g. "24h", and optionally "allow-missing-iat" to accept
+// tokens without iat claim.
+func (*maxTokenLifetimeSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) < 1 || len(sargs) > 2 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	maxLifetime, err := time.ParseDuration(sargs[0])
+	if err != nil || maxLifetime <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &maxTokenLifetimeFilter{maxLifetime: maxLifetime}
+	if len(sargs) == 2 {
+		if sargs[1] != allowMissingIAT {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.allowMissing = true
+	}
+
+	return f, nil
+}
+
+func (f *maxTokenLifetimeFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "no validated token available for max token lifetime validation")
+		return
+	}
+
+	// a token without exp has an unbounded lifetime
+	exp, ok := numericDate(claims, expKey)
+	if !ok {
+		unauthorized(ctx, "", suspiciousToken, r.Host, "missing exp claim")
+		return
+	}
+
+	iat, ok := issuedAt(claims)
+	if !ok {
+		if !f.allowMissing {
+			unauthorized(ctx, "", suspiciousToken, r.Host, "missing iat claim")
+		}
+
+		return
+	}
+
+	if lifetime := exp.Sub(iat); lifetime > f.maxLifetime {
+		unauthorized(ctx, "", suspiciousToken, r.Host, fmt.Sprintf("token lifetime %s exceeds %s", lifetime, f.maxLifetime))
+	}
+}
+
+func (*maxTokenLifetimeFilter) Response(filters.FilterContext) {}
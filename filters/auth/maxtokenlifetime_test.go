@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestMaxTokenLifetime(t *testing.T) {
+	iat := time.Now().Add(-time.Hour).Unix()
+	exp := time.Now().Add(7 * time.Hour).Unix()
+	farExp := time.Now().Add(10 * 365 * 24 * time.Hour).Unix()
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		key      string
+		claims   interface{}
+		expected int
+	}{{
+		msg:      "no validated token",
+		args:     []interface{}{"24h"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "reasonable tokeninfo token",
+		args:     []interface{}{"24h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(iat), "exp": float64(exp)},
+		expected: http.StatusOK,
+	}, {
+		msg:      "excessive tokeninfo token",
+		args:     []interface{}{"24h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(iat), "exp": float64(farExp)},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "lifetime at the bound",
+		args:     []interface{}{"8h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(iat), "exp": float64(exp)},
+		expected: http.StatusOK,
+	}, {
+		msg:  "excessive introspected token",
+		args: []interface{}{"24h"},
+		key:  tokenintrospectionCacheKey,
+		claims: tokenIntrospectionInfo{
+			"iat": json.Number(strconv.FormatInt(iat, 10)),
+			"exp": json.Number(strconv.FormatInt(farExp, 10)),
+		},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "reasonable oidc token",
+		args:     []interface{}{"24h"},
+		key:      oidcClaimsCacheKey,
+		claims:   tokenContainer{Claims: map[string]interface{}{"iat": float64(iat), "exp": float64(exp)}},
+		expected: http.StatusOK,
+	}, {
+		msg:      "missing exp",
+		args:     []interface{}{"24h", "allow-missing-iat"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"iat": float64(iat)},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "missing iat rejected",
+		args:     []interface{}{"24h"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"exp": float64(farExp)},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "missing iat skipped",
+		args:     []interface{}{"24h", "allow-missing-iat"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"exp": float64(farExp)},
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthMaxTokenLifetime().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+			if ti.key != "" {
+				ctx.FStateBag[ti.key] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.key != "" && status != http.StatusOK && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(suspiciousToken) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestMaxTokenLifetimeCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{}, {"invalid"}, {"-1h"}, {"24h", "invalid"}, {"24h", "allow-missing-iat", "x"}, {24}} {
+		if _, err := NewOAuthMaxTokenLifetime().CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
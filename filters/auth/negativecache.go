@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type negativeCacheEntry struct {
+	reason rejectReason
+	expiry time.Time
+}
+
+// negativeCache remembers the tokens, that were rejected as invalid or
+// inactive, for a short time, so repeated presentations can be rejected
+// without calling the identity provider. Only the hash of the token and
+// the reject reason are stored, never the claims. It holds at most size
+// entries, when full, the oldest inserted entry is evicted.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]negativeCacheEntry
+	keys    [][sha256.Size]byte
+	next    int
+}
+
+func newNegativeCache(ttl time.Duration, size int) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]negativeCacheEntry),
+		keys:    make([][sha256.Size]byte, 0, size),
+	}
+}
+
+// get returns the reject reason of the token, when it was rejected
+// within the ttl. It is safe to call on a nil cache.
+func (c *negativeCache) get(token string, now time.Time) (rejectReason, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expiry) {
+		return "", false
+	}
+
+	return e.reason, true
+}
+
+// set stores the reject reason of the token. It is safe to call on a
+// nil cache.
+func (c *negativeCache) set(token string, reason rejectReason, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		if len(c.keys) < cap(c.keys) {
+			c.keys = append(c.keys, key)
+		} else {
+			delete(c.entries, c.keys[c.next])
+			c.keys[c.next] = key
+			c.next = (c.next + 1) % len(c.keys)
+		}
+	}
+
+	c.entries[key] = negativeCacheEntry{reason: reason, expiry: now.Add(c.ttl)}
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Now()
+	c := newNegativeCache(time.Second, 2)
+
+	if _, ok := c.get("a", now); ok {
+		t.Error("unexpected cached token")
+	}
+
+	c.set("a", inactiveToken, now)
+	if reason, ok := c.get("a", now); !ok || reason != inactiveToken {
+		t.Errorf("failed to get the cached token: %v, %v", reason, ok)
+	}
+
+	if _, ok := c.get("a", now.Add(time.Second)); ok {
+		t.Error("failed to expire the cached token")
+	}
+
+	c.set("b", invalidToken, now)
+	c.set("c", invalidToken, now)
+	if len(c.entries) != 2 {
+		t.Errorf("cache is not bounded: %d", len(c.entries))
+	}
+
+	if _, ok := c.get("a", now); ok {
+		t.Error("oldest token was not evicted")
+	}
+
+	var nilCache *negativeCache
+	nilCache.set("a", invalidToken, now)
+	if _, ok := nilCache.get("a", now); ok {
+		t.Error("unexpected cached token in disabled cache")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,6 +36,13 @@ const (
 	stateValidity       = 1 * time.Minute
 	oidcInfoHeader      = "Skipper-Oidc-Info"
 	cookieMaxSize       = 4093 // common cookie size limit http://browsercookielimits.squawky.net/
+
+	// cookieMaxDecompressedSize limits the decompressed content of
+	// the cookies
+	cookieMaxDecompressedSize = 1 << 20
+
+	// nonEmptyClaimSuffix marks the claims, that have to be non-empty
+	nonEmptyClaimSuffix = "!"
 )
 
 // Filter parameter:
@@ -53,11 +61,25 @@ const (
 	paramUpstrHeaders
 )
 
+// OidcOptions configures the oauthOidc* filters.
+type OidcOptions struct {
+	// NonceCache remembers the nonces of the id tokens to reject
+	// replayed id tokens. Defaults to an in-memory cache of each
+	// filter spec.
+	NonceCache *NonceCache
+
+	// JWKS bounds the fetches of the keys of the providers.
+	JWKS JWKSOptions
+}
+
 type (
 	tokenOidcSpec struct {
 		typ             roleCheckType
 		SecretsFile     string
 		secretsRegistry secrets.EncrypterCreator
+		nonces          *NonceCache
+		claimSources    *claimSourceResolver
+		jwks            JWKSOptions
 	}
 
 	tokenOidcFilter struct {
@@ -74,6 +96,8 @@ type (
 		queryParams     []string
 		compressor      cookieCompression
 		upstreamHeaders map[string]string
+		nonces          *NonceCache
+		claimSources    *claimSourceResolver
 	}
 
 	tokenContainer struct {
@@ -95,19 +119,54 @@ type (
 
 // NewOAuthOidcUserInfos creates filter spec which tests user info.
 func NewOAuthOidcUserInfos(secretsFile string, secretsRegistry *secrets.Registry) filters.Spec {
-	return &tokenOidcSpec{typ: checkOIDCUserInfo, SecretsFile: secretsFile, secretsRegistry: secretsRegistry}
+	return NewOAuthOidcUserInfosWithOptions(secretsFile, secretsRegistry, OidcOptions{})
+}
+
+// NewOAuthOidcUserInfosWithOptions creates filter spec which tests
+// user info, configured by the options.
+func NewOAuthOidcUserInfosWithOptions(secretsFile string, secretsRegistry *secrets.Registry, o OidcOptions) filters.Spec {
+	return newOidcSpec(checkOIDCUserInfo, secretsFile, secretsRegistry, o)
 }
 
 // NewOAuthOidcAnyClaims creates a filter spec which verifies that the token
 // has one of the claims specified
 func NewOAuthOidcAnyClaims(secretsFile string, secretsRegistry *secrets.Registry) filters.Spec {
-	return &tokenOidcSpec{typ: checkOIDCAnyClaims, SecretsFile: secretsFile, secretsRegistry: secretsRegistry}
+	return NewOAuthOidcAnyClaimsWithOptions(secretsFile, secretsRegistry, OidcOptions{})
+}
+
+// NewOAuthOidcAnyClaimsWithOptions creates a filter spec which
+// verifies that the token has one of the claims specified, configured
+// by the options.
+func NewOAuthOidcAnyClaimsWithOptions(secretsFile string, secretsRegistry *secrets.Registry, o OidcOptions) filters.Spec {
+	return newOidcSpec(checkOIDCAnyClaims, secretsFile, secretsRegistry, o)
 }
 
 // NewOAuthOidcAllClaims creates a filter spec which verifies that the token
 // has all the claims specified
 func NewOAuthOidcAllClaims(secretsFile string, secretsRegistry *secrets.Registry) filters.Spec {
-	return &tokenOidcSpec{typ: checkOIDCAllClaims, SecretsFile: secretsFile, secretsRegistry: secretsRegistry}
+	return NewOAuthOidcAllClaimsWithOptions(secretsFile, secretsRegistry, OidcOptions{})
+}
+
+// NewOAuthOidcAllClaimsWithOptions creates a filter spec which
+// verifies that the token has all the claims specified, configured by
+// the options.
+func NewOAuthOidcAllClaimsWithOptions(secretsFile string, secretsRegistry *secrets.Registry, o OidcOptions) filters.Spec {
+	return newOidcSpec(checkOIDCAllClaims, secretsFile, secretsRegistry, o)
+}
+
+func newOidcSpec(typ roleCheckType, secretsFile string, secretsRegistry *secrets.Registry, o OidcOptions) *tokenOidcSpec {
+	if o.NonceCache == nil {
+		o.NonceCache = NewNonceCache(NonceCacheOptions{})
+	}
+
+	return &tokenOidcSpec{
+		typ:             typ,
+		SecretsFile:     secretsFile,
+		secretsRegistry: secretsRegistry,
+		nonces:          o.NonceCache,
+		claimSources:    newClaimSourceResolver(),
+		jwks:            o.JWKS,
+	}
 }
 
 // CreateFilter creates an OpenID Connect authorization filter.
@@ -140,6 +199,15 @@ func (s *tokenOidcSpec) CreateFilter(args []interface{}) (filters.Filter, error)
 		return nil, filters.ErrInvalidFilterParameters
 	}
 
+	var providerClaims struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&providerClaims); err != nil {
+		log.Errorf("Failed to get the provider configuration %s: %v.", issuerURL, err)
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
 	h := sha256.New()
 	for i, s := range sargs {
 		// CallbackURL not taken into account for cookie hashing for additional sub path ingresses
@@ -174,13 +242,17 @@ func (s *tokenOidcSpec) CreateFilter(args []interface{}) (filters.Filter, error)
 			Scopes:       []string{oidc.ScopeOpenID}, // mandatory scope by spec
 		},
 		provider: provider,
-		verifier: provider.Verifier(&oidc.Config{
-			ClientID: sargs[paramClientID],
-		}),
-		validity:   1 * time.Hour,
-		cookiename: generatedCookieName,
-		encrypter:  encrypter,
-		compressor: newDeflatePoolCompressor(flate.BestCompression),
+		verifier: oidc.NewVerifier(
+			providerClaims.Issuer,
+			getJWKSKeySet(providerClaims.Issuer, providerClaims.JWKSURL, s.jwks),
+			&oidc.Config{ClientID: sargs[paramClientID]},
+		),
+		validity:     1 * time.Hour,
+		cookiename:   generatedCookieName,
+		encrypter:    encrypter,
+		compressor:   newDeflatePoolCompressor(flate.BestCompression),
+		nonces:       s.nonces,
+		claimSources: s.claimSources,
 	}
 
 	// user defined scopes
@@ -194,6 +266,11 @@ func (s *tokenOidcSpec) CreateFilter(args []interface{}) (filters.Filter, error)
 	// user defined claims to check for authnz
 	if len(sargs[paramClaims]) > 0 {
 		f.claims = strings.Split(sargs[paramClaims], " ")
+		for _, c := range f.claims {
+			if c == nonEmptyClaimSuffix {
+				return nil, filters.ErrInvalidFilterParameters
+			}
+		}
 	}
 
 	f.authCodeOptions = make([]oauth2.AuthCodeOption, 0)
@@ -252,28 +329,66 @@ func (f *tokenOidcFilter) validateAnyClaims(h map[string]interface{}) bool {
 		return false
 	}
 
-	keys := make([]string, 0, len(h))
-	for k := range h {
-		keys = append(keys, k)
+	for _, c := range f.claims {
+		if hasClaim(h, c) {
+			return true
+		}
 	}
-
-	return intersect(f.claims, keys)
+	return false
 }
 
 func (f *tokenOidcFilter) validateAllClaims(h map[string]interface{}) bool {
-	l := len(f.claims)
-	if l == 0 {
+	if len(f.claims) == 0 {
 		return true
 	}
-	if len(h) < l {
+	if len(h) == 0 {
 		return false
 	}
 
-	keys := make([]string, 0, len(h))
-	for k := range h {
-		keys = append(keys, k)
+	for _, c := range f.claims {
+		if !hasClaim(h, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasClaim tells whether the claims contain the claim c, or when c has
+// the suffix "!", e.g. "department!", whether they contain it with a
+// non-empty value.
+func hasClaim(h map[string]interface{}, c string) bool {
+	if !strings.HasSuffix(c, nonEmptyClaimSuffix) {
+		_, ok := claimValue(h, c)
+		return ok
+	}
+
+	v, ok := claimValue(h, strings.TrimSuffix(c, nonEmptyClaimSuffix))
+	return ok && !emptyClaim(v)
+}
+
+// emptyClaim tells whether the value of a claim is null, an empty
+// string, an empty array or an empty object.
+func emptyClaim(v interface{}) bool {
+	switch vt := v.(type) {
+	case nil:
+		return true
+	case string:
+		return vt == ""
+	case []interface{}:
+		for _, e := range vt {
+			if !emptyClaim(e) {
+				return false
+			}
+		}
+
+		return true
+	case []string:
+		return len(vt) == 0
+	case map[string]interface{}:
+		return len(vt) == 0
+	default:
+		return false
 	}
-	return all(f.claims, keys)
 }
 
 type OauthState struct {
@@ -332,14 +447,14 @@ func (f *tokenOidcFilter) doOauthRedirect(ctx filters.FilterContext) {
 		return
 	}
 
-	opts := f.authCodeOptions
-	if f.queryParams != nil {
-		opts = make([]oauth2.AuthCodeOption, len(f.authCodeOptions), len(f.authCodeOptions)+len(f.queryParams))
-		copy(opts, f.authCodeOptions)
-		for _, p := range f.queryParams {
-			if v := ctx.Request().URL.Query().Get(p); v != "" {
-				opts = append(opts, oauth2.SetAuthURLParam(p, v))
-			}
+	// the id token has to contain the nonce of the state, see
+	// https://openid.net/specs/openid-connect-core-1_0.html#NonceNotes
+	opts := make([]oauth2.AuthCodeOption, len(f.authCodeOptions), len(f.authCodeOptions)+len(f.queryParams)+1)
+	copy(opts, f.authCodeOptions)
+	opts = append(opts, oidc.Nonce(fmt.Sprintf("%x", nonce)))
+	for _, p := range f.queryParams {
+		if v := ctx.Request().URL.Query().Get(p); v != "" {
+			opts = append(opts, oauth2.SetAuthURLParam(p, v))
 		}
 	}
 
@@ -547,12 +662,12 @@ func (f *tokenOidcFilter) callbackEndpoint(ctx filters.FilterContext) {
 			return
 		}
 		sub = userInfo.Subject
-		claimsMap, _, err = f.tokenClaims(ctx, oauth2Token)
+		claimsMap, _, err = f.tokenClaims(ctx, oauth2Token, oauthState.Nonce)
 		if err != nil {
 			unauthorized(
 				ctx,
 				"",
-				invalidToken,
+				claimsRejectReason(err),
 				r.Host,
 				fmt.Sprintf("Failed to get claims: %v.", err),
 			)
@@ -575,7 +690,7 @@ func (f *tokenOidcFilter) callbackEndpoint(ctx filters.FilterContext) {
 
 			return
 		}
-		claimsMap, sub, err = f.tokenClaims(ctx, oauth2Token)
+		claimsMap, sub, err = f.tokenClaims(ctx, oauth2Token, oauthState.Nonce)
 		if err != nil {
 			if _, ok := err.(*requestError); !ok {
 				log.Errorf("Failed to get claims with error: %v", err)
@@ -584,7 +699,7 @@ func (f *tokenOidcFilter) callbackEndpoint(ctx filters.FilterContext) {
 			unauthorized(
 				ctx,
 				"",
-				invalidToken,
+				claimsRejectReason(err),
 				r.Host,
 				fmt.Sprintf(
 					"Failed to get claims: %s, %v",
@@ -640,6 +755,10 @@ func (f *tokenOidcFilter) callbackEndpoint(ctx filters.FilterContext) {
 }
 
 func (f *tokenOidcFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
 	var (
 		allowed   bool
 		cookies   []http.Cookie
@@ -680,6 +799,9 @@ func (f *tokenOidcFilter) Request(ctx filters.FilterContext) {
 
 		return
 	}
+
+	transformClaims(ctx, container.Claims)
+
 	// filter specific checks
 	switch f.typ {
 	case checkOIDCUserInfo:
@@ -738,7 +860,7 @@ func (f *tokenOidcFilter) setHeaders(ctx filters.FilterContext, container tokenC
 	return
 }
 
-func (f *tokenOidcFilter) tokenClaims(ctx filters.FilterContext, oauth2Token *oauth2.Token) (map[string]interface{}, string, error) {
+func (f *tokenOidcFilter) tokenClaims(ctx filters.FilterContext, oauth2Token *oauth2.Token, nonce string) (map[string]interface{}, string, error) {
 	r := ctx.Request()
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
@@ -751,6 +873,17 @@ func (f *tokenOidcFilter) tokenClaims(ctx filters.FilterContext, oauth2Token *oa
 		return nil, "", requestErrorf("failed to verify id token: %v", err)
 	}
 
+	// https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowTokenValidation
+	// the at_hash claim is optional in the code flow, but when the
+	// id token contains it, it has to match the access token
+	if err = idToken.VerifyAccessToken(oauth2Token.AccessToken); err != nil {
+		return nil, "", requestErrorf("%w: %v", errInvalidATHash, err)
+	}
+
+	if err = f.verifyNonce(r.Context(), idToken, nonce); err != nil {
+		return nil, "", err
+	}
+
 	tokenMap := make(map[string]interface{})
 	if err = idToken.Claims(&tokenMap); err != nil {
 		return nil, "", requestErrorf("failed to deserialize id token: %v", err)
@@ -761,9 +894,59 @@ func (f *tokenOidcFilter) tokenClaims(ctx filters.FilterContext, oauth2Token *oa
 		return nil, "", requestErrorf("claims do not contain sub")
 	}
 
+	// distributed claims, e.g. the groups of the Azure AD overage
+	// scenario, are resolved before the claims are checked
+	if f.claimSources != nil {
+		if err = f.claimSources.resolve(r.Context(), tokenMap, oauth2Token.AccessToken); err != nil {
+			return nil, "", err
+		}
+	}
+
 	return tokenMap, sub, nil
 }
 
+// verifyNonce rejects id tokens, whose nonce does not match the nonce
+// of the authentication request, or that were seen before.
+func (f *tokenOidcFilter) verifyNonce(ctx context.Context, idToken *oidc.IDToken, nonce string) error {
+	// the authentication requests always send a nonce, so the id
+	// token has to contain it, see
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+	if idToken.Nonce == "" || idToken.Nonce != nonce {
+		return requestErrorf("nonce of the id token does not match the authentication request")
+	}
+
+	seen, err := f.nonces.seen(ctx, idToken.Issuer, idToken.Nonce, idToken.Expiry)
+	if err != nil {
+		// the nonce matches the state, that is valid only for a short time
+		log.Errorf("Failed to check the nonce of the id token: %v.", err)
+		return nil
+	}
+
+	if seen {
+		return requestErrorf("%w", errReplayedNonce)
+	}
+
+	return nil
+}
+
+// claimsRejectReason returns the reject reason for the errors of
+// tokenClaims.
+func claimsRejectReason(err error) rejectReason {
+	if errors.Is(err, errInvalidATHash) {
+		return invalidATHash
+	}
+
+	if errors.Is(err, errReplayedNonce) {
+		return replayedNonce
+	}
+
+	if errors.Is(err, errClaimSource) {
+		return authServiceAccess
+	}
+
+	return invalidToken
+}
+
 func (f *tokenOidcFilter) getidtoken(ctx filters.FilterContext, oauth2Token *oauth2.Token) (string, error) {
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
@@ -870,5 +1053,17 @@ func (dc *deflatePoolCompressor) decompress(compData []byte) ([]byte, error) {
 	if err := zr.Close(); err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(zr)
+
+	// reading one more byte than allowed detects the content, that
+	// exceeds the limit
+	b, err := ioutil.ReadAll(io.LimitReader(zr, cookieMaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > cookieMaxDecompressedSize {
+		return nil, errors.New("decompressed cookie exceeds the max size")
+	}
+
+	return b, nil
 }
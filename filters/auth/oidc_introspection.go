@@ -109,6 +109,10 @@ func (filter *oidcIntrospectionFilter) String() string {
 }
 
 func (filter *oidcIntrospectionFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
 	r := ctx.Request()
 
 	token, ok := ctx.StateBag()[oidcClaimsCacheKey].(tokenContainer)
@@ -231,6 +231,7 @@ func TestOIDCQueryClaimsFilter(t *testing.T) {
 				typ:             checkOIDCAnyClaims,
 				SecretsFile:     "/tmp/foo",
 				secretsRegistry: secrettest.NewTestRegistry(),
+				nonces:          NewNonceCache(NonceCacheOptions{}),
 			}
 			fr := make(filters.Registry)
 			fr.Register(spec)
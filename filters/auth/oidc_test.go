@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"bytes"
 	"compress/flate"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -17,6 +20,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -125,7 +129,11 @@ var testOpenIDConfig = `{
 // server with configendpoint, tokenendpoint, authenticationserver endpoint, userinfor
 // endpoint, jwks endpoint
 func createOIDCServer(cb, client, clientsecret string) *httptest.Server {
-	var oidcServer *httptest.Server
+	var (
+		oidcServer *httptest.Server
+		mu         sync.Mutex
+		nonce      string
+	)
 	oidcServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/.well-known/openid-configuration":
@@ -173,6 +181,11 @@ func createOIDCServer(cb, client, clientsecret string) *httptest.Server {
 			//
 			// redirect if we have a callback
 			if cb != "" {
+				// the nonce is returned in the id token of the code
+				mu.Lock()
+				nonce = r.URL.Query().Get("nonce")
+				mu.Unlock()
+
 				state := r.URL.Query().Get("state")
 				u, err := url.Parse(cb + "?state=" + state + "&code=" + validCode)
 				if err != nil {
@@ -218,13 +231,26 @@ func createOIDCServer(cb, client, clientsecret string) *httptest.Server {
 				w.Header().Set("Cache-Control", "no-store")
 				w.Header().Set("Pragma", "no-cache")
 
+				// https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+				atHash := sha256.Sum256([]byte(validAccessToken))
+				accessToken := validAccessToken
+				if r.Form.Get("substitute_access_token") != "" {
+					accessToken = "substituted-access-token"
+				}
+
+				mu.Lock()
+				idTokenNonce := nonce
+				mu.Unlock()
+
 				token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-					testKey: testValue, // claims to check
-					"iss":   oidcServer.URL,
-					"sub":   testSub,
-					"aud":   validClient,
-					"iat":   time.Now().Add(-time.Minute).UTC().Unix(),
-					"exp":   time.Now().Add(time.Hour).UTC().Unix(),
+					"nonce":   idTokenNonce,
+					"at_hash": base64.RawURLEncoding.EncodeToString(atHash[:len(atHash)/2]),
+					testKey:   testValue, // claims to check
+					"iss":     oidcServer.URL,
+					"sub":     testSub,
+					"aud":     validClient,
+					"iat":     time.Now().Add(-time.Minute).UTC().Unix(),
+					"exp":     time.Now().Add(time.Hour).UTC().Unix(),
 					"groups": []string{
 						"CD-Administrators",
 						"Purchasing-Department",
@@ -249,7 +275,7 @@ func createOIDCServer(cb, client, clientsecret string) *httptest.Server {
 					log.Fatalf("Failed to sign token: %v", err)
 				}
 
-				body := fmt.Sprintf(`{"access_token": "%s", "token_type": "Bearer", "refresh_token": "%s", "expires_in": 3600, "id_token": "%s"}`, validAccessToken, validRefreshToken, validIDToken)
+				body := fmt.Sprintf(`{"access_token": "%s", "token_type": "Bearer", "refresh_token": "%s", "expires_in": 3600, "id_token": "%s"}`, accessToken, validRefreshToken, validIDToken)
 				w.Write([]byte(body))
 				return
 
@@ -424,6 +450,62 @@ func TestOidcValidateAnyClaims(t *testing.T) {
 		"claims are valid but filter returned false.")
 }
 
+func TestOidcValidateNestedClaims(t *testing.T) {
+	oidcFilter, err := makeTestingFilter([]string{"realm_access.roles", "email"})
+	assert.NoError(t, err, "error creating test filter")
+	assert.True(t, oidcFilter.validateAllClaims(
+		map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}, "email": "test@example.org"}),
+		"nested claims should be valid but filter returned false.")
+	assert.False(t, oidcFilter.validateAllClaims(
+		map[string]interface{}{"realm_access": map[string]interface{}{}, "email": "test@example.org"}),
+		"nested claim is missing but filter returned true.")
+	assert.False(t, oidcFilter.validateAllClaims(
+		map[string]interface{}{"email": "test@example.org"}),
+		"intermediate claim is missing but filter returned true.")
+	assert.True(t, oidcFilter.validateAnyClaims(
+		map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}}),
+		"nested claims should be valid but filter returned false.")
+}
+
+func TestOidcValidateNonEmptyClaims(t *testing.T) {
+	oidcFilter, err := makeTestingFilter([]string{"uid", "department!", "groups!"})
+	assert.NoError(t, err, "error creating test filter")
+	for _, ti := range []struct {
+		msg      string
+		claims   map[string]interface{}
+		expected bool
+	}{{
+		msg:      "non-empty claims",
+		claims:   map[string]interface{}{"uid": "", "department": "sales", "groups": []interface{}{"admins"}},
+		expected: true,
+	}, {
+		msg:    "empty string",
+		claims: map[string]interface{}{"uid": "test", "department": "", "groups": []interface{}{"admins"}},
+	}, {
+		msg:    "null",
+		claims: map[string]interface{}{"uid": "test", "department": nil, "groups": []interface{}{"admins"}},
+	}, {
+		msg:    "empty array",
+		claims: map[string]interface{}{"uid": "test", "department": "sales", "groups": []interface{}{}},
+	}, {
+		msg:    "missing key",
+		claims: map[string]interface{}{"uid": "test", "groups": []interface{}{"admins"}},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			assert.Equal(t, ti.expected, oidcFilter.validateAllClaims(ti.claims))
+		})
+	}
+
+	oidcFilter, err = makeTestingFilter([]string{"department!", "realm_access.roles!"})
+	assert.NoError(t, err, "error creating test filter")
+	assert.False(t, oidcFilter.validateAnyClaims(
+		map[string]interface{}{"department": "", "realm_access": map[string]interface{}{"roles": []interface{}{}}}),
+		"empty claims but filter returned true.")
+	assert.True(t, oidcFilter.validateAnyClaims(
+		map[string]interface{}{"department": "", "realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}}),
+		"nested claim is not empty but filter returned false.")
+}
+
 func TestExtractDomainFromHost(t *testing.T) {
 
 	for _, ht := range []struct {
@@ -457,19 +539,19 @@ func TestNewOidc(t *testing.T) {
 			name: "test UserInfo",
 			args: "/foo",
 			f:    NewOAuthOidcUserInfos,
-			want: &tokenOidcSpec{typ: checkOIDCUserInfo, SecretsFile: "/foo", secretsRegistry: reg},
+			want: &tokenOidcSpec{typ: checkOIDCUserInfo, SecretsFile: "/foo", secretsRegistry: reg, nonces: NewNonceCache(NonceCacheOptions{}), claimSources: newClaimSourceResolver()},
 		},
 		{
 			name: "test AnyClaims",
 			args: "/foo",
 			f:    NewOAuthOidcAnyClaims,
-			want: &tokenOidcSpec{typ: checkOIDCAnyClaims, SecretsFile: "/foo", secretsRegistry: reg},
+			want: &tokenOidcSpec{typ: checkOIDCAnyClaims, SecretsFile: "/foo", secretsRegistry: reg, nonces: NewNonceCache(NonceCacheOptions{}), claimSources: newClaimSourceResolver()},
 		},
 		{
 			name: "test AllClaims",
 			args: "/foo",
 			f:    NewOAuthOidcAllClaims,
-			want: &tokenOidcSpec{typ: checkOIDCAllClaims, SecretsFile: "/foo", secretsRegistry: reg},
+			want: &tokenOidcSpec{typ: checkOIDCAllClaims, SecretsFile: "/foo", secretsRegistry: reg, nonces: NewNonceCache(NonceCacheOptions{}), claimSources: newClaimSourceResolver()},
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
@@ -527,6 +609,30 @@ func TestCreateFilterOIDC(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "test non-empty claims",
+			args: []interface{}{
+				oidcServer.URL,
+				"",
+				"",
+				oidcServer.URL + "/redirect",
+				"",
+				"email department!",
+			},
+			wantErr: false,
+		},
+		{
+			name: "test non-empty claim without name",
+			args: []interface{}{
+				oidcServer.URL,
+				"",
+				"",
+				oidcServer.URL + "/redirect",
+				"",
+				"email !",
+			},
+			wantErr: true,
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			spec := &tokenOidcSpec{
@@ -685,6 +791,16 @@ func TestOIDCSetup(t *testing.T) {
 		claims:          []string{"sub", "uid"},
 		upstreamheaders: "x-auth-email:claims.email x-auth-something:claims.sub x-auth-groups:claims.groups.#[%\"*-Users\"]",
 		expectRequest:   "X-Auth-Email: someone@example.org\r\nX-Auth-Groups: AppX-Test-Users\r\nX-Auth-Something: somesub",
+	}, {
+		msg:          "access token does not match at_hash",
+		client:       validClient,
+		clientsecret: "mysec",
+		authType:     checkOIDCAnyClaims,
+		authCodeOpts: []string{"substitute_access_token=true"},
+		expected:     401,
+		expectErr:    false,
+		scopes:       []string{testKey, "email"},
+		claims:       []string{testKey},
 	}, {
 		msg:          "invalid auth code option",
 		client:       validClient,
@@ -716,6 +832,7 @@ func TestOIDCSetup(t *testing.T) {
 				typ:             tc.authType,
 				SecretsFile:     "/tmp/foo", // TODO(sszuecs): random
 				secretsRegistry: secrettest.NewTestRegistry(),
+				nonces:          NewNonceCache(NonceCacheOptions{}),
 			}
 			fr := make(filters.Registry)
 			fr.Register(spec)
@@ -906,6 +1023,26 @@ func Test_deflatePoolCompressor(t *testing.T) {
 	}
 }
 
+func Test_deflatePoolCompressorMaxSize(t *testing.T) {
+	c := newDeflatePoolCompressor(flate.BestCompression)
+	for _, ti := range []struct {
+		size int
+		fail bool
+	}{
+		{cookieMaxDecompressedSize, false},
+		{cookieMaxDecompressedSize + 1, true},
+	} {
+		compressed, err := c.compress(bytes.Repeat([]byte("a"), ti.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.decompress(compressed); (err != nil) != ti.fail {
+			t.Errorf("unexpected error of size %d: %v", ti.size, err)
+		}
+	}
+}
+
 func Benchmark_deflatePoolCompressor(b *testing.B) {
 	for _, rw := range []string{"comp", "decomp"} {
 		for _, run := range cookieCompressRuns {
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	claimNamesKey   = "_claim_names"
+	claimSourcesKey = "_claim_sources"
+
+	claimSourceTimeout   = 5 * time.Second
+	claimSourceCacheTTL  = 5 * time.Minute
+	claimSourceCacheSize = 1024
+	claimSourceMaxBody   = 1 << 20
+)
+
+var errClaimSource = errors.New("failed to resolve distributed claims")
+
+type (
+	cachedClaimSource struct {
+		claims map[string]interface{}
+		expiry time.Time
+	}
+
+	// claimSourceResolver resolves the distributed claims of the id
+	// tokens, https://openid.net/specs/openid-connect-core-1_0.html#AggregatedDistributedClaims,
+	// e.g. the groups of the Azure AD overage scenario. The claims of
+	// a source are cached by the endpoint and the access token.
+	claimSourceResolver struct {
+		client *http.Client
+
+		mu    sync.Mutex
+		cache map[string]cachedClaimSource
+	}
+)
+
+func newClaimSourceResolver() *claimSourceResolver {
+	return &claimSourceResolver{
+		client: &http.Client{Timeout: claimSourceTimeout},
+		cache:  make(map[string]cachedClaimSource),
+	}
+}
+
+// resolve replaces the distributed claims of the claims with the
+// values fetched from their sources with the access token of the
+// source, or if not provided, with the access token of the client.
+// The _claim_names and _claim_sources claims are removed, so the access
+// tokens of the sources are not stored in the cookie. Aggregated
+// claims are not resolved, because their signature can't be verified
+// with the keys of the provider.
+func (cr *claimSourceResolver) resolve(ctx context.Context, claims map[string]interface{}, accessToken string) error {
+	names, _ := claims[claimNamesKey].(map[string]interface{})
+	sources, _ := claims[claimSourcesKey].(map[string]interface{})
+	delete(claims, claimNamesKey)
+	delete(claims, claimSourcesKey)
+
+	resolved := make(map[string]map[string]interface{})
+	for name, v := range names {
+		sourceName, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		source, ok := sources[sourceName].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: missing source %s of claim %s", errClaimSource, sourceName, name)
+		}
+
+		endpoint, ok := source["endpoint"].(string)
+		if !ok {
+			// aggregated claims
+			continue
+		}
+
+		sourceClaims, ok := resolved[sourceName]
+		if !ok {
+			token, _ := source["access_token"].(string)
+			if token == "" {
+				token = accessToken
+			}
+
+			var err error
+			if sourceClaims, err = cr.get(ctx, endpoint, token); err != nil {
+				return fmt.Errorf("%w: %s: %v", errClaimSource, sourceName, err)
+			}
+
+			resolved[sourceName] = sourceClaims
+		}
+
+		if value, ok := sourceClaims[name]; ok {
+			claims[name] = value
+		}
+	}
+
+	return nil
+}
+
+func (cr *claimSourceResolver) get(ctx context.Context, endpoint, accessToken string) (map[string]interface{}, error) {
+	h := sha256.Sum256([]byte(accessToken))
+	key := endpoint + " " + base64.RawURLEncoding.EncodeToString(h[:])
+	now := time.Now()
+
+	cr.mu.Lock()
+	c, ok := cr.cache[key]
+	cr.mu.Unlock()
+	if ok && now.Before(c.expiry) {
+		return c.claims, nil
+	}
+
+	claims, err := cr.fetch(ctx, endpoint, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if len(cr.cache) >= claimSourceCacheSize {
+		for k, c := range cr.cache {
+			if !now.Before(c.expiry) {
+				delete(cr.cache, k)
+			}
+		}
+
+		// still full of valid entries
+		if len(cr.cache) >= claimSourceCacheSize {
+			cr.cache = make(map[string]cachedClaimSource)
+		}
+	}
+
+	cr.cache[key] = cachedClaimSource{claims: claims, expiry: now.Add(claimSourceCacheTTL)}
+	return claims, nil
+}
+
+// fetch gets the claims of the source. The response is either a JSON
+// object or a JWT. The JWT is fetched from the endpoint of the id token
+// verified before, over TLS, so its payload is used without verifying
+// its signature.
+func (cr *claimSourceResolver) fetch(ctx context.Context, endpoint, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessToken != "" {
+		req.Header.Set(authHeaderName, authHeaderPrefix+accessToken)
+	}
+
+	rsp, err := cr.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("claim source responded with status code: %d", rsp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, rsp.Body, claimSourceMaxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(rsp.Header.Get("Content-Type"), "application/jwt") {
+		parts := strings.Split(strings.TrimSpace(string(body)), ".")
+		if len(parts) != 3 {
+			return nil, errors.New("malformed jwt of the claim source")
+		}
+
+		if body, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, fmt.Errorf("malformed jwt payload of the claim source: %w", err)
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode the claims of the source: %w", err)
+	}
+
+	return claims, nil
+}
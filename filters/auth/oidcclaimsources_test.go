@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClaimSourceResolver(t *testing.T) {
+	var requests int
+	var lastToken string
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		lastToken = r.Header.Get(authHeaderName)
+		switch r.URL.Path {
+		case "/groups":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"groups": ["admins", "devs"], "other": "ignored"}`))
+		case "/jwt":
+			payload := base64.RawURLEncoding.EncodeToString([]byte(`{"roles": ["reader"]}`))
+			w.Header().Set("Content-Type", "application/jwt")
+			w.Write([]byte("eyJhbGciOiJub25lIn0." + payload + ".sig"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer source.Close()
+
+	for _, ti := range []struct {
+		msg           string
+		claims        map[string]interface{}
+		expected      map[string]interface{}
+		expectedToken string
+		fail          bool
+	}{{
+		msg:      "no distributed claims",
+		claims:   map[string]interface{}{"sub": "jdoe"},
+		expected: map[string]interface{}{"sub": "jdoe"},
+	}, {
+		msg: "distributed groups with the access token of the client",
+		claims: map[string]interface{}{
+			"sub":           "jdoe",
+			claimNamesKey:   map[string]interface{}{"groups": "src1"},
+			claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{"endpoint": source.URL + "/groups"}},
+		},
+		expected:      map[string]interface{}{"sub": "jdoe", "groups": []interface{}{"admins", "devs"}},
+		expectedToken: "Bearer client-token",
+	}, {
+		msg: "distributed groups with the access token of the source",
+		claims: map[string]interface{}{
+			"sub":         "jdoe",
+			claimNamesKey: map[string]interface{}{"groups": "src1"},
+			claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{
+				"endpoint":     source.URL + "/groups",
+				"access_token": "source-token",
+			}},
+		},
+		expected:      map[string]interface{}{"sub": "jdoe", "groups": []interface{}{"admins", "devs"}},
+		expectedToken: "Bearer source-token",
+	}, {
+		msg: "jwt response",
+		claims: map[string]interface{}{
+			"sub":           "jdoe",
+			claimNamesKey:   map[string]interface{}{"roles": "src1"},
+			claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{"endpoint": source.URL + "/jwt"}},
+		},
+		expected:      map[string]interface{}{"sub": "jdoe", "roles": []interface{}{"reader"}},
+		expectedToken: "Bearer client-token",
+	}, {
+		msg: "aggregated claims are not resolved",
+		claims: map[string]interface{}{
+			"sub":           "jdoe",
+			claimNamesKey:   map[string]interface{}{"groups": "src1"},
+			claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{"JWT": "a.b.c"}},
+		},
+		expected: map[string]interface{}{"sub": "jdoe"},
+	}, {
+		msg: "missing source",
+		claims: map[string]interface{}{
+			"sub":         "jdoe",
+			claimNamesKey: map[string]interface{}{"groups": "src1"},
+		},
+		fail: true,
+	}, {
+		msg: "failing source",
+		claims: map[string]interface{}{
+			"sub":           "jdoe",
+			claimNamesKey:   map[string]interface{}{"groups": "src1"},
+			claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{"endpoint": source.URL + "/missing"}},
+		},
+		fail: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			lastToken = ""
+			err := newClaimSourceResolver().resolve(context.Background(), ti.claims, "client-token")
+			if ti.fail {
+				if !errors.Is(err, errClaimSource) {
+					t.Fatalf("expected claim source error, got: %v", err)
+				}
+
+				if claimsRejectReason(err) != authServiceAccess {
+					t.Errorf("unexpected reject reason: %s", claimsRejectReason(err))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(ti.claims, ti.expected) {
+				t.Errorf("unexpected claims: %v != %v", ti.claims, ti.expected)
+			}
+
+			if lastToken != ti.expectedToken {
+				t.Errorf("unexpected access token: %q != %q", lastToken, ti.expectedToken)
+			}
+		})
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		cr := newClaimSourceResolver()
+		claims := func() map[string]interface{} {
+			return map[string]interface{}{
+				claimNamesKey:   map[string]interface{}{"groups": "src1"},
+				claimSourcesKey: map[string]interface{}{"src1": map[string]interface{}{"endpoint": source.URL + "/groups"}},
+			}
+		}
+
+		requests = 0
+		for i := 0; i < 3; i++ {
+			if err := cr.resolve(context.Background(), claims(), "client-token"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := cr.resolve(context.Background(), claims(), "other-token"); err != nil {
+			t.Fatal(err)
+		}
+
+		if requests != 2 {
+			t.Errorf("unexpected number of requests to the claim source: %d", requests)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultNonceCacheSize = 10000
+	oidcNonceKeyPrefix    = "oidcnonce."
+)
+
+// NonceCacheOptions configures the cache of the id token nonces.
+type NonceCacheOptions struct {
+	// Size is the maximum number of nonces remembered in memory.
+	// Defaults to 10000.
+	Size int
+
+	// RedisRing returns the redis ring used to share the nonces
+	// across all skipper instances. It is called on the first use of
+	// the cache, and the ring is owned by the caller. Without redis,
+	// the nonces are stored in memory of each instance.
+	RedisRing func() *redis.Ring
+}
+
+// nonceStore stores a key until its expiry, and reports whether the
+// key was stored before.
+type nonceStore interface {
+	seen(ctx context.Context, key string, expiry time.Time) (bool, error)
+	close() error
+}
+
+type (
+	// NonceCache remembers the nonces of the verified id tokens until
+	// the tokens expire, to reject replayed id tokens. On tear down
+	// make sure to Close() it.
+	NonceCache struct {
+		store nonceStore
+	}
+
+	memoryNonceStore struct {
+		cache *replayCache
+	}
+
+	redisNonceStore struct {
+		ring func() *redis.Ring
+	}
+)
+
+// NewNonceCache creates a cache of id token nonces, that can be shared
+// by the oauthOidc* filters.
+func NewNonceCache(o NonceCacheOptions) *NonceCache {
+	if o.RedisRing != nil {
+		return &NonceCache{store: &redisNonceStore{ring: o.RedisRing}}
+	}
+
+	if o.Size <= 0 {
+		o.Size = defaultNonceCacheSize
+	}
+
+	return &NonceCache{store: &memoryNonceStore{cache: newReplayCache(o.Size)}}
+}
+
+// Close releases the resources of the cache. The redis ring is not
+// closed.
+func (c *NonceCache) Close() error {
+	return c.store.close()
+}
+
+// seen returns true if the nonce of the issuer was stored before.
+// Otherwise it stores the nonce until expiry.
+func (c *NonceCache) seen(ctx context.Context, iss, nonce string, expiry time.Time) (bool, error) {
+	return c.store.seen(ctx, oidcNonceKeyPrefix+iss+" "+nonce, expiry)
+}
+
+func (s *memoryNonceStore) seen(_ context.Context, key string, expiry time.Time) (bool, error) {
+	return s.cache.checkAndStore(key, expiry, time.Now()), nil
+}
+
+func (*memoryNonceStore) close() error { return nil }
+
+func (s *redisNonceStore) seen(ctx context.Context, key string, expiry time.Time) (bool, error) {
+	ttl := time.Until(expiry)
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	ok, err := s.ring().SetNX(ctx, key, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return !ok, nil
+}
+
+func (*redisNonceStore) close() error { return nil }
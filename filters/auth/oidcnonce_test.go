@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+)
+
+func TestOidcVerifyNonce(t *testing.T) {
+	f := &tokenOidcFilter{nonces: NewNonceCache(NonceCacheOptions{})}
+	defer f.nonces.Close()
+
+	exp := time.Now().Add(time.Hour)
+	idToken := func(iss, nonce string) *oidc.IDToken {
+		return &oidc.IDToken{Issuer: iss, Nonce: nonce, Expiry: exp}
+	}
+
+	ctx := context.Background()
+	if err := f.verifyNonce(ctx, idToken("https://idp.example.org", ""), "n1"); err == nil || errors.Is(err, errReplayedNonce) {
+		t.Errorf("expected nonce mismatch for id token without nonce, got: %v", err)
+	}
+
+	if err := f.verifyNonce(ctx, idToken("https://idp.example.org", "n1"), "n2"); err == nil || errors.Is(err, errReplayedNonce) {
+		t.Errorf("expected nonce mismatch, got: %v", err)
+	}
+
+	if err := f.verifyNonce(ctx, idToken("https://idp.example.org", "n1"), "n1"); err != nil {
+		t.Errorf("unexpected error for the first use of the nonce: %v", err)
+	}
+
+	err := f.verifyNonce(ctx, idToken("https://idp.example.org", "n1"), "n1")
+	if !errors.Is(err, errReplayedNonce) {
+		t.Errorf("expected replayed nonce, got: %v", err)
+	}
+
+	if claimsRejectReason(err) != replayedNonce {
+		t.Errorf("unexpected reject reason: %s", claimsRejectReason(err))
+	}
+
+	if err := f.verifyNonce(ctx, idToken("https://other-idp.example.org", "n1"), "n1"); err != nil {
+		t.Errorf("unexpected error for the nonce of another issuer: %v", err)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	c := NewNonceCache(NonceCacheOptions{Size: 1})
+	defer c.Close()
+
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour)
+	if seen, _ := c.seen(ctx, "iss", "n1", exp); seen {
+		t.Error("unexpected replay of new nonce")
+	}
+
+	// evicts n1 from the cache of size 1
+	c.seen(ctx, "iss", "n2", exp)
+	if seen, _ := c.seen(ctx, "iss", "n1", exp); seen {
+		t.Error("unexpected replay of evicted nonce")
+	}
+
+	c.seen(ctx, "iss", "n3", time.Now().Add(-time.Second))
+	if seen, _ := c.seen(ctx, "iss", "n3", exp); seen {
+		t.Error("unexpected replay of expired nonce")
+	}
+}
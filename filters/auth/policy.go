@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthPolicyName = "oauthPolicy"
+
+	policySpanName = "policy"
+
+	defaultPolicyTimeout   = 2 * time.Second
+	defaultPolicyCacheTTL  = 10 * time.Second
+	defaultPolicyCacheSize = 10000
+)
+
+var (
+	errPolicyServiceStatus = errors.New("policy service responded with unexpected status")
+	errInvalidPolicyResult = errors.New("invalid policy decision")
+)
+
+// PolicyOptions configures the oauthPolicy filter.
+type PolicyOptions struct {
+	// Timeout of the calls to the policy service. Defaults to 2
+	// seconds.
+	Timeout      time.Duration
+	MaxIdleConns int
+	Tracer       opentracing.Tracer
+
+	// CacheTTL is the duration, for which the decisions are cached
+	// per subject, resource and action. Defaults to 10 seconds, a
+	// negative value disables the cache.
+	CacheTTL time.Duration
+
+	// CacheSize is the maximum number of the cached decisions. When
+	// full, the oldest decision is evicted. Defaults to 10000.
+	CacheSize int
+
+	// FailOpen passes the requests, when the policy service fails,
+	// instead of rejecting them with auth-service-access.
+	FailOpen bool
+
+	// Transport tunes the connections to the policy service.
+	Transport TransportOptions
+}
+
+type (
+	policySpec struct {
+		options PolicyOptions
+	}
+
+	policyFilter struct {
+		authClient *authClient
+		action     string
+		cache      *policyCache
+		failOpen   bool
+	}
+
+	// policyInput is the input of the decision of the policy service.
+	policyInput struct {
+		Subject  string                 `json:"subject"`
+		Resource string                 `json:"resource"`
+		Action   string                 `json:"action"`
+		Claims   map[string]interface{} `json:"claims"`
+	}
+
+	// policyRequest follows the format of the OPA data API.
+	policyRequest struct {
+		Input policyInput `json:"input"`
+	}
+
+	// policyResponse accepts the result of the OPA data API, either a
+	// boolean, or an object with an allow field.
+	policyResponse struct {
+		Result json.RawMessage `json:"result"`
+	}
+
+	policyDecision struct {
+		allow  bool
+		expiry time.Time
+	}
+
+	// policyCache holds the decisions until their expiry. It holds at
+	// most size entries, when full, the oldest inserted entry is
+	// evicted.
+	policyCache struct {
+		ttl     time.Duration
+		mu      sync.Mutex
+		entries map[string]policyDecision
+		keys    []string
+		next    int
+	}
+)
+
+func (r policyResponse) allowed() (bool, error) {
+	var allow bool
+	if err := json.Unmarshal(r.Result, &allow); err == nil {
+		return allow, nil
+	}
+
+	var result struct {
+		Allow *bool `json:"allow"`
+	}
+
+	if err := json.Unmarshal(r.Result, &result); err != nil || result.Allow == nil {
+		return false, errInvalidPolicyResult
+	}
+
+	return *result.Allow, nil
+}
+
+func newPolicyCache(ttl time.Duration, size int) *policyCache {
+	return &policyCache{
+		ttl:     ttl,
+		entries: make(map[string]policyDecision),
+		keys:    make([]string, 0, size),
+	}
+}
+
+func policyCacheKey(sub, resource, action string) string {
+	return sub + "\x00" + resource + "\x00" + action
+}
+
+func (c *policyCache) get(key string, now time.Time) (allow, ok bool) {
+	if c == nil {
+		return false, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.entries[key]
+	if !ok || !now.Before(d.expiry) {
+		return false, false
+	}
+
+	return d.allow, true
+}
+
+func (c *policyCache) set(key string, allow bool, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		if len(c.keys) < cap(c.keys) {
+			c.keys = append(c.keys, key)
+		} else {
+			delete(c.entries, c.keys[c.next])
+			c.keys[c.next] = key
+			c.next = (c.next + 1) % len(c.keys)
+		}
+	}
+
+	c.entries[key] = policyDecision{allow: allow, expiry: now.Add(c.ttl)}
+}
+
+// NewOAuthPolicy creates a filter spec, which posts the subject of the
+// token, the requested path and the action to an external policy
+// service, e.g. OPA, and rejects the request, when the service denies
+// it. The filter has to be placed after one of the oauthTokeninfo*,
+// oauthTokenintrospection* or oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokeninfoAnyScope("read") -> oauthPolicy("http://opa.example.org/v1/data/skipper/allow") -> "https://internal.example.org";
+func NewOAuthPolicy(o PolicyOptions) filters.Spec {
+	if o.Timeout <= 0 {
+		o.Timeout = defaultPolicyTimeout
+	}
+
+	if o.CacheTTL == 0 {
+		o.CacheTTL = defaultPolicyCacheTTL
+	}
+
+	if o.CacheSize <= 0 {
+		o.CacheSize = defaultPolicyCacheSize
+	}
+
+	return &policySpec{options: o}
+}
+
+func (*policySpec) Name() string {
+	return OAuthPolicyName
+}
+
+// CreateFilter accepts the URL of the policy service, and optionally,
+// the action. The action defaults to the method of the request.
+//
+//	s.CreateFilter("http://opa.example.org/v1/data/skipper/allow")
+//	s.CreateFilter("http://opa.example.org/v1/data/skipper/allow", "read")
+func (s *policySpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) == 0 || len(sargs) > 2 || sargs[0] == "" {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	ac, err := newAuthClient(sargs[0], policySpanName, s.options.Timeout, s.options.MaxIdleConns, s.options.Tracer, s.options.Transport)
+	if err != nil {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &policyFilter{authClient: ac, failOpen: s.options.FailOpen}
+	if len(sargs) == 2 {
+		f.action = sargs[1]
+	}
+
+	if s.options.CacheTTL > 0 {
+		f.cache = newPolicyCache(s.options.CacheTTL, s.options.CacheSize)
+	}
+
+	return f, nil
+}
+
+func (f *policyFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, ctx.Request().Host, "no validated token available for the policy check")
+		return
+	}
+
+	r := ctx.Request()
+	input := policyInput{
+		Resource: r.URL.Path,
+		Action:   f.action,
+		Claims:   claims,
+	}
+
+	// tokeninfo responses carry the uid instead of the sub claim
+	input.Subject, _ = claims[subKey].(string)
+	if input.Subject == "" {
+		input.Subject, _ = claims[uidKey].(string)
+	}
+
+	if input.Action == "" {
+		input.Action = r.Method
+	}
+
+	// without a subject, the decision can't be cached, because it
+	// would be shared by all tokens
+	now := time.Now()
+	key := policyCacheKey(input.Subject, input.Resource, input.Action)
+	var allow, cached bool
+	if input.Subject != "" {
+		allow, cached = f.cache.get(key, now)
+	}
+
+	if !cached {
+		var err error
+		allow, err = f.authClient.getPolicyDecision(input, ctx)
+		if err != nil {
+			log.Errorf("Error while calling the policy service: %v.", err)
+			if f.failOpen {
+				return
+			}
+
+			unauthorized(ctx, input.Subject, authServiceAccess, f.authClient.url.Hostname(), "")
+			return
+		}
+
+		if input.Subject != "" {
+			f.cache.set(key, allow, now)
+		}
+	}
+
+	if !allow {
+		forbidden(ctx, input.Subject, invalidAccess, "denied by the policy service")
+		return
+	}
+
+	authorized(ctx, input.Subject)
+}
+
+func (*policyFilter) Response(filters.FilterContext) {}
+
+// Close cleans-up the authClient
+func (f *policyFilter) Close() {
+	f.authClient.Close()
+}
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req policyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch req.Input.Subject {
+		case "service-a":
+			w.Write([]byte(`{"result": true}`))
+		case "service-b":
+			allow := req.Input.Resource == "/public" && req.Input.Action == "GET"
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"allow": allow}})
+		case "service-c":
+			w.Write([]byte(`{"result": false}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer policy.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  PolicyOptions
+		args     []interface{}
+		method   string
+		path     string
+		claims   map[string]interface{}
+		expected int
+		reason   rejectReason
+	}{{
+		msg:      "no validated token",
+		args:     []interface{}{policy.URL},
+		expected: http.StatusUnauthorized,
+		reason:   missingToken,
+	}, {
+		msg:      "allowed",
+		args:     []interface{}{policy.URL},
+		claims:   map[string]interface{}{"sub": "service-a"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "allowed resource and action",
+		args:     []interface{}{policy.URL},
+		path:     "/public",
+		claims:   map[string]interface{}{"sub": "service-b"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "denied action",
+		args:     []interface{}{policy.URL},
+		method:   "POST",
+		path:     "/public",
+		claims:   map[string]interface{}{"sub": "service-b"},
+		expected: http.StatusForbidden,
+		reason:   invalidAccess,
+	}, {
+		msg:      "action of the filter",
+		args:     []interface{}{policy.URL, "GET"},
+		method:   "POST",
+		path:     "/public",
+		claims:   map[string]interface{}{"sub": "service-b"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "denied",
+		args:     []interface{}{policy.URL},
+		claims:   map[string]interface{}{"sub": "service-c"},
+		expected: http.StatusForbidden,
+		reason:   invalidAccess,
+	}, {
+		msg:      "policy service fails closed",
+		args:     []interface{}{policy.URL},
+		claims:   map[string]interface{}{"sub": "service-x"},
+		expected: http.StatusUnauthorized,
+		reason:   authServiceAccess,
+	}, {
+		msg:      "policy service fails open",
+		options:  PolicyOptions{FailOpen: true},
+		args:     []interface{}{policy.URL},
+		claims:   map[string]interface{}{"sub": "service-x"},
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthPolicy(ti.options).CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*policyFilter).Close()
+
+			method, path := ti.method, ti.path
+			if method == "" {
+				method = "GET"
+			}
+
+			if path == "" {
+				path = "/"
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest(method, path, nil), FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.reason != "" && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(ti.reason) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestPolicyCache(t *testing.T) {
+	var calls int32
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"result": true}`))
+	}))
+	defer policy.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		ttl      time.Duration
+		expected int32
+	}{{
+		msg:      "cached",
+		ttl:      time.Minute,
+		expected: 2,
+	}, {
+		msg:      "cache disabled",
+		ttl:      -1,
+		expected: 3,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			f, err := NewOAuthPolicy(PolicyOptions{CacheTTL: ti.ttl}).CreateFilter([]interface{}{policy.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*policyFilter).Close()
+
+			for _, sub := range []string{"service-a", "service-a", "service-b"} {
+				ctx := &filtertest.Context{
+					FRequest:  httptest.NewRequest("GET", "/", nil),
+					FStateBag: map[string]interface{}{tokeninfoCacheKey: map[string]interface{}{"sub": sub}},
+				}
+
+				f.Request(ctx)
+				if ctx.FServed {
+					t.Fatalf("unexpected rejection: %d", ctx.FResponse.StatusCode)
+				}
+			}
+
+			if c := atomic.LoadInt32(&calls); c != ti.expected {
+				t.Errorf("unexpected calls to the policy service: %d != %d", c, ti.expected)
+			}
+		})
+	}
+}
+
+func TestPolicyCacheEviction(t *testing.T) {
+	c := newPolicyCache(time.Minute, 2)
+	now := time.Now()
+	c.set("a", true, now)
+	c.set("b", false, now)
+	c.set("c", true, now)
+
+	if _, ok := c.get("a", now); ok {
+		t.Error("failed to evict the oldest decision")
+	}
+
+	if allow, ok := c.get("b", now); !ok || allow {
+		t.Error("failed to get the cached deny")
+	}
+
+	if _, ok := c.get("c", now.Add(time.Minute)); ok {
+		t.Error("failed to expire the decision")
+	}
+}
+
+func TestPolicyCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{""},
+		{42},
+		{"http://opa.example.org", "read", "write"},
+	} {
+		if _, err := NewOAuthPolicy(PolicyOptions{}).CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
+
+func TestPolicyTokeninfoSubjects(t *testing.T) {
+	tokeninfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(authHeaderName) {
+		case authHeaderPrefix + "alice-token":
+			w.Write([]byte(`{"uid": "alice", "scope": ["read"]}`))
+		case authHeaderPrefix + "bob-token":
+			w.Write([]byte(`{"uid": "bob", "scope": ["read"]}`))
+		case authHeaderPrefix + "anonymous-token":
+			w.Write([]byte(`{"scope": ["read"]}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer tokeninfo.Close()
+
+	var calls int32
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		var req policyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": req.Input.Subject == "alice" || req.Input.Subject == ""})
+	}))
+	defer policy.Close()
+
+	ti, err := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{URL: tokeninfo.URL, Timeout: time.Second}).CreateFilter([]interface{}{"read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewOAuthPolicy(PolicyOptions{CacheTTL: time.Minute}).CreateFilter([]interface{}{policy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*policyFilter).Close()
+
+	request := func(token string) int {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+token)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		ti.Request(ctx)
+		if !ctx.FServed {
+			f.Request(ctx)
+		}
+
+		if ctx.FServed {
+			return ctx.FResponse.StatusCode
+		}
+
+		return http.StatusOK
+	}
+
+	if status := request("alice-token"); status != http.StatusOK {
+		t.Errorf("allowed user denied: %d", status)
+	}
+
+	if status := request("bob-token"); status != http.StatusForbidden {
+		t.Errorf("denied user got the cached decision of another user: %d", status)
+	}
+
+	if status := request("alice-token"); status != http.StatusOK {
+		t.Errorf("allowed user denied: %d", status)
+	}
+
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("unexpected calls to the policy service: %d", c)
+	}
+
+	request("anonymous-token")
+	request("anonymous-token")
+	if c := atomic.LoadInt32(&calls); c != 4 {
+		t.Errorf("decision without a subject was cached: %d", c)
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthProblemResponseName = "oauthProblemResponse"
+
+	problemResponseKey         = "auth.problemResponse"
+	problemContentType         = "application/problem+json"
+	problemTypePrefix          = "urn:skipper:auth:"
+	problemDetailArgumentTrue  = "true"
+	problemDetailArgumentFalse = "false"
+)
+
+type (
+	problemResponseSpec   struct{}
+	problemResponseFilter struct {
+		contentType string
+		detail      bool
+	}
+
+	// problem is the body of the rejected requests, see
+	// https://tools.ietf.org/html/rfc7807#section-3.1
+	problem struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail,omitempty"`
+	}
+)
+
+// NewOAuthProblemResponse creates a filter spec, which makes the auth
+// filters reject the requests with a problem details body (RFC 7807)
+// instead of an empty body. The type of the problem is derived from
+// the reject reason, e.g. urn:skipper:auth:invalid-scope, and the title
+// from the status. The optional first argument overrides the content
+// type, which defaults to application/problem+json. The optional second
+// argument, "true" or "false", enables the detail of the rejection,
+// which can contain information about the token or the auth service,
+// so it is disabled by default. The filter has to be placed before the
+// auth filters.
+//
+// Example:
+//
+//	oauthProblemResponse() -> oauthTokeninfoAnyScope("read") -> "https://api.example.org";
+//	oauthProblemResponse("application/json", "true") -> oauthTokeninfoAnyScope("read") -> "https://api.example.org";
+func NewOAuthProblemResponse() filters.Spec {
+	return &problemResponseSpec{}
+}
+
+func (*problemResponseSpec) Name() string { return OAuthProblemResponseName }
+
+func (*problemResponseSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &problemResponseFilter{contentType: problemContentType}
+	switch len(sargs) {
+	case 2:
+		switch sargs[1] {
+		case problemDetailArgumentTrue:
+			f.detail = true
+		case problemDetailArgumentFalse:
+		default:
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		fallthrough
+	case 1:
+		if sargs[0] != "" {
+			f.contentType = sargs[0]
+		}
+	case 0:
+	default:
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return f, nil
+}
+
+func (f *problemResponseFilter) Request(ctx filters.FilterContext) {
+	ctx.StateBag()[problemResponseKey] = f
+}
+
+func (*problemResponseFilter) Response(filters.FilterContext) {}
+
+// response returns the response of the rejected request with the
+// problem details body.
+func (f *problemResponseFilter) response(status int, reason rejectReason, debuginfo string) *http.Response {
+	p := problem{
+		Type:   problemTypePrefix + string(reason),
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+
+	if f.detail {
+		p.Detail = debuginfo
+	}
+
+	rsp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Errorf("Failed to encode the problem details: %v", err)
+		return rsp
+	}
+
+	rsp.Header.Set("Content-Type", f.contentType)
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	rsp.ContentLength = int64(len(b))
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return rsp
+}
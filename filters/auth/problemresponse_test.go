@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestProblemResponse(t *testing.T) {
+	for _, ti := range []struct {
+		msg                 string
+		args                []interface{}
+		reject              func(*filtertest.Context)
+		expectedStatus      int
+		expectedContentType string
+		expected            map[string]interface{}
+	}{{
+		msg: "invalid scope",
+		reject: func(ctx *filtertest.Context) {
+			forbidden(ctx, "jdoe", invalidScope, "missing scope write")
+		},
+		expectedStatus:      http.StatusForbidden,
+		expectedContentType: "application/problem+json",
+		expected: map[string]interface{}{
+			"type":   "urn:skipper:auth:invalid-scope",
+			"title":  "Forbidden",
+			"status": float64(http.StatusForbidden),
+		},
+	}, {
+		msg: "inactive token",
+		reject: func(ctx *filtertest.Context) {
+			unauthorized(ctx, "", inactiveToken, "www.example.org", "token expired")
+		},
+		expectedStatus:      http.StatusUnauthorized,
+		expectedContentType: "application/problem+json",
+		expected: map[string]interface{}{
+			"type":   "urn:skipper:auth:inactive-token",
+			"title":  "Unauthorized",
+			"status": float64(http.StatusUnauthorized),
+		},
+	}, {
+		msg:  "invalid scope with detail",
+		args: []interface{}{"application/json", "true"},
+		reject: func(ctx *filtertest.Context) {
+			forbidden(ctx, "jdoe", invalidScope, "missing scope write")
+		},
+		expectedStatus:      http.StatusForbidden,
+		expectedContentType: "application/json",
+		expected: map[string]interface{}{
+			"type":   "urn:skipper:auth:invalid-scope",
+			"title":  "Forbidden",
+			"status": float64(http.StatusForbidden),
+			"detail": "missing scope write",
+		},
+	}, {
+		msg:  "inactive token with detail",
+		args: []interface{}{"", "true"},
+		reject: func(ctx *filtertest.Context) {
+			unauthorized(ctx, "", inactiveToken, "www.example.org", "token expired")
+		},
+		expectedStatus:      http.StatusUnauthorized,
+		expectedContentType: "application/problem+json",
+		expected: map[string]interface{}{
+			"type":   "urn:skipper:auth:inactive-token",
+			"title":  "Unauthorized",
+			"status": float64(http.StatusUnauthorized),
+			"detail": "token expired",
+		},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthProblemResponse().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{
+				FRequest:  httptest.NewRequest("GET", "/", nil),
+				FStateBag: map[string]interface{}{},
+			}
+
+			f.Request(ctx)
+			ti.reject(ctx)
+
+			rsp := ctx.FResponse
+			if rsp.StatusCode != ti.expectedStatus {
+				t.Errorf("unexpected status code: %d != %d", rsp.StatusCode, ti.expectedStatus)
+			}
+
+			if ct := rsp.Header.Get("Content-Type"); ct != ti.expectedContentType {
+				t.Errorf("unexpected content type: %q != %q", ct, ti.expectedContentType)
+			}
+
+			b, err := ioutil.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal(b, &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(body, ti.expected) {
+				t.Errorf("unexpected body: %v != %v", body, ti.expected)
+			}
+		})
+	}
+}
+
+func TestProblemResponseDisabled(t *testing.T) {
+	ctx := &filtertest.Context{
+		FRequest:  httptest.NewRequest("GET", "/", nil),
+		FStateBag: map[string]interface{}{},
+	}
+
+	forbidden(ctx, "jdoe", invalidScope, "missing scope write")
+
+	if ctx.FResponse.StatusCode != http.StatusForbidden || ctx.FResponse.Body != nil {
+		t.Errorf("unexpected response: %d, %v", ctx.FResponse.StatusCode, ctx.FResponse.Body)
+	}
+}
+
+func TestProblemResponseCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		{"application/json", "yes"},
+		{"application/json", "true", "foo"},
+		{42},
+	} {
+		if _, err := NewOAuthProblemResponse().CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
+	"golang.org/x/net/http/httpguts"
+)
+
+const OAuthReplaceAuthorizationName = "oauthReplaceAuthorization"
+
+type (
+	replaceAuthorizationSpec   struct{}
+	replaceAuthorizationFilter struct {
+		value *eskip.Template
+	}
+)
+
+// NewOAuthReplaceAuthorization creates a filter spec, which removes the
+// Authorization header of the validated request before it is proxied,
+// so the backend doesn't see the original token. With an argument, the
+// header is replaced by the value, which can contain placeholders of
+// the claims of the validated token, e.g. ${sub}. When a placeholder
+// can not be resolved, the header is removed. The filter has to be
+// placed after the oauthTokeninfo*, oauthTokenintrospection* or
+// oauthOidc* filters. The forwardToken filter reads the claims from
+// the state bag, so the backend still gets the identity of the client.
+//
+// Example:
+//
+//	oauthTokeninfoAnyScope("read") -> forwardToken("X-Tokeninfo-Forward", "uid") -> oauthReplaceAuthorization() -> "https://internal.example.org";
+//	oauthTokeninfoAnyScope("read") -> oauthReplaceAuthorization("Internal ${uid}") -> "https://internal.example.org";
+func NewOAuthReplaceAuthorization() filters.Spec {
+	return &replaceAuthorizationSpec{}
+}
+
+func (*replaceAuthorizationSpec) Name() string { return OAuthReplaceAuthorizationName }
+
+func (*replaceAuthorizationSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(sargs) {
+	case 0:
+		return &replaceAuthorizationFilter{}, nil
+	case 1:
+		if sargs[0] == "" {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		return &replaceAuthorizationFilter{value: eskip.NewTemplate(sargs[0])}, nil
+	default:
+		return nil, filters.ErrInvalidFilterParameters
+	}
+}
+
+// claimString returns the claim as string, the values of arrays of
+// strings are joined by comma. Objects are not supported.
+func claimString(claims map[string]interface{}, key string) string {
+	v, ok := claimValue(claims, key)
+	if !ok {
+		return ""
+	}
+
+	if s, ok := claimStrings(v); ok {
+		return strings.Join(s, ",")
+	}
+
+	switch v.(type) {
+	case float64, bool:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
+
+func (f *replaceAuthorizationFilter) Request(ctx filters.FilterContext) {
+	h := ctx.Request().Header
+	h.Del(authHeaderName)
+	if f.value == nil {
+		return
+	}
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		log.Debugf("Failed to replace the authorization header without validated token")
+		return
+	}
+
+	var missing bool
+	v := f.value.Apply(func(key string) string {
+		s := claimString(claims, key)
+		missing = missing || s == ""
+		return s
+	})
+
+	if missing || !httpguts.ValidHeaderFieldValue(v) {
+		log.Debugf("Failed to resolve the authorization header of the claims")
+		return
+	}
+
+	h.Set(authHeaderName, v)
+}
+
+func (*replaceAuthorizationFilter) Response(filters.FilterContext) {}
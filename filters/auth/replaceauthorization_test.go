@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestReplaceAuthorization(t *testing.T) {
+	claims := map[string]interface{}{
+		"uid":   "jdoe",
+		"realm": "/employees",
+		"roles": []interface{}{"admin", "user"},
+		"nested": map[string]interface{}{
+			"id": "n1",
+		},
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		claims   map[string]interface{}
+		expected string
+	}{{
+		msg:    "remove",
+		claims: claims,
+	}, {
+		msg:      "static value",
+		args:     []interface{}{"Bearer internal"},
+		claims:   claims,
+		expected: "Bearer internal",
+	}, {
+		msg:      "claims",
+		args:     []interface{}{"Internal ${uid} ${realm} ${roles} ${nested.id}"},
+		claims:   claims,
+		expected: "Internal jdoe /employees admin,user n1",
+	}, {
+		msg:    "missing claim",
+		args:   []interface{}{"Internal ${email}"},
+		claims: claims,
+	}, {
+		msg:  "without validated token",
+		args: []interface{}{"Bearer internal"},
+	}, {
+		msg:    "invalid header value",
+		args:   []interface{}{"Internal ${uid}"},
+		claims: map[string]interface{}{"uid": "jdoe\r\nX-Injected: true"},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthReplaceAuthorization().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, "Bearer original")
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			if got := req.Header.Get(authHeaderName); got != ti.expected {
+				t.Errorf("unexpected authorization header: %q != %q", got, ti.expected)
+			}
+		})
+	}
+}
+
+func TestReplaceAuthorizationForwardToken(t *testing.T) {
+	replace, err := NewOAuthReplaceAuthorization().CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward, err := NewForwardToken().CreateFilter([]interface{}{"X-Tokeninfo-Forward", "uid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(authHeaderName, "Bearer original")
+	ctx := &filtertest.Context{
+		FRequest:  req,
+		FStateBag: map[string]interface{}{tokeninfoCacheKey: map[string]interface{}{"uid": "jdoe"}},
+	}
+
+	replace.Request(ctx)
+	forward.Request(ctx)
+
+	if got := req.Header.Get(authHeaderName); got != "" {
+		t.Errorf("unexpected authorization header: %q", got)
+	}
+
+	if got := req.Header.Get("X-Tokeninfo-Forward"); got != `{"uid":"jdoe"}` {
+		t.Errorf("unexpected forwarded token: %q", got)
+	}
+}
+
+func TestReplaceAuthorizationCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{
+		{""},
+		{"a", "b"},
+		{42},
+	} {
+		if _, err := NewOAuthReplaceAuthorization().CreateFilter(args); err == nil {
+			t.Errorf("expected error for arguments: %v", args)
+		}
+	}
+}
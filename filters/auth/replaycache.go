@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// replayCache remembers keys, e.g. jti or nonce values, until their
+// expiry to detect replays. It holds at most size entries, when full,
+// the oldest inserted entry is evicted.
+type replayCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	keys    []string
+	next    int
+}
+
+func newReplayCache(size int) *replayCache {
+	return &replayCache{
+		entries: make(map[string]time.Time),
+		keys:    make([]string, 0, size),
+	}
+}
+
+// checkAndStore returns true if key was already stored and is not yet
+// expired. Otherwise it stores the key until expiry and returns false.
+func (c *replayCache) checkAndStore(key string, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if exp, ok := c.entries[key]; ok {
+		if now.Before(exp) {
+			return true
+		}
+
+		// expired keys are still part of the eviction order
+		c.entries[key] = expiry
+		return false
+	}
+
+	if len(c.keys) < cap(c.keys) {
+		c.keys = append(c.keys, key)
+	} else {
+		delete(c.entries, c.keys[c.next])
+		c.keys[c.next] = key
+		c.next = (c.next + 1) % len(c.keys)
+	}
+
+	c.entries[key] = expiry
+	return false
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	c := newReplayCache(2)
+
+	if c.checkAndStore("a", now.Add(time.Minute), now) {
+		t.Error("unexpected replay of a new key")
+	}
+
+	if !c.checkAndStore("a", now.Add(time.Minute), now) {
+		t.Error("failed to detect replay")
+	}
+
+	if c.checkAndStore("a", now.Add(3*time.Minute), now.Add(2*time.Minute)) {
+		t.Error("unexpected replay of an expired key")
+	}
+
+	c.checkAndStore("b", now.Add(time.Hour), now)
+	c.checkAndStore("c", now.Add(time.Hour), now)
+	if len(c.entries) != 2 {
+		t.Errorf("cache is not bounded: %d", len(c.entries))
+	}
+
+	if c.checkAndStore("a", now.Add(time.Hour), now) {
+		t.Error("oldest key was not evicted")
+	}
+}
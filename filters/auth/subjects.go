@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthSubjectAllowlistName = "oauthSubjectAllowlist"
+	OAuthSubjectDenylistName  = "oauthSubjectDenylist"
+
+	defaultSubjectsRefreshInterval = time.Minute
+	subjectsFilePrefix             = "file:"
+)
+
+// SubjectListOptions configures the oauthSubjectAllowlist and
+// oauthSubjectDenylist filters.
+type SubjectListOptions struct {
+	// RefreshInterval defines how often the subject files are
+	// reloaded. Defaults to 1 minute.
+	RefreshInterval time.Duration
+}
+
+type (
+	// SubjectListSpec is the filter spec of the oauthSubjectAllowlist
+	// and oauthSubjectDenylist filters. It reloads the subject files
+	// in the background, so on tear down make sure to Close() it.
+	SubjectListSpec struct {
+		allow   bool
+		options SubjectListOptions
+
+		mu      sync.RWMutex
+		files   map[string]map[string]struct{}
+		started bool
+		quit    chan struct{}
+		once    sync.Once
+	}
+
+	subjectListFilter struct {
+		spec     *SubjectListSpec
+		subjects map[string]struct{}
+		files    []string
+	}
+)
+
+// NewOAuthSubjectAllowlist creates a filter spec, which rejects the
+// tokens, whose sub claim is not on the list of the filter arguments.
+// The filter has to be placed after one of the oauthTokeninfo*,
+// oauthTokenintrospection* or oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokeninfoAnyScope("read") -> oauthSubjectAllowlist("stups_service-a", "file:/etc/skipper/subjects") -> "https://internal.example.org";
+func NewOAuthSubjectAllowlist(o SubjectListOptions) *SubjectListSpec {
+	return newSubjectListSpec(true, o)
+}
+
+// NewOAuthSubjectDenylist creates a filter spec, which rejects the
+// tokens, whose sub claim is on the list of the filter arguments. The
+// filter has to be placed after one of the oauthTokeninfo*,
+// oauthTokenintrospection* or oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokeninfoAnyScope("read") -> oauthSubjectDenylist("compromised-service") -> "https://internal.example.org";
+func NewOAuthSubjectDenylist(o SubjectListOptions) *SubjectListSpec {
+	return newSubjectListSpec(false, o)
+}
+
+func newSubjectListSpec(allow bool, o SubjectListOptions) *SubjectListSpec {
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = defaultSubjectsRefreshInterval
+	}
+
+	return &SubjectListSpec{
+		allow:   allow,
+		options: o,
+		files:   make(map[string]map[string]struct{}),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (s *SubjectListSpec) Name() string {
+	if s.allow {
+		return OAuthSubjectAllowlistName
+	}
+
+	return OAuthSubjectDenylistName
+}
+
+// readSubjects reads a file with a subject per line. Empty lines and
+// lines starting with # are ignored.
+func readSubjects(path string) (map[string]struct{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		subjects[line] = struct{}{}
+	}
+
+	return subjects, scanner.Err()
+}
+
+// addFile loads the file, and registers it for the background reload,
+// that is started with the first file.
+func (s *SubjectListSpec) addFile(path string) error {
+	subjects, err := readSubjects(path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[path] = subjects
+	if !s.started {
+		// lazy init background goroutine, such that we have only a goroutine if there is work
+		go s.runRefresher()
+		s.started = true
+	}
+
+	return nil
+}
+
+func (s *SubjectListSpec) runRefresher() {
+	for {
+		select {
+		case <-time.After(s.options.RefreshInterval):
+			s.refresh()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// refresh reloads the subject files. If a file can't be read, the last
+// loaded subjects of the file are kept.
+func (s *SubjectListSpec) refresh() {
+	s.mu.RLock()
+	paths := make([]string, 0, len(s.files))
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	s.mu.RUnlock()
+
+	for _, p := range paths {
+		subjects, err := readSubjects(p)
+		if err != nil {
+			log.Errorf("Failed to reload subjects file %s: %v.", p, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.files[p] = subjects
+		s.mu.Unlock()
+	}
+}
+
+func (s *SubjectListSpec) fileContains(path, sub string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.files[path][sub]
+	return ok
+}
+
+// Close stops the background reload of the subject files.
+func (s *SubjectListSpec) Close() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// CreateFilter accepts one or more subjects, or files with a subject
+// per line prefixed with file:, e.g. file:/etc/skipper/subjects. The
+// files are reloaded periodically.
+func (s *SubjectListSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) == 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &subjectListFilter{spec: s, subjects: make(map[string]struct{})}
+	for _, a := range sargs {
+		if !strings.HasPrefix(a, subjectsFilePrefix) {
+			f.subjects[a] = struct{}{}
+			continue
+		}
+
+		path := strings.TrimPrefix(a, subjectsFilePrefix)
+		if err := s.addFile(path); err != nil {
+			log.Errorf("Failed to read subjects file %s: %v.", path, err)
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.files = append(f.files, path)
+	}
+
+	return f, nil
+}
+
+func (f *subjectListFilter) contains(sub string) bool {
+	if _, ok := f.subjects[sub]; ok {
+		return true
+	}
+
+	for _, p := range f.files {
+		if f.spec.fileContains(p, sub) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *subjectListFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, ctx.Request().Host, "no validated token available for subject validation")
+		return
+	}
+
+	sub, _ := claims[subKey].(string)
+	if sub == "" && f.spec.allow {
+		forbidden(ctx, "", invalidSub, "missing sub claim")
+		return
+	}
+
+	if f.contains(sub) != f.spec.allow {
+		forbidden(ctx, sub, invalidSub, "")
+	}
+}
+
+func (*subjectListFilter) Response(filters.FilterContext) {}
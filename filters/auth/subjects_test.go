@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+)
+
+func TestSubjectList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subjects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "subjects")
+	if err := ioutil.WriteFile(file, []byte("# service accounts\nservice-a\n\n  service-b  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist := NewOAuthSubjectAllowlist(SubjectListOptions{})
+	defer allowlist.Close()
+	denylist := NewOAuthSubjectDenylist(SubjectListOptions{})
+	defer denylist.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		spec     *SubjectListSpec
+		args     []interface{}
+		claims   map[string]interface{}
+		expected int
+	}{{
+		msg:      "no validated token",
+		spec:     allowlist,
+		args:     []interface{}{"service-a"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "allowed subject",
+		spec:     allowlist,
+		args:     []interface{}{"service-a", "service-c"},
+		claims:   map[string]interface{}{"sub": "service-c"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "allowed subject from file",
+		spec:     allowlist,
+		args:     []interface{}{"file:" + file},
+		claims:   map[string]interface{}{"sub": "service-b"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "subject not on the allowlist",
+		spec:     allowlist,
+		args:     []interface{}{"service-a", "file:" + file},
+		claims:   map[string]interface{}{"sub": "service-x"},
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "missing subject with allowlist",
+		spec:     allowlist,
+		args:     []interface{}{"service-a"},
+		claims:   map[string]interface{}{"uid": "service-a"},
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "denied subject from file",
+		spec:     denylist,
+		args:     []interface{}{"file:" + file},
+		claims:   map[string]interface{}{"sub": "service-a"},
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "subject not on the denylist",
+		spec:     denylist,
+		args:     []interface{}{"service-x"},
+		claims:   map[string]interface{}{"sub": "service-a"},
+		expected: http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := ti.spec.CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if status == http.StatusForbidden && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(invalidSub) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestSubjectListReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subjects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "subjects")
+	if err := ioutil.WriteFile(file, []byte("service-a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := NewOAuthSubjectDenylist(SubjectListOptions{})
+	defer spec.Close()
+
+	f, err := spec.CreateFilter([]interface{}{"file:" + file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := func(sub string) bool {
+		ctx := &filtertest.Context{
+			FRequest:  httptest.NewRequest("GET", "/", nil),
+			FStateBag: map[string]interface{}{tokeninfoCacheKey: map[string]interface{}{"sub": sub}},
+		}
+
+		f.Request(ctx)
+		return ctx.FServed
+	}
+
+	if !denied("service-a") || denied("service-b") {
+		t.Fatal("unexpected decision before reload")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("service-b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec.refresh()
+	if denied("service-a") || !denied("service-b") {
+		t.Error("unexpected decision after reload")
+	}
+
+	// the last loaded subjects are kept, when the file is missing
+	os.Remove(file)
+	spec.refresh()
+	if !denied("service-b") {
+		t.Error("subjects lost after failed reload")
+	}
+}
+
+func TestSubjectListCreateFilter(t *testing.T) {
+	spec := NewOAuthSubjectAllowlist(SubjectListOptions{})
+	defer spec.Close()
+
+	for _, args := range [][]interface{}{{}, {1}, {"file:/does/not/exist"}} {
+		if _, err := spec.CreateFilter(args); err != filters.ErrInvalidFilterParameters {
+			t.Errorf("expected invalid parameters error for args %v, got: %v", args, err)
+		}
+	}
+}
@@ -7,15 +7,19 @@ import (
 
 	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/eskip"
 	"github.com/zalando/skipper/filters"
+	logfilter "github.com/zalando/skipper/filters/log"
 )
 
 const (
-	OAuthTokeninfoAnyScopeName = "oauthTokeninfoAnyScope"
-	OAuthTokeninfoAllScopeName = "oauthTokeninfoAllScope"
-	OAuthTokeninfoAnyKVName    = "oauthTokeninfoAnyKV"
-	OAuthTokeninfoAllKVName    = "oauthTokeninfoAllKV"
-	tokeninfoCacheKey          = "tokeninfo"
+	OAuthTokeninfoAnyScopeName   = "oauthTokeninfoAnyScope"
+	OAuthTokeninfoAllScopeName   = "oauthTokeninfoAllScope"
+	OAuthTokeninfoAnyKVName      = "oauthTokeninfoAnyKV"
+	OAuthTokeninfoAllKVName      = "oauthTokeninfoAllKV"
+	OAuthTokeninfoExactScopeName = "oauthTokeninfoExactScope"
+	tokeninfoCacheKey            = "tokeninfo"
+	scopeKeyArgPrefix            = "scopeKey="
 )
 
 type TokeninfoOptions struct {
@@ -23,6 +27,27 @@ type TokeninfoOptions struct {
 	Timeout      time.Duration
 	MaxIdleConns int
 	Tracer       opentracing.Tracer
+
+	// ScopesIgnoreCase enables case-insensitive comparison of
+	// the scopes in the tokeninfo response with the scopes configured
+	// in the filters. Default is exact comparison.
+	ScopesIgnoreCase bool
+
+	// UserKeys is the prioritized list of keys in the tokeninfo
+	// response, whose first available value is logged as the user
+	// of the request. Defaults to "uid".
+	UserKeys []string
+
+	// Breaker configures the circuit breaker around the calls to
+	// the tokeninfo endpoint. Disabled by default.
+	Breaker BreakerOptions
+
+	// Concurrency limits the calls in flight to the tokeninfo
+	// endpoint. Disabled by default.
+	Concurrency ConcurrencyOptions
+
+	// Transport tunes the connections to the tokeninfo endpoint.
+	Transport TransportOptions
 }
 
 type (
@@ -32,10 +57,14 @@ type (
 	}
 
 	tokeninfoFilter struct {
-		typ        roleCheckType
-		authClient *authClient
-		scopes     []string
-		kv         kv
+		typ              roleCheckType
+		authClient       *authClient
+		scopes           []string
+		scopeTemplates   []*eskip.Template
+		scopesIgnoreCase bool
+		scopeKeys        []string
+		userKeys         []string
+		kv               kv
 	}
 )
 
@@ -80,6 +109,24 @@ func NewOAuthTokeninfoAnyScope(OAuthTokeninfoURL string, OAuthTokeninfoTimeout t
 	}
 }
 
+func NewOAuthTokeninfoExactScopeWithOptions(to TokeninfoOptions) filters.Spec {
+	return &tokeninfoSpec{
+		typ:     checkOAuthTokeninfoExactScopes,
+		options: to,
+	}
+}
+
+// NewOAuthTokeninfoExactScope creates a new auth filter specification
+// to validate authorization for requests. Current implementation uses
+// Bearer tokens to authorize requests and checks that the token
+// contains all scopes, and no other scopes.
+func NewOAuthTokeninfoExactScope(OAuthTokeninfoURL string, OAuthTokeninfoTimeout time.Duration) filters.Spec {
+	return NewOAuthTokeninfoExactScopeWithOptions(TokeninfoOptions{
+		URL:     OAuthTokeninfoURL,
+		Timeout: OAuthTokeninfoTimeout,
+	})
+}
+
 func NewOAuthTokeninfoAllKVWithOptions(to TokeninfoOptions) filters.Spec {
 	return &tokeninfoSpec{
 		typ:     checkOAuthTokeninfoAllKV,
@@ -128,8 +175,8 @@ func NewOAuthTokeninfoAnyKV(OAuthTokeninfoURL string, OAuthTokeninfoTimeout time
 //
 // Use one of the base initializer functions as the first argument:
 // NewOAuthTokeninfoAllScope, NewOAuthTokeninfoAnyScope,
-// NewOAuthTokeninfoAllKV or NewOAuthTokeninfoAnyKV.
-//
+// NewOAuthTokeninfoExactScope, NewOAuthTokeninfoAllKV or
+// NewOAuthTokeninfoAnyKV.
 func TokeninfoWithOptions(create func(string, time.Duration) filters.Spec, o TokeninfoOptions) filters.Spec {
 	s := create(o.URL, o.Timeout)
 	ts, ok := s.(*tokeninfoSpec)
@@ -147,6 +194,8 @@ func (s *tokeninfoSpec) Name() string {
 		return OAuthTokeninfoAnyScopeName
 	case checkOAuthTokeninfoAllScopes:
 		return OAuthTokeninfoAllScopeName
+	case checkOAuthTokeninfoExactScopes:
+		return OAuthTokeninfoExactScopeName
 	case checkOAuthTokeninfoAnyKV:
 		return OAuthTokeninfoAnyKVName
 	case checkOAuthTokeninfoAllKV:
@@ -162,8 +211,13 @@ func (s *tokeninfoSpec) Name() string {
 // type. The shown example for checkOAuthTokeninfoAllScopes will grant
 // access only to tokens, that have scopes read-x and write-y:
 //
-//     s.CreateFilter("read-x", "write-y")
+//	s.CreateFilter("read-x", "write-y")
 //
+// The scopes are read from the "scope" key of the tokeninfo response,
+// or from the "scp" key, when the response has no "scope". The scope
+// checks accept arguments of the form "scopeKey=<key>" to read the
+// scopes from other keys instead, e.g. "scopeKey=scp". When multiple
+// keys are set, their scopes are merged.
 func (s *tokeninfoSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
 	sargs, err := getStrings(args)
 	if err != nil {
@@ -176,20 +230,52 @@ func (s *tokeninfoSpec) CreateFilter(args []interface{}) (filters.Filter, error)
 	var ac *authClient
 	var ok bool
 	if ac, ok = tokeninfoAuthClient[s.options.URL]; !ok {
-		ac, err = newAuthClient(s.options.URL, tokenInfoSpanName, s.options.Timeout, s.options.MaxIdleConns, s.options.Tracer)
+		ac, err = newAuthClient(s.options.URL, tokenInfoSpanName, s.options.Timeout, s.options.MaxIdleConns, s.options.Tracer, s.options.Transport)
 		if err != nil {
 			return nil, filters.ErrInvalidFilterParameters
 		}
+		ac.breaker = newAuthBreaker(tokenInfoSpanName, s.options.Breaker)
+		ac.inflight = newAuthSemaphore(tokenInfoSpanName, s.options.Concurrency)
 		tokeninfoAuthClient[s.options.URL] = ac
 	}
 
-	f := &tokeninfoFilter{typ: s.typ, authClient: ac, kv: make(map[string][]string)}
+	f := &tokeninfoFilter{
+		typ:              s.typ,
+		authClient:       ac,
+		scopesIgnoreCase: s.options.ScopesIgnoreCase,
+		userKeys:         s.options.UserKeys,
+		kv:               make(map[string][]string),
+	}
+	if len(f.userKeys) == 0 {
+		f.userKeys = []string{uidKey}
+	}
+
 	switch f.typ {
 	// all scopes
 	case checkOAuthTokeninfoAllScopes:
 		fallthrough
+	case checkOAuthTokeninfoExactScopes:
+		fallthrough
 	case checkOAuthTokeninfoAnyScopes:
-		f.scopes = sargs[:]
+		for _, a := range sargs {
+			if strings.HasPrefix(a, scopeKeyArgPrefix) {
+				k := strings.TrimPrefix(a, scopeKeyArgPrefix)
+				if k == "" {
+					return nil, filters.ErrInvalidFilterParameters
+				}
+				f.scopeKeys = append(f.scopeKeys, k)
+			} else if strings.Contains(a, "${") {
+				f.scopeTemplates = append(f.scopeTemplates, eskip.NewTemplate(a))
+			} else {
+				f.scopes = append(f.scopes, a)
+			}
+		}
+		if len(f.scopes) == 0 && len(f.scopeTemplates) == 0 {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+		if f.scopesIgnoreCase {
+			f.scopes = toLower(f.scopes)
+		}
 	// key value pairs
 	case checkOAuthTokeninfoAnyKV:
 		fallthrough
@@ -215,6 +301,8 @@ func (f *tokeninfoFilter) String() string {
 		return fmt.Sprintf("%s(%s)", OAuthTokeninfoAnyScopeName, strings.Join(f.scopes, ","))
 	case checkOAuthTokeninfoAllScopes:
 		return fmt.Sprintf("%s(%s)", OAuthTokeninfoAllScopeName, strings.Join(f.scopes, ","))
+	case checkOAuthTokeninfoExactScopes:
+		return fmt.Sprintf("%s(%s)", OAuthTokeninfoExactScopeName, strings.Join(f.scopes, ","))
 	case checkOAuthTokeninfoAnyKV:
 		return fmt.Sprintf("%s(%s)", OAuthTokeninfoAnyKVName, f.kv)
 	case checkOAuthTokeninfoAllKV:
@@ -223,79 +311,135 @@ func (f *tokeninfoFilter) String() string {
 	return AuthUnknown
 }
 
-func (f *tokeninfoFilter) validateAnyScopes(h map[string]interface{}) bool {
-	if len(f.scopes) == 0 {
-		return true
+// tokenScopes returns the scopes of the tokeninfo response. The scope
+// claim is accepted as an array of strings, or as a single whitespace
+// separated string, as defined in
+// https://tools.ietf.org/html/rfc6749#section-3.3. When the response
+// contains multiple of the scope keys, their scopes are merged. Without
+// scope keys in the filter arguments, the scopes are read from the
+// "scope" key, or from the "scp" key, when the response has no "scope".
+func (f *tokeninfoFilter) tokenScopes(h map[string]interface{}) ([]string, bool) {
+	var (
+		a     []string
+		found bool
+	)
+
+	keys := f.scopeKeys
+	if len(keys) == 0 {
+		keys = []string{scopeKey}
+		if _, ok := h[scopeKey]; !ok {
+			keys = []string{scpKey}
+		}
 	}
 
-	vI, ok := h[scopeKey]
-	if !ok {
-		return false
+	for _, k := range keys {
+		vI, ok := h[k]
+		if !ok {
+			continue
+		}
+
+		var v []string
+		if s, ok := vI.(string); ok {
+			v = strings.Fields(s)
+		} else if v, ok = claimStrings(vI); !ok {
+			return nil, false
+		}
+
+		a = append(a, v...)
+		found = true
 	}
-	v, ok := vI.([]interface{})
-	if !ok {
-		return false
+
+	if !found {
+		return nil, false
 	}
-	var a []string
-	for i := range v {
-		s, ok := v[i].(string)
-		if !ok {
-			return false
+
+	if f.scopesIgnoreCase {
+		a = toLower(a)
+	}
+
+	return a, true
+}
+
+// requiredScopes returns the scopes of the filter arguments, together
+// with the scopes resolved from the arguments with placeholders, like
+// ${id} for path parameters or ${request.header.X-Scope} for request
+// headers. A resolved value can contain multiple whitespace separated
+// scopes. It returns false, when a placeholder resolves to no scope, so
+// that an empty dynamic requirement rejects the request.
+func (f *tokeninfoFilter) requiredScopes(ctx filters.FilterContext) ([]string, bool) {
+	if len(f.scopeTemplates) == 0 {
+		return f.scopes, true
+	}
+
+	scopes := append([]string(nil), f.scopes...)
+	for _, t := range f.scopeTemplates {
+		v, ok := t.ApplyRequestContext(ctx)
+		resolved := strings.Fields(v)
+		if !ok || len(resolved) == 0 {
+			return nil, false
 		}
-		a = append(a, s)
+
+		if f.scopesIgnoreCase {
+			resolved = toLower(resolved)
+		}
+
+		scopes = append(scopes, resolved...)
 	}
 
-	return intersect(f.scopes, a)
+	return scopes, true
 }
 
-func (f *tokeninfoFilter) validateAllScopes(h map[string]interface{}) bool {
-	if len(f.scopes) == 0 {
+func (f *tokeninfoFilter) validateAnyScopes(h map[string]interface{}, scopes []string) bool {
+	if len(scopes) == 0 {
 		return true
 	}
 
-	vI, ok := h[scopeKey]
+	a, ok := f.tokenScopes(h)
 	if !ok {
 		return false
 	}
-	v, ok := vI.([]interface{})
+
+	return intersect(scopes, a)
+}
+
+func (f *tokeninfoFilter) validateAllScopes(h map[string]interface{}, scopes []string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+
+	a, ok := f.tokenScopes(h)
 	if !ok {
 		return false
 	}
-	var a []string
-	for i := range v {
-		s, ok := v[i].(string)
-		if !ok {
-			return false
-		}
-		a = append(a, s)
+
+	return all(scopes, a)
+}
+
+// validateExactScopes checks, that the token contains all the
+// scopes, and no other scopes, to reject over-privileged tokens.
+func (f *tokeninfoFilter) validateExactScopes(h map[string]interface{}, scopes []string) bool {
+	a, ok := f.tokenScopes(h)
+	if !ok {
+		return len(scopes) == 0
 	}
 
-	return all(f.scopes, a)
+	return all(scopes, a) && all(a, scopes)
 }
 
 func (f *tokeninfoFilter) validateAnyKV(h map[string]interface{}) bool {
 	for k, v := range f.kv {
-		for _, res := range v {
-			if v2, ok := h[k].(string); ok {
-				if res == v2 {
-					return true
-				}
-			}
+		if v2, ok := claimStringValues(h, k); ok && intersect(v, v2) {
+			return true
 		}
 	}
 	return false
 }
 
 func (f *tokeninfoFilter) validateAllKV(h map[string]interface{}) bool {
-	if len(h) < len(f.kv) {
-		return false
-	}
 	for k, v := range f.kv {
-		for _, res := range v {
-			v2, ok := h[k].(string)
-			if !ok || res != v2 {
-				return false
-			}
+		v2, ok := claimStringValues(h, k)
+		if !ok || !all(v, v2) {
+			return false
 		}
 	}
 	return true
@@ -303,12 +447,14 @@ func (f *tokeninfoFilter) validateAllKV(h map[string]interface{}) bool {
 
 // Request handles authentication based on the defined auth type.
 func (f *tokeninfoFilter) Request(ctx filters.FilterContext) {
-	r := ctx.Request()
+	if authBypassed(ctx) {
+		return
+	}
 
 	var authMap map[string]interface{}
 	authMapTemp, ok := ctx.StateBag()[tokeninfoCacheKey]
 	if !ok {
-		token, ok := getToken(r)
+		token, ok := requestToken(ctx)
 		if !ok || token == "" {
 			unauthorized(ctx, "", missingBearerToken, f.authClient.url.Hostname(), "")
 			return
@@ -316,6 +462,10 @@ func (f *tokeninfoFilter) Request(ctx filters.FilterContext) {
 
 		var err error
 		authMap, err = f.authClient.getTokeninfo(token, ctx)
+		if f.authClient.passes(err) {
+			return
+		}
+
 		if err != nil {
 			reason := authServiceAccess
 			if err == errInvalidToken {
@@ -331,17 +481,39 @@ func (f *tokeninfoFilter) Request(ctx filters.FilterContext) {
 		authMap = authMapTemp.(map[string]interface{})
 	}
 
-	uid, _ := authMap[uidKey].(string) // uid can be empty string, but if not we set the who for auditlogging
+	transformClaims(ctx, authMap)
+
+	uid := claimUser(authMap, f.userKeys) // uid can be empty string, but if not we set the who for auditlogging
+
+	if !dpopBound(ctx, authMap) {
+		unauthorized(ctx, uid, dpopInvalid, f.authClient.url.Hostname(), "key of the DPoP proof is not bound to the access token")
+		return
+	}
 
 	var allowed bool
 	switch f.typ {
-	case checkOAuthTokeninfoAnyScopes:
-		allowed = f.validateAnyScopes(authMap)
-	case checkOAuthTokeninfoAllScopes:
-		allowed = f.validateAllScopes(authMap)
+	case checkOAuthTokeninfoAnyScopes, checkOAuthTokeninfoAllScopes, checkOAuthTokeninfoExactScopes:
+		scopes, ok := f.requiredScopes(ctx)
+		if !ok {
+			forbidden(ctx, uid, invalidScope, "no scopes resolved from the dynamic requirement")
+			return
+		}
+
+		presented, _ := f.tokenScopes(authMap)
+		setAuthDecision(ctx, &logfilter.AuthDecision{RequiredScopes: scopes, PresentedScopes: presented})
+		switch f.typ {
+		case checkOAuthTokeninfoAnyScopes:
+			allowed = f.validateAnyScopes(authMap, scopes)
+		case checkOAuthTokeninfoExactScopes:
+			allowed = f.validateExactScopes(authMap, scopes)
+		default:
+			allowed = f.validateAllScopes(authMap, scopes)
+		}
 	case checkOAuthTokeninfoAnyKV:
+		setAuthDecision(ctx, kvDecision(authMap, f.kv, false))
 		allowed = f.validateAnyKV(authMap)
 	case checkOAuthTokeninfoAllKV:
+		setAuthDecision(ctx, kvDecision(authMap, f.kv, true))
 		allowed = f.validateAllKV(authMap)
 	default:
 		log.Errorf("Wrong tokeninfoFilter type: %s.", f)
@@ -5,11 +5,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/zalando/skipper/eskip"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
 	"github.com/zalando/skipper/proxy/proxytest"
 )
 
@@ -267,6 +270,134 @@ func TestOAuth2Tokeninfo(t *testing.T) {
 	}
 }
 
+func TestOAuth2TokeninfoScopeNormalization(t *testing.T) {
+	for _, ti := range []struct {
+		msg             string
+		typ             roleCheckType
+		caseInsensitive bool
+		scopes          []interface{}
+		tokenScope      interface{}
+		token           map[string]interface{}
+		expected        bool
+	}{{
+		msg:        "space separated scope string",
+		typ:        checkOAuthTokeninfoAllScopes,
+		scopes:     []interface{}{"read", "Write"},
+		tokenScope: " read  Write\t",
+		expected:   true,
+	}, {
+		msg:        "case sensitive by default",
+		typ:        checkOAuthTokeninfoAnyScopes,
+		scopes:     []interface{}{"write"},
+		tokenScope: "read Write",
+		expected:   false,
+	}, {
+		msg:             "case insensitive, scope string",
+		typ:             checkOAuthTokeninfoAnyScopes,
+		caseInsensitive: true,
+		scopes:          []interface{}{"write"},
+		tokenScope:      "read Write",
+		expected:        true,
+	}, {
+		msg:             "case insensitive, scope array",
+		typ:             checkOAuthTokeninfoAllScopes,
+		caseInsensitive: true,
+		scopes:          []interface{}{"READ", "write"},
+		tokenScope:      []interface{}{"read", "Write"},
+		expected:        true,
+	}, {
+		msg:             "case insensitive, missing scope",
+		typ:             checkOAuthTokeninfoAllScopes,
+		caseInsensitive: true,
+		scopes:          []interface{}{"read", "delete"},
+		tokenScope:      "read Write",
+		expected:        false,
+	}, {
+		msg:        "invalid scope type",
+		typ:        checkOAuthTokeninfoAnyScopes,
+		scopes:     []interface{}{"read"},
+		tokenScope: 42.0,
+		expected:   false,
+	}, {
+		msg:      "scp is ignored by default when scope is present",
+		typ:      checkOAuthTokeninfoAnyScopes,
+		scopes:   []interface{}{"read"},
+		token:    map[string]interface{}{"scope": "write", "scp": []interface{}{"read"}},
+		expected: false,
+	}, {
+		msg:      "scp array without scope by default",
+		typ:      checkOAuthTokeninfoAllScopes,
+		scopes:   []interface{}{"User.Read", "Mail.Send"},
+		token:    map[string]interface{}{"scp": []interface{}{"User.Read", "Mail.Send"}},
+		expected: true,
+	}, {
+		msg:      "scp string without scope by default",
+		typ:      checkOAuthTokeninfoAnyScopes,
+		scopes:   []interface{}{"User.Read"},
+		token:    map[string]interface{}{"scp": "User.Read Mail.Send"},
+		expected: true,
+	}, {
+		msg:      "scp array",
+		typ:      checkOAuthTokeninfoAllScopes,
+		scopes:   []interface{}{"scopeKey=scp", "User.Read", "Mail.Send"},
+		token:    map[string]interface{}{"scp": []interface{}{"User.Read", "Mail.Send"}},
+		expected: true,
+	}, {
+		msg:    "scope string and scp array are merged",
+		typ:    checkOAuthTokeninfoAllScopes,
+		scopes: []interface{}{"scopeKey=scope", "scopeKey=scp", "read", "User.Read"},
+		token: map[string]interface{}{
+			"scope": "read write",
+			"scp":   []interface{}{"User.Read"},
+		},
+		expected: true,
+	}, {
+		msg:      "custom scope key",
+		typ:      checkOAuthTokeninfoAnyScopes,
+		scopes:   []interface{}{"scopeKey=permissions", "read"},
+		token:    map[string]interface{}{"permissions": []interface{}{"read"}},
+		expected: true,
+	}, {
+		msg:      "custom scope key ignores the default key",
+		typ:      checkOAuthTokeninfoAnyScopes,
+		scopes:   []interface{}{"scopeKey=permissions", "read"},
+		token:    map[string]interface{}{"scope": "read"},
+		expected: false,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			spec := &tokeninfoSpec{
+				typ: ti.typ,
+				options: TokeninfoOptions{
+					URL:              "http://tokeninfo.example.org",
+					ScopesIgnoreCase: ti.caseInsensitive,
+				},
+			}
+
+			f, err := spec.CreateFilter(ti.scopes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tf := f.(*tokeninfoFilter)
+			h := ti.token
+			if h == nil {
+				h = map[string]interface{}{scopeKey: ti.tokenScope}
+			}
+
+			var allowed bool
+			if ti.typ == checkOAuthTokeninfoAllScopes {
+				allowed = tf.validateAllScopes(h, tf.scopes)
+			} else {
+				allowed = tf.validateAnyScopes(h, tf.scopes)
+			}
+
+			if allowed != ti.expected {
+				t.Errorf("unexpected result: %v != %v", allowed, ti.expected)
+			}
+		})
+	}
+}
+
 func TestOAuth2TokenTimeout(t *testing.T) {
 	for _, ti := range []struct {
 		msg      string
@@ -388,3 +519,288 @@ func BenchmarkOAuthTokeninfoFilter(b *testing.B) {
 		allF[i].Close()
 	}
 }
+
+func TestOAuth2TokeninfoUserKeys(t *testing.T) {
+	for _, ti := range []struct {
+		msg       string
+		userKeys  []string
+		tokeninfo map[string]interface{}
+		expected  string
+	}{{
+		msg:       "default uid",
+		tokeninfo: map[string]interface{}{"uid": "jdoe", "preferred_username": "john"},
+		expected:  "jdoe",
+	}, {
+		msg:       "default without uid",
+		tokeninfo: map[string]interface{}{"preferred_username": "john"},
+		expected:  "",
+	}, {
+		msg:       "uid preferred",
+		userKeys:  []string{"uid", "preferred_username"},
+		tokeninfo: map[string]interface{}{"uid": "jdoe", "preferred_username": "john"},
+		expected:  "jdoe",
+	}, {
+		msg:       "fallback to preferred_username",
+		userKeys:  []string{"uid", "preferred_username"},
+		tokeninfo: map[string]interface{}{"preferred_username": "john"},
+		expected:  "john",
+	}, {
+		msg:       "empty values are skipped",
+		userKeys:  []string{"uid", "email"},
+		tokeninfo: map[string]interface{}{"uid": "", "email": "john@example.org"},
+		expected:  "john@example.org",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			spec := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{
+				URL:      "http://tokeninfo.example.org",
+				UserKeys: ti.userKeys,
+			})
+
+			f, err := spec.CreateFilter([]interface{}{"read"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ti.tokeninfo["scope"] = []interface{}{"read"}
+			ctx := &filtertest.Context{
+				FRequest:  httptest.NewRequest("GET", "/", nil),
+				FStateBag: map[string]interface{}{tokeninfoCacheKey: ti.tokeninfo},
+			}
+
+			f.Request(ctx)
+
+			if ctx.FServed {
+				t.Fatalf("unexpected rejection: %d", ctx.FResponse.StatusCode)
+			}
+
+			if u := ctx.FStateBag[logfilter.AuthUserKey]; u != ti.expected {
+				t.Errorf("unexpected user: %v != %s", u, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokeninfoDynamicScopes(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		allScope bool
+		args     []interface{}
+		params   map[string]string
+		header   string
+		expected int
+	}{{
+		msg:      "scope from path parameter",
+		args:     []interface{}{"${resource}.read"},
+		params:   map[string]string{"resource": "orders"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "scope from path parameter not in token",
+		args:     []interface{}{"${resource}.read"},
+		params:   map[string]string{"resource": "payments"},
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "scopes from request header",
+		allScope: true,
+		args:     []interface{}{"${request.header.X-Required-Scopes}"},
+		header:   "orders.read uid",
+		expected: http.StatusOK,
+	}, {
+		msg:      "scopes from request header not all in token",
+		allScope: true,
+		args:     []interface{}{"${request.header.X-Required-Scopes}"},
+		header:   "orders.read orders.write",
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "static and dynamic scopes",
+		allScope: true,
+		args:     []interface{}{"uid", "${resource}.read"},
+		params:   map[string]string{"resource": "orders"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "empty dynamic requirement rejects",
+		args:     []interface{}{"${request.header.X-Required-Scopes}"},
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "whitespace dynamic requirement rejects",
+		args:     []interface{}{"${request.header.X-Required-Scopes}"},
+		header:   " ",
+		expected: http.StatusForbidden,
+	}, {
+		msg:      "missing path parameter rejects with static scopes",
+		args:     []interface{}{"uid", "${resource}"},
+		expected: http.StatusForbidden,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			o := TokeninfoOptions{URL: "http://tokeninfo.example.org"}
+			spec := NewOAuthTokeninfoAnyScopeWithOptions(o)
+			if ti.allScope {
+				spec = NewOAuthTokeninfoAllScopeWithOptions(o)
+			}
+
+			f, err := spec.CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if ti.header != "" {
+				req.Header.Set("X-Required-Scopes", ti.header)
+			}
+
+			ctx := &filtertest.Context{
+				FRequest: req,
+				FParams:  ti.params,
+				FStateBag: map[string]interface{}{
+					tokeninfoCacheKey: map[string]interface{}{"uid": "jdoe", "scope": []interface{}{"uid", "orders.read"}},
+				},
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokeninfoAuthDecision(t *testing.T) {
+	o := TokeninfoOptions{URL: "http://tokeninfo.example.org"}
+	tokeninfo := map[string]interface{}{"uid": "jdoe", "realm": "users", "scope": []interface{}{"uid"}}
+
+	f, err := NewOAuthTokeninfoAllScopeWithOptions(o).CreateFilter([]interface{}{"uid", "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &filtertest.Context{
+		FRequest:  httptest.NewRequest("GET", "/", nil),
+		FStateBag: map[string]interface{}{tokeninfoCacheKey: tokeninfo},
+	}
+
+	f.Request(ctx)
+
+	d, ok := ctx.FStateBag[logfilter.AuthDecisionKey].(*logfilter.AuthDecision)
+	if !ok {
+		t.Fatal("missing auth decision")
+	}
+
+	if !reflect.DeepEqual(d.RequiredScopes, []string{"uid", "write"}) || !reflect.DeepEqual(d.PresentedScopes, []string{"uid"}) {
+		t.Errorf("unexpected scopes: %+v", d)
+	}
+
+	f, err = NewOAuthTokeninfoAnyKVWithOptions(o).CreateFilter([]interface{}{"realm", "users", "team", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx = &filtertest.Context{
+		FRequest:  httptest.NewRequest("GET", "/", nil),
+		FStateBag: map[string]interface{}{tokeninfoCacheKey: tokeninfo},
+	}
+
+	f.Request(ctx)
+
+	d = ctx.FStateBag[logfilter.AuthDecisionKey].(*logfilter.AuthDecision)
+	if !reflect.DeepEqual(d.RequiredClaims, []string{"realm", "team"}) || !reflect.DeepEqual(d.MatchedClaims, []string{"realm"}) {
+		t.Errorf("unexpected claims: %+v", d)
+	}
+}
+
+func TestOAuth2TokeninfoExactScope(t *testing.T) {
+	var tokenScope interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{uidKey: "jdoe", scopeKey: tokenScope})
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg             string
+		caseInsensitive bool
+		scopes          []interface{}
+		tokenScope      interface{}
+		expected        int
+	}{{
+		msg:        "exact match",
+		scopes:     []interface{}{"read", "write"},
+		tokenScope: []interface{}{"write", "read"},
+		expected:   http.StatusOK,
+	}, {
+		msg:        "exact match with duplicates",
+		scopes:     []interface{}{"read", "write"},
+		tokenScope: "read write read",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "superset",
+		scopes:     []interface{}{"read", "write"},
+		tokenScope: []interface{}{"read", "write", "delete"},
+		expected:   http.StatusForbidden,
+	}, {
+		msg:        "subset",
+		scopes:     []interface{}{"read", "write"},
+		tokenScope: []interface{}{"read"},
+		expected:   http.StatusForbidden,
+	}, {
+		msg:        "no scopes",
+		scopes:     []interface{}{"read"},
+		tokenScope: nil,
+		expected:   http.StatusForbidden,
+	}, {
+		msg:             "case insensitive",
+		caseInsensitive: true,
+		scopes:          []interface{}{"Read"},
+		tokenScope:      "read",
+		expected:        http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			tokenScope = ti.tokenScope
+			spec := NewOAuthTokeninfoExactScopeWithOptions(TokeninfoOptions{
+				URL:              backend.URL,
+				Timeout:          time.Second,
+				ScopesIgnoreCase: ti.caseInsensitive,
+			})
+
+			if spec.Name() != OAuthTokeninfoExactScopeName {
+				t.Errorf("unexpected name: %s", spec.Name())
+			}
+
+			f, err := spec.CreateFilter(ti.scopes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokeninfoFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Fatalf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if status == http.StatusForbidden && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(invalidScope) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestOAuth2TokeninfoScopeKeyArgs(t *testing.T) {
+	spec := NewOAuthTokeninfoAnyScopeWithOptions(TokeninfoOptions{URL: "http://tokeninfo.example.org"})
+	for _, args := range [][]interface{}{{"scopeKey="}, {"scopeKey=scp"}, {"scopeKey=", "read"}} {
+		if _, err := spec.CreateFilter(args); err != filters.ErrInvalidFilterParameters {
+			t.Errorf("expected invalid filter parameters for %v, got: %v", args, err)
+		}
+	}
+}
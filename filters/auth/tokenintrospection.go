@@ -12,6 +12,8 @@ import (
 	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/secrets"
 )
 
 const (
@@ -23,15 +25,116 @@ const (
 	SecureOAuthTokenintrospectionAllClaimsName = "secureOauthTokenintrospectionAllClaims"
 	SecureOAuthTokenintrospectionAnyKVName     = "secureOauthTokenintrospectionAnyKV"
 	SecureOAuthTokenintrospectionAllKVName     = "secureOauthTokenintrospectionAllKV"
+	OAuthTokenintrospectionHybridName          = "oauthTokenintrospectionHybrid"
+	SecureOAuthTokenintrospectionHybridName    = "secureOauthTokenintrospectionHybrid"
 
-	tokenintrospectionCacheKey   = "tokenintrospection"
-	TokenIntrospectionConfigPath = "/.well-known/openid-configuration"
+	tokenintrospectionCacheKey    = "tokenintrospection"
+	tokenintrospectionEndpointKey = "tokenintrospection.endpoint"
+	TokenIntrospectionConfigPath  = "/.well-known/openid-configuration"
+
+	negativeCacheHitMetricsKey = "auth.tokenintrospection.negative_cache.hit"
+
+	// maxNegativeCacheTTL limits how long a token stays rejected,
+	// that may have been reissued in the meantime
+	maxNegativeCacheTTL      = time.Minute
+	defaultNegativeCacheSize = 10000
+)
+
+const (
+	// IntrospectionTokenBody sends the token in the form body of the
+	// introspection request, as defined by RFC 7662.
+	IntrospectionTokenBody = "body"
+
+	// IntrospectionTokenQuery sends the token as query parameter of
+	// the introspection request.
+	IntrospectionTokenQuery = "query"
+
+	// ClientSecretBasic sends the client credentials of the secure
+	// filters as Basic auth, see
+	// https://tools.ietf.org/html/rfc6749#section-2.3.1.
+	ClientSecretBasic = "client_secret_basic"
+
+	// ClientSecretPost sends the client credentials of the secure
+	// filters as client_id and client_secret in the form body.
+	ClientSecretPost = "client_secret_post"
 )
 
 type TokenintrospectionOptions struct {
 	Timeout      time.Duration
 	Tracer       opentracing.Tracer
 	MaxIdleConns int
+
+	// Breaker configures the circuit breaker around the calls to
+	// the introspection endpoint. Disabled by default.
+	Breaker BreakerOptions
+
+	// Concurrency limits the calls in flight to each introspection
+	// endpoint. Disabled by default.
+	Concurrency ConcurrencyOptions
+
+	// Transport tunes the connections to the introspection endpoint.
+	Transport TransportOptions
+
+	// ActiveField is the field of the introspection response, that
+	// tells whether the token is active, for endpoints, that don't
+	// comply with RFC 7662, e.g. "valid". Defaults to "active".
+	ActiveField string
+
+	// ActiveValues are the values of ActiveField, that mark the
+	// token active, compared with the string representation of the
+	// field, e.g. "true" matches the boolean true and the string
+	// "true". By default, the field has to be the boolean true.
+	ActiveValues []string
+
+	// TokenStyle defines how the token is sent to the introspection
+	// endpoint, IntrospectionTokenBody or IntrospectionTokenQuery.
+	// Defaults to IntrospectionTokenBody.
+	TokenStyle string
+
+	// CredentialStyle defines how the secure filters send the client
+	// credentials, ClientSecretBasic or ClientSecretPost. Defaults to
+	// ClientSecretBasic.
+	CredentialStyle string
+
+	// NegativeCacheTTL enables caching the tokens, that the
+	// introspection endpoint reported inactive, so that repeated
+	// presentations are rejected without calling the endpoint. It
+	// should be a few seconds, and it is limited to one minute.
+	// Disabled by default.
+	NegativeCacheTTL time.Duration
+
+	// NegativeCacheSize limits the number of cached invalid tokens.
+	// Defaults to 10000.
+	NegativeCacheSize int
+
+	// ClientSecretFile is the path to the file containing the client
+	// secret of the secure filters, used when the filter doesn't set
+	// the secret. The file is reloaded by the SecretsProvider, so
+	// rotated secrets are used without restart.
+	ClientSecretFile string
+
+	// SecretsProvider reads the ClientSecretFile. Required, when
+	// ClientSecretFile is set.
+	SecretsProvider secrets.SecretsProvider
+
+	// ClaimsPath is the dot separated path of the object in the
+	// introspection response, that contains the claims, for
+	// endpoints, that wrap them, e.g. "data" or "result.token". The
+	// checks of the filters and the following filters see this
+	// object as the introspection response, and the claims filters
+	// check the claims in this object, instead of its "claims" field. When the object doesn't
+	// contain the ActiveField, it is taken from the top-level of the
+	// response. Defaults to the top-level, as defined by RFC 7662.
+	ClaimsPath string
+
+	// JWKS bounds the fetches of the keys, that the hybrid filters
+	// use to validate the tokens locally.
+	JWKS JWKSOptions
+
+	// Freshness re-validates a sample of the tokens, that the hybrid
+	// filters validated locally, against the introspection endpoint,
+	// to reject the revoked tokens before they expire.
+	Freshness FreshnessOptions
 }
 
 type (
@@ -44,10 +147,20 @@ type (
 	tokenIntrospectionInfo map[string]interface{}
 
 	tokenintrospectFilter struct {
-		typ        roleCheckType
-		authClient *authClient
-		claims     []string
-		kv         kv
+		typ          roleCheckType
+		authClients  []*authClient
+		claims       []string
+		kv           kv
+		activeField  string
+		activeValues []string
+		claimsPath   string
+		invalid      *negativeCache
+
+		// the keys of the issuer, the JWTs signed with them are
+		// validated without introspection, only used in hybrid mode
+		issuer string
+		keys   *jwksKeySet
+		fresh  *freshnessTracker
 	}
 
 	openIDConfig struct {
@@ -69,7 +182,25 @@ type (
 	}
 )
 
-var issuerAuthClient map[string]*authClient = make(map[string]*authClient)
+// introspectionClientKey identifies the auth clients, that can be
+// shared by the filters. The clients are not changed after they were
+// created, so the filters with different credentials or options of the
+// same issuer use different clients.
+type introspectionClientKey struct {
+	issuer          string
+	clientID        string
+	clientSecret    string
+	secretFile      string
+	timeout         time.Duration
+	maxIdleConns    int
+	tokenStyle      string
+	credentialStyle string
+	breaker         BreakerOptions
+	concurrency     ConcurrencyOptions
+	transport       TransportOptions
+}
+
+var issuerAuthClient = make(map[introspectionClientKey]*authClient)
 
 // Active returns token introspection response, which is true if token
 // is not revoked and in the time frame of
@@ -78,6 +209,32 @@ func (tii tokenIntrospectionInfo) Active() bool {
 	return tii.getBoolValue("active")
 }
 
+// isActive is like Active, but checks the field, and when values are
+// provided, matches the string representation of the field with them.
+func (tii tokenIntrospectionInfo) isActive(field string, values []string) bool {
+	if field == "" {
+		field = "active"
+	}
+
+	if len(values) == 0 {
+		return tii.getBoolValue(field)
+	}
+
+	v, ok := tii[field]
+	if !ok || v == nil {
+		return false
+	}
+
+	s := fmt.Sprint(v)
+	for _, av := range values {
+		if s == av {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (tii tokenIntrospectionInfo) Sub() (string, error) {
 	return tii.getStringValue("sub")
 }
@@ -157,6 +314,28 @@ func NewSecureOAuthTokenintrospectionAllClaims(timeout time.Duration) filters.Sp
 	return newSecureOAuthTokenintrospectionFilter(checkSecureOAuthTokenintrospectionAllClaims, timeout)
 }
 
+// NewOAuthTokenintrospectionHybrid creates a filter spec, which
+// validates the JWTs signed with a known key of the issuer locally,
+// with the keys from the jwks_uri of the openid configuration, and
+// the other tokens, e.g. opaque tokens, with the introspection
+// endpoint. The claims are stored like the introspection response,
+// so the following oauthTokenintrospection* filters check the claims
+// of both kinds of tokens without calling the endpoint again.
+//
+// Example:
+//
+//	oauthTokenintrospectionHybrid("https://idp.example.org") -> oauthTokenintrospectionAnyKV("https://idp.example.org", "realm", "/employees") -> "https://internal.example.org";
+func NewOAuthTokenintrospectionHybrid(timeout time.Duration) filters.Spec {
+	return newOAuthTokenintrospectionFilter(checkOAuthTokenintrospectionHybrid, timeout)
+}
+
+// NewSecureOAuthTokenintrospectionHybrid is like
+// NewOAuthTokenintrospectionHybrid, but it calls the introspection
+// endpoint with client credentials.
+func NewSecureOAuthTokenintrospectionHybrid(timeout time.Duration) filters.Spec {
+	return newSecureOAuthTokenintrospectionFilter(checkSecureOAuthTokenintrospectionHybrid, timeout)
+}
+
 // TokenintrospectionWithOptions create a new auth filter specification
 // for validating authorization requests with additional options to the
 // mandatory timeout parameter.
@@ -166,6 +345,7 @@ func NewSecureOAuthTokenintrospectionAllClaims(timeout time.Duration) filters.Sp
 // NewOAuthTokenintrospectionAnyClaims, NewOAuthTokenintrospectionAllClaims,
 // NewSecureOAuthTokenintrospectionAnyKV, NewSecureOAuthTokenintrospectionAllKV,
 // NewSecureOAuthTokenintrospectionAnyClaims, NewSecureOAuthTokenintrospectionAllClaims,
+// NewOAuthTokenintrospectionHybrid, NewSecureOAuthTokenintrospectionHybrid,
 // pass opentracing.Tracer and other options in TokenintrospectionOptions.
 func TokenintrospectionWithOptions(
 	create func(time.Duration) filters.Spec,
@@ -242,6 +422,10 @@ func (s *tokenIntrospectionSpec) Name() string {
 		return SecureOAuthTokenintrospectionAnyKVName
 	case checkSecureOAuthTokenintrospectionAllKV:
 		return SecureOAuthTokenintrospectionAllKVName
+	case checkOAuthTokenintrospectionHybrid:
+		return OAuthTokenintrospectionHybridName
+	case checkSecureOAuthTokenintrospectionHybrid:
+		return SecureOAuthTokenintrospectionHybridName
 	}
 	return AuthUnknown
 }
@@ -251,13 +435,35 @@ func (s *tokenIntrospectionSpec) CreateFilter(args []interface{}) (filters.Filte
 	if err != nil {
 		return nil, err
 	}
-	if s.secure && len(sargs) < 4 || !s.secure && len(sargs) < 2 {
+	minArgs := 2
+	if s.secure {
+		minArgs = 4
+	}
+
+	// the hybrid filters don't accept claims
+	if s.typ == checkOAuthTokenintrospectionHybrid || s.typ == checkSecureOAuthTokenintrospectionHybrid {
+		minArgs--
+	}
+
+	if len(sargs) < minArgs {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	switch s.options.TokenStyle {
+	case "", IntrospectionTokenBody, IntrospectionTokenQuery:
+	default:
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	switch s.options.CredentialStyle {
+	case "", ClientSecretBasic, ClientSecretPost:
+	default:
 		return nil, filters.ErrInvalidFilterParameters
 	}
 
 	issuerURL := sargs[0]
 
-	var clientId, clientSecret string
+	var clientId, clientSecret, secretFile string
 
 	if s.secure {
 		clientId = sargs[1]
@@ -267,39 +473,104 @@ func (s *tokenIntrospectionSpec) CreateFilter(args []interface{}) (filters.Filte
 			clientId, _ = os.LookupEnv("OAUTH_CLIENT_ID")
 		}
 
-		if clientSecret == "" {
+		if clientSecret == "" && s.options.ClientSecretFile != "" {
+			if s.options.SecretsProvider == nil {
+				return nil, filters.ErrInvalidFilterParameters
+			}
+
+			// the secret is read on every request, the error is
+			// logged by the provider, and the file may be created later
+			s.options.SecretsProvider.Add(s.options.ClientSecretFile)
+			secretFile = s.options.ClientSecretFile
+		} else if clientSecret == "" {
 			clientSecret, _ = os.LookupEnv("OAUTH_CLIENT_SECRET")
 		}
 	} else {
 		sargs = sargs[1:]
 	}
 
-	cfg, err := getOpenIDConfig(issuerURL)
-	if err != nil {
-		return nil, err
+	var cfg *openIDConfig
+	f := &tokenintrospectFilter{
+		typ:          s.typ,
+		kv:           make(map[string][]string),
+		activeField:  s.options.ActiveField,
+		activeValues: s.options.ActiveValues,
+		claimsPath:   s.options.ClaimsPath,
 	}
 
-	var ac *authClient
-	var ok bool
-	if ac, ok = issuerAuthClient[issuerURL]; !ok {
-		ac, err = newAuthClient(cfg.IntrospectionEndpoint, tokenIntrospectionSpanName, s.options.Timeout, s.options.MaxIdleConns, s.options.Tracer)
-		if err != nil {
-			return nil, filters.ErrInvalidFilterParameters
+	if ttl := s.options.NegativeCacheTTL; ttl > 0 {
+		if ttl > maxNegativeCacheTTL {
+			log.Warnf("Negative cache TTL of the tokenintrospection filters %v is limited to %v.", ttl, maxNegativeCacheTTL)
+			ttl = maxNegativeCacheTTL
+		}
+
+		size := s.options.NegativeCacheSize
+		if size <= 0 {
+			size = defaultNegativeCacheSize
 		}
-		issuerAuthClient[issuerURL] = ac
+
+		f.invalid = newNegativeCache(ttl, size)
 	}
 
-	if s.secure && clientId != "" && clientSecret != "" {
-		ac.url.User = url.UserPassword(clientId, clientSecret)
-	} else {
-		ac.url.User = nil
+	for _, issuerURL := range strings.Split(issuerURL, ",") {
+		issuerURL = strings.TrimSpace(issuerURL)
+		var icfg *openIDConfig
+		icfg, err = getOpenIDConfig(issuerURL)
+		if err != nil {
+			log.Errorf("Failed to get the openid configuration of %s: %v.", issuerURL, err)
+			continue
+		}
+
+		key := introspectionClientKey{
+			issuer:          issuerURL,
+			timeout:         s.options.Timeout,
+			maxIdleConns:    s.options.MaxIdleConns,
+			tokenStyle:      s.options.TokenStyle,
+			credentialStyle: s.options.CredentialStyle,
+			breaker:         s.options.Breaker,
+			concurrency:     s.options.Concurrency,
+			transport:       s.options.Transport,
+		}
+
+		if s.secure && clientId != "" && secretFile != "" {
+			key.clientID, key.secretFile = clientId, secretFile
+		} else if s.secure && clientId != "" && clientSecret != "" {
+			key.clientID, key.clientSecret = clientId, clientSecret
+		}
+
+		ac, ok := issuerAuthClient[key]
+		if !ok {
+			ac, err = newAuthClient(icfg.IntrospectionEndpoint, tokenIntrospectionSpanName, s.options.Timeout, s.options.MaxIdleConns, s.options.Tracer, s.options.Transport)
+			if err != nil {
+				return nil, filters.ErrInvalidFilterParameters
+			}
+			ac.breaker = newAuthBreaker(tokenIntrospectionSpanName, s.options.Breaker)
+			ac.inflight = newAuthSemaphore(tokenIntrospectionSpanName, s.options.Concurrency)
+			ac.tokenInQuery = s.options.TokenStyle == IntrospectionTokenQuery
+			ac.clientSecretPost = s.options.CredentialStyle == ClientSecretPost
+			if key.secretFile != "" {
+				ac.url.User = url.User(key.clientID)
+				ac.secrets, ac.secretFile = s.options.SecretsProvider, key.secretFile
+			} else if key.clientSecret != "" {
+				ac.url.User = url.UserPassword(key.clientID, key.clientSecret)
+			} else {
+				ac.url.User = nil
+			}
+
+			issuerAuthClient[key] = ac
+		}
+
+		if cfg == nil {
+			cfg = icfg
+		}
+
+		f.authClients = append(f.authClients, ac)
 	}
 
-	f := &tokenintrospectFilter{
-		typ:        s.typ,
-		authClient: ac,
-		kv:         make(map[string][]string),
+	if cfg == nil {
+		return nil, err
 	}
+
 	switch f.typ {
 	case checkOAuthTokenintrospectionAllClaims:
 		fallthrough
@@ -327,6 +598,14 @@ func (s *tokenIntrospectionSpec) CreateFilter(args []interface{}) (filters.Filte
 		if len(sargs) == 0 || len(sargs)%2 != 0 {
 			return nil, filters.ErrInvalidFilterParameters
 		}
+	case checkOAuthTokenintrospectionHybrid, checkSecureOAuthTokenintrospectionHybrid:
+		if len(sargs) != 0 || cfg.JwksURI == "" {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.issuer = cfg.Issuer
+		f.keys = getJWKSKeySet(cfg.Issuer, cfg.JwksURI, s.options.JWKS)
+		f.fresh = newFreshnessTracker(s.options.Freshness)
 	default:
 		return nil, filters.ErrInvalidFilterParameters
 	}
@@ -354,14 +633,30 @@ func (f *tokenintrospectFilter) String() string {
 		return fmt.Sprintf("%s(%s)", SecureOAuthTokenintrospectionAnyKVName, f.kv)
 	case checkSecureOAuthTokenintrospectionAllKV:
 		return fmt.Sprintf("%s(%s)", SecureOAuthTokenintrospectionAllKVName, f.kv)
+	case checkOAuthTokenintrospectionHybrid:
+		return fmt.Sprintf("%s(%s)", OAuthTokenintrospectionHybridName, f.issuer)
+	case checkSecureOAuthTokenintrospectionHybrid:
+		return fmt.Sprintf("%s(%s)", SecureOAuthTokenintrospectionHybridName, f.issuer)
 	}
 	return AuthUnknown
 }
 
+// tokenClaims returns the claims of the introspection response. With
+// a claims path, the object at the path contains the claims, otherwise
+// the "claims" field of the response.
+func (f *tokenintrospectFilter) tokenClaims(info tokenIntrospectionInfo) (map[string]interface{}, bool) {
+	if f.claimsPath != "" {
+		return map[string]interface{}(info), info != nil
+	}
+
+	claims, ok := info["claims"].(map[string]interface{})
+	return claims, ok
+}
+
 func (f *tokenintrospectFilter) validateAnyClaims(info tokenIntrospectionInfo) bool {
 	for _, wantedClaim := range f.claims {
-		if claims, ok := info["claims"].(map[string]interface{}); ok {
-			if _, ok2 := claims[wantedClaim]; ok2 {
+		if claims, ok := f.tokenClaims(info); ok {
+			if _, ok2 := claimValue(claims, wantedClaim); ok2 {
 				return true
 			}
 		}
@@ -371,10 +666,10 @@ func (f *tokenintrospectFilter) validateAnyClaims(info tokenIntrospectionInfo) b
 
 func (f *tokenintrospectFilter) validateAllClaims(info tokenIntrospectionInfo) bool {
 	for _, v := range f.claims {
-		if claims, ok := info["claims"].(map[string]interface{}); !ok {
+		if claims, ok := f.tokenClaims(info); !ok {
 			return false
 		} else {
-			if _, ok := claims[v]; !ok {
+			if _, ok := claimValue(claims, v); !ok {
 				return false
 			}
 		}
@@ -384,11 +679,9 @@ func (f *tokenintrospectFilter) validateAllClaims(info tokenIntrospectionInfo) b
 
 func (f *tokenintrospectFilter) validateAllKV(info tokenIntrospectionInfo) bool {
 	for k, v := range f.kv {
-		for _, res := range v {
-			v2, ok := info[k].(string)
-			if !ok || res != v2 {
-				return false
-			}
+		v2, ok := claimStringValues(info, k)
+		if !ok || !all(v, v2) {
+			return false
 		}
 	}
 	return true
@@ -396,76 +689,198 @@ func (f *tokenintrospectFilter) validateAllKV(info tokenIntrospectionInfo) bool
 
 func (f *tokenintrospectFilter) validateAnyKV(info tokenIntrospectionInfo) bool {
 	for k, v := range f.kv {
-		for _, res := range v {
-			v2, ok := info[k].(string)
-			if ok && res == v2 {
-				return true
-			}
+		if v2, ok := claimStringValues(info, k); ok && intersect(v, v2) {
+			return true
 		}
 	}
 	return false
 }
 
+// introspect calls the introspection endpoints in order, and returns
+// the response of the first one, that is available. Endpoints with an
+// open circuit breaker, failed connections or server errors are
+// skipped.
+func (f *tokenintrospectFilter) introspect(token string, ctx filters.FilterContext) (tokenIntrospectionInfo, *authClient, error) {
+	var (
+		ac   *authClient
+		info tokenIntrospectionInfo
+		err  error
+	)
+
+	for _, ac = range f.authClients {
+		info, err = ac.getTokenintrospect(token, ctx)
+		if err == nil {
+			break
+		}
+
+		if err != errAuthServiceUnavailable {
+			log.Errorf("Error while calling token introspection %s: %v.", ac.url.Hostname(), err)
+		}
+	}
+
+	return info, ac, err
+}
+
+// claimsRoot returns the object at the claims path of the
+// introspection response. The active field is copied from the
+// top-level, when the object doesn't contain it.
+func (f *tokenintrospectFilter) claimsRoot(info tokenIntrospectionInfo) (tokenIntrospectionInfo, bool) {
+	if f.claimsPath == "" {
+		return info, true
+	}
+
+	v, ok := lookupClaimPath(map[string]interface{}(info), strings.Split(f.claimsPath, "."))
+	if !ok {
+		return nil, false
+	}
+
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	activeField := f.activeField
+	if activeField == "" {
+		activeField = "active"
+	}
+
+	if _, ok := root[activeField]; !ok {
+		if active, ok := info[activeField]; ok {
+			root[activeField] = active
+		}
+	}
+
+	return tokenIntrospectionInfo(root), true
+}
+
 func (f *tokenintrospectFilter) Request(ctx filters.FilterContext) {
-	r := ctx.Request()
+	if authBypassed(ctx) {
+		return
+	}
+
+	host := f.authClients[0].url.Hostname()
+
+	var (
+		info     tokenIntrospectionInfo
+		token    string
+		localJWT bool
+	)
 
-	var info tokenIntrospectionInfo
 	infoTemp, ok := ctx.StateBag()[tokenintrospectionCacheKey]
 	if !ok {
-		token, ok := getToken(r)
+		token, ok = requestToken(ctx)
 		if !ok || token == "" {
-			unauthorized(ctx, "", missingToken, f.authClient.url.Hostname(), "")
+			unauthorized(ctx, "", missingToken, host, "")
 			return
 		}
 
-		var err error
-		info, err = f.authClient.getTokenintrospect(token, ctx)
-		if err != nil {
-			reason := authServiceAccess
-			if err == errInvalidToken {
-				reason = invalidToken
-			} else {
-				log.Errorf("Error while calling token introspection: %v.", err)
+		if reason, ok := f.invalid.get(token, time.Now()); ok {
+			metrics.Default.IncCounter(negativeCacheHitMetricsKey)
+			unauthorized(ctx, "", reason, host, "")
+			return
+		}
+
+		var reason rejectReason
+		info, localJWT, reason = f.validateJWT(ctx, token)
+		if localJWT && reason != "" {
+			// the invalid signatures may be caused by a key
+			// rotation, only the inactive tokens are cached
+			if reason == inactiveToken {
+				f.invalid.set(token, reason, time.Now())
 			}
 
-			unauthorized(ctx, "", reason, f.authClient.url.Hostname(), "")
+			unauthorized(ctx, "", reason, host, "")
 			return
 		}
+
+		if localJWT && f.fresh.due(token, time.Now()) {
+			if h, reason := f.revalidate(ctx, token); reason != "" {
+				unauthorized(ctx, "", reason, h, "revoked before expiry")
+				return
+			}
+		}
+
+		if !localJWT {
+			var (
+				ac  *authClient
+				err error
+			)
+
+			info, ac, err = f.introspect(token, ctx)
+			if ac.passes(err) {
+				return
+			}
+
+			host = ac.url.Hostname()
+			ctx.StateBag()[tokenintrospectionEndpointKey] = host
+			// only the inactive tokens are cached, the errors
+			// don't tell that the token is invalid
+			if err != nil {
+				unauthorized(ctx, "", authServiceAccess, host, "")
+				return
+			}
+
+			info, ok = f.claimsRoot(info)
+			if !ok {
+				unauthorized(ctx, "", invalidToken, host, "claims not found in the introspection response")
+				return
+			}
+		}
 	} else {
 		info = infoTemp.(tokenIntrospectionInfo)
 	}
 
+	transformClaims(ctx, info)
+
 	sub, err := info.Sub()
 	if err != nil {
 		if err != errInvalidTokenintrospectionData {
 			log.Errorf("Error while reading token: %v.", err)
 		}
 
-		unauthorized(ctx, sub, invalidSub, f.authClient.url.Hostname(), "")
+		unauthorized(ctx, sub, invalidSub, host, "")
+		return
+	}
+
+	// the locally validated JWTs are active, the configured active
+	// field applies only to the introspection responses
+	if !localJWT && !info.isActive(f.activeField, f.activeValues) {
+		if token != "" {
+			f.invalid.set(token, inactiveToken, time.Now())
+		}
+
+		unauthorized(ctx, sub, inactiveToken, host, "")
 		return
 	}
 
-	if !info.Active() {
-		unauthorized(ctx, sub, inactiveToken, f.authClient.url.Hostname(), "")
+	if !dpopBound(ctx, info) {
+		unauthorized(ctx, sub, dpopInvalid, host, "key of the DPoP proof is not bound to the access token")
 		return
 	}
 
 	var allowed bool
+	claims, _ := f.tokenClaims(info)
 	switch f.typ {
 	case checkOAuthTokenintrospectionAnyClaims, checkSecureOAuthTokenintrospectionAnyClaims:
+		setAuthDecision(ctx, claimsDecision(claims, f.claims))
 		allowed = f.validateAnyClaims(info)
 	case checkOAuthTokenintrospectionAnyKV, checkSecureOAuthTokenintrospectionAnyKV:
+		setAuthDecision(ctx, kvDecision(info, f.kv, false))
 		allowed = f.validateAnyKV(info)
 	case checkOAuthTokenintrospectionAllClaims, checkSecureOAuthTokenintrospectionAllClaims:
+		setAuthDecision(ctx, claimsDecision(claims, f.claims))
 		allowed = f.validateAllClaims(info)
 	case checkOAuthTokenintrospectionAllKV, checkSecureOAuthTokenintrospectionAllKV:
+		setAuthDecision(ctx, kvDecision(info, f.kv, true))
 		allowed = f.validateAllKV(info)
+	case checkOAuthTokenintrospectionHybrid, checkSecureOAuthTokenintrospectionHybrid:
+		allowed = true
 	default:
 		log.Errorf("Wrong tokenintrospectionFilter type: %s.", f)
 	}
 
 	if !allowed {
-		unauthorized(ctx, sub, invalidClaim, f.authClient.url.Hostname(), "")
+		unauthorized(ctx, sub, invalidClaim, host, "")
 		return
 	}
 
@@ -477,5 +892,7 @@ func (f *tokenintrospectFilter) Response(filters.FilterContext) {}
 
 // Close cleans-up the authClient
 func (f *tokenintrospectFilter) Close() {
-	f.authClient.Close()
+	for _, ac := range f.authClients {
+		ac.Close()
+	}
 }
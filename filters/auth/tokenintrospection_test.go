@@ -1,18 +1,26 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zalando/skipper/eskip"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
 	"github.com/zalando/skipper/net"
 	"github.com/zalando/skipper/proxy/proxytest"
+	"github.com/zalando/skipper/secrets"
 )
 
 func introspectionEndpointGetToken(r *http.Request) (string, error) {
@@ -718,3 +726,825 @@ func Test_validateAllClaims(t *testing.T) {
 		})
 	}
 }
+
+func Test_validateNestedKV(t *testing.T) {
+	info := tokenIntrospectionInfo{
+		"sub": "jdoe",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin", "user"},
+		},
+		"groups": []interface{}{
+			map[string]interface{}{"name": "g1"},
+			map[string]interface{}{"name": "g2"},
+		},
+	}
+
+	for _, ti := range []struct {
+		msg         string
+		kv          kv
+		expectedAll bool
+		expectedAny bool
+	}{{
+		msg:         "nested array contains value",
+		kv:          kv{"realm_access.roles": []string{"admin"}},
+		expectedAll: true,
+		expectedAny: true,
+	}, {
+		msg:         "nested array contains all values",
+		kv:          kv{"realm_access.roles": []string{"admin", "user"}},
+		expectedAll: true,
+		expectedAny: true,
+	}, {
+		msg:         "nested array contains one of the values",
+		kv:          kv{"realm_access.roles": []string{"admin", "other"}},
+		expectedAll: false,
+		expectedAny: true,
+	}, {
+		msg:         "array of objects",
+		kv:          kv{"groups.name": []string{"g2"}},
+		expectedAll: true,
+		expectedAny: true,
+	}, {
+		msg:         "missing intermediate key",
+		kv:          kv{"resource_access.roles": []string{"admin"}},
+		expectedAll: false,
+		expectedAny: false,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f := &tokenintrospectFilter{kv: ti.kv}
+			if f.validateAllKV(info) != ti.expectedAll {
+				t.Error("failed to validate all kv")
+			}
+
+			if f.validateAnyKV(info) != ti.expectedAny {
+				t.Error("failed to validate any kv")
+			}
+		})
+	}
+}
+
+func TestTokenintrospectionActiveField(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		info     tokenIntrospectionInfo
+		field    string
+		values   []string
+		expected bool
+	}{{
+		msg:      "standard active field",
+		info:     tokenIntrospectionInfo{"active": true},
+		expected: true,
+	}, {
+		msg:      "standard inactive field",
+		info:     tokenIntrospectionInfo{"active": false},
+		expected: false,
+	}, {
+		msg:      "standard field requires a boolean",
+		info:     tokenIntrospectionInfo{"active": "true"},
+		expected: false,
+	}, {
+		msg:      "missing field",
+		info:     tokenIntrospectionInfo{"valid": true},
+		expected: false,
+	}, {
+		msg:      "custom boolean field",
+		info:     tokenIntrospectionInfo{"valid": true},
+		field:    "valid",
+		expected: true,
+	}, {
+		msg:      "custom string true",
+		info:     tokenIntrospectionInfo{"valid": "true"},
+		field:    "valid",
+		values:   []string{"true"},
+		expected: true,
+	}, {
+		msg:      "custom value matches boolean true",
+		info:     tokenIntrospectionInfo{"valid": true},
+		field:    "valid",
+		values:   []string{"true"},
+		expected: true,
+	}, {
+		msg:      "custom value with boolean false",
+		info:     tokenIntrospectionInfo{"valid": false},
+		field:    "valid",
+		values:   []string{"true"},
+		expected: false,
+	}, {
+		msg:      "custom status value",
+		info:     tokenIntrospectionInfo{"status": "valid"},
+		field:    "status",
+		values:   []string{"active", "valid"},
+		expected: true,
+	}, {
+		msg:      "custom status value mismatch",
+		info:     tokenIntrospectionInfo{"status": "revoked"},
+		field:    "status",
+		values:   []string{"active", "valid"},
+		expected: false,
+	}, {
+		msg:      "custom field absent",
+		info:     tokenIntrospectionInfo{"active": true},
+		field:    "status",
+		values:   []string{"valid"},
+		expected: false,
+	}, {
+		msg:      "custom field null",
+		info:     tokenIntrospectionInfo{"status": nil},
+		field:    "status",
+		values:   []string{"<nil>"},
+		expected: false,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			if got := ti.info.isActive(ti.field, ti.values); got != ti.expected {
+				t.Errorf("unexpected active: %v != %v", got, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionFailover(t *testing.T) {
+	newIdP := func(status int, users chan<- string) *httptest.Server {
+		var s *httptest.Server
+		s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == TokenIntrospectionConfigPath {
+				cfg := getTestOidcConfig()
+				cfg.Issuer = s.URL
+				cfg.IntrospectionEndpoint = s.URL + testAuthPath
+				json.NewEncoder(w).Encode(cfg)
+				return
+			}
+
+			user, _, _ := r.BasicAuth()
+			users <- user
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+
+			json.NewEncoder(w).Encode(tokenIntrospectionInfo{
+				"sub":    "testSub",
+				"active": true,
+				"claims": map[string]string{validClaim1: validClaim1Value},
+			})
+		}))
+
+		return s
+	}
+
+	users := make(chan string, 2)
+	failing := newIdP(http.StatusServiceUnavailable, users)
+	defer failing.Close()
+	working := newIdP(http.StatusOK, users)
+	defer working.Close()
+
+	spec := NewSecureOAuthTokenintrospectionAnyClaims(time.Second)
+	f, err := spec.CreateFilter([]interface{}{failing.URL + ", " + working.URL, "client-id", "client-secret", validClaim1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*tokenintrospectFilter).Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+	ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+	f.Request(ctx)
+
+	if ctx.FServed {
+		t.Fatalf("unexpected response: %d", ctx.FResponse.StatusCode)
+	}
+
+	u, _ := url.Parse(working.URL)
+	if endpoint := ctx.FStateBag[tokenintrospectionEndpointKey]; endpoint != u.Hostname() {
+		t.Errorf("unexpected endpoint: %v", endpoint)
+	}
+
+	for i := 0; i < 2; i++ {
+		if user := <-users; user != "client-id" {
+			t.Errorf("unexpected client id: %s", user)
+		}
+	}
+}
+
+func TestOAuth2TokenintrospectionRequestStyle(t *testing.T) {
+	type introspectionRequest struct {
+		token, tokenInQuery, user, password, clientID, clientSecret string
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		options  TokenintrospectionOptions
+		expected introspectionRequest
+	}{{
+		msg: "client_secret_basic",
+		expected: introspectionRequest{
+			token:    testToken,
+			user:     "client-id",
+			password: "client-secret",
+		},
+	}, {
+		msg:     "client_secret_post",
+		options: TokenintrospectionOptions{CredentialStyle: ClientSecretPost},
+		expected: introspectionRequest{
+			token:        testToken,
+			clientID:     "client-id",
+			clientSecret: "client-secret",
+		},
+	}, {
+		msg:     "token in query",
+		options: TokenintrospectionOptions{TokenStyle: IntrospectionTokenQuery},
+		expected: introspectionRequest{
+			tokenInQuery: testToken,
+			user:         "client-id",
+			password:     "client-secret",
+		},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			requests := make(chan introspectionRequest, 1)
+			var s *httptest.Server
+			s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == TokenIntrospectionConfigPath {
+					cfg := getTestOidcConfig()
+					cfg.Issuer = s.URL
+					cfg.IntrospectionEndpoint = s.URL + testAuthPath
+					json.NewEncoder(w).Encode(cfg)
+					return
+				}
+
+				user, password, _ := r.BasicAuth()
+				tokenInQuery := r.URL.Query().Get(tokenKey)
+				r.ParseForm()
+				requests <- introspectionRequest{
+					token:        r.PostForm.Get(tokenKey),
+					tokenInQuery: tokenInQuery,
+					user:         user,
+					password:     password,
+					clientID:     r.PostForm.Get(clientIDKey),
+					clientSecret: r.PostForm.Get(clientSecretKey),
+				}
+
+				json.NewEncoder(w).Encode(tokenIntrospectionInfo{
+					"sub":    "testSub",
+					"active": true,
+					"claims": map[string]string{validClaim1: validClaim1Value},
+				})
+			}))
+			defer s.Close()
+
+			ti.options.Timeout = time.Second
+			spec := TokenintrospectionWithOptions(NewSecureOAuthTokenintrospectionAnyClaims, ti.options)
+			f, err := spec.CreateFilter([]interface{}{s.URL, "client-id", "client-secret", validClaim1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokenintrospectFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			if ctx.FServed {
+				t.Fatalf("unexpected response: %d", ctx.FResponse.StatusCode)
+			}
+
+			if r := <-requests; r != ti.expected {
+				t.Errorf("unexpected introspection request: %+v, expected: %+v", r, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionSharedIssuerClients(t *testing.T) {
+	type introspectionRequest struct {
+		user, clientID string
+	}
+
+	requests := make(chan introspectionRequest, 1)
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TokenIntrospectionConfigPath {
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			json.NewEncoder(w).Encode(cfg)
+			return
+		}
+
+		user, _, _ := r.BasicAuth()
+		r.ParseForm()
+		requests <- introspectionRequest{user: user, clientID: r.PostForm.Get(clientIDKey)}
+		json.NewEncoder(w).Encode(tokenIntrospectionInfo{
+			"sub":    "testSub",
+			"active": true,
+			"claims": map[string]string{validClaim1: validClaim1Value},
+		})
+	}))
+	defer s.Close()
+
+	create := func(o TokenintrospectionOptions, clientID string) filters.Filter {
+		o.Timeout = time.Second
+		spec := TokenintrospectionWithOptions(NewSecureOAuthTokenintrospectionAnyClaims, o)
+		f, err := spec.CreateFilter([]interface{}{s.URL, clientID, clientID + "-secret", validClaim1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f
+	}
+
+	// the filters created later for the same issuer don't change the
+	// credentials and the options of the filters created before
+	basic := create(TokenintrospectionOptions{}, "client-a")
+	defer basic.(*tokenintrospectFilter).Close()
+	post := create(TokenintrospectionOptions{CredentialStyle: ClientSecretPost}, "client-b")
+	defer post.(*tokenintrospectFilter).Close()
+	other := create(TokenintrospectionOptions{}, "client-c")
+	defer other.(*tokenintrospectFilter).Close()
+
+	for _, ti := range []struct {
+		filter   filters.Filter
+		expected introspectionRequest
+	}{
+		{basic, introspectionRequest{user: "client-a"}},
+		{post, introspectionRequest{clientID: "client-b"}},
+		{other, introspectionRequest{user: "client-c"}},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		ti.filter.Request(ctx)
+		if ctx.FServed {
+			t.Fatalf("unexpected response: %d", ctx.FResponse.StatusCode)
+		}
+
+		if r := <-requests; r != ti.expected {
+			t.Errorf("unexpected introspection request: %+v, expected: %+v", r, ti.expected)
+		}
+	}
+}
+
+func TestOAuth2TokenintrospectionInvalidRequestStyle(t *testing.T) {
+	for _, o := range []TokenintrospectionOptions{
+		{TokenStyle: "header"},
+		{CredentialStyle: "private_key_jwt"},
+	} {
+		spec := TokenintrospectionWithOptions(NewSecureOAuthTokenintrospectionAnyClaims, o)
+		if _, err := spec.CreateFilter([]interface{}{"https://idp.example.org", "client-id", "client-secret", validClaim1}); err != filters.ErrInvalidFilterParameters {
+			t.Errorf("expected invalid filter parameters for %+v, got: %v", o, err)
+		}
+	}
+}
+
+func TestOAuth2TokenintrospectionNegativeCache(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		ttl      time.Duration
+		token    string
+		expected int32
+		reason   rejectReason
+	}{{
+		msg:      "disabled",
+		token:    "inactive-token",
+		expected: 3,
+		reason:   inactiveToken,
+	}, {
+		msg:      "inactive token",
+		ttl:      time.Minute,
+		token:    "inactive-token",
+		expected: 1,
+		reason:   inactiveToken,
+	}, {
+		msg:      "unauthorized client is not cached",
+		ttl:      time.Minute,
+		token:    "unauthorized-token",
+		expected: 3,
+		reason:   authServiceAccess,
+	}, {
+		msg:      "too many requests are not cached",
+		ttl:      time.Minute,
+		token:    "ratelimited-token",
+		expected: 3,
+		reason:   authServiceAccess,
+	}, {
+		msg:      "service failure is not cached",
+		ttl:      time.Minute,
+		token:    "failing-token",
+		expected: 3,
+		reason:   authServiceAccess,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			var calls int32
+			var s *httptest.Server
+			s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == TokenIntrospectionConfigPath {
+					cfg := getTestOidcConfig()
+					cfg.Issuer = s.URL
+					cfg.IntrospectionEndpoint = s.URL + testAuthPath
+					json.NewEncoder(w).Encode(cfg)
+					return
+				}
+
+				atomic.AddInt32(&calls, 1)
+				switch r.FormValue(tokenKey) {
+				case "unauthorized-token":
+					w.WriteHeader(http.StatusUnauthorized)
+				case "ratelimited-token":
+					w.WriteHeader(http.StatusTooManyRequests)
+				case "failing-token":
+					w.WriteHeader(http.StatusInternalServerError)
+				default:
+					json.NewEncoder(w).Encode(tokenIntrospectionInfo{"sub": "testSub", "active": false})
+				}
+			}))
+			defer s.Close()
+
+			spec := TokenintrospectionWithOptions(NewOAuthTokenintrospectionAnyClaims, TokenintrospectionOptions{
+				Timeout:          time.Second,
+				NegativeCacheTTL: ti.ttl,
+			})
+
+			f, err := spec.CreateFilter([]interface{}{s.URL, validClaim1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokenintrospectFilter).Close()
+
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(authHeaderName, authHeaderPrefix+ti.token)
+				ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+				f.Request(ctx)
+
+				if !ctx.FServed || ctx.FResponse.StatusCode != http.StatusUnauthorized {
+					t.Fatal("failed to reject the token")
+				}
+
+				if r := ctx.FStateBag[logfilter.AuthRejectReasonKey]; r != string(ti.reason) {
+					t.Errorf("unexpected reject reason: %v != %s", r, ti.reason)
+				}
+			}
+
+			if c := atomic.LoadInt32(&calls); c != ti.expected {
+				t.Errorf("unexpected calls to the introspection endpoint: %d != %d", c, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionClientSecretRotation(t *testing.T) {
+	passwords := make(chan string, 1)
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TokenIntrospectionConfigPath {
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			json.NewEncoder(w).Encode(cfg)
+			return
+		}
+
+		_, password, _ := r.BasicAuth()
+		passwords <- password
+		json.NewEncoder(w).Encode(tokenIntrospectionInfo{
+			"sub":    "testSub",
+			"active": true,
+			"claims": map[string]string{validClaim1: validClaim1Value},
+		})
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "tokenintrospection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "client-secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sp := secrets.NewSecretPaths(10 * time.Millisecond)
+	defer sp.Close()
+
+	spec := TokenintrospectionWithOptions(NewSecureOAuthTokenintrospectionAnyClaims, TokenintrospectionOptions{
+		Timeout:          time.Second,
+		ClientSecretFile: secretFile,
+		SecretsProvider:  sp,
+	})
+
+	f, err := spec.CreateFilter([]interface{}{s.URL, "client-id", "", validClaim1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*tokenintrospectFilter).Close()
+
+	introspect := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if ctx.FServed {
+			t.Fatalf("unexpected response: %d", ctx.FResponse.StatusCode)
+		}
+
+		return <-passwords
+	}
+
+	if p := introspect(); p != "secret1" {
+		t.Fatalf("unexpected client secret: %s", p)
+	}
+
+	if err := ioutil.WriteFile(secretFile, []byte("secret2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; {
+		p := introspect()
+		if p == "secret2" {
+			break
+		}
+
+		if p != "secret1" || time.Now().After(deadline) {
+			t.Fatalf("failed to use the rotated client secret: %s", p)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOAuth2TokenintrospectionClientSecretFileWithoutProvider(t *testing.T) {
+	spec := TokenintrospectionWithOptions(NewSecureOAuthTokenintrospectionAnyClaims, TokenintrospectionOptions{ClientSecretFile: "client-secret"})
+	if _, err := spec.CreateFilter([]interface{}{"https://idp.example.org", "client-id", "", validClaim1}); err != filters.ErrInvalidFilterParameters {
+		t.Errorf("expected invalid filter parameters, got: %v", err)
+	}
+}
+
+func TestOAuth2TokenintrospectionClaimsPath(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		path     string
+		response map[string]interface{}
+		expected int
+		sub      string
+	}{{
+		msg:  "flat response",
+		path: "",
+		response: map[string]interface{}{
+			"active": true,
+			"sub":    "testSub",
+			"uid":    "testUID",
+		},
+		expected: http.StatusOK,
+		sub:      "testSub",
+	}, {
+		msg:  "nested response",
+		path: "data.token",
+		response: map[string]interface{}{
+			"active": true,
+			"data": map[string]interface{}{
+				"token": map[string]interface{}{"sub": "nestedSub", "uid": "testUID"},
+			},
+		},
+		expected: http.StatusOK,
+		sub:      "nestedSub",
+	}, {
+		msg:  "nested active field",
+		path: "data",
+		response: map[string]interface{}{
+			"active": true,
+			"data":   map[string]interface{}{"active": false, "sub": "nestedSub", "uid": "testUID"},
+		},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:  "nested response without path",
+		path: "",
+		response: map[string]interface{}{
+			"active": true,
+			"sub":    "testSub",
+			"data":   map[string]interface{}{"uid": "testUID"},
+		},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:  "missing claims object",
+		path: "data",
+		response: map[string]interface{}{
+			"active": true,
+			"sub":    "testSub",
+			"uid":    "testUID",
+		},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:  "claims path not an object",
+		path: "data",
+		response: map[string]interface{}{
+			"active": true,
+			"data":   "testUID",
+		},
+		expected: http.StatusUnauthorized,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			var s *httptest.Server
+			s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == TokenIntrospectionConfigPath {
+					cfg := getTestOidcConfig()
+					cfg.Issuer = s.URL
+					cfg.IntrospectionEndpoint = s.URL + testAuthPath
+					json.NewEncoder(w).Encode(cfg)
+					return
+				}
+
+				json.NewEncoder(w).Encode(ti.response)
+			}))
+			defer s.Close()
+
+			spec := TokenintrospectionWithOptions(NewOAuthTokenintrospectionAnyKV, TokenintrospectionOptions{
+				Timeout:    time.Second,
+				ClaimsPath: ti.path,
+			})
+
+			f, err := spec.CreateFilter([]interface{}{s.URL, "uid", "testUID"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokenintrospectFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Fatalf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.expected != http.StatusOK {
+				return
+			}
+
+			info, ok := ctx.FStateBag[tokenintrospectionCacheKey].(tokenIntrospectionInfo)
+			if !ok {
+				t.Fatal("introspection info not found in the state bag")
+			}
+
+			if sub, _ := info.Sub(); sub != ti.sub {
+				t.Errorf("unexpected sub: %s != %s", sub, ti.sub)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionAnyClaimsClaimsPath(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		path     string
+		response map[string]interface{}
+		expected int
+	}{{
+		msg:  "claims field without path",
+		path: "",
+		response: map[string]interface{}{
+			"active": true,
+			"sub":    "testSub",
+			"claims": map[string]interface{}{"email": "jdoe@example.org"},
+		},
+		expected: http.StatusOK,
+	}, {
+		msg:  "claims at the path",
+		path: "data.token",
+		response: map[string]interface{}{
+			"active": true,
+			"data": map[string]interface{}{
+				"token": map[string]interface{}{"sub": "nestedSub", "email": "jdoe@example.org"},
+			},
+		},
+		expected: http.StatusOK,
+	}, {
+		msg:  "claims only at the top-level",
+		path: "data",
+		response: map[string]interface{}{
+			"active": true,
+			"claims": map[string]interface{}{"email": "jdoe@example.org"},
+			"data":   map[string]interface{}{"sub": "nestedSub"},
+		},
+		expected: http.StatusUnauthorized,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			var s *httptest.Server
+			s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == TokenIntrospectionConfigPath {
+					cfg := getTestOidcConfig()
+					cfg.Issuer = s.URL
+					cfg.IntrospectionEndpoint = s.URL + testAuthPath
+					json.NewEncoder(w).Encode(cfg)
+					return
+				}
+
+				json.NewEncoder(w).Encode(ti.response)
+			}))
+			defer s.Close()
+
+			spec := TokenintrospectionWithOptions(NewOAuthTokenintrospectionAnyClaims, TokenintrospectionOptions{
+				Timeout:    time.Second,
+				ClaimsPath: ti.path,
+			})
+
+			f, err := spec.CreateFilter([]interface{}{s.URL, "email"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.(*tokenintrospectFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionSharedCalls(t *testing.T) {
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TokenIntrospectionConfigPath {
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			json.NewEncoder(w).Encode(cfg)
+			return
+		}
+
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+
+		json.NewEncoder(w).Encode(tokenIntrospectionInfo{"active": true, "sub": "testSub", "uid": "testUID"})
+	}))
+	defer s.Close()
+
+	spec := TokenintrospectionWithOptions(NewOAuthTokenintrospectionAnyKV, TokenintrospectionOptions{Timeout: time.Second})
+	f, err := spec.CreateFilter([]interface{}{s.URL, "uid", "testUID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*tokenintrospectFilter).Close()
+
+	request := func(rctx context.Context) int {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(rctx)
+		req.Header.Set(authHeaderName, authHeaderPrefix+testToken)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if ctx.FServed {
+			return ctx.FResponse.StatusCode
+		}
+
+		return http.StatusOK
+	}
+
+	// the request starting the shared call is cancelled
+	cancelled, cancel := context.WithCancel(context.Background())
+	first := make(chan int)
+	go func() { first <- request(cancelled) }()
+	<-started
+
+	const n = 5
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() { statuses <- request(context.Background()) }()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if status := <-first; status != http.StatusUnauthorized {
+		t.Errorf("unexpected status code of the cancelled request: %d", status)
+	}
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("unexpected status code: %d", status)
+		}
+	}
+
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("unexpected calls to the introspection endpoint: %d", c)
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/metrics"
+)
+
+const (
+	freshnessCheckMetricsKey   = "auth.tokenintrospection.freshness.check"
+	freshnessRevokedMetricsKey = "auth.tokenintrospection.freshness.revoked"
+
+	defaultFreshnessSize = 10000
+)
+
+// FreshnessOptions configures the re-validation of the locally
+// validated tokens of the hybrid filters against the introspection
+// endpoint, so that revoked tokens are rejected before they expire.
+// Disabled by default.
+type FreshnessOptions struct {
+	// SampleRate is the fraction of the requests with a locally
+	// validated token, between 0 and 1, that are re-validated.
+	SampleRate float64
+
+	// Interval re-validates each token, when it was last validated
+	// against the introspection endpoint longer ago.
+	Interval time.Duration
+
+	// Size limits the number of tokens tracked for the Interval.
+	// Defaults to 10000.
+	Size int
+}
+
+// freshnessTracker decides, which locally validated tokens are
+// re-validated against the introspection endpoint. For the interval,
+// it remembers when the tokens were last validated, storing only the
+// hash of the token. It holds at most size entries, when full, the
+// oldest inserted entry is evicted.
+type freshnessTracker struct {
+	sampleRate float64
+	interval   time.Duration
+
+	mu      sync.Mutex
+	checked map[[sha256.Size]byte]time.Time
+	keys    [][sha256.Size]byte
+	next    int
+}
+
+func newFreshnessTracker(o FreshnessOptions) *freshnessTracker {
+	if o.SampleRate <= 0 && o.Interval <= 0 {
+		return nil
+	}
+
+	size := o.Size
+	if size <= 0 {
+		size = defaultFreshnessSize
+	}
+
+	return &freshnessTracker{
+		sampleRate: o.SampleRate,
+		interval:   o.Interval,
+		checked:    make(map[[sha256.Size]byte]time.Time),
+		keys:       make([][sha256.Size]byte, 0, size),
+	}
+}
+
+// due tells whether the token has to be re-validated, because it was
+// sampled, or because the interval elapsed since its last validation.
+// The first validation of a token starts its interval. It is safe to
+// call on a nil tracker.
+func (t *freshnessTracker) due(token string, now time.Time) bool {
+	if t == nil {
+		return false
+	}
+
+	sampled := t.sampleRate > 0 && rand.Float64() < t.sampleRate
+	if t.interval <= 0 {
+		return sampled
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.checked[key]
+	if !ok {
+		t.add(key)
+		t.checked[key] = now
+		return sampled
+	}
+
+	if sampled || now.Sub(last) >= t.interval {
+		t.checked[key] = now
+		return true
+	}
+
+	return false
+}
+
+func (t *freshnessTracker) add(key [sha256.Size]byte) {
+	if len(t.keys) < cap(t.keys) {
+		t.keys = append(t.keys, key)
+		return
+	}
+
+	delete(t.checked, t.keys[t.next])
+	t.keys[t.next] = key
+	t.next = (t.next + 1) % len(t.keys)
+}
+
+// forget marks the token stale, when it was rejected, so its next use
+// is re-validated. The entry is kept, because its key stays in the ring
+// of the inserted keys. It is safe to call on a nil tracker.
+func (t *freshnessTracker) forget(token string) {
+	if t == nil {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.checked[key]; ok {
+		t.checked[key] = time.Time{}
+	}
+}
+
+// revalidate checks the locally validated token against the
+// introspection endpoint, and returns the reject reason, when the token
+// is not active anymore. When the endpoint is not available, the local
+// validation stands.
+func (f *tokenintrospectFilter) revalidate(ctx filters.FilterContext, token string) (string, rejectReason) {
+	metrics.Default.IncCounter(freshnessCheckMetricsKey)
+
+	info, ac, err := f.introspect(token, ctx)
+	host := ac.url.Hostname()
+	if err != nil {
+		log.Debugf("Failed to re-validate the token at %s: %v.", host, err)
+		return host, ""
+	}
+
+	var reason rejectReason
+	if info, ok := f.claimsRoot(info); !ok {
+		reason = invalidToken
+	} else if !info.isActive(f.activeField, f.activeValues) {
+		reason = inactiveToken
+	}
+
+	if reason != "" {
+		metrics.Default.IncCounter(freshnessRevokedMetricsKey)
+		f.fresh.forget(token)
+	}
+
+	if reason == inactiveToken {
+		f.invalid.set(token, reason, time.Now())
+	}
+
+	return host, reason
+}
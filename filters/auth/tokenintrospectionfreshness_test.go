@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestFreshnessTracker(t *testing.T) {
+	now := time.Now()
+
+	t.Run("disabled", func(t *testing.T) {
+		tr := newFreshnessTracker(FreshnessOptions{})
+		if tr != nil {
+			t.Fatal("unexpected tracker")
+		}
+
+		if tr.due("a", now) {
+			t.Error("unexpected re-validation")
+		}
+
+		tr.forget("a")
+	})
+
+	t.Run("sampled", func(t *testing.T) {
+		tr := newFreshnessTracker(FreshnessOptions{SampleRate: 1})
+		if !tr.due("a", now) || !tr.due("a", now) {
+			t.Error("failed to sample")
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		tr := newFreshnessTracker(FreshnessOptions{Interval: time.Minute})
+		if tr.due("a", now) {
+			t.Error("unexpected re-validation of a new token")
+		}
+
+		if tr.due("a", now.Add(30*time.Second)) {
+			t.Error("unexpected re-validation within the interval")
+		}
+
+		if !tr.due("a", now.Add(time.Minute)) {
+			t.Error("failed to re-validate after the interval")
+		}
+
+		if tr.due("a", now.Add(90*time.Second)) {
+			t.Error("interval not restarted")
+		}
+
+		tr.forget("a")
+		if !tr.due("a", now.Add(100*time.Second)) {
+			t.Error("failed to re-validate a forgotten token")
+		}
+
+		if tr.due("a", now.Add(110*time.Second)) {
+			t.Error("interval not restarted after the re-validation of a forgotten token")
+		}
+	})
+
+	t.Run("forgotten tokens stay in the ring", func(t *testing.T) {
+		tr := newFreshnessTracker(FreshnessOptions{Interval: time.Minute, Size: 2})
+		tr.due("a", now)
+		tr.forget("a")
+		tr.due("a", now)
+		tr.due("b", now)
+		if len(tr.keys) != 2 || tr.keys[0] == tr.keys[1] {
+			t.Fatalf("duplicate keys in the ring: %d", len(tr.keys))
+		}
+
+		// evicting the oldest key doesn't drop the live entries
+		tr.due("c", now)
+		if len(tr.checked) != 2 {
+			t.Errorf("unexpected number of entries: %d", len(tr.checked))
+		}
+
+		if tr.due("b", now.Add(30*time.Second)) {
+			t.Error("live entry was evicted")
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		tr := newFreshnessTracker(FreshnessOptions{Interval: time.Minute, Size: 2})
+		tr.due("a", now)
+		tr.due("b", now)
+		tr.due("c", now)
+		if len(tr.checked) != 2 {
+			t.Errorf("tracker is not bounded: %d", len(tr.checked))
+		}
+
+		if tr.due("a", now.Add(time.Minute)) {
+			t.Error("oldest token was not evicted")
+		}
+	})
+}
+
+func TestOAuth2TokenintrospectionFreshness(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := jose.JSONWebKey{Key: k, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	var (
+		calls   int32
+		revoked atomic.Value
+		down    int32
+	)
+
+	revoked.Store("")
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case TokenIntrospectionConfigPath:
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			cfg.JwksURI = s.URL + "/jwks"
+			json.NewEncoder(w).Encode(cfg)
+		case "/jwks":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+		default:
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&down) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			active := r.FormValue(tokenKey) != revoked.Load().(string)
+			json.NewEncoder(w).Encode(tokenIntrospectionInfo{"active": active, "sub": "jwtSub"})
+		}
+	}))
+	defer s.Close()
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	token := sign(map[string]interface{}{"iss": s.URL, "sub": "jwtSub", "exp": exp})
+
+	options := TokenintrospectionOptions{
+		Timeout:          time.Second,
+		NegativeCacheTTL: time.Minute,
+		Freshness:        FreshnessOptions{SampleRate: 1},
+	}
+
+	f, err := TokenintrospectionWithOptions(NewOAuthTokenintrospectionHybrid, options).CreateFilter([]interface{}{s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*tokenintrospectFilter).Close()
+
+	request := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+token)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if ctx.FServed {
+			return ctx.FResponse.StatusCode
+		}
+
+		return http.StatusOK
+	}
+
+	if status := request(); status != http.StatusOK || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("unexpected status code: %d, calls: %d", status, atomic.LoadInt32(&calls))
+	}
+
+	atomic.StoreInt32(&down, 1)
+	if status := request(); status != http.StatusOK {
+		t.Errorf("unexpected status code when the endpoint is down: %d", status)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	revoked.Store(token)
+	if status := request(); status != http.StatusUnauthorized {
+		t.Errorf("revoked token not rejected: %d", status)
+	}
+
+	// the revoked token is rejected from the negative cache
+	atomic.StoreInt32(&calls, 0)
+	if status := request(); status != http.StatusUnauthorized || atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("unexpected status code: %d, calls: %d", status, atomic.LoadInt32(&calls))
+	}
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestOAuth2TokenintrospectionHybrid(t *testing.T) {
+	newKey := func(kid string) jose.JSONWebKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return jose.JSONWebKey{Key: k, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	}
+
+	sign := func(k jose.JSONWebKey, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	key := newKey("k1")
+	var calls int32
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case TokenIntrospectionConfigPath:
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			cfg.JwksURI = s.URL + "/jwks"
+			json.NewEncoder(w).Encode(cfg)
+		case "/jwks":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+		default:
+			atomic.AddInt32(&calls, 1)
+			if r.FormValue(tokenKey) == "invalid-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			json.NewEncoder(w).Encode(tokenIntrospectionInfo{"active": true, "sub": "opaqueSub", "uid": "testUID"})
+		}
+	}))
+	defer s.Close()
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	validClaims := map[string]interface{}{"iss": s.URL, "sub": "jwtSub", "uid": "testUID", "exp": exp}
+
+	for _, ti := range []struct {
+		msg      string
+		token    string
+		expected int
+		calls    int32
+		sub      string
+	}{{
+		msg:      "valid jwt",
+		token:    sign(key, validClaims),
+		expected: http.StatusOK,
+		sub:      "jwtSub",
+	}, {
+		msg:      "jwt with invalid signature",
+		token:    sign(newKey("k1"), validClaims),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "jwt of another issuer",
+		token:    sign(key, map[string]interface{}{"iss": "https://other.example.org", "sub": "jwtSub", "exp": exp}),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "expired jwt",
+		token:    sign(key, map[string]interface{}{"iss": s.URL, "sub": "jwtSub", "exp": float64(time.Now().Add(-time.Minute).Unix())}),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "jwt without expiry",
+		token:    sign(key, map[string]interface{}{"iss": s.URL, "sub": "jwtSub"}),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "jwt with unknown key id is introspected",
+		token:    sign(newKey("k2"), validClaims),
+		expected: http.StatusOK,
+		calls:    1,
+		sub:      "opaqueSub",
+	}, {
+		msg:      "opaque token is introspected",
+		token:    testToken,
+		expected: http.StatusOK,
+		calls:    1,
+		sub:      "opaqueSub",
+	}, {
+		msg:      "invalid opaque token",
+		token:    "invalid-token",
+		expected: http.StatusUnauthorized,
+		calls:    1,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+
+			create := func(spec filters.Spec, args ...interface{}) filters.Filter {
+				f, err := spec.CreateFilter(args)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return f
+			}
+
+			options := TokenintrospectionOptions{Timeout: time.Second}
+			hybrid := create(TokenintrospectionWithOptions(NewOAuthTokenintrospectionHybrid, options), s.URL)
+			defer hybrid.(*tokenintrospectFilter).Close()
+
+			// the claims of both kinds of tokens are checked by the following filters
+			anyKV := create(TokenintrospectionWithOptions(NewOAuthTokenintrospectionAnyKV, options), s.URL, "uid", "testUID")
+			defer anyKV.(*tokenintrospectFilter).Close()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeaderName, authHeaderPrefix+ti.token)
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			hybrid.Request(ctx)
+			if !ctx.FServed {
+				anyKV.Request(ctx)
+			}
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Fatalf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if c := atomic.LoadInt32(&calls); c != ti.calls {
+				t.Errorf("unexpected calls to the introspection endpoint: %d != %d", c, ti.calls)
+			}
+
+			if ti.expected != http.StatusOK {
+				return
+			}
+
+			info, ok := ctx.StateBag()[tokenintrospectionCacheKey].(tokenIntrospectionInfo)
+			if !ok {
+				t.Fatal("claims not stored in the state bag")
+			}
+
+			if sub, _ := info.Sub(); sub != ti.sub {
+				t.Errorf("unexpected sub: %s != %s", sub, ti.sub)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenintrospectionHybridNegativeCache(t *testing.T) {
+	newKey := func() jose.JSONWebKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return jose.JSONWebKey{Key: k, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}
+	}
+
+	sign := func(k jose.JSONWebKey, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	key := newKey()
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case TokenIntrospectionConfigPath:
+			cfg := getTestOidcConfig()
+			cfg.Issuer = s.URL
+			cfg.IntrospectionEndpoint = s.URL + testAuthPath
+			cfg.JwksURI = s.URL + "/jwks"
+			json.NewEncoder(w).Encode(cfg)
+		case "/jwks":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer s.Close()
+
+	spec := TokenintrospectionWithOptions(NewOAuthTokenintrospectionHybrid, TokenintrospectionOptions{
+		Timeout:          time.Second,
+		NegativeCacheTTL: time.Minute,
+	})
+
+	f, err := spec.CreateFilter([]interface{}{s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf := f.(*tokenintrospectFilter)
+	defer tf.Close()
+
+	request := func(token string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(authHeaderName, authHeaderPrefix+token)
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if ctx.FServed {
+			return ctx.FResponse.StatusCode
+		}
+
+		return http.StatusOK
+	}
+
+	// the token is signed with a rotated key, that is not loaded yet
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	token := sign(newKey(), map[string]interface{}{"iss": s.URL, "sub": "jwtSub", "exp": exp})
+	if status := request(token); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code of the invalid signature: %d", status)
+	}
+
+	if _, ok := tf.invalid.get(token, time.Now()); ok {
+		t.Error("token with invalid signature cached")
+	}
+
+	expired := sign(key, map[string]interface{}{"iss": s.URL, "sub": "jwtSub", "exp": float64(time.Now().Add(-time.Minute).Unix())})
+	if status := request(expired); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code of the expired token: %d", status)
+	}
+
+	if reason, ok := tf.invalid.get(expired, time.Now()); !ok || reason != inactiveToken {
+		t.Errorf("expired token not cached: %v", reason)
+	}
+}
+
+func TestOAuth2TokenintrospectionHybridArgs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(getTestOidcConfig())
+	}))
+	defer s.Close()
+
+	spec := NewOAuthTokenintrospectionHybrid(time.Second)
+	if spec.Name() != OAuthTokenintrospectionHybridName {
+		t.Errorf("unexpected name: %s", spec.Name())
+	}
+
+	if _, err := spec.CreateFilter([]interface{}{s.URL, "uid"}); err == nil {
+		t.Error("failed to reject the claims")
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	stdnet "net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/net"
+)
+
+const (
+	OAuthTokenIPBindingName = "oauthTokenIPBinding"
+
+	defaultTokenIPBindingTTL = time.Hour
+	tokenIPBindingKeyPrefix  = "tokenip."
+	expKey                   = "exp"
+)
+
+// TokenIPBindingOptions configures the store of the client IPs,
+// that the tokens are bound to.
+type TokenIPBindingOptions struct {
+	// RedisRing returns the redis ring used to share the bindings
+	// across all skipper instances. It is called on the first use of
+	// the store, and the ring is owned by the caller. Without redis,
+	// the bindings are stored in memory of each instance.
+	RedisRing func() *redis.Ring
+
+	// TTL of the binding of tokens without exp claim. Defaults to 1
+	// hour.
+	TTL time.Duration
+}
+
+// tokenIPStore binds a key to the first IP stored, and returns the
+// IP the key is bound to.
+type tokenIPStore interface {
+	bind(ctx context.Context, key, ip string, ttl time.Duration) (string, error)
+	close() error
+}
+
+type (
+	// TokenIPBindingSpec is the filter spec of the
+	// oauthTokenIPBinding filter. On tear down make sure to Close()
+	// it.
+	TokenIPBindingSpec struct {
+		options TokenIPBindingOptions
+		store   tokenIPStore
+	}
+
+	tokenIPBindingFilter struct {
+		spec    *TokenIPBindingSpec
+		proxies []*stdnet.IPNet
+	}
+
+	redisTokenIPStore struct {
+		ring func() *redis.Ring
+	}
+
+	memoryTokenIPBinding struct {
+		ip      string
+		expires time.Time
+	}
+
+	memoryTokenIPStore struct {
+		mu        sync.Mutex
+		bindings  map[string]memoryTokenIPBinding
+		lastSweep time.Time
+	}
+)
+
+// NewOAuthTokenIPBinding creates a filter spec, which binds tokens to
+// the client IP they were first seen with, and rejects requests with
+// the same token from a different client IP. The filter has to be
+// placed after one of the oauthTokeninfo* or oauthTokenintrospection*
+// filters.
+//
+// The arguments of the filters are the IPs or CIDR ranges of the
+// trusted proxies, that are skipped in the X-Forwarded-For header to
+// find the client IP:
+//
+//	oauthTokeninfoAnyScope("read") -> oauthTokenIPBinding("10.0.0.0/8") -> "https://internal.example.org";
+func NewOAuthTokenIPBinding(o TokenIPBindingOptions) *TokenIPBindingSpec {
+	if o.TTL <= 0 {
+		o.TTL = defaultTokenIPBindingTTL
+	}
+
+	s := &TokenIPBindingSpec{options: o}
+	if o.RedisRing != nil {
+		s.store = &redisTokenIPStore{ring: o.RedisRing}
+	} else {
+		s.store = &memoryTokenIPStore{bindings: make(map[string]memoryTokenIPBinding)}
+	}
+
+	return s
+}
+
+// Close releases the resources of the store. The redis ring is not
+// closed.
+func (s *TokenIPBindingSpec) Close() error {
+	return s.store.close()
+}
+
+func (*TokenIPBindingSpec) Name() string { return OAuthTokenIPBindingName }
+
+// CreateFilter creates an oauthTokenIPBinding filter. The optional
+// arguments are the IPs or CIDR ranges of the trusted proxies.
+func (s *TokenIPBindingSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := parseProxies(sargs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenIPBindingFilter{spec: s, proxies: proxies}, nil
+}
+
+// parseProxies parses the IPs or CIDR ranges of the trusted proxies.
+func parseProxies(args []string) ([]*stdnet.IPNet, error) {
+	var proxies []*stdnet.IPNet
+	for _, a := range args {
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+
+		_, n, err := stdnet.ParseCIDR(a)
+		if err != nil {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		proxies = append(proxies, n)
+	}
+
+	return proxies, nil
+}
+
+// ttl returns the remaining lifetime of the token based on the exp
+// claim, or the configured default.
+func (f *tokenIPBindingFilter) ttl(claims map[string]interface{}, now time.Time) time.Duration {
+	exp, ok := claims[expKey].(float64)
+	if !ok {
+		return f.spec.options.TTL
+	}
+
+	return time.Unix(int64(exp), 0).Sub(now)
+}
+
+func (f *tokenIPBindingFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, "", "")
+		return
+	}
+
+	token, ok := requestToken(ctx)
+	if !ok || token == "" {
+		unauthorized(ctx, "", missingBearerToken, "", "")
+		return
+	}
+
+	ip := net.RemoteHostBehindProxies(r, f.proxies)
+	if ip == nil {
+		unauthorized(ctx, "", tokenIPMismatch, "", "failed to get client IP")
+		return
+	}
+
+	ttl := f.ttl(claims, time.Now())
+	if ttl <= 0 {
+		return
+	}
+
+	h := sha256.Sum256([]byte(token))
+	key := tokenIPBindingKeyPrefix + hex.EncodeToString(h[:])
+	bound, err := f.spec.store.bind(r.Context(), key, ip.String(), ttl)
+	if err != nil {
+		log.Errorf("Failed to bind token to client IP: %v.", err)
+		return
+	}
+
+	if bound != ip.String() {
+		uid, _ := claims[uidKey].(string)
+		unauthorized(ctx, uid, tokenIPMismatch, "", fmt.Sprintf("token bound to %s, used from %s", bound, ip))
+	}
+}
+
+func (*tokenIPBindingFilter) Response(filters.FilterContext) {}
+
+func (s *redisTokenIPStore) bind(ctx context.Context, key, ip string, ttl time.Duration) (string, error) {
+	ok, err := s.ring().SetNX(ctx, key, ip, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+
+	if ok {
+		return ip, nil
+	}
+
+	return s.ring().Get(ctx, key).Result()
+}
+
+func (*redisTokenIPStore) close() error { return nil }
+
+func (s *memoryTokenIPStore) bind(_ context.Context, key, ip string, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.bindings {
+			if now.After(b.expires) {
+				delete(s.bindings, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	if b, ok := s.bindings[key]; ok && now.Before(b.expires) {
+		return b.ip, nil
+	}
+
+	s.bindings[key] = memoryTokenIPBinding{ip: ip, expires: now.Add(ttl)}
+	return ip, nil
+}
+
+func (*memoryTokenIPStore) close() error { return nil }
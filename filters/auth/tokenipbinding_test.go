@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestTokenIPBinding(t *testing.T) {
+	spec := NewOAuthTokenIPBinding(TokenIPBindingOptions{})
+	defer spec.Close()
+
+	f, err := spec.CreateFilter([]interface{}{"10.0.0.0/8", "192.168.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	expired := float64(time.Now().Add(-time.Minute).Unix())
+
+	for _, ti := range []struct {
+		msg        string
+		token      string
+		claims     map[string]interface{}
+		remoteAddr string
+		xff        string
+		expected   int
+	}{{
+		msg:        "no validated token",
+		token:      "token1",
+		remoteAddr: "1.2.3.4:1234",
+		expected:   http.StatusUnauthorized,
+	}, {
+		msg:        "first use binds the token",
+		token:      "token1",
+		claims:     map[string]interface{}{"exp": exp},
+		remoteAddr: "1.2.3.4:1234",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "same client IP",
+		token:      "token1",
+		claims:     map[string]interface{}{"exp": exp},
+		remoteAddr: "1.2.3.4:4321",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "same client IP behind trusted proxies",
+		token:      "token1",
+		claims:     map[string]interface{}{"exp": exp},
+		remoteAddr: "10.0.0.1:1234",
+		xff:        "1.2.3.4, 192.168.0.1",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "different client IP",
+		token:      "token1",
+		claims:     map[string]interface{}{"exp": exp},
+		remoteAddr: "5.6.7.8:1234",
+		expected:   http.StatusUnauthorized,
+	}, {
+		msg:        "spoofed X-Forwarded-For from untrusted address",
+		token:      "token1",
+		claims:     map[string]interface{}{"exp": exp},
+		remoteAddr: "5.6.7.8:1234",
+		xff:        "1.2.3.4",
+		expected:   http.StatusUnauthorized,
+	}, {
+		msg:        "other token is bound independently",
+		token:      "token2",
+		claims:     map[string]interface{}{},
+		remoteAddr: "5.6.7.8:1234",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "expired token is not bound",
+		token:      "token3",
+		claims:     map[string]interface{}{"exp": expired},
+		remoteAddr: "5.6.7.8:1234",
+		expected:   http.StatusOK,
+	}, {
+		msg:        "expired token from other IP",
+		token:      "token3",
+		claims:     map[string]interface{}{"exp": expired},
+		remoteAddr: "1.2.3.4:1234",
+		expected:   http.StatusOK,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = ti.remoteAddr
+			req.Header.Set(authHeaderName, authHeaderPrefix+ti.token)
+			if ti.xff != "" {
+				req.Header.Set("X-Forwarded-For", ti.xff)
+			}
+
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			if ti.claims != nil {
+				ctx.FStateBag[tokeninfoCacheKey] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+		})
+	}
+}
+
+func TestTokenIPBindingCreateFilter(t *testing.T) {
+	spec := NewOAuthTokenIPBinding(TokenIPBindingOptions{})
+	defer spec.Close()
+
+	for _, args := range [][]interface{}{{"invalid"}, {"10.0.0.0/33"}, {1}} {
+		if _, err := spec.CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+
+	if _, err := spec.CreateFilter([]interface{}{"2001:db8::1", "2001:db8::/32"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTokenIPBindingLazyRedisRing(t *testing.T) {
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs:       map[string]string{"redis0": "127.0.0.1:1"},
+		DialTimeout: 10 * time.Millisecond,
+	})
+	defer ring.Close()
+
+	var calls int
+	spec := NewOAuthTokenIPBinding(TokenIPBindingOptions{RedisRing: func() *redis.Ring {
+		calls++
+		return ring
+	}})
+	defer spec.Close()
+
+	f, err := spec.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 0 {
+		t.Fatal("redis ring created before the first use")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(authHeaderName, authHeaderPrefix+"token1")
+	f.Request(&filtertest.Context{
+		FRequest:  req,
+		FStateBag: map[string]interface{}{tokeninfoCacheKey: map[string]interface{}{}},
+	})
+
+	if calls != 1 {
+		t.Errorf("redis ring not used: %d", calls)
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/zalando/skipper/filters"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	OAuthTokenTypeName = "oauthTokenType"
+
+	// tokenTypeKey defined at https://tools.ietf.org/html/rfc7662#section-2.2
+	tokenTypeKey = "token_type"
+	// mediaTypePrefix can be omitted from the typ header, https://tools.ietf.org/html/rfc7515#section-4.1.9
+	mediaTypePrefix = "application/"
+)
+
+type (
+	tokenTypeSpec struct{}
+
+	tokenTypeFilter struct {
+		types []string
+	}
+)
+
+// NewOAuthTokenType creates a filter spec, which rejects the requests,
+// when the type of the token is not one of the expected types, e.g.
+// to prevent accepting id tokens instead of access tokens. The type is
+// taken from the token_type of the introspection response, or from
+// the typ header of a JWT bearer token. The filter has to be placed
+// after one of the oauthTokeninfo*, oauthTokenintrospection* or
+// oauthOidc* filters.
+//
+// Example:
+//
+//	oauthTokenintrospectionAnyClaims("https://idp.example.org", "uid") -> oauthTokenType("access_token", "at+jwt") -> "https://internal.example.org";
+func NewOAuthTokenType() filters.Spec {
+	return &tokenTypeSpec{}
+}
+
+func (*tokenTypeSpec) Name() string { return OAuthTokenTypeName }
+
+// CreateFilter accepts one or more expected token types.
+func (*tokenTypeSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sargs) == 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &tokenTypeFilter{}
+	for _, s := range sargs {
+		f.types = append(f.types, normalizeTokenType(s))
+	}
+
+	return f, nil
+}
+
+func normalizeTokenType(t string) string {
+	t = strings.ToLower(t)
+	return strings.TrimPrefix(t, mediaTypePrefix)
+}
+
+// jwtType returns the typ header of the token, if it is a JWT.
+func jwtType(token string) (string, bool) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil || len(jws.Signatures) != 1 {
+		return "", false
+	}
+
+	typ, ok := jws.Signatures[0].Protected.ExtraHeaders[jose.HeaderType].(string)
+	return typ, ok
+}
+
+// tokenType returns the type of the validated token, preferring the
+// token_type of the introspection response.
+func tokenType(ctx filters.FilterContext, claims map[string]interface{}) (string, bool) {
+	if t, ok := claims[tokenTypeKey].(string); ok && t != "" {
+		return t, true
+	}
+
+	if token, ok := requestToken(ctx); ok {
+		return jwtType(token)
+	}
+
+	return "", false
+}
+
+func (f *tokenTypeFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
+	r := ctx.Request()
+
+	claims, ok := tokenClaims(ctx)
+	if !ok {
+		unauthorized(ctx, "", missingToken, r.Host, "no validated token available for token type validation")
+		return
+	}
+
+	t, ok := tokenType(ctx, claims)
+	if !ok {
+		unauthorized(ctx, "", wrongTokenType, r.Host, "missing token type")
+		return
+	}
+
+	nt := normalizeTokenType(t)
+	for _, expected := range f.types {
+		if nt == expected {
+			return
+		}
+	}
+
+	unauthorized(ctx, "", wrongTokenType, r.Host, "unexpected token type "+t)
+}
+
+func (*tokenTypeFilter) Response(filters.FilterContext) {}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	logfilter "github.com/zalando/skipper/filters/log"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func signedJWT(t *testing.T, typ string) string {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &jose.SignerOptions{}
+	if typ != "" {
+		opts = opts.WithType(jose.ContentType(typ))
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign([]byte(`{"sub": "jdoe"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestTokenType(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		key      string
+		claims   interface{}
+		token    string
+		expected int
+	}{{
+		msg:      "no validated token",
+		args:     []interface{}{"access_token"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "introspected access token",
+		args:     []interface{}{"access_token"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"active": true, "token_type": "access_token"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "introspected id token",
+		args:     []interface{}{"access_token"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"active": true, "token_type": "id_token"},
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "one of multiple types",
+		args:     []interface{}{"access_token", "Bearer"},
+		key:      tokenintrospectionCacheKey,
+		claims:   tokenIntrospectionInfo{"active": true, "token_type": "bearer"},
+		expected: http.StatusOK,
+	}, {
+		msg:      "jwt access token",
+		args:     []interface{}{"at+jwt"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"uid": "jdoe"},
+		token:    signedJWT(t, "at+jwt"),
+		expected: http.StatusOK,
+	}, {
+		msg:      "jwt access token with media type prefix",
+		args:     []interface{}{"at+jwt"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"uid": "jdoe"},
+		token:    signedJWT(t, "application/at+jwt"),
+		expected: http.StatusOK,
+	}, {
+		msg:      "jwt id token",
+		args:     []interface{}{"at+jwt"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"uid": "jdoe"},
+		token:    signedJWT(t, "JWT"),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "jwt without typ",
+		args:     []interface{}{"at+jwt"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"uid": "jdoe"},
+		token:    signedJWT(t, ""),
+		expected: http.StatusUnauthorized,
+	}, {
+		msg:      "opaque token without type",
+		args:     []interface{}{"access_token"},
+		key:      tokeninfoCacheKey,
+		claims:   map[string]interface{}{"uid": "jdoe"},
+		token:    "opaque",
+		expected: http.StatusUnauthorized,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewOAuthTokenType().CreateFilter(ti.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if ti.token != "" {
+				req.Header.Set(authHeaderName, authHeaderPrefix+ti.token)
+			}
+
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			if ti.key != "" {
+				ctx.FStateBag[ti.key] = ti.claims
+			}
+
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.expected {
+				t.Errorf("unexpected status code: %d != %d", status, ti.expected)
+			}
+
+			if ti.key != "" && status != http.StatusOK && ctx.FStateBag[logfilter.AuthRejectReasonKey] != string(wrongTokenType) {
+				t.Errorf("unexpected reject reason: %v", ctx.FStateBag[logfilter.AuthRejectReasonKey])
+			}
+		})
+	}
+}
+
+func TestTokenTypeCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{}, {1}, {"access_token", 2}} {
+		if _, err := NewOAuthTokenType().CreateFilter(args); err == nil {
+			t.Errorf("expected error for args: %v", args)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/zalando/skipper/filters"
+)
+
+const (
+	OAuthUserSpanTagName = "oauthUserSpanTag"
+
+	userSpanTagKey = "auth.userSpanTag"
+	userSpanTag    = "auth.user"
+
+	userTagMasked = "masked"
+	userTagPlain  = "plain"
+
+	// the masked user is the prefix of the hex encoded SHA-256 hash
+	maskedUserLength = 16
+)
+
+type (
+	userSpanTagSpec struct{}
+
+	userSpanTagFilter struct {
+		plain bool
+	}
+)
+
+// NewOAuthUserSpanTag creates a filter spec, which makes the auth
+// filters set the username of the authenticated or rejected request as
+// the auth.user tag of the request span, so the traces can be filtered
+// by user. By default, the username is masked, and the tag is the
+// prefix of its SHA-256 hash, so no PII leaks into the traces, but the
+// traces of a user can be found by the hash of the username. With the
+// argument "plain", the username is tagged as is. The filter has to be
+// placed before the auth filters.
+//
+// Example:
+//
+//	oauthUserSpanTag() -> oauthTokeninfoAnyScope("read") -> "https://internal.example.org";
+//	oauthUserSpanTag("plain") -> oauthTokeninfoAnyScope("read") -> "https://internal.example.org";
+func NewOAuthUserSpanTag() filters.Spec {
+	return &userSpanTagSpec{}
+}
+
+func (*userSpanTagSpec) Name() string { return OAuthUserSpanTagName }
+
+// CreateFilter accepts optionally "masked", the default, or "plain".
+func (*userSpanTagSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(sargs) == 0:
+		return &userSpanTagFilter{}, nil
+	case len(sargs) == 1 && sargs[0] == userTagMasked:
+		return &userSpanTagFilter{}, nil
+	case len(sargs) == 1 && sargs[0] == userTagPlain:
+		return &userSpanTagFilter{plain: true}, nil
+	default:
+		return nil, filters.ErrInvalidFilterParameters
+	}
+}
+
+func (f *userSpanTagFilter) Request(ctx filters.FilterContext) {
+	ctx.StateBag()[userSpanTagKey] = f
+}
+
+func (*userSpanTagFilter) Response(filters.FilterContext) {}
+
+// maskUser returns the prefix of the hex encoded SHA-256 hash of the
+// username.
+func maskUser(username string) string {
+	h := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(h[:])[:maskedUserLength]
+}
+
+// tagUser sets the username as a tag of the request span, when the
+// route has the oauthUserSpanTag filter.
+func tagUser(ctx filters.FilterContext, username string) {
+	if username == "" {
+		return
+	}
+
+	f, ok := ctx.StateBag()[userSpanTagKey].(*userSpanTagFilter)
+	if !ok {
+		return
+	}
+
+	span := opentracing.SpanFromContext(ctx.Request().Context())
+	if span == nil {
+		return
+	}
+
+	if !f.plain {
+		username = maskUser(username)
+	}
+
+	span.SetTag(userSpanTag, username)
+}
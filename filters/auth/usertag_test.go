@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestUserSpanTag(t *testing.T) {
+	tracer := mocktracer.New()
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		reject   bool
+		expected interface{}
+	}{{
+		msg:      "no filter",
+		expected: nil,
+	}, {
+		msg:      "masked by default",
+		args:     []interface{}{},
+		expected: maskUser("jdoe"),
+	}, {
+		msg:      "masked",
+		args:     []interface{}{"masked"},
+		expected: maskUser("jdoe"),
+	}, {
+		msg:      "plain",
+		args:     []interface{}{"plain"},
+		expected: "jdoe",
+	}, {
+		msg:      "rejected",
+		args:     []interface{}{},
+		reject:   true,
+		expected: maskUser("jdoe"),
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			span := tracer.StartSpan("proxy").(*mocktracer.MockSpan)
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+
+			if ti.args != nil {
+				f, err := NewOAuthUserSpanTag().CreateFilter(ti.args)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				f.Request(ctx)
+			}
+
+			if ti.reject {
+				forbidden(ctx, "jdoe", invalidScope, "")
+			} else {
+				authorized(ctx, "jdoe")
+			}
+
+			if tag := span.Tag("auth.user"); tag != ti.expected {
+				t.Errorf("unexpected tag: %v, expected: %v", tag, ti.expected)
+			}
+		})
+	}
+
+	t.Run("masked user", func(t *testing.T) {
+		m := maskUser("jdoe")
+		if len(m) != maskedUserLength || m == maskUser("jane") || m != maskUser("jdoe") {
+			t.Errorf("unexpected masked user: %s", m)
+		}
+	})
+
+	t.Run("no span", func(t *testing.T) {
+		ctx := &filtertest.Context{FRequest: httptest.NewRequest("GET", "/", nil), FStateBag: map[string]interface{}{}}
+		f, err := NewOAuthUserSpanTag().CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Request(ctx)
+		authorized(ctx, "jdoe")
+		unauthorized(ctx, "jdoe", invalidToken, "", "")
+		if ctx.FResponse.StatusCode != http.StatusUnauthorized {
+			t.Errorf("unexpected status code: %d", ctx.FResponse.StatusCode)
+		}
+	})
+}
+
+func TestUserSpanTagCreateFilter(t *testing.T) {
+	for _, args := range [][]interface{}{{"hashed"}, {"plain", "masked"}, {1}} {
+		if _, err := NewOAuthUserSpanTag().CreateFilter(args); err != filters.ErrInvalidFilterParameters {
+			t.Errorf("expected error for args %v: %v", args, err)
+		}
+	}
+}
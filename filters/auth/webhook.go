@@ -21,6 +21,9 @@ type WebhookOptions struct {
 	Timeout      time.Duration
 	MaxIdleConns int
 	Tracer       opentracing.Tracer
+
+	// Transport tunes the connections to the webhook.
+	Transport TransportOptions
 }
 
 type (
@@ -88,7 +91,7 @@ func (ws *webhookSpec) CreateFilter(args []interface{}) (filters.Filter, error)
 		}
 	}
 
-	ac, err := newAuthClient(s, webhookSpanName, ws.options.Timeout, ws.options.MaxIdleConns, ws.options.Tracer)
+	ac, err := newAuthClient(s, webhookSpanName, ws.options.Timeout, ws.options.MaxIdleConns, ws.options.Tracer, ws.options.Transport)
 	if err != nil {
 		return nil, filters.ErrInvalidFilterParameters
 	}
@@ -103,6 +106,10 @@ func copyHeader(to, from http.Header) {
 }
 
 func (f *webhookFilter) Request(ctx filters.FilterContext) {
+	if authBypassed(ctx) {
+		return
+	}
+
 	resp, err := f.authClient.getWebhook(ctx)
 	if err != nil {
 		log.Errorf("Failed to make authentication webhook request: %v.", err)
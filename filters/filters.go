@@ -112,6 +112,16 @@ type FilterContext interface {
 	Loopback()
 }
 
+// PathTemplateContext is an optional interface of the FilterContext.
+// Filters, that need the path pattern of the matched route, can
+// type-assert the FilterContext for it.
+type PathTemplateContext interface {
+	// Provides the path pattern of the Path or PathSubtree predicate of
+	// the matched route, e.g. /users/:id, or an empty string, when the
+	// route has neither.
+	PathTemplate() string
+}
+
 // Metrics provides possibility to use custom metrics from filter implementations. The custom metrics will
 // be exposed by the common metrics endpoint exposed by the proxy, where they can be accessed by the custom
 // key prefixed by the filter name and the string 'custom'. E.g: <filtername>.custom.<customkey>.
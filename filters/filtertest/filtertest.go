@@ -26,6 +26,7 @@ type Context struct {
 	FServed             bool
 	FServedWithResponse bool
 	FParams             map[string]string
+	FPathTemplate       string
 	FStateBag           map[string]interface{}
 	FBackendUrl         string
 	FOutgoingHost       string
@@ -43,6 +44,7 @@ func (fc *Context) Response() *http.Response            { return fc.FResponse }
 func (fc *Context) MarkServed()                         { fc.FServed = true }
 func (fc *Context) Served() bool                        { return fc.FServed }
 func (fc *Context) PathParam(key string) string         { return fc.FParams[key] }
+func (fc *Context) PathTemplate() string                { return fc.FPathTemplate }
 func (fc *Context) StateBag() map[string]interface{}    { return fc.FStateBag }
 func (fc *Context) OriginalRequest() *http.Request      { return nil }
 func (fc *Context) OriginalResponse() *http.Response    { return nil }
@@ -30,6 +30,10 @@ const (
 	// reject reason information into the state bag to pass the
 	// information to the auditLog filter.
 	AuthRejectReasonKey = "auth-reject-reason"
+	// AuthDecisionKey is used by the auth package to set the
+	// details of the authorization decision, an *AuthDecision, into
+	// the state bag to pass them to the auditLog filter.
+	AuthDecisionKey = "auth-decision"
 	// UnverifiedAuditLogName is the filtername seen by the user
 	UnverifiedAuditLogName = "unverifiedAuditLog"
 
@@ -45,9 +49,39 @@ var (
 	re = regexp.MustCompile("^[a-zA-z0-9_/:?=&%@.#-]*$")
 )
 
+// AuditLogOptions configures the auditLog filter.
+type AuditLogOptions struct {
+	// MaxAuditBody limits the size of the logged request body.
+	MaxAuditBody int
+
+	// ClaimValues enables logging the values of the claims, that
+	// were checked by the auth filters. By default only the claim
+	// keys are logged.
+	ClaimValues bool
+}
+
+// AuthDecision contains the details of an authorization decision of
+// the auth filters. The raw token is never part of it.
+type AuthDecision struct {
+	// RequiredScopes and PresentedScopes are the scopes required by
+	// the filter and the scopes of the token.
+	RequiredScopes  []string `json:"requiredScopes,omitempty"`
+	PresentedScopes []string `json:"presentedScopes,omitempty"`
+
+	// RequiredClaims are the keys of the claims checked by the
+	// filter, and MatchedClaims the keys, that satisfied the check.
+	RequiredClaims []string `json:"requiredClaims,omitempty"`
+	MatchedClaims  []string `json:"matchedClaims,omitempty"`
+
+	// ClaimValues are the values of the checked claims in the token.
+	// They are only logged when enabled in the AuditLogOptions.
+	ClaimValues map[string]interface{} `json:"claimValues,omitempty"`
+}
+
 type auditLog struct {
-	writer     io.Writer
-	maxBodyLog int
+	writer      io.Writer
+	maxBodyLog  int
+	claimValues bool
 }
 
 type teeBody struct {
@@ -66,9 +100,10 @@ type auditDoc struct {
 }
 
 type authStatusDoc struct {
-	User     string `json:"user,omitempty"`
-	Rejected bool   `json:"rejected"`
-	Reason   string `json:"reason,omitempty"`
+	User     string        `json:"user,omitempty"`
+	Rejected bool          `json:"rejected"`
+	Reason   string        `json:"reason,omitempty"`
+	Decision *AuthDecision `json:"decision,omitempty"`
 }
 
 func newTeeBody(rc io.ReadCloser, maxTee int) io.ReadCloser {
@@ -111,9 +146,16 @@ func (tb *teeBody) Write(b []byte) (int, error) {
 //
 //     spec := NewAuditLog(1024)
 func NewAuditLog(maxAuditBody int) filters.Spec {
+	return NewAuditLogWithOptions(AuditLogOptions{MaxAuditBody: maxAuditBody})
+}
+
+// NewAuditLogWithOptions creates an auditLog filter specification
+// configured by the options.
+func NewAuditLogWithOptions(o AuditLogOptions) filters.Spec {
 	return &auditLog{
-		writer:     os.Stderr,
-		maxBodyLog: maxAuditBody,
+		writer:      os.Stderr,
+		maxBodyLog:  o.MaxAuditBody,
+		claimValues: o.ClaimValues,
 	}
 }
 
@@ -126,7 +168,7 @@ func (al *auditLog) CreateFilter(args []interface{}) (filters.Filter, error) {
 		return nil, filters.ErrInvalidFilterParameters
 	}
 
-	return &auditLog{writer: al.writer, maxBodyLog: al.maxBodyLog}, nil
+	return &auditLog{writer: al.writer, maxBodyLog: al.maxBodyLog, claimValues: al.claimValues}, nil
 }
 
 func (al *auditLog) Request(ctx filters.FilterContext) {
@@ -146,13 +188,23 @@ func (al *auditLog) Response(ctx filters.FilterContext) {
 	sb := ctx.StateBag()
 	au, _ := sb[AuthUserKey].(string)
 	rr, _ := sb[AuthRejectReasonKey].(string)
+	ad, _ := sb[AuthDecisionKey].(*AuthDecision)
 
-	if au != "" || rr != "" {
+	if au != "" || rr != "" || ad != nil {
 		doc.AuthStatus = &authStatusDoc{User: au}
 		if rr != "" {
 			doc.AuthStatus.Rejected = true
 			doc.AuthStatus.Reason = rr
 		}
+
+		if ad != nil {
+			d := *ad
+			if !al.claimValues {
+				d.ClaimValues = nil
+			}
+
+			doc.AuthStatus.Decision = &d
+		}
 	}
 
 	if tb, ok := req.Body.(*teeBody); ok {
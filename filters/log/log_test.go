@@ -1,7 +1,10 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/zalando/skipper/filters/filtertest"
@@ -107,3 +110,61 @@ func TestRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestAuditLogAuthDecision(t *testing.T) {
+	for _, ti := range []struct {
+		msg         string
+		claimValues bool
+	}{{
+		msg: "claim values redacted",
+	}, {
+		msg:         "claim values enabled",
+		claimValues: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			var buf bytes.Buffer
+			spec := NewAuditLogWithOptions(AuditLogOptions{ClaimValues: ti.claimValues}).(*auditLog)
+			spec.writer = &buf
+
+			f, err := spec.CreateFilter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{
+				FRequest:  httptest.NewRequest("GET", "/orders", nil),
+				FResponse: &http.Response{StatusCode: http.StatusForbidden},
+				FStateBag: map[string]interface{}{
+					AuthUserKey:         "jdoe",
+					AuthRejectReasonKey: "invalid-scope",
+					AuthDecisionKey: &AuthDecision{
+						RequiredScopes:  []string{"orders.write"},
+						PresentedScopes: []string{"orders.read"},
+						RequiredClaims:  []string{"realm"},
+						ClaimValues:     map[string]interface{}{"realm": "users"},
+					},
+				},
+			}
+
+			f.Response(ctx)
+
+			var doc auditDoc
+			if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			d := doc.AuthStatus.Decision
+			if doc.AuthStatus.Reason != "invalid-scope" || d == nil {
+				t.Fatalf("unexpected auth status: %s", buf.String())
+			}
+
+			if d.RequiredScopes[0] != "orders.write" || d.PresentedScopes[0] != "orders.read" || d.RequiredClaims[0] != "realm" {
+				t.Errorf("unexpected decision: %s", buf.String())
+			}
+
+			if ti.claimValues != (d.ClaimValues["realm"] == "users") {
+				t.Errorf("unexpected claim values: %s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/ratelimit"
+)
+
+// concurrencyLimit acquires the slots of the requests in flight.
+type concurrencyLimit interface {
+	Acquire(context.Context, string) (func(), bool)
+}
+
+// concurrencyProvider is implemented by the providers, that support
+// the cluster concurrency limits.
+type concurrencyProvider interface {
+	concurrencyLimit(group string, max int, ttl time.Duration) concurrencyLimit
+}
+
+func (a *registryAdapter) concurrencyLimit(group string, max int, ttl time.Duration) concurrencyLimit {
+	if c := a.registry.ConcurrencyLimit(group, max, ttl); c != nil {
+		return c
+	}
+
+	return nil
+}
+
+type concurrencySpec struct {
+	provider RatelimitProvider
+}
+
+type concurrencyFilter struct {
+	group    string
+	max      int
+	ttl      time.Duration
+	lookuper ratelimit.Lookuper
+	provider RatelimitProvider
+}
+
+// NewClusterConcurrencyLimit creates a filter, that limits the
+// requests in flight of a client across all instances of the
+// cluster. The arguments are the group, the maximum number of
+// requests in flight, the TTL of a slot, and optionally the lookuper
+// like of the clusterClientRatelimit. A slot is acquired by the
+// request and released by the proxy, when the response body was
+// served or the request failed. The slot of a request, that died
+// without releasing it, expires after the TTL, so the TTL should be
+// longer than the longest request. It requires redis, without redis
+// all requests are allowed.
+//
+// It can be combined with a cluster ratelimit of the same client,
+// to limit both the rate and the concurrency of the requests:
+//
+//	api: Path("/api")
+//	-> clusterClientRatelimit("api", 100, "1m", "Authorization")
+//	-> clusterConcurrencyLimit("api", 5, "30s", "Authorization")
+//	-> "https://foo.backend.net";
+func NewClusterConcurrencyLimit(provider RatelimitProvider) filters.Spec {
+	return &concurrencySpec{provider: provider}
+}
+
+func (*concurrencySpec) Name() string {
+	return ratelimit.ClusterConcurrencyLimitName
+}
+
+func (s *concurrencySpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	group, err := getStringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	max, err := getIntArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if max <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	ttl, err := getDurationArg(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &concurrencyFilter{
+		group:    group,
+		max:      max,
+		ttl:      ttl,
+		provider: s.provider,
+	}
+
+	if len(args) > 3 {
+		if f.lookuper, err = getLookuperArg(args[3]); err != nil {
+			return nil, err
+		}
+	} else {
+		f.lookuper = ratelimit.NewXForwardedForLookuper()
+	}
+
+	return f, nil
+}
+
+func noRelease() {}
+
+// acquire acquires the slot of the request. The request is allowed
+// without a slot, when the concurrency limit or the client are not
+// available.
+func (f *concurrencyFilter) acquire(ctx filters.FilterContext) (func(), bool) {
+	cp, ok := f.provider.(concurrencyProvider)
+	if !ok {
+		log.Errorf("Concurrency limits are not supported by the ratelimit provider for group: %s", f.group)
+		return noRelease, true
+	}
+
+	limiter := cp.concurrencyLimit(f.group, f.max, f.ttl)
+	if limiter == nil {
+		log.Errorf("Concurrency limit is nil for group: %s", f.group)
+		return noRelease, true
+	}
+
+	s, _ := lookup(f.lookuper, ctx)
+	if s == "" {
+		log.Debugf("Lookuper found no data in request for concurrency limit group: %s and request: %v", f.group, ctx.Request())
+		return noRelease, true
+	}
+
+	return limiter.Acquire(ratelimit.WithHashedKeyMemo(ctx.Request().Context()), s)
+}
+
+// Request acquires a slot of the client and serves `429 Too Many
+// Requests`, if the maximum number of requests is in flight. The slot
+// is released by the proxy, after the response body was served, so a
+// slow response occupies the slot until its end.
+func (f *concurrencyFilter) Request(ctx filters.FilterContext) {
+	release, ok := f.acquire(ctx)
+	if !ok {
+		ctx.Serve(&http.Response{StatusCode: http.StatusTooManyRequests, Header: make(http.Header)})
+		return
+	}
+
+	pending, _ := ctx.StateBag()[ratelimit.ConcurrencyReleaseKey].([]func())
+	ctx.StateBag()[ratelimit.ConcurrencyReleaseKey] = append(pending, release)
+}
+
+// Response does nothing, the slot is released by the proxy.
+func (*concurrencyFilter) Response(filters.FilterContext) {}
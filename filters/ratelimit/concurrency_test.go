@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+	"github.com/zalando/skipper/ratelimit"
+)
+
+type testConcurrencyLimit struct {
+	max      int
+	inFlight map[string]int
+}
+
+func (l *testConcurrencyLimit) get(ratelimit.Settings) limit { return nil }
+
+func (l *testConcurrencyLimit) concurrencyLimit(string, int, time.Duration) concurrencyLimit {
+	return l
+}
+
+func (l *testConcurrencyLimit) Acquire(_ context.Context, s string) (func(), bool) {
+	if l.inFlight[s] >= l.max {
+		return nil, false
+	}
+
+	l.inFlight[s]++
+	return func() { l.inFlight[s]-- }, true
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	provider := &testConcurrencyLimit{max: 2, inFlight: make(map[string]int)}
+	f, err := NewClusterConcurrencyLimit(provider).CreateFilter([]interface{}{"groupA", 2, "30s", "Authorization"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(token string) *filtertest.Context {
+		r, _ := http.NewRequest("GET", "https://www.example.org", nil)
+		r.Header.Set("Authorization", token)
+		ctx := &filtertest.Context{FRequest: r, FStateBag: make(map[string]interface{})}
+		f.Request(ctx)
+		return ctx
+	}
+
+	first := request("foo")
+	second := request("foo")
+	if first.FServed || second.FServed {
+		t.Fatal("request denied under the limit")
+	}
+
+	denied := request("foo")
+	if !denied.FServed || denied.FResponse.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("request allowed over the limit")
+	}
+
+	if other := request("bar"); other.FServed {
+		t.Fatal("request of another client denied")
+	}
+
+	if _, ok := denied.FStateBag[ratelimit.ConcurrencyReleaseKey]; ok {
+		t.Fatal("denied request holds a slot")
+	}
+
+	// the slot is held until the proxy served the response body
+	f.Response(first)
+	if provider.inFlight["foo"] != 2 {
+		t.Fatalf("slot released by the response: %d", provider.inFlight["foo"])
+	}
+
+	release := func(ctx *filtertest.Context) {
+		pending, _ := ctx.FStateBag[ratelimit.ConcurrencyReleaseKey].([]func())
+		for _, release := range pending {
+			release()
+		}
+	}
+
+	release(first)
+	if provider.inFlight["foo"] != 1 {
+		t.Fatalf("failed to release the slot: %d", provider.inFlight["foo"])
+	}
+
+	if third := request("foo"); third.FServed {
+		t.Fatal("request denied after release")
+	}
+
+	release(second)
+	if provider.inFlight["foo"] != 1 {
+		t.Fatalf("failed to release the pending slot: %d", provider.inFlight["foo"])
+	}
+}
+
+func TestConcurrencyLimitNotSupported(t *testing.T) {
+	f, err := NewClusterConcurrencyLimit(&noLimit{}).CreateFilter([]interface{}{"groupA", 1, "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx := &filtertest.Context{FRequest: &http.Request{}, FStateBag: make(map[string]interface{})}
+		f.Request(ctx)
+		if ctx.FServed {
+			t.Fatal("request denied without concurrency limit")
+		}
+	}
+}
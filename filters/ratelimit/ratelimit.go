@@ -7,24 +7,103 @@ package ratelimit
 
 import (
 	"context"
+	"fmt"
+	stdnet "net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/net"
 	"github.com/zalando/skipper/ratelimit"
 )
 
 type spec struct {
-	typ        ratelimit.RatelimitType
-	provider   RatelimitProvider
-	filterName string
+	typ          ratelimit.RatelimitType
+	provider     RatelimitProvider
+	filterName   string
+	dryRun       bool
+	hierarchical bool
+	multiWindow  bool
+	dedupe       bool
+	clientCert   bool
 }
 
+// DryRunForbiddenKey is the key in the state bag, which is set to
+// true, when a rate limiter in dry-run mode would have denied the
+// request.
+const DryRunForbiddenKey = "ratelimit:dryrun:forbidden"
+
+// SoftLimitKey is the key in the state bag, which is set to true,
+// when an allowed request exceeded the soft limit of a cluster
+// ratelimit. The response of the request gets the
+// X-RateLimit-Warning header.
+const SoftLimitKey = "ratelimit:softlimit"
+
+// WindowKey is the key in the state bag, which is set to the time
+// window of a multi-window cluster ratelimit, e.g. 1s, that denied the
+// request, for logging.
+const WindowKey = "ratelimit:window"
+
+// defaultFingerprintBodySize is the default maximum size of the body
+// of the requests of clusterRequestDedupe, that are hashed into their
+// fingerprint.
+const defaultFingerprintBodySize = 1 << 16
+
+// backendErrorRetryAfter is the Retry-After header in seconds of the
+// requests denied, because the ratelimit failed closed.
+const backendErrorRetryAfter = 1
+
+// softLimitWarning is the value of the X-RateLimit-Warning header.
+const softLimitWarning = "soft limit exceeded"
+
+// bypassedMetricsKey counts the requests, that bypassed the ratelimit
+// filters, because they came from one of the bypass CIDRs.
+const bypassedMetricsKey = "ratelimit.bypassed"
+
+// deniedMetricsKey and backendErrorMetricsKey count the requests
+// denied, because they exceeded the limit, and because the ratelimit
+// failed closed.
+const (
+	deniedMetricsKey       = "ratelimit.denied.limit"
+	backendErrorMetricsKey = "ratelimit.denied.backend-error"
+)
+
+// missingClientCertMetricsKey counts the requests denied by
+// clusterClientCertRatelimit, because they had no verified client
+// certificate.
+const missingClientCertMetricsKey = "ratelimit.denied.missing-client-cert"
+
+// bodyTooLargeMetricsKey counts the requests denied by
+// clusterRequestDedupe, because their body was larger than the maximum
+// body size.
+const bodyTooLargeMetricsKey = "ratelimit.denied.body-too-large"
+
+// the clusterClientCertRatelimit options
+const (
+	clientCertFingerprint = "fingerprint"
+	clientCertSubject     = "subject"
+	clientCertReject      = "reject"
+	clientCertBypass      = "bypass"
+)
+
 type filter struct {
 	settings ratelimit.Settings
 	provider RatelimitProvider
+
+	// requests from the bypass networks are not ratelimited
+	bypass         []*stdnet.IPNet
+	trustedProxies int
+
+	// the denied duplicates are served with 409 Conflict
+	conflict bool
+
+	// the requests without key are denied with 403 Forbidden,
+	// instead of bypassing the ratelimit
+	rejectMissingKey bool
 }
 
 // RatelimitProvider returns a limit instance for provided Settings
@@ -33,12 +112,111 @@ type RatelimitProvider interface {
 }
 
 type limit interface {
-	// AllowContext is used to decide if call is allowed to pass
-	AllowContext(context.Context, string) bool
+	// AllowResultContext is used to decide if call is allowed to
+	// pass
+	AllowResultContext(context.Context, string) ratelimit.AllowResult
+
+	// RetryAfterContext is used to inform the client how many
+	// seconds it should wait before making a new request
+	RetryAfterContext(context.Context, string) int
+}
+
+// nLimit extends limit with the AllowN method, that counts a request
+// with a declared cost as n hits.
+type nLimit interface {
+	limit
+	AllowN(context.Context, string, int) ratelimit.AllowResult
+}
+
+// DefaultMaxCost is the default maximum of the request cost declared
+// by the cost header.
+const DefaultMaxCost = 10
+
+// CostOptions configure the cost of a request, declared by trusted
+// backends or clients in a header, e.g. X-RateLimit-Cost: 5. The cost
+// is counted as hits by the cluster ratelimits, that support it.
+type CostOptions struct {
+	// Header is the name of the header declaring the cost as
+	// positive integer. Requests without a valid header cost 1. The
+	// cost is disabled, if it is empty.
+	Header string
+
+	// MaxCost clamps the declared cost to prevent abuse. Defaults
+	// to DefaultMaxCost.
+	MaxCost int
+}
+
+// costProvider is implemented by the providers configured with
+// CostOptions.
+type costProvider interface {
+	costOptions() CostOptions
+}
+
+// ProviderOptions configure the ratelimit filters created with the
+// provider.
+type ProviderOptions struct {
+	// Cost configures the cost of the requests.
+	Cost CostOptions
+
+	// SoftLimit is the fraction of the max hits of the cluster
+	// ratelimits, e.g. 0.8, after which the allowed requests get the
+	// X-RateLimit-Warning header. 0 disables the soft limit.
+	SoftLimit float64
+
+	// RetryAfterDate sets the Retry-After header of the ratelimited
+	// responses as HTTP-date, instead of delta-seconds.
+	RetryAfterDate bool
+
+	// NormalizeKeys lowercases the keys, and strips the surrounding
+	// whitespace and a trailing dot, before they are hashed.
+	NormalizeKeys bool
+
+	// BypassCIDRs are the networks, e.g. of health checkers and
+	// internal services, whose requests are not ratelimited.
+	BypassCIDRs []string
+
+	// TrustedProxies is the number of the proxies in front of skipper,
+	// that append the address of the client to the X-Forwarded-For
+	// header. It is used to find the address of the client, checked
+	// against the BypassCIDRs. 0 means the remote address of the
+	// connection is checked.
+	TrustedProxies int
+
+	// BackendErrorStatus is the status code of the requests denied,
+	// because the ratelimit failed closed, when redis failed.
+	// Defaults to 503 Service Unavailable.
+	BackendErrorStatus int
+}
+
+// softLimitProvider is implemented by the providers configured with
+// a soft limit.
+type softLimitProvider interface {
+	softLimit() float64
+}
+
+// bypassProvider is implemented by the providers configured with
+// bypass networks.
+type bypassProvider interface {
+	bypassOptions() ([]string, int)
+}
+
+// backendErrorStatusProvider is implemented by the providers, that
+// configure the status code of the requests denied, because the
+// ratelimit failed closed.
+type backendErrorStatusProvider interface {
+	backendErrorStatus() int
+}
+
+// normalizeKeysProvider is implemented by the providers, that can
+// normalize the keys of the ratelimits.
+type normalizeKeysProvider interface {
+	normalizeKeys() bool
+}
 
-	// RetryAfter is used to inform the client how many seconds it
-	// should wait before making a new request
-	RetryAfter(string) int
+// retryAfterDateProvider is implemented by the providers, that can
+// configure the Retry-After header as HTTP-date.
+type retryAfterDateProvider interface {
+	retryAfterDate() bool
 }
 
 // RegistryAdapter adapts ratelimit.Registry to RateLimitProvider interface.
@@ -48,14 +226,71 @@ type limit interface {
 // and enables easier test stubbing
 type registryAdapter struct {
 	registry *ratelimit.Registry
+	cost     CostOptions
+	soft     float64
+	date     bool
+	normKeys bool
+	bypass   []string
+	proxies  int
+	status   int
 }
 
 func (a *registryAdapter) get(s ratelimit.Settings) limit {
 	return a.registry.Get(s)
 }
 
+func (a *registryAdapter) costOptions() CostOptions {
+	return a.cost
+}
+
+func (a *registryAdapter) softLimit() float64 {
+	return a.soft
+}
+
+func (a *registryAdapter) retryAfterDate() bool {
+	return a.date
+}
+
+func (a *registryAdapter) normalizeKeys() bool {
+	return a.normKeys
+}
+
+func (a *registryAdapter) bypassOptions() ([]string, int) {
+	return a.bypass, a.proxies
+}
+
+func (a *registryAdapter) backendErrorStatus() int {
+	return a.status
+}
+
 func NewRatelimitProvider(registry *ratelimit.Registry) RatelimitProvider {
-	return &registryAdapter{registry}
+	return &registryAdapter{registry: registry}
+}
+
+// NewRatelimitProviderWithCost is like NewRatelimitProvider, but the
+// filters read the cost of the requests from the header of the
+// CostOptions.
+func NewRatelimitProviderWithCost(registry *ratelimit.Registry, o CostOptions) RatelimitProvider {
+	return NewRatelimitProviderWithOptions(registry, ProviderOptions{Cost: o})
+}
+
+// NewRatelimitProviderWithOptions is like NewRatelimitProvider, but
+// the filters are configured with the ProviderOptions.
+func NewRatelimitProviderWithOptions(registry *ratelimit.Registry, o ProviderOptions) RatelimitProvider {
+	if o.Cost.MaxCost <= 0 {
+		o.Cost.MaxCost = DefaultMaxCost
+	}
+
+	return &registryAdapter{
+		registry: registry,
+		cost:     o.Cost,
+		soft:     o.SoftLimit,
+		date:     o.RetryAfterDate,
+		normKeys: o.NormalizeKeys,
+		bypass:   o.BypassCIDRs,
+		proxies:  o.TrustedProxies,
+		status:   o.BackendErrorStatus,
+	}
 }
 
 // NewLocalRatelimit is *DEPRECATED*, use NewClientRatelimit, instead
@@ -142,6 +377,116 @@ func NewClusterClientRateLimit(provider RatelimitProvider) filters.Spec {
 	return &spec{typ: ratelimit.ClusterClientRatelimit, provider: provider, filterName: ratelimit.ClusterClientRatelimitName}
 }
 
+// NewClusterRateLimitDryRun creates a cluster rate limiting in dry-run
+// mode, which takes the same arguments as NewClusterRateLimit. The hits
+// are counted and the decision is calculated, but the requests are not
+// denied. The requests that would be denied, are marked in the state
+// bag with DryRunForbiddenKey.
+//
+// Example:
+//
+//    backendHealthcheck: Path("/healthcheck")
+//    -> clusterRatelimitDryRun("groupA", 200, "1m")
+//    -> "https://foo.backend.net";
+//
+func NewClusterRateLimitDryRun(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterServiceRatelimit, provider: provider, filterName: ratelimit.ClusterServiceRatelimitDryRunName, dryRun: true}
+}
+
+// NewClusterClientRateLimitDryRun creates a cluster client rate
+// limiting in dry-run mode, which takes the same arguments as
+// NewClusterClientRateLimit.
+//
+// Example:
+//
+//    backendHealthcheck: Path("/login")
+//    -> clusterClientRatelimitDryRun("groupC", 20, "1h", "Authorization")
+//    -> "https://foo.backend.net";
+//
+func NewClusterClientRateLimitDryRun(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterClientRatelimit, provider: provider, filterName: ratelimit.ClusterClientRatelimitDryRunName, dryRun: true}
+}
+
+// NewClusterHierarchicalRateLimit creates a cluster rate limiting of a
+// group, that shares a parent budget with other groups. The first three
+// arguments are the same as of NewClusterRateLimit, followed by the
+// name of the parent budget, the maximum hits of the parent budget and
+// the hits reserved for the group. The group is allowed the reserved
+// hits, even when the other groups exhausted the parent budget.
+//
+// Example:
+//
+//    api: Path("/api")
+//    -> clusterHierarchicalRatelimit("groupA", 200, "1m", "api", 1000, 50)
+//    -> "https://foo.backend.net";
+//
+func NewClusterHierarchicalRateLimit(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterServiceRatelimit, provider: provider, filterName: ratelimit.ClusterHierarchicalRatelimitName, hierarchical: true}
+}
+
+// NewClusterMultiWindowRateLimit creates a cluster rate limiting, that
+// enforces several time windows for the same key, e.g. for burst and
+// sustained protection, without chaining several ratelimit filters.
+// The first argument is the group, followed by at least two pairs of
+// the maximum hits and the time window, and optionally the lookuper of
+// NewClusterClientRateLimit, which makes it a cluster client rate
+// limiting. The requests are denied, when they exceed any of the
+// windows, and the time window, that denied the request, is stored in
+// the state bag with WindowKey. It requires redis.
+//
+// Example:
+//
+//    api: Path("/api")
+//    -> clusterMultiWindowRatelimit("groupA", 10, "1s", 100, "1m", "Authorization")
+//    -> "https://foo.backend.net";
+//
+func NewClusterMultiWindowRateLimit(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterServiceRatelimit, provider: provider, filterName: ratelimit.ClusterMultiWindowRatelimitName, multiWindow: true}
+}
+
+// NewClusterRequestDedupe creates a cluster rate limiting of the
+// identical requests, e.g. to protect non-idempotent endpoints from
+// retried or replayed requests. The requests are identical, when the
+// method, the host, the path, the query and the body are the same. The
+// arguments are the group, the maximum number of identical requests,
+// the time window, and optionally the maximum size of the body in
+// bytes, which defaults to 64KiB. The body is restored, before the
+// request is forwarded. The requests with larger bodies are denied with
+// 413 Request Entity Too Large, the duplicates with 409 Conflict. With
+// maximum body size 0, the body is not compared. It requires redis.
+//
+// Example:
+//
+//    payments: Path("/payments") && Method("POST")
+//    -> clusterRequestDedupe("payments", 1, "10s")
+//    -> "https://foo.backend.net";
+//
+func NewClusterRequestDedupe(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterClientRatelimit, provider: provider, filterName: ratelimit.ClusterRequestDedupeName, dedupe: true}
+}
+
+// NewClusterClientCertRatelimit creates a cluster client rate
+// limiting, that selects the client by its verified TLS client
+// certificate, instead of its IP, e.g. for mTLS-fronted APIs. The
+// arguments are the group, the maximum hits, the time window, and
+// optionally the key of the client, "fingerprint", the SHA-256 hash of
+// the certificate, which is the default, or "subject", the subject of
+// the certificate, and what happens to the requests without verified
+// client certificate, "reject", the default, denies them with 403
+// Forbidden, and "bypass" doesn't ratelimit them. The certificates
+// have to be verified by the TLS config of the proxy, see
+// ratelimit.ClientCertLookuper.
+//
+// Example:
+//
+//    api: Path("/api")
+//    -> clusterClientCertRatelimit("groupA", 100, "1m", "subject", "bypass")
+//    -> "https://foo.backend.net";
+//
+func NewClusterClientCertRatelimit(provider RatelimitProvider) filters.Spec {
+	return &spec{typ: ratelimit.ClusterClientRatelimit, provider: provider, filterName: ratelimit.ClusterClientCertRatelimitName, clientCert: true}
+}
+
 // NewDisableRatelimit disables rate limiting
 //
 // Example:
@@ -213,6 +558,103 @@ func clusterRatelimitFilter(args []interface{}) (*filter, error) {
 	return &filter{settings: s}, nil
 }
 
+func clusterHierarchicalRatelimitFilter(args []interface{}) (*filter, error) {
+	if len(args) != 6 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f, err := clusterRatelimitFilter(args[:3])
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := getStringArg(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	parentMaxHits, err := getIntArg(args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	reserved, err := getIntArg(args[5])
+	if err != nil {
+		return nil, err
+	}
+
+	if parent == "" || parentMaxHits <= 0 || reserved < 0 || reserved > f.settings.MaxHits || reserved > parentMaxHits {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f.settings.Parent = parent
+	f.settings.ParentMaxHits = parentMaxHits
+	f.settings.Reserved = reserved
+	return f, nil
+}
+
+func clusterMultiWindowRatelimitFilter(args []interface{}) (*filter, error) {
+	if len(args) < 5 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	group, err := getStringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	s := ratelimit.Settings{
+		Type:     ratelimit.ClusterServiceRatelimit,
+		Group:    group,
+		Lookuper: ratelimit.NewSameBucketLookuper(),
+	}
+
+	pairs := args[1:]
+	if len(pairs)%2 == 1 {
+		if s.Lookuper, err = getLookuperArg(pairs[len(pairs)-1]); err != nil {
+			return nil, err
+		}
+
+		s.Type = ratelimit.ClusterClientRatelimit
+		pairs = pairs[:len(pairs)-1]
+	}
+
+	if len(pairs) < 4 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	var windows []ratelimit.Window
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < len(pairs); i += 2 {
+		maxHits, err := getIntArg(pairs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		timeWindow, err := getDurationArg(pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		// the windows are stored by their duration
+		if timeWindow <= 0 || seen[timeWindow] {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		seen[timeWindow] = true
+		windows = append(windows, ratelimit.Window{MaxHits: maxHits, TimeWindow: timeWindow})
+	}
+
+	s.MaxHits = windows[0].MaxHits
+	s.TimeWindow = windows[0].TimeWindow
+	s.Windows = ratelimit.FormatWindows(windows[1:])
+	if s.Type == ratelimit.ClusterClientRatelimit {
+		s.CleanInterval = 10 * s.TimeWindow
+	}
+
+	return &filter{settings: s}, nil
+}
+
 func clusterClientRatelimitFilter(args []interface{}) (*filter, error) {
 	if !(len(args) == 3 || len(args) == 4) {
 		return nil, filters.ErrInvalidFilterParameters
@@ -242,19 +684,9 @@ func clusterClientRatelimitFilter(args []interface{}) (*filter, error) {
 	}
 
 	if len(args) > 3 {
-		lookuperString, err := getStringArg(args[3])
-		if err != nil {
+		if s.Lookuper, err = getLookuperArg(args[3]); err != nil {
 			return nil, err
 		}
-		if strings.Contains(lookuperString, ",") {
-			var lookupers []ratelimit.Lookuper
-			for _, ls := range strings.Split(lookuperString, ",") {
-				lookupers = append(lookupers, getLookuper(ls))
-			}
-			s.Lookuper = ratelimit.NewTupleLookuper(lookupers...)
-		} else {
-			s.Lookuper = getLookuper(lookuperString)
-		}
 	} else {
 		s.Lookuper = ratelimit.NewXForwardedForLookuper()
 	}
@@ -262,6 +694,160 @@ func clusterClientRatelimitFilter(args []interface{}) (*filter, error) {
 	return &filter{settings: s}, nil
 }
 
+func clusterRequestDedupeFilter(args []interface{}) (*filter, error) {
+	if !(len(args) == 3 || len(args) == 4) {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	group, err := getStringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	maxHits, err := getIntArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	timeWindow, err := getDurationArg(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if maxHits < 1 || timeWindow <= 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	maxBodySize := defaultFingerprintBodySize
+	if len(args) > 3 {
+		if maxBodySize, err = getIntArg(args[3]); err != nil {
+			return nil, err
+		}
+
+		if maxBodySize < 0 {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	return &filter{
+		settings: ratelimit.Settings{
+			Type:          ratelimit.ClusterClientRatelimit,
+			Group:         group,
+			MaxHits:       maxHits,
+			TimeWindow:    timeWindow,
+			CleanInterval: 10 * timeWindow,
+			Lookuper:      ratelimit.NewRequestFingerprintLookuper(int64(maxBodySize)),
+		},
+		conflict: true,
+	}, nil
+}
+
+func clusterClientCertRatelimitFilter(args []interface{}) (*filter, error) {
+	if len(args) < 3 || len(args) > 5 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f, err := clusterClientRatelimitFilter(args[:3])
+	if err != nil {
+		return nil, err
+	}
+
+	var subject bool
+	if len(args) > 3 {
+		key, err := getStringArg(args[3])
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case clientCertFingerprint:
+		case clientCertSubject:
+			subject = true
+		default:
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	f.settings.Lookuper = ratelimit.NewClientCertLookuper(subject)
+	f.rejectMissingKey = true
+	if len(args) > 4 {
+		missing, err := getStringArg(args[4])
+		if err != nil {
+			return nil, err
+		}
+
+		switch missing {
+		case clientCertReject:
+		case clientCertBypass:
+			f.rejectMissingKey = false
+		default:
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	return f, nil
+}
+
+// getLookuperArg returns the lookuper of the cluster client
+// ratelimits, a template, a comma separated list of headers, or a
+// single header.
+func getLookuperArg(a interface{}) (ratelimit.Lookuper, error) {
+	lookuperString, err := getStringArg(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if isTemplate(lookuperString) {
+		l, err := ratelimit.NewTemplateLookuper(lookuperString)
+		if err != nil {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		return l, nil
+	}
+
+	if strings.Contains(lookuperString, ",") {
+		var lookupers []ratelimit.Lookuper
+		for _, ls := range strings.Split(lookuperString, ",") {
+			lookupers = append(lookupers, getLookuper(ls))
+		}
+
+		return ratelimit.NewTupleLookuper(lookupers...), nil
+	}
+
+	return getLookuper(lookuperString), nil
+}
+
+// isTemplate tells whether the lookuper argument is a template for
+// the ratelimit.TemplateLookuper, e.g. "{client-ip}:{path}".
+func isTemplate(s string) bool {
+	return strings.ContainsAny(s, "{}")
+}
+
+// lookup returns the bucket of the request, rendering the path
+// template of the matched route for the lookupers, that use it.
+func lookup(l ratelimit.Lookuper, ctx filters.FilterContext) (string, error) {
+	if fl, ok := l.(ratelimit.RequestFingerprintLookuper); ok {
+		s, err := fl.LookupBody(ctx.Request())
+		if err == ratelimit.ErrRequestBodyTooLarge {
+			return "", err
+		}
+
+		return s, nil
+	}
+
+	if rl, ok := l.(ratelimit.RouteLookuper); ok {
+		var template string
+		if pc, ok := ctx.(filters.PathTemplateContext); ok {
+			template = pc.PathTemplate()
+		}
+
+		return rl.LookupRoute(ctx.Request(), template), nil
+	}
+
+	return l.Lookup(ctx.Request()), nil
+}
+
 func getLookuper(s string) ratelimit.Lookuper {
 	headerName := http.CanonicalHeaderKey(s)
 	if headerName == "X-Forwarded-For" {
@@ -292,7 +878,11 @@ func clientRatelimitFilter(args []interface{}) (*filter, error) {
 		if err != nil {
 			return nil, err
 		}
-		if strings.Contains(lookuperString, ",") {
+		if isTemplate(lookuperString) {
+			if lookuper, err = ratelimit.NewTemplateLookuper(lookuperString); err != nil {
+				return nil, filters.ErrInvalidFilterParameters
+			}
+		} else if strings.Contains(lookuperString, ",") {
 			var lookupers []ratelimit.Lookuper
 			for _, ls := range strings.Split(lookuperString, ",") {
 				lookupers = append(lookupers, getLookuper(ls))
@@ -328,10 +918,54 @@ func (s *spec) CreateFilter(args []interface{}) (filters.Filter, error) {
 	f, err := s.createFilter(args)
 	if f != nil {
 		f.provider = s.provider
+		f.settings.DryRun = s.dryRun
+		if sp, ok := s.provider.(softLimitProvider); ok &&
+			(s.typ == ratelimit.ClusterServiceRatelimit || s.typ == ratelimit.ClusterClientRatelimit) {
+			f.settings.SoftLimit = sp.softLimit()
+		}
+
+		if np, ok := s.provider.(normalizeKeysProvider); ok && f.settings.Type != ratelimit.DisableRatelimit {
+			f.settings.NormalizeKeys = np.normalizeKeys()
+		}
+
+		if bp, ok := s.provider.(bypassProvider); ok {
+			cidrs, proxies := bp.bypassOptions()
+			for _, c := range cidrs {
+				_, n, perr := stdnet.ParseCIDR(c)
+				if perr != nil {
+					return nil, fmt.Errorf("invalid ratelimit bypass CIDR %q: %w", c, perr)
+				}
+
+				f.bypass = append(f.bypass, n)
+			}
+
+			f.trustedProxies = proxies
+		}
 	}
 	return f, err
 }
 
+// bypassed tells whether the request came from one of the bypass
+// networks.
+func (f *filter) bypassed(r *http.Request) bool {
+	if len(f.bypass) == 0 {
+		return false
+	}
+
+	ip := net.RemoteHostBehindProxyCount(r, f.trustedProxies)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range f.bypass {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *spec) createFilter(args []interface{}) (*filter, error) {
 	switch s.typ {
 	case ratelimit.ServiceRatelimit:
@@ -342,8 +976,24 @@ func (s *spec) createFilter(args []interface{}) (*filter, error) {
 	case ratelimit.ClientRatelimit:
 		return clientRatelimitFilter(args)
 	case ratelimit.ClusterServiceRatelimit:
+		if s.hierarchical {
+			return clusterHierarchicalRatelimitFilter(args)
+		}
+
+		if s.multiWindow {
+			return clusterMultiWindowRatelimitFilter(args)
+		}
+
 		return clusterRatelimitFilter(args)
 	case ratelimit.ClusterClientRatelimit:
+		if s.dedupe {
+			return clusterRequestDedupeFilter(args)
+		}
+
+		if s.clientCert {
+			return clusterClientCertRatelimitFilter(args)
+		}
+
 		return clusterClientRatelimitFilter(args)
 	default:
 		return disableFilter(args)
@@ -379,6 +1029,40 @@ func getDurationArg(a interface{}) (time.Duration, error) {
 	return time.Duration(i) * time.Second, err
 }
 
+// cost returns the cost of the request declared by the cost header,
+// clamped to the configured maximum. Without the header, or with an
+// invalid value, the request costs 1.
+func (f *filter) cost(r *http.Request) int {
+	cp, ok := f.provider.(costProvider)
+	if !ok {
+		return 1
+	}
+
+	o := cp.costOptions()
+	if o.Header == "" {
+		return 1
+	}
+
+	v := r.Header.Get(o.Header)
+	if v == "" {
+		return 1
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Debugf("Invalid ratelimit cost in header %s: %q", o.Header, v)
+		return 1
+	}
+
+	if n > o.MaxCost {
+		log.Debugf("Ratelimit cost in header %s: %d clamped to %d", o.Header, n, o.MaxCost)
+		return o.MaxCost
+	}
+
+	log.Debugf("Ratelimit cost in header %s: %d", o.Header, n)
+	return n
+}
+
 // Request checks ratelimit using filter settings and serves `429 Too Many Requests` response if limit is reached
 func (f *filter) Request(ctx filters.FilterContext) {
 	rateLimiter := f.provider.get(f.settings)
@@ -392,18 +1076,108 @@ func (f *filter) Request(ctx filters.FilterContext) {
 		return
 	}
 
-	s := f.settings.Lookuper.Lookup(ctx.Request())
+	if f.bypassed(ctx.Request()) {
+		metrics.Default.IncCounter(bypassedMetricsKey)
+		return
+	}
+
+	s, err := lookup(f.settings.Lookuper, ctx)
+	if err == ratelimit.ErrRequestBodyTooLarge {
+		metrics.Default.IncCounter(bodyTooLargeMetricsKey)
+		ctx.Serve(&http.Response{StatusCode: http.StatusRequestEntityTooLarge})
+		return
+	}
+
+	if s == "" && f.rejectMissingKey {
+		metrics.Default.IncCounter(missingClientCertMetricsKey)
+		ctx.Serve(&http.Response{StatusCode: http.StatusForbidden})
+		return
+	}
+
 	if s == "" {
 		log.Debugf("Lookuper found no data in request for settings: %s and request: %v", f.settings, ctx.Request())
 		return
 	}
 
-	if !rateLimiter.AllowContext(ctx.Request().Context(), s) {
+	// the request context carries the tracing span of the proxy, and
+	// memoizes the hashed key for the calls of the request
+	reqCtx := ratelimit.WithHashedKeyMemo(ctx.Request().Context())
+	var result ratelimit.AllowResult
+	if ln, ok := rateLimiter.(nLimit); ok {
+		result = ln.AllowN(reqCtx, s, f.cost(ctx.Request()))
+	} else {
+		result = rateLimiter.AllowResultContext(reqCtx, s)
+	}
+	if result.DryRunForbidden {
+		ctx.StateBag()[DryRunForbiddenKey] = true
+	}
+
+	if result.SoftLimited {
+		ctx.StateBag()[SoftLimitKey] = true
+	}
+
+	if result.Window > 0 {
+		ctx.StateBag()[WindowKey] = result.Window.String()
+	}
+
+	if !result.Allowed && result.BackendError {
+		metrics.Default.IncCounter(backendErrorMetricsKey)
+		f.serveBackendError(ctx)
+		return
+	}
+
+	if !result.Allowed {
+		metrics.Default.IncCounter(deniedMetricsKey)
+		retryAfter := rateLimiter.RetryAfterContext(reqCtx, s)
+		result.RetryAfter = retryAfter
+		if result.Limit == 0 {
+			result.Limit = f.settings.MaxHits
+		}
+
+		h := ratelimit.ResultHeaders(&f.settings, result)
+
+		if dp, ok := f.provider.(retryAfterDateProvider); ok && dp.retryAfterDate() {
+			h.Set(ratelimit.RetryAfterHeader, ratelimit.RetryAfterDate(time.Now(), retryAfter))
+		}
+
+		status := http.StatusTooManyRequests
+		if f.conflict {
+			status = http.StatusConflict
+		}
+
 		ctx.Serve(&http.Response{
-			StatusCode: http.StatusTooManyRequests,
-			Header:     ratelimit.Headers(&f.settings, rateLimiter.RetryAfter(s)),
+			StatusCode: status,
+			Header:     h,
 		})
 	}
 }
 
-func (*filter) Response(filters.FilterContext) {}
+// serveBackendError serves the requests denied, because the ratelimit
+// failed closed. The client didn't exceed the limit, so the response
+// is not 429 Too Many Requests, and it doesn't have the ratelimit
+// headers.
+func (f *filter) serveBackendError(ctx filters.FilterContext) {
+	status := http.StatusServiceUnavailable
+	if sp, ok := f.provider.(backendErrorStatusProvider); ok && sp.backendErrorStatus() != 0 {
+		status = sp.backendErrorStatus()
+	}
+
+	h := http.Header{}
+	h.Set(ratelimit.RetryAfterHeader, strconv.Itoa(backendErrorRetryAfter))
+	if dp, ok := f.provider.(retryAfterDateProvider); ok && dp.retryAfterDate() {
+		h.Set(ratelimit.RetryAfterHeader, ratelimit.RetryAfterDate(time.Now(), backendErrorRetryAfter))
+	}
+
+	ctx.Serve(&http.Response{
+		StatusCode: status,
+		Header:     h,
+	})
+}
+
+// Response adds the X-RateLimit-Warning header to the response, when
+// the request exceeded the soft limit.
+func (*filter) Response(ctx filters.FilterContext) {
+	if softLimited, _ := ctx.StateBag()[SoftLimitKey].(bool); softLimited {
+		ctx.Response().Header.Set(ratelimit.WarningHeader, softLimitWarning)
+	}
+}
@@ -2,13 +2,23 @@ package ratelimit
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/zalando/skipper/eskip"
 	"github.com/zalando/skipper/filters"
 	"github.com/zalando/skipper/filters/filtertest"
+	"github.com/zalando/skipper/proxy/proxytest"
 	"github.com/zalando/skipper/ratelimit"
 )
 
@@ -41,6 +51,8 @@ func TestArgs(t *testing.T) {
 	t.Run("client", func(t *testing.T) {
 		rl := NewClientRatelimit(provider)
 		t.Run("missing", testErr(rl, nil))
+		t.Run("template", testOK(rl, 3, "1m", "{client-ip}:{header:X-Api-Version}:{path}"))
+		t.Run("unknown template placeholder", testErr(rl, 3, "1m", "{client-ip}:{unknown}"))
 	})
 
 	t.Run("cluster", func(t *testing.T) {
@@ -51,6 +63,61 @@ func TestArgs(t *testing.T) {
 	t.Run("clusterClient", func(t *testing.T) {
 		rl := NewClusterClientRateLimit(provider)
 		t.Run("missing", testErr(rl, nil))
+		t.Run("template", testOK(rl, "groupA", 3, "1m", "{client-ip}:{header:X-Api-Version}:{path}"))
+		t.Run("unterminated template placeholder", testErr(rl, "groupA", 3, "1m", "{client-ip"))
+	})
+
+	t.Run("clusterHierarchical", func(t *testing.T) {
+		rl := NewClusterHierarchicalRateLimit(provider)
+		t.Run("missing", testErr(rl, nil))
+		t.Run("ok", testOK(rl, "groupA", 20, "1m", "parent", 100, 5))
+		t.Run("missing parent", testErr(rl, "groupA", 20, "1m"))
+		t.Run("empty parent", testErr(rl, "groupA", 20, "1m", "", 100, 5))
+		t.Run("reserved over max hits", testErr(rl, "groupA", 20, "1m", "parent", 100, 30))
+		t.Run("zero parent max hits", testErr(rl, "groupA", 20, "1m", "parent", 0, 0))
+		t.Run("negative parent max hits", testErr(rl, "groupA", 20, "1m", "parent", -1, 0))
+		t.Run("reserved over parent max hits", testErr(rl, "groupA", 20, "1m", "parent", 10, 15))
+	})
+
+	t.Run("clusterMultiWindow", func(t *testing.T) {
+		rl := NewClusterMultiWindowRateLimit(provider)
+		t.Run("missing", testErr(rl, nil))
+		t.Run("ok", testOK(rl, "groupA", 10, "1s", 100, "1m"))
+		t.Run("lookuper", testOK(rl, "groupA", 10, "1s", 100, "1m", 1000, "1h", "Authorization"))
+		t.Run("single window", testErr(rl, "groupA", 10, "1s"))
+		t.Run("single window with lookuper", testErr(rl, "groupA", 10, "1s", "Authorization"))
+		t.Run("duplicate window", testErr(rl, "groupA", 10, "1m", 100, "1m"))
+		t.Run("zero window", testErr(rl, "groupA", 10, "0s", 100, "1m"))
+	})
+
+	t.Run("clusterRequestDedupe", func(t *testing.T) {
+		rl := NewClusterRequestDedupe(provider)
+		t.Run("missing", testErr(rl, nil))
+		t.Run("ok", testOK(rl, "groupA", 1, "10s"))
+		t.Run("body size", testOK(rl, "groupA", 1, "10s", 1024))
+		t.Run("zero max", testErr(rl, "groupA", 0, "10s"))
+		t.Run("negative body size", testErr(rl, "groupA", 1, "10s", -1))
+		t.Run("too many", testErr(rl, "groupA", 1, "10s", 1024, "Authorization"))
+	})
+
+	t.Run("clusterClientCert", func(t *testing.T) {
+		rl := NewClusterClientCertRatelimit(provider)
+		t.Run("missing", testErr(rl, nil))
+		t.Run("ok", testOK(rl, "groupA", 10, "1m"))
+		t.Run("subject", testOK(rl, "groupA", 10, "1m", "subject", "bypass"))
+		t.Run("unknown key", testErr(rl, "groupA", 10, "1m", "serial"))
+		t.Run("unknown missing", testErr(rl, "groupA", 10, "1m", "fingerprint", "allow"))
+		t.Run("too many", testErr(rl, "groupA", 10, "1m", "fingerprint", "reject", "X-Foo"))
+	})
+
+	t.Run("clusterConcurrency", func(t *testing.T) {
+		rl := NewClusterConcurrencyLimit(provider)
+		t.Run("missing", testErr(rl, nil))
+		t.Run("ok", testOK(rl, "groupA", 5, "30s"))
+		t.Run("lookuper", testOK(rl, "groupA", 5, "30s", "Authorization"))
+		t.Run("zero max", testErr(rl, "groupA", 0, "30s"))
+		t.Run("zero ttl", testErr(rl, "groupA", 5, "0s"))
+		t.Run("too many", testErr(rl, "groupA", 5, "30s", "Authorization", "X-Foo"))
 	})
 
 	t.Run("disable", func(t *testing.T) {
@@ -76,8 +143,10 @@ func (l *testLimit) get(s ratelimit.Settings) limit {
 	}
 	return l
 }
-func (l *testLimit) AllowContext(context.Context, string) bool { return false }
-func (l *testLimit) RetryAfter(string) int                     { return 31415 }
+func (l *testLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	return ratelimit.AllowResult{}
+}
+func (l *testLimit) RetryAfterContext(context.Context, string) int { return 31415 }
 
 func TestRateLimit(t *testing.T) {
 	test := func(
@@ -127,8 +196,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		3,
@@ -146,8 +217,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		3.3,
@@ -166,8 +239,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"1"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"1"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"2"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		2,
@@ -186,8 +261,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		3,
@@ -208,8 +285,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		3,
@@ -228,8 +307,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		3,
@@ -249,8 +330,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		"mygroup",
@@ -271,8 +354,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		"mygroup",
@@ -295,8 +380,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		"mygroup",
@@ -318,8 +405,10 @@ func TestRateLimit(t *testing.T) {
 		&http.Response{
 			StatusCode: http.StatusTooManyRequests,
 			Header: http.Header{
-				"X-Rate-Limit": []string{"10800"},
-				"Retry-After":  []string{"31415"},
+				"X-Rate-Limit":          []string{"10800"},
+				"Retry-After":           []string{"31415"},
+				"X-Ratelimit-Limit":     []string{"3"},
+				"X-Ratelimit-Remaining": []string{"0"},
 			},
 		},
 		"mygroup",
@@ -345,8 +434,12 @@ func (n *noLimit) get(ratelimit.Settings) limit {
 	}
 	return n
 }
-func (n *noLimit) AllowContext(context.Context, string) bool { return true }
-func (n *noLimit) RetryAfter(string) int                     { panic("unexpected RetryAfter call") }
+func (n *noLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	return ratelimit.AllowResult{Allowed: true}
+}
+func (n *noLimit) RetryAfterContext(context.Context, string) int {
+	panic("unexpected RetryAfterContext call")
+}
 
 func TestNilLimit(t *testing.T) {
 	f := &filter{provider: &noLimit{nilLimit: true}}
@@ -397,3 +490,602 @@ func TestAllowsContext(t *testing.T) {
 		t.Errorf("unexpected response: %v", ctx.FResponse)
 	}
 }
+
+type dryRunLimit struct {
+	settings ratelimit.Settings
+}
+
+func (l *dryRunLimit) get(s ratelimit.Settings) limit {
+	l.settings = s
+	return l
+}
+
+func (l *dryRunLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	return ratelimit.AllowResult{Allowed: true, DryRunForbidden: true}
+}
+
+func (l *dryRunLimit) RetryAfterContext(context.Context, string) int {
+	panic("unexpected RetryAfterContext call")
+}
+
+func TestDryRun(t *testing.T) {
+	provider := &dryRunLimit{}
+	f, err := NewClusterClientRateLimitDryRun(provider).CreateFilter([]interface{}{"groupA", 3, "1m", "Authorization"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &filtertest.Context{
+		FRequest:  &http.Request{Header: http.Header{"Authorization": []string{"foo"}}},
+		FStateBag: map[string]interface{}{},
+	}
+
+	f.Request(ctx)
+
+	if !provider.settings.DryRun {
+		t.Error("failed to set dry-run mode")
+	}
+
+	if ctx.FResponse != nil {
+		t.Errorf("unexpected response: %v", ctx.FResponse)
+	}
+
+	if ctx.FStateBag[DryRunForbiddenKey] != true {
+		t.Error("failed to mark the request in the state bag")
+	}
+}
+
+type contextLimit struct {
+	allowCtx, retryCtx context.Context
+}
+
+func (l *contextLimit) get(ratelimit.Settings) limit { return l }
+
+func (l *contextLimit) AllowResultContext(ctx context.Context, _ string) ratelimit.AllowResult {
+	l.allowCtx = ctx
+	return ratelimit.AllowResult{}
+}
+
+func (l *contextLimit) RetryAfterContext(ctx context.Context, _ string) int {
+	l.retryCtx = ctx
+	return 1
+}
+
+func TestRequestContext(t *testing.T) {
+	type key struct{}
+	provider := &contextLimit{}
+	f := &filter{settings: ratelimit.Settings{MaxHits: 1, TimeWindow: time.Second, Lookuper: &lookuper{"key"}}, provider: provider}
+
+	req := (&http.Request{}).WithContext(context.WithValue(context.Background(), key{}, "span"))
+	f.Request(&filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}})
+
+	if provider.allowCtx == nil || provider.allowCtx.Value(key{}) != "span" {
+		t.Error("failed to pass the request context to the allow decision")
+	}
+
+	if provider.retryCtx == nil || provider.retryCtx.Value(key{}) != "span" {
+		t.Error("failed to pass the request context to the retry after query")
+	}
+}
+
+type costLimit struct {
+	cost CostOptions
+	n    int
+}
+
+func (l *costLimit) get(ratelimit.Settings) limit { return l }
+
+func (l *costLimit) costOptions() CostOptions { return l.cost }
+
+func (l *costLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	panic("unexpected AllowResultContext call")
+}
+
+func (l *costLimit) AllowN(_ context.Context, _ string, n int) ratelimit.AllowResult {
+	l.n = n
+	return ratelimit.AllowResult{Allowed: true}
+}
+
+func (l *costLimit) RetryAfterContext(context.Context, string) int { return 1 }
+
+func TestCost(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		header   string
+		value    string
+		expected int
+	}{{
+		msg:      "disabled",
+		value:    "5",
+		expected: 1,
+	}, {
+		msg:      "no header",
+		header:   "X-RateLimit-Cost",
+		expected: 1,
+	}, {
+		msg:      "declared cost",
+		header:   "X-RateLimit-Cost",
+		value:    "5",
+		expected: 5,
+	}, {
+		msg:      "clamped cost",
+		header:   "X-RateLimit-Cost",
+		value:    "500",
+		expected: DefaultMaxCost,
+	}, {
+		msg:      "negative cost",
+		header:   "X-RateLimit-Cost",
+		value:    "-5",
+		expected: 1,
+	}, {
+		msg:      "invalid cost",
+		header:   "X-RateLimit-Cost",
+		value:    "2.5",
+		expected: 1,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			provider := &costLimit{cost: CostOptions{Header: ti.header, MaxCost: DefaultMaxCost}}
+			f := &filter{settings: ratelimit.Settings{Lookuper: &lookuper{"key"}}, provider: provider}
+
+			req := &http.Request{Header: http.Header{}}
+			req.Header.Set("X-RateLimit-Cost", ti.value)
+			f.Request(&filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}})
+
+			if provider.n != ti.expected {
+				t.Errorf("unexpected cost: %d != %d", provider.n, ti.expected)
+			}
+		})
+	}
+}
+
+func TestRemainingHeader(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	provider := NewRatelimitProviderWithOptions(registry, ProviderOptions{Cost: CostOptions{Header: "X-RateLimit-Cost", MaxCost: 10}})
+	f, err := NewClusterClientRateLimit(provider).CreateFilter([]interface{}{"remaining", 4, "1m", "Authorization"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(cost string) *filtertest.Context {
+		ctx := &filtertest.Context{
+			FRequest:  &http.Request{Header: http.Header{"Authorization": []string{"foo"}, "X-Ratelimit-Cost": []string{cost}}},
+			FStateBag: map[string]interface{}{},
+		}
+
+		f.Request(ctx)
+		return ctx
+	}
+
+	if ctx := request("3"); ctx.FServed {
+		t.Fatal("first request ratelimited")
+	}
+
+	ctx := request("3")
+	if !ctx.FServed {
+		t.Fatal("request exceeding the remaining hits not ratelimited")
+	}
+
+	if h := ctx.FResponse.Header.Get(ratelimit.RemainingHeader); h != "1" {
+		t.Errorf("unexpected remaining header: %q", h)
+	}
+
+	if h := ctx.FResponse.Header.Get(ratelimit.LimitHeader); h != "4" {
+		t.Errorf("unexpected limit header: %q", h)
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	provider := NewRatelimitProviderWithOptions(registry, ProviderOptions{SoftLimit: 0.5})
+	f, err := NewClusterClientRateLimit(provider).CreateFilter([]interface{}{"soft-limit", 4, "1m", "Authorization"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"", "soft limit exceeded", "soft limit exceeded"} {
+		ctx := &filtertest.Context{
+			FRequest:  &http.Request{Header: http.Header{"Authorization": []string{"foo"}}},
+			FResponse: &http.Response{Header: http.Header{}},
+			FStateBag: map[string]interface{}{},
+		}
+
+		f.Request(ctx)
+		f.Response(ctx)
+
+		if ctx.FServed {
+			t.Fatalf("request %d ratelimited", i+1)
+		}
+
+		if h := ctx.FResponse.Header.Get(ratelimit.WarningHeader); h != expected {
+			t.Errorf("unexpected warning header of request %d: %q != %q", i+1, h, expected)
+		}
+	}
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	for _, ti := range []struct {
+		msg  string
+		date bool
+	}{{
+		msg: "delta-seconds",
+	}, {
+		msg:  "HTTP-date",
+		date: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			provider := NewRatelimitProviderWithOptions(registry, ProviderOptions{RetryAfterDate: ti.date})
+			f, err := NewClusterClientRateLimit(provider).CreateFilter([]interface{}{"retry-after-" + ti.msg, 1, "1m", "Authorization"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ctx *filtertest.Context
+			for i := 0; i < 2; i++ {
+				ctx = &filtertest.Context{
+					FRequest:  &http.Request{Header: http.Header{"Authorization": []string{"foo"}}},
+					FStateBag: map[string]interface{}{},
+				}
+
+				f.Request(ctx)
+			}
+
+			if !ctx.FServed {
+				t.Fatal("request not ratelimited")
+			}
+
+			h := ctx.FResponse.Header.Get(ratelimit.RetryAfterHeader)
+			if _, err := strconv.Atoi(h); (err == nil) == ti.date {
+				t.Errorf("unexpected Retry-After header: %q", h)
+			}
+
+			if _, err := http.ParseTime(h); (err == nil) != ti.date {
+				t.Errorf("unexpected Retry-After header: %q", h)
+			}
+		})
+	}
+}
+
+func TestBypass(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	provider := NewRatelimitProviderWithOptions(registry, ProviderOptions{
+		BypassCIDRs:    []string{"10.0.0.0/8", "2001:db8::/32"},
+		TrustedProxies: 1,
+	})
+
+	f, err := NewClusterRateLimit(provider).CreateFilter([]interface{}{"bypass", 1, "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg         string
+		forwarded   string
+		ratelimited bool
+	}{{
+		msg:       "first request",
+		forwarded: "1.2.3.4",
+	}, {
+		msg:         "ratelimited",
+		forwarded:   "1.2.3.4",
+		ratelimited: true,
+	}, {
+		msg:       "bypassed",
+		forwarded: "10.1.2.3",
+	}, {
+		msg:       "bypassed ipv6",
+		forwarded: "2001:db8::1",
+	}, {
+		msg:         "spoofed client address",
+		forwarded:   "10.1.2.3, 1.2.3.4",
+		ratelimited: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: "192.168.0.1:4242", Header: http.Header{"X-Forwarded-For": []string{ti.forwarded}}}
+			ctx := &filtertest.Context{FRequest: r, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+			if ctx.FServed != ti.ratelimited {
+				t.Errorf("unexpected ratelimit: %v", ctx.FServed)
+			}
+		})
+	}
+
+	invalid := NewRatelimitProviderWithOptions(registry, ProviderOptions{BypassCIDRs: []string{"10.0.0.0"}})
+	if _, err := NewClusterRateLimit(invalid).CreateFilter([]interface{}{"bypass", 1, "1m"}); err == nil {
+		t.Error("failed to fail for a malformed CIDR")
+	}
+}
+
+type windowLimit struct {
+	settings ratelimit.Settings
+}
+
+func (l *windowLimit) get(s ratelimit.Settings) limit {
+	l.settings = s
+	return l
+}
+
+func (l *windowLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	return ratelimit.AllowResult{Limit: 10, Window: time.Second}
+}
+
+func (l *windowLimit) RetryAfterContext(context.Context, string) int { return 1 }
+
+func TestMultiWindow(t *testing.T) {
+	provider := &windowLimit{}
+	f, err := NewClusterMultiWindowRateLimit(provider).CreateFilter([]interface{}{"groupA", 10, "1s", 100, "1m", 1000, "1h", "Authorization"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &filtertest.Context{
+		FRequest:  &http.Request{Header: http.Header{"Authorization": []string{"foo"}}},
+		FStateBag: map[string]interface{}{},
+	}
+
+	f.Request(ctx)
+
+	s := provider.settings
+	if s.Type != ratelimit.ClusterClientRatelimit || s.Group != "groupA" || s.MaxHits != 10 || s.TimeWindow != time.Second || s.Windows != "100/1m0s,1000/1h0m0s" {
+		t.Errorf("unexpected settings: %v", s)
+	}
+
+	if !ctx.FServed || ctx.FResponse.StatusCode != http.StatusTooManyRequests {
+		t.Error("failed to ratelimit the request")
+	}
+
+	if ctx.FStateBag[WindowKey] != "1s" {
+		t.Errorf("unexpected window in the state bag: %v", ctx.FStateBag[WindowKey])
+	}
+}
+
+func TestRequestDedupe(t *testing.T) {
+	provider := &windowLimit{}
+	f, err := NewClusterRequestDedupe(provider).CreateFilter([]interface{}{"groupA", 1, "10s", 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &filtertest.Context{
+		FRequest:  httptest.NewRequest("POST", "/payments", strings.NewReader("payload")),
+		FStateBag: map[string]interface{}{},
+	}
+
+	f.Request(ctx)
+
+	s := provider.settings
+	if s.Type != ratelimit.ClusterClientRatelimit || s.Group != "groupA" || s.MaxHits != 1 || s.TimeWindow != 10*time.Second {
+		t.Errorf("unexpected settings: %v", s)
+	}
+
+	if s.Lookuper != ratelimit.NewRequestFingerprintLookuper(8) {
+		t.Errorf("unexpected lookuper: %v", s.Lookuper)
+	}
+
+	if !ctx.FServed || ctx.FResponse.StatusCode != http.StatusConflict {
+		t.Error("failed to deny the duplicate request")
+	}
+}
+
+func TestRequestDedupeMaxBodySize(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	f, err := NewClusterRequestDedupe(NewRatelimitProvider(registry)).CreateFilter([]interface{}{"groupA", 1, "10s", 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg    string
+		body   string
+		status int
+	}{{
+		msg:    "under the limit",
+		body:   "1234567",
+		status: http.StatusOK,
+	}, {
+		msg:    "at the limit",
+		body:   "12345678",
+		status: http.StatusOK,
+	}, {
+		msg:    "just over the limit",
+		body:   "123456789",
+		status: http.StatusRequestEntityTooLarge,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/payments", ioutil.NopCloser(strings.NewReader(ti.body)))
+			req.ContentLength = -1
+			ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			status := http.StatusOK
+			if ctx.FServed {
+				status = ctx.FResponse.StatusCode
+			}
+
+			if status != ti.status {
+				t.Errorf("unexpected status: %d, expected: %d", status, ti.status)
+			}
+
+			if status != http.StatusOK {
+				return
+			}
+
+			b, err := ioutil.ReadAll(ctx.Request().Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != ti.body {
+				t.Errorf("failed to restore the body: %q", b)
+			}
+		})
+	}
+}
+
+func TestClientCertRatelimit(t *testing.T) {
+	registry := ratelimit.NewInMemoryRegistry()
+	defer registry.Close()
+
+	provider := NewRatelimitProvider(registry)
+	request := func(f filters.Filter, cn string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cn != "" {
+			cert := &x509.Certificate{Raw: []byte(cn), Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+
+		ctx := &filtertest.Context{FRequest: req, FStateBag: map[string]interface{}{}}
+		f.Request(ctx)
+		if ctx.FServed {
+			return ctx.FResponse.StatusCode
+		}
+
+		return http.StatusOK
+	}
+
+	f, err := NewClusterClientCertRatelimit(provider).CreateFilter([]interface{}{"cert", 1, "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := request(f, "client-a"); status != http.StatusOK {
+		t.Errorf("unexpected status of the first request: %d", status)
+	}
+
+	if status := request(f, "client-a"); status != http.StatusTooManyRequests {
+		t.Errorf("unexpected status over the limit: %d", status)
+	}
+
+	if status := request(f, "client-b"); status != http.StatusOK {
+		t.Errorf("unexpected status of another client: %d", status)
+	}
+
+	if status := request(f, ""); status != http.StatusForbidden {
+		t.Errorf("unexpected status without client certificate: %d", status)
+	}
+
+	bypass, err := NewClusterClientCertRatelimit(provider).CreateFilter([]interface{}{"cert-bypass", 1, "1m", "subject", "bypass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := request(bypass, ""); status != http.StatusOK {
+			t.Errorf("unexpected status without client certificate: %d", status)
+		}
+	}
+}
+
+type backendErrorLimit struct {
+	status int
+}
+
+func (l *backendErrorLimit) get(ratelimit.Settings) limit { return l }
+
+func (l *backendErrorLimit) backendErrorStatus() int { return l.status }
+
+func (l *backendErrorLimit) AllowResultContext(context.Context, string) ratelimit.AllowResult {
+	return ratelimit.AllowResult{Limit: 10, BackendError: true}
+}
+
+func (l *backendErrorLimit) RetryAfterContext(context.Context, string) int { return 60 }
+
+func TestBackendError(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		status   int
+		expected int
+	}{{
+		msg:      "default status",
+		expected: http.StatusServiceUnavailable,
+	}, {
+		msg:      "configured status",
+		status:   http.StatusInternalServerError,
+		expected: http.StatusInternalServerError,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			f, err := NewClusterRateLimit(&backendErrorLimit{status: ti.status}).CreateFilter([]interface{}{"groupA", 10, "1m"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &filtertest.Context{FRequest: &http.Request{}, FStateBag: map[string]interface{}{}}
+			f.Request(ctx)
+
+			if !ctx.FServed || ctx.FResponse.StatusCode != ti.expected {
+				t.Fatal("failed to deny the request with the backend error status")
+			}
+
+			if h := ctx.FResponse.Header.Get(ratelimit.RetryAfterHeader); h != "1" {
+				t.Errorf("unexpected Retry-After header: %q", h)
+			}
+
+			if h := ctx.FResponse.Header.Get(ratelimit.Header); h != "" {
+				t.Errorf("unexpected ratelimit header: %q", h)
+			}
+		})
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+
+	registry := ratelimit.NewRegistry()
+	defer registry.Close()
+
+	spec := NewClientRatelimit(NewRatelimitProvider(registry))
+	fr := make(filters.Registry)
+	fr.Register(spec)
+
+	routes, err := eskip.Parse(fmt.Sprintf(`
+		orders: Path("/users/:id/orders/:orderId") -> clientRatelimit(2, "1m", "{path-template}") -> "%s";
+		users: Path("/users/:id") -> clientRatelimit(2, "1m", "{path-template}") -> "%s";
+	`, backend.URL, backend.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := proxytest.New(fr, routes...)
+	defer p.Close()
+
+	get := func(path string) int {
+		rsp, err := http.Get(p.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// the requests of all the orders share the bucket of the route
+	for _, ti := range []struct {
+		path     string
+		expected int
+	}{
+		{"/users/1/orders/1", http.StatusOK},
+		{"/users/2/orders/2", http.StatusOK},
+		{"/users/3/orders/3", http.StatusTooManyRequests},
+		{"/users/1", http.StatusOK},
+		{"/users/2", http.StatusOK},
+		{"/users/3", http.StatusTooManyRequests},
+	} {
+		if status := get(ti.path); status != ti.expected {
+			t.Errorf("unexpected status code for %s: %d != %d", ti.path, status, ti.expected)
+		}
+	}
+}
@@ -78,6 +78,20 @@ type Metrics interface {
 	UpdateGauge(key string, value float64)
 }
 
+// Labels are the names and values of the labels of a metric.
+type Labels map[string]string
+
+// LabeledMetrics is implemented by the backends supporting labels,
+// e.g. Prometheus. The clients, that can provide their metrics with
+// labels, e.g. the cluster ratelimits, check whether the injected
+// Metrics implement it, and fall back to the dot-delimited keys
+// otherwise. The set of the label names must be the same for every
+// call with the same key.
+type LabeledMetrics interface {
+	MeasureSinceWithLabels(key string, labels Labels, start time.Time)
+	IncCounterWithLabels(key string, labels Labels)
+}
+
 // Options for initializing metrics collection.
 type Options struct {
 	// the metrics exposing format.
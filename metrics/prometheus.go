@@ -3,7 +3,10 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,6 +24,8 @@ const (
 	promCustomSubsystem    = "custom"
 )
 
+var promInvalidNameChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
 // Prometheus implements the prometheus metrics backend.
 type Prometheus struct {
 	// Metrics.
@@ -44,9 +49,15 @@ type Prometheus struct {
 	customCounterM             *prometheus.CounterVec
 	customGaugeM               *prometheus.GaugeVec
 
-	opts     Options
-	registry *prometheus.Registry
-	handler  http.Handler
+	// The metrics with labels, created on their first use.
+	labeledMu         sync.Mutex
+	labeledCounters   map[string]*prometheus.CounterVec
+	labeledHistograms map[string]*prometheus.HistogramVec
+
+	namespace string
+	opts      Options
+	registry  *prometheus.Registry
+	handler   http.Handler
 }
 
 // NewPrometheus returns a new Prometheus metric backend.
@@ -222,8 +233,12 @@ func NewPrometheus(opts Options) *Prometheus {
 		customGaugeM:               customGauge,
 		customHistogramM:           customHistogram,
 
-		registry: opts.PrometheusRegistry,
-		opts:     opts,
+		labeledCounters:   make(map[string]*prometheus.CounterVec),
+		labeledHistograms: make(map[string]*prometheus.HistogramVec),
+
+		namespace: namespace,
+		registry:  opts.PrometheusRegistry,
+		opts:      opts,
 	}
 
 	if p.registry == nil {
@@ -314,6 +329,68 @@ func (p *Prometheus) UpdateGauge(key string, v float64) {
 	p.customGaugeM.WithLabelValues(key).Set(v)
 }
 
+// promLabeledName returns the name of the metric with labels of the
+// key, e.g. swarm_redis_query for swarm.redis.query.
+func promLabeledName(key string) string {
+	return promInvalidNameChars.ReplaceAllString(key, "_")
+}
+
+func labelNames(labels Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// MeasureSinceWithLabels satisfies LabeledMetrics interface. The
+// durations are exported as the histogram
+// <namespace>_custom_<key>_duration_seconds.
+func (p *Prometheus) MeasureSinceWithLabels(key string, labels Labels, start time.Time) {
+	p.labeledMu.Lock()
+	h, ok := p.labeledHistograms[key]
+	if !ok {
+		h = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: p.namespace,
+			Subsystem: promCustomSubsystem,
+			Name:      promLabeledName(key) + "_duration_seconds",
+			Help:      "Duration in seconds of " + key + ".",
+			Buckets:   p.opts.HistogramBuckets,
+		}, labelNames(labels))
+		p.registry.MustRegister(h)
+		p.labeledHistograms[key] = h
+	}
+	p.labeledMu.Unlock()
+
+	if o, err := h.GetMetricWith(prometheus.Labels(labels)); err == nil {
+		o.Observe(p.sinceS(start))
+	}
+}
+
+// IncCounterWithLabels satisfies LabeledMetrics interface. The counts
+// are exported as the counter <namespace>_custom_<key>_total.
+func (p *Prometheus) IncCounterWithLabels(key string, labels Labels) {
+	p.labeledMu.Lock()
+	c, ok := p.labeledCounters[key]
+	if !ok {
+		c = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: p.namespace,
+			Subsystem: promCustomSubsystem,
+			Name:      promLabeledName(key) + "_total",
+			Help:      "Total number of " + key + ".",
+		}, labelNames(labels))
+		p.registry.MustRegister(c)
+		p.labeledCounters[key] = c
+	}
+	p.labeledMu.Unlock()
+
+	if m, err := c.GetMetricWith(prometheus.Labels(labels)); err == nil {
+		m.Inc()
+	}
+}
+
 // MeasureRouteLookup satisfies Metrics interface.
 func (p *Prometheus) MeasureRouteLookup(start time.Time) {
 	t := p.sinceS(start)
@@ -691,6 +691,32 @@ func TestPrometheusMetrics(t *testing.T) {
 			},
 			expCode: http.StatusOK,
 		},
+		{
+			name: "Incrementing the counters with labels should get the totals of the labels.",
+			addMetrics: func(pm *metrics.Prometheus) {
+				pm.IncCounterWithLabels("swarm.redis.ratelimit", metrics.Labels{"result": "allows", "group": "A"})
+				pm.IncCounterWithLabels("swarm.redis.ratelimit", metrics.Labels{"result": "allows", "group": "A"})
+				pm.IncCounterWithLabels("swarm.redis.ratelimit", metrics.Labels{"result": "forbids", "group": "B"})
+			},
+			expMetrics: []string{
+				`skipper_custom_swarm_redis_ratelimit_total{group="A",result="allows"} 2`,
+				`skipper_custom_swarm_redis_ratelimit_total{group="B",result="forbids"} 1`,
+			},
+			expCode: http.StatusOK,
+		},
+		{
+			name: "Measuring with labels should get the durations of the labels.",
+			addMetrics: func(pm *metrics.Prometheus) {
+				pm.MeasureSinceWithLabels("swarm.redis.query", metrics.Labels{"operation": "allow", "result": "success", "group": "A"}, time.Now().Add(-15*time.Millisecond))
+				pm.MeasureSinceWithLabels("swarm.redis.query", metrics.Labels{"operation": "allow", "result": "failure", "group": "A"}, time.Now().Add(-3*time.Millisecond))
+			},
+			expMetrics: []string{
+				`skipper_custom_swarm_redis_query_duration_seconds_bucket{group="A",operation="allow",result="success",le="0.025"} 1`,
+				`skipper_custom_swarm_redis_query_duration_seconds_count{group="A",operation="allow",result="success"} 1`,
+				`skipper_custom_swarm_redis_query_duration_seconds_bucket{group="A",operation="allow",result="failure",le="0.005"} 1`,
+			},
+			expCode: http.StatusOK,
+		},
 		{
 			name: "Updating custom gauges should update custom gauges in the gauges custom metrics",
 			addMetrics: func(pm *metrics.Prometheus) {
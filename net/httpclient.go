@@ -3,6 +3,7 @@ package net
 import (
 	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
@@ -17,6 +18,7 @@ import (
 
 const (
 	defaultIdleConnTimeout = 30 * time.Second
+	defaultKeepAlive       = 30 * time.Second
 	defaultRefreshInterval = 5 * time.Minute
 )
 
@@ -157,6 +159,9 @@ type Options struct {
 	// Timeout sets all Timeouts, that are set to 0 to the given
 	// value. Basically it's the default timeout value.
 	Timeout time.Duration
+	// DialTimeout see https://golang.org/pkg/net/#Dialer.Timeout, if
+	// not set or set to 0, the connections are dialed without timeout.
+	DialTimeout time.Duration
 	// TLSHandshakeTimeout see
 	// https://golang.org/pkg/net/http/#Transport.TLSHandshakeTimeout,
 	// if not set or set to 0, its using Options.Timeout.
@@ -256,6 +261,13 @@ func NewTransport(options Options) *Transport {
 		ExpectContinueTimeout:  options.ExpectContinueTimeout,
 	}
 
+	if options.DialTimeout > 0 {
+		htransport.DialContext = (&net.Dialer{
+			Timeout:   options.DialTimeout,
+			KeepAlive: defaultKeepAlive,
+		}).DialContext
+	}
+
 	t := &Transport{
 		quit:   make(chan struct{}),
 		tr:     htransport,
@@ -335,7 +347,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if t.spanName != "" {
 		req, span = t.injectSpan(req)
 		defer span.Finish()
-		req = injectClientTrace(req, span)
+		req = InjectClientTrace(req, span)
 		span.LogKV("http_do", "start")
 	}
 	if t.bearerToken != "" {
@@ -373,7 +385,10 @@ func (t *Transport) injectSpan(req *http.Request) (*http.Request, opentracing.Sp
 	return req, span
 }
 
-func injectClientTrace(req *http.Request, span opentracing.Span) *http.Request {
+// InjectClientTrace returns a shallow copy of the request with an
+// httptrace.ClientTrace, that logs the DNS, TCP connect, TLS handshake
+// and connection pool events into the given span.
+func InjectClientTrace(req *http.Request, span opentracing.Span) *http.Request {
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(httptrace.DNSStartInfo) {
 			span.LogKV("DNS", "start")
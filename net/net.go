@@ -61,3 +61,88 @@ func RemoteHostFromLast(r *http.Request) net.IP {
 
 	return parse(r.RemoteAddr)
 }
+
+// RemoteHostBehindProxies returns the remote address of the client,
+// when the request passed the given trusted proxies. It walks the
+// 'X-Forwarded-For' header from right to left, starting with the
+// remote address of the connection, and returns the first address,
+// that is not a trusted proxy. Unlike RemoteHost, it can't be spoofed
+// by the client, by sending an 'X-Forwarded-For' header.
+//
+// Example, where proxy1 and proxy2 are trusted:
+//
+//     X-Forwarded-For: spoofed, client, proxy1
+//     RemoteAddr: proxy2
+func RemoteHostBehindProxies(r *http.Request, proxies []*net.IPNet) net.IP {
+	ip := parse(r.RemoteAddr)
+	if ip == nil || !containsIP(proxies, ip) {
+		return ip
+	}
+
+	ffs := r.Header.Get("X-Forwarded-For")
+	if ffs == "" {
+		return ip
+	}
+
+	ffa := strings.Split(ffs, ",")
+	for i := len(ffa) - 1; i >= 0; i-- {
+		ffip := parse(strings.TrimSpace(ffa[i]))
+		if ffip == nil {
+			return ip
+		}
+
+		ip = ffip
+		if !containsIP(proxies, ip) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+// RemoteHostBehindProxyCount returns the remote address of the client,
+// when the request passed the given number of trusted proxies, e.g.
+// load balancers, in front of skipper. Each proxy appends the address
+// of its peer to the 'X-Forwarded-For' header, so the address is taken
+// from the header, counting from the right. With 0 proxies, the remote
+// address of the connection is returned. When the header has less
+// addresses, or an invalid address, the last valid address is
+// returned.
+//
+// Example, with 2 trusted proxies:
+//
+//     X-Forwarded-For: spoofed, client, proxy1
+//     RemoteAddr: proxy2
+func RemoteHostBehindProxyCount(r *http.Request, proxies int) net.IP {
+	ip := parse(r.RemoteAddr)
+	if proxies <= 0 {
+		return ip
+	}
+
+	ffs := r.Header.Get("X-Forwarded-For")
+	if ffs == "" {
+		return ip
+	}
+
+	ffa := strings.Split(ffs, ",")
+	for i := len(ffa) - 1; i >= 0 && i >= len(ffa)-proxies; i-- {
+		ffip := parse(strings.TrimSpace(ffa[i]))
+		if ffip == nil {
+			return ip
+		}
+
+		ip = ffip
+	}
+
+	return ip
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
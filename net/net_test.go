@@ -84,3 +84,64 @@ func BenchmarkRemoteHostFromLast(b *testing.B) {
 		RemoteHostFromLast(r)
 	}
 }
+
+func TestRemoteHostBehindProxies(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxies}
+
+	for _, tt := range []struct {
+		name   string
+		input  string
+		want   net.IP
+		fwdHdr string
+	}{
+		{"no header", "1.2.3.4:8080", net.IPv4(1, 2, 3, 4), ""},
+		{"untrusted remote addr ignores header", "1.2.3.4", net.IPv4(1, 2, 3, 4), "5.6.7.8"},
+		{"trusted proxy without header", "10.0.0.1", net.IPv4(10, 0, 0, 1), ""},
+		{"trusted proxy", "10.0.0.1", net.IPv4(5, 6, 7, 8), "5.6.7.8"},
+		{"spoofed header", "10.0.0.1", net.IPv4(5, 6, 7, 8), "1.1.1.1, 5.6.7.8, 10.0.0.2"},
+		{"only trusted proxies", "10.0.0.1", net.IPv4(10, 0, 0, 3), "10.0.0.3, 10.0.0.2"},
+		{"invalid header", "10.0.0.1", net.IPv4(10, 0, 0, 2), "invalid, 10.0.0.2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.input, Header: make(http.Header)}
+			if tt.fwdHdr != "" {
+				r.Header.Set("x-forwarded-for", tt.fwdHdr)
+			}
+
+			got := RemoteHostBehindProxies(r, trusted)
+			if !got.Equal(tt.want) {
+				t.Errorf("Unexpected IP address '%v'. Wanted '%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteHostBehindProxyCount(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		input   string
+		proxies int
+		want    net.IP
+		fwdHdr  string
+	}{
+		{"no proxies", "1.2.3.4:8080", 0, net.IPv4(1, 2, 3, 4), "5.6.7.8"},
+		{"no header", "10.0.0.1", 1, net.IPv4(10, 0, 0, 1), ""},
+		{"one proxy", "10.0.0.1", 1, net.IPv4(5, 6, 7, 8), "1.1.1.1, 5.6.7.8"},
+		{"two proxies", "10.0.0.1", 2, net.IPv4(5, 6, 7, 8), "1.1.1.1, 5.6.7.8, 10.0.0.2"},
+		{"less addresses than proxies", "10.0.0.1", 3, net.IPv4(5, 6, 7, 8), "5.6.7.8, 10.0.0.2"},
+		{"invalid header", "10.0.0.1", 2, net.IPv4(10, 0, 0, 2), "invalid, 10.0.0.2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.input, Header: make(http.Header)}
+			if tt.fwdHdr != "" {
+				r.Header.Set("x-forwarded-for", tt.fwdHdr)
+			}
+
+			got := RemoteHostBehindProxyCount(r, tt.proxies)
+			if !got.Equal(tt.want) {
+				t.Errorf("Unexpected IP address '%v'. Wanted '%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -16,9 +16,11 @@ package oauth
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -28,13 +30,25 @@ const (
 	testToken  = "test token"
 )
 
-func setup() error {
-	err := createFileWithContent("client.json", clientJson)
+// setup creates the credentials files in a temporary directory, that
+// has to be removed by the caller.
+func setup() (string, error) {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		return "", err
+	}
+
+	err = createFileWithContent(path.Join(dir, clientJsonFn), clientJson)
 	if err == nil {
-		err = createFileWithContent("user.json", userJson)
+		err = createFileWithContent(path.Join(dir, userJsonFn), userJson)
 	}
 
-	return err
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
 }
 
 var successHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -93,12 +107,15 @@ func TestGetAuthPostBody(t *testing.T) {
 }
 
 func TestGetClient(t *testing.T) {
-	if err := setup(); err != nil {
+	dir, err := setup()
+	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	oc := New("", "", "")
+	defer os.RemoveAll(dir)
+
+	oc := New(dir, "", "")
 	client, _ := oc.getClientCredentials()
 	if client.Id != "theclientid" {
 		t.Error("the client id is not correct")
@@ -109,12 +126,15 @@ func TestGetClient(t *testing.T) {
 }
 
 func TestGetUser(t *testing.T) {
-	if err := setup(); err != nil {
+	dir, err := setup()
+	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	oc := New("", "", "")
+	defer os.RemoveAll(dir)
+
+	oc := New(dir, "", "")
 	user, err := oc.getUserCredentials()
 	if err != nil {
 		t.Error(err)
@@ -131,9 +151,17 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestAuthenticate(t *testing.T) {
+	dir, err := setup()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
 	oas := httptest.NewServer(successHandler)
 	defer oas.Close()
-	oauthClient := New("", oas.URL, "scope0 scope1")
+	oauthClient := New(dir, oas.URL, "scope0 scope1")
 	authToken, err := oauthClient.GetToken()
 
 	if err != nil {
@@ -146,9 +174,17 @@ func TestAuthenticate(t *testing.T) {
 }
 
 func TestAuthenticateFail(t *testing.T) {
+	dir, err := setup()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
 	oas := httptest.NewServer(failureHandler)
 	defer oas.Close()
-	oauthClient := New("", oas.URL, "scope0 scope1")
+	oauthClient := New(dir, oas.URL, "scope0 scope1")
 	authToken, err := oauthClient.GetToken()
 
 	if err == nil {
@@ -197,6 +197,7 @@ func (c *context) Response() *http.Response            { return c.response }
 func (c *context) MarkServed()                         { c.deprecatedServed = true }
 func (c *context) Served() bool                        { return c.deprecatedServed || c.servedWithResponse }
 func (c *context) PathParam(key string) string         { return c.pathParams[key] }
+func (c *context) PathTemplate() string                { return c.route.PathTemplate() }
 func (c *context) StateBag() map[string]interface{}    { return c.stateBag }
 func (c *context) BackendUrl() string                  { return c.route.Backend }
 func (c *context) OriginalRequest() *http.Request      { return c.originalRequest }
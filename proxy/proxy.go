@@ -1421,6 +1421,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// the concurrency slots are released, when the response body was
+	// served
+	defer func() {
+		pendingConcurrency, _ := ctx.StateBag()[ratelimit.ConcurrencyReleaseKey].([]func())
+		for _, release := range pendingConcurrency {
+			release()
+		}
+	}()
+
 	err := p.do(ctx)
 
 	if err != nil {
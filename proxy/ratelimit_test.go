@@ -1,15 +1,18 @@
 package proxy_test
 
 import (
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
 	"github.com/zalando/skipper/filters/builtin"
 	"github.com/zalando/skipper/proxy"
 	"github.com/zalando/skipper/proxy/proxytest"
@@ -465,3 +468,70 @@ func TestRetryAfterHeader(t *testing.T) {
 		t.Fatalf("should calculate ratelimit header correctly: %d expected: %d", i, expected)
 	}
 }
+
+type concurrencySlotSpec struct {
+	released int32
+}
+
+func (*concurrencySlotSpec) Name() string { return "concurrencySlot" }
+
+func (s *concurrencySlotSpec) CreateFilter([]interface{}) (filters.Filter, error) { return s, nil }
+
+func (s *concurrencySlotSpec) Request(ctx filters.FilterContext) {
+	ctx.StateBag()[ratelimit.ConcurrencyReleaseKey] = []func(){func() { atomic.AddInt32(&s.released, 1) }}
+}
+
+func (*concurrencySlotSpec) Response(filters.FilterContext) {}
+
+func TestConcurrencySlotReleasedAfterBody(t *testing.T) {
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-unblock
+		w.Write([]byte("second"))
+	}))
+	defer backend.Close()
+
+	spec := &concurrencySlotSpec{}
+	fr := builtin.MakeRegistry()
+	fr.Register(spec)
+
+	p := proxytest.New(fr, &eskip.Route{
+		Filters: []*eskip.Filter{{Name: spec.Name()}},
+		Backend: backend.URL,
+	})
+	defer p.Close()
+
+	rsp, err := http.Get(p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	first := make([]byte, len("first"))
+	if _, err := io.ReadFull(rsp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&spec.released) != 0 {
+		t.Fatal("slot released before the response body was served")
+	}
+
+	close(unblock)
+	if _, err := ioutil.ReadAll(rsp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&spec.released) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released after the response body was served")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&spec.released); n != 1 {
+		t.Errorf("slot released %d times", n)
+	}
+}
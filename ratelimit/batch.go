@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/metrics"
+)
+
+// DefaultBatchSize is the default maximum number of the checks of a
+// batch, when batching is enabled.
+const DefaultBatchSize = 128
+
+type checkResult struct {
+	count int64
+	err   error
+}
+
+// checkRequest is a check of the hits of a key, waiting for the flush
+// of its batch.
+type checkRequest struct {
+	ctx         context.Context
+	key         string
+	clearBefore int64
+	capRank     int64
+	n           int64
+	result      chan checkResult
+}
+
+// checkBatcher coalesces the checks of the hits of concurrent
+// ratelimit calls into a single redis pipeline. A batch is flushed
+// when the batch window passed since its first check, or when it is
+// full. The count of a check includes the hits of the preceding checks
+// of the same key in the batch, because they may be recorded after
+// the flush, so the hits of concurrent calls are never undercounted.
+type checkBatcher struct {
+	ring          *redis.Ring
+	window        time.Duration
+	size          int
+	metrics       metrics.Metrics
+	metricsPrefix string
+
+	mu      sync.Mutex
+	pending []*checkRequest
+	timer   *time.Timer
+}
+
+func newCheckBatcher(r *ring, window time.Duration, size int) *checkBatcher {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	return &checkBatcher{
+		ring:          r.ring,
+		window:        window,
+		size:          size,
+		metrics:       r.metrics,
+		metricsPrefix: r.metricsPrefix,
+	}
+}
+
+// check drops the hits of the key before clearBefore, caps the size
+// of the set at capRank, and returns the number of the hits, with the
+// next flush of the batch. It returns the error of the context, when
+// it is done before the flush.
+func (b *checkBatcher) check(ctx context.Context, key string, clearBefore, capRank, n int64) (int64, error) {
+	req := &checkRequest{
+		ctx:         ctx,
+		key:         key,
+		clearBefore: clearBefore,
+		capRank:     capRank,
+		n:           n,
+		result:      make(chan checkResult, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.size {
+		batch := b.take()
+		b.mu.Unlock()
+		go b.flush(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flushPending)
+		}
+
+		b.mu.Unlock()
+	}
+
+	select {
+	case r := <-req.result:
+		return r.count, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// take returns the pending checks and resets the batch. It must be
+// called with the lock.
+func (b *checkBatcher) take() []*checkRequest {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	return batch
+}
+
+func (b *checkBatcher) flushPending() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.flush(batch)
+}
+
+// flush executes the checks of the batch in a single pipeline. The
+// checks, whose context is done already, are skipped. The pipeline
+// is not canceled by the contexts of the single checks.
+func (b *checkBatcher) flush(batch []*checkRequest) {
+	var live []*checkRequest
+	for _, req := range batch {
+		if req.ctx.Err() == nil {
+			live = append(live, req)
+		}
+	}
+
+	if len(live) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := b.ring.Pipeline()
+	cards := make([]*redis.IntCmd, len(live))
+	for i, req := range live {
+		pipe.ZRemRangeByScore(ctx, req.key, "0.0", fmt.Sprint(float64(req.clearBefore)))
+		pipe.ZRemRangeByRank(ctx, req.key, 0, -req.capRank)
+		cards[i] = pipe.ZCard(ctx, req.key)
+	}
+
+	start := time.Now()
+	cmds, err := pipe.Exec(ctx)
+	b.metrics.MeasureSince(b.metricsPrefix+"query.batch", start)
+	b.metrics.IncCounterBy(b.metricsPrefix+"batch.checks", int64(len(live)))
+	err = queryErr(err)
+	if err != nil {
+		log.Errorf("Failed to execute the batch of %d checks: %v", len(live), err)
+	}
+
+	// the failure of a command fails the check of its key
+	failed := make(map[string]error)
+	for _, cmd := range cmds {
+		if cerr := queryErr(cmd.Err()); cerr != nil {
+			if key, ok := cmd.Args()[1].(string); ok {
+				failed[key] = fmt.Errorf("%s: %w", cmd.Name(), cerr)
+			}
+		}
+	}
+
+	preceding := make(map[string]int64)
+	for i, req := range live {
+		if ferr := failed[req.key]; ferr != nil {
+			req.result <- checkResult{err: ferr}
+			continue
+		}
+
+		if err != nil && len(failed) == 0 {
+			req.result <- checkResult{err: fmt.Errorf("batch: %w", err)}
+			continue
+		}
+
+		count := cards[i].Val() + preceding[req.key]
+		preceding[req.key] += req.n
+		req.result <- checkResult{count: count}
+	}
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestCheckBatcherContextDeadline(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := newRingOf(client, &RedisOptions{BatchWindow: time.Second}, redisMetricsPrefix)
+	if r.batcher == nil {
+		t.Fatal("batcher not created")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.batcher.check(ctx, "key", 0, 10, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("check waited for the batch window: %v", d)
+	}
+}
+
+func TestCheckBatcherDisabled(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	if r := newRingOf(client, &RedisOptions{}, redisMetricsPrefix); r.batcher != nil {
+		t.Error("batcher created without batch window")
+	}
+
+	r := newRingOf(client, &RedisOptions{BatchWindow: time.Millisecond}, redisMetricsPrefix)
+	if r.batcher.size != DefaultBatchSize {
+		t.Errorf("unexpected default batch size: %d", r.batcher.size)
+	}
+}
@@ -13,6 +13,10 @@ const (
 // redis.Ring and group is the ratelimit group that can span one or
 // multiple routes.
 func newClusterRateLimiter(s Settings, sw Swarmer, ring *ring, group string) limiter {
+	if s.InMemory {
+		return newClusterRateLimiterMemory(s, group)
+	}
+
 	if sw != nil {
 		if l := newClusterRateLimiterSwim(s, sw, group); l != nil {
 			return l
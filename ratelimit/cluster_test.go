@@ -26,13 +26,12 @@ func Test_newClusterRateLimiter(t *testing.T) {
 	cancel := startRedis2("16079")
 	defer cancel()
 
-	quit := make(chan struct{})
 	myring := newRing(
 		&RedisOptions{
 			Addrs: []string{"127.0.0.1:16079"},
 		},
-		quit,
 	)
+	defer myring.Close()
 	fake, err := newFakeSwarm("foo01", 3*time.Second)
 	if err != nil {
 		t.Fatalf("Failed to create fake swarm to test: %v", err)
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/zalando/skipper/metrics"
+)
+
+const (
+	// ConcurrencyReleaseKey is the key in the state bag of the
+	// release functions of the acquired concurrency slots. The
+	// slots are released by the proxy, when the response body was
+	// served, or the request failed.
+	ConcurrencyReleaseKey = "ratelimit:concurrency:release"
+
+	// DefaultConcurrencyTTL is the default expiry of an acquired
+	// slot, that was not released.
+	DefaultConcurrencyTTL = time.Minute
+
+	concurrencyKeyFormat = swarmPrefix + "concurrency.%s.%s"
+)
+
+// acquireScript drops the expired slots of the key, and adds a slot,
+// which expires at its score, if there are less than max slots left.
+// It returns 1, when the slot was acquired, otherwise 0.
+//
+// KEYS[1]: the key, ARGV[1]: now in nanoseconds, ARGV[2]: max slots,
+// ARGV[3]: expiry of the slot in nanoseconds, ARGV[4]: slot member,
+// ARGV[5]: expiry of the key in milliseconds
+var acquireScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// ConcurrencyLimit limits the requests of a key in flight across the
+// cluster. The acquired slots are stored in a sorted set per key in
+// redis, scored by their expiry, so a slot of a request, that died
+// without releasing it, is dropped after the TTL.
+type ConcurrencyLimit struct {
+	group         string
+	max           int
+	ttl           time.Duration
+	ring          *redis.Ring
+	metrics       metrics.Metrics
+	metricsPrefix string
+}
+
+type concurrencyKey struct {
+	group string
+	max   int
+	ttl   time.Duration
+}
+
+func newConcurrencyLimit(group string, max int, ttl time.Duration, r *ring) *ConcurrencyLimit {
+	if r == nil {
+		return nil
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultConcurrencyTTL
+	}
+
+	return &ConcurrencyLimit{
+		group:         group,
+		max:           max,
+		ttl:           ttl,
+		ring:          r.ring,
+		metrics:       r.metrics,
+		metricsPrefix: r.metricsPrefix,
+	}
+}
+
+func (c *ConcurrencyLimit) prefixKey(clearText string) string {
+	return fmt.Sprintf(concurrencyKeyFormat, c.group, clearText)
+}
+
+// Acquire acquires a slot of the key, and returns the function to
+// release it and true, or false, when max slots are acquired already.
+// The release function can be called more than once. When redis is
+// not available, the request is allowed with a noop release.
+func (c *ConcurrencyLimit) Acquire(ctx context.Context, clearText string) (func(), bool) {
+	key := c.prefixKey(hashedKey(ctx, clearText))
+	now := time.Now()
+	member := fmt.Sprintf("%d.%d", now.UnixNano(), rand.Int63())
+
+	acquired, err := acquireScript.Run(
+		ctx,
+		c.ring,
+		[]string{key},
+		now.UnixNano(),
+		c.max,
+		now.Add(c.ttl).UnixNano(),
+		member,
+		(c.ttl + expireMargin).Milliseconds(),
+	).Int()
+	if err != nil {
+		log.Errorf("Failed to acquire concurrency slot: %v", err)
+		return func() {}, true
+	}
+
+	if acquired == 0 {
+		c.metrics.IncCounter(c.metricsPrefix + "concurrency.forbids")
+		return nil, false
+	}
+
+	c.metrics.IncCounter(c.metricsPrefix + "concurrency.allows")
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// the request context may be canceled already
+			if err := c.ring.ZRem(context.Background(), key, member).Err(); err != nil {
+				log.Errorf("Failed to release concurrency slot, it expires in %v: %v", c.ttl, err)
+			}
+		})
+	}, true
+}
@@ -109,7 +109,7 @@ undefined and could toggle between different configurations.
 HTTP Response
 
 In case of rate limiting, the HTTP response status will be 429 Too
-Many Requests and two headers will be set.
+Many Requests and the following headers will be set.
 
 One which shows the maximum requests per hour:
 
@@ -122,6 +122,35 @@ request:
 
 Both are based on RFC 6585.
 
+The limit of the time window and the remaining requests, which are
+only more than 0, when the denied request counted as multiple hits:
+
+	X-RateLimit-Limit: 100
+	X-RateLimit-Remaining: 0
+
+Active Keys
+
+The redis based cluster ratelimits can list the hashed keys of the
+clients with recorded hits with Ratelimit.ActiveKeys, e.g. for an
+admin dashboard. It scans the keyspace of every redis shard, which is
+O(keyspace), so it is meant for admin tooling, and not to be used in
+the request path.
+
+In-memory Cluster Ratelimits
+
+Single instance deployments can calculate the cluster ratelimits in
+the memory of the instance by setting Settings.InMemory, or by using a
+registry created with NewInMemoryRegistry, which sets it for all the
+cluster ratelimits. The in-memory limiter has the same sliding window
+semantics as the redis based one.
+
+Shared Redis Ring
+
+Applications embedding the ratelimits, that already have a redis ring,
+can reuse it with NewRedisRingRegistry instead of opening a second
+connection pool. The ring stays owned by the application, the registry
+doesn't close it.
+
 Registry
 
 The active rate limiters are stored in a registry. They are created
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDrainTimeout is the default maximum time, that closing a redis
+// ring waits for the in-flight ratelimit calls.
+const DefaultDrainTimeout = time.Second
+
+// drain tracks the in-flight ratelimit calls of a redis ring, so the
+// ring is closed only after their queries completed, and a recorded hit
+// is not left without the expiry of its key.
+type drain struct {
+	mu       sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+}
+
+// start registers an in-flight call, and returns the func to call, when
+// it completed. The calls started after the wait are not tracked.
+func (d *drain) start() func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return func() {}
+	}
+
+	d.inflight.Add(1)
+	return d.inflight.Done
+}
+
+// wait blocks until the in-flight calls completed, or the timeout
+// passed.
+func (d *drain) wait(timeout time.Duration) {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("Closing the redis ring with in-flight ratelimit calls after %v.", timeout)
+	}
+}
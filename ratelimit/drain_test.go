@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSlowRedis starts a fake redis server, that replies to all the
+// commands with 1, but holds the replies to ZADD until release is
+// closed. The ZADD commands received are signaled on zadd.
+func startSlowRedis(t *testing.T, zadd chan<- struct{}, release <-chan struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveSlowRedis(conn, zadd, release)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveSlowRedis(conn net.Conn, zadd chan<- struct{}, release <-chan struct{}) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		// commands are arrays of bulk strings: *<n>, then $<len> and
+		// the argument for each argument
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		var args []string
+		for i := 0; i < n; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			args = append(args, strings.TrimSpace(arg))
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			conn.Write([]byte("+PONG\r\n"))
+			continue
+		case "ZADD":
+			zadd <- struct{}{}
+			<-release
+		}
+
+		conn.Write([]byte(":1\r\n"))
+	}
+}
+
+func TestRingCloseDrain(t *testing.T) {
+	for _, ti := range []struct {
+		msg          string
+		drainTimeout time.Duration
+		release      bool
+	}{{
+		msg:          "in-flight call completes",
+		drainTimeout: 5 * time.Second,
+		release:      true,
+	}, {
+		msg:          "drain timeout",
+		drainTimeout: 100 * time.Millisecond,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			zadd := make(chan struct{}, 1)
+			release := make(chan struct{})
+			defer func() {
+				if !ti.release {
+					close(release)
+				}
+			}()
+
+			addr := startSlowRedis(t, zadd, release)
+			r := newRing(&RedisOptions{
+				Addrs:        []string{addr},
+				ReadTimeout:  10 * time.Second,
+				ZAddRetries:  -1,
+				DrainTimeout: ti.drainTimeout,
+			})
+
+			c := newClusterRateLimiterRedis(Settings{MaxHits: 10, TimeWindow: time.Minute}, r, "drain")
+			if c == nil {
+				t.Fatal("failed to create the cluster ratelimit")
+			}
+
+			allowed := make(chan bool)
+			go func() { allowed <- c.AllowContext(context.Background(), "clientA") }()
+
+			select {
+			case <-zadd:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the slow ZADD")
+			}
+
+			start := time.Now()
+			closed := make(chan struct{})
+			go func() {
+				r.Close()
+				close(closed)
+			}()
+
+			if !ti.release {
+				select {
+				case <-closed:
+					if d := time.Since(start); d < ti.drainTimeout {
+						t.Errorf("ring closed before the drain timeout: %v", d)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("ring not closed after the drain timeout")
+				}
+
+				return
+			}
+
+			select {
+			case <-closed:
+				t.Fatal("ring closed with an in-flight call")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(release)
+
+			select {
+			case <-allowed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the call")
+			}
+
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("ring not closed after the in-flight call completed")
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const parentGroupPrefix = "parent."
+
+// clusterLimitHierarchical is a cluster ratelimit of a group, that
+// shares the budget of a parent with other groups. The requests of the
+// group are allowed up to the reserved number of hits without
+// checking the parent budget, and up to the max hits of the group as
+// long as the parent budget is not exhausted. This way a group gets
+// its reserved share, even when the other groups exhaust the parent
+// budget.
+//
+// The hits of all the groups are counted in the parent budget, so the
+// reserved hits can exceed the parent budget at most by the sum of the
+// reservations.
+type clusterLimitHierarchical struct {
+	*clusterLimitRedis
+	parent     *clusterLimitRedis
+	parentName string
+	reserved   int64
+}
+
+func newClusterLimitHierarchical(s Settings, group limiter, parentRing *ring) limiter {
+	groupRedis, ok := group.(*clusterLimitRedis)
+	if !ok || parentRing == nil {
+		log.Warnf("Ratelimit parent %s of group %s requires redis, ignoring the parent.", s.Parent, s.Group)
+		return group
+	}
+
+	ps := Settings{
+		Type:         ClusterServiceRatelimit,
+		MaxHits:      s.ParentMaxHits,
+		TimeWindow:   s.TimeWindow,
+		Group:        parentGroupPrefix + s.Parent,
+		ExpireMargin: s.ExpireMargin,
+	}
+
+	parent := newClusterRateLimiterRedis(ps, parentRing, ps.Group)
+	if parent == nil {
+		return group
+	}
+
+	// the limits of the groups with a parent budget are static
+	groupRedis.limits, parent.limits = nil, nil
+	c := &clusterLimitHierarchical{
+		clusterLimitRedis: groupRedis,
+		parent:            parent,
+		parentName:        s.Parent,
+		reserved:          int64(s.Reserved),
+	}
+
+	c.metrics.UpdateGauge(c.groupMetricsKey("reserved"), float64(s.Reserved))
+	return c
+}
+
+func (c *clusterLimitHierarchical) groupMetricsKey(name string) string {
+	return fmt.Sprintf("%shierarchy.%s.%s.%s", c.metricsPrefix, c.parentName, c.group, name)
+}
+
+// AllowContext returns true if the request is allowed by the group
+// and, above the reserved hits of the group, by the parent budget.
+func (c *clusterLimitHierarchical) AllowContext(ctx context.Context, clearText string) bool {
+	return c.AllowResultContext(ctx, clearText).Allowed
+}
+
+// Allow is like AllowContext, but not using a context.
+func (c *clusterLimitHierarchical) Allow(clearText string) bool {
+	return c.AllowContext(context.Background(), clearText)
+}
+
+// AllowNResultContext overrides the method of the embedded cluster
+// ratelimit, because the hits of the parent budget are counted once
+// per request. It counts the request once.
+func (c *clusterLimitHierarchical) AllowNResultContext(ctx context.Context, clearText string, _ int) AllowResult {
+	return c.AllowResultContext(ctx, clearText)
+}
+
+// RetryAfterContext overrides the method of the embedded cluster
+// ratelimit, to return the seconds to wait for the limiter, that
+// denied the request: the group, when its max hits are consumed, or
+// the parent budget. When both are consumed, it waits for the later
+// one.
+func (c *clusterLimitHierarchical) RetryAfterContext(ctx context.Context, clearText string) int {
+	return c.retryAfter(ctx, clearText, c.nextAdmitted)
+}
+
+// RetryAfter is like RetryAfterContext, but not using a context.
+func (c *clusterLimitHierarchical) RetryAfter(clearText string) int {
+	return c.RetryAfterContext(context.Background(), clearText)
+}
+
+// nextAdmitted returns the time, when both the group and the parent
+// budget admit the next request. The zero time means that neither of
+// them has consumed its max hits.
+func (c *clusterLimitHierarchical) nextAdmitted(ctx context.Context, clearText string, now time.Time) (time.Time, error) {
+	admitted, err := c.clusterLimitRedis.nextAdmitted(ctx, clearText, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	parentAdmitted, err := c.parent.nextAdmitted(ctx, clearText, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if parentAdmitted.After(admitted) {
+		return parentAdmitted, nil
+	}
+
+	return admitted, nil
+}
+
+// AllowResultContext is like AllowContext, but returns the details of
+// the decision.
+//
+// Performance considerations:
+//
+// Like the cluster ratelimit, it checks the set of hits of the group,
+// and when the reserved hits are consumed, the set of hits of the
+// parent as well. In case of allow, it records the hit in both sets.
+func (c *clusterLimitHierarchical) AllowResultContext(ctx context.Context, clearText string) AllowResult {
+	defer c.drain.start()()
+
+	ctx = c.sample(ctx, clearText)
+	s := hashedKey(ctx, clearText)
+	c.metrics.IncCounter(c.metricsPrefix + "total")
+	if c.killSwitch.active() {
+		c.incCounter("killswitch.allows")
+		return AllowResult{Allowed: true, Limit: int(c.maxHits)}
+	}
+
+	key := c.prefixKey(s)
+	parentKey := c.parent.prefixKey(s)
+
+	start := time.Now()
+	var queryFailure bool
+	defer c.measureQuery(allowOperation, &queryFailure, start)
+
+	now := c.clock.adjust(start)
+
+	nowNanos := now.UnixNano()
+	clearBefore := now.Add(-c.window).UnixNano()
+	result := AllowResult{Allowed: true, Limit: int(c.maxHits)}
+
+	count, countErr := c.checkCard(ctx, key, clearBefore, 1, c.maxHits)
+	if countErr != nil {
+		log.Errorf("Failed to get redis cardinality of the group: %v", countErr)
+		queryFailure = true
+		if c.failClosed && !c.dryRun {
+			return c.backendErrorResult(c.maxHits)
+		}
+	}
+
+	forbid := countErr == nil && count >= c.maxHits
+	if countErr == nil && !forbid && count >= c.reserved {
+		parentCount, err := c.parent.checkCard(ctx, parentKey, clearBefore, 1, c.parent.maxHits)
+		if err != nil {
+			log.Errorf("Failed to get redis cardinality of the parent: %v", err)
+			queryFailure = true
+			if c.failClosed && !c.dryRun {
+				return c.backendErrorResult(c.maxHits)
+			}
+		}
+
+		forbid = err == nil && parentCount >= c.parent.maxHits
+	}
+
+	if forbid {
+		if !c.dryRun {
+			c.incCounter("forbids")
+			c.recordDenied(ctx, key)
+			result.Allowed = false
+			return result
+		}
+
+		c.incCounter("dryrun.forbids")
+		result.DryRunForbidden = true
+	} else if countErr == nil {
+		result.Remaining = int(c.maxHits - count - 1)
+		result.Count = int(count) + 1
+	}
+
+	zaddErr, err := c.record(ctx, key, nowNanos, nowNanos)
+	if zaddErr != nil || err != nil {
+		queryFailure = true
+	}
+
+	// the member is unique per group, to count the hits of the groups
+	// in the same nanosecond
+	zaddErr, parentErr := c.parent.record(ctx, parentKey, nowNanos, fmt.Sprintf("%d:%s", nowNanos, c.group))
+	if zaddErr != nil || parentErr != nil {
+		queryFailure = true
+	}
+
+	if err != nil || parentErr != nil {
+		return result
+	}
+
+	if countErr == nil {
+		c.metrics.UpdateGauge(c.groupMetricsKey("consumed"), float64(count+1))
+	}
+
+	if !result.DryRunForbidden {
+		c.incCounter("allows")
+	}
+
+	return result
+}
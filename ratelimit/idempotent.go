@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyKeySuffix    = ".idempotency."
+	allowIdempotentSpanName = "redis_allow_idempotent"
+)
+
+var errIdempotentScriptResult = errors.New("unexpected result of the idempotent allow script")
+
+// idempotentAllowScript checks and records the hit of a call with an
+// idempotency token atomically. KEYS[1] is the set of the hits, and
+// KEYS[2] the marker of the token, that stores the decision of the
+// first call. The arguments are the score, before which the hits are
+// dropped, the max hits, the score and the member of the new hit, the
+// expiry of the keys in milliseconds, and 1 in dry-run mode, when the
+// hit is recorded, even when it exceeds the max hits. It returns the
+// decision, 1 or 0, the number of hits, and 1, when the decision was
+// taken by a previous call with the same token.
+var idempotentAllowScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local decision = redis.call('GET', KEYS[2])
+if decision then
+	return {tonumber(decision), redis.call('ZCARD', KEYS[1]), 1}
+end
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < tonumber(ARGV[2]) then
+	allowed = 1
+end
+if allowed == 1 or ARGV[6] == '1' then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	count = count + 1
+end
+redis.call('SET', KEYS[2], allowed, 'PX', ARGV[5])
+return {allowed, count, 0}
+`)
+
+// idempotentLimiter is implemented by the limiters, that count the
+// calls with the same idempotency token once.
+type idempotentLimiter interface {
+	AllowIdempotentContext(ctx context.Context, clearText, token string) AllowResult
+}
+
+// AllowIdempotentContext is like AllowResultContext, but the calls
+// with the same idempotency token, e.g. the retries of a request,
+// within the time window consume only one hit. The repeated calls
+// return the decision of the first call, without recording a new hit.
+// The decision is stored in a marker of the token, that expires with
+// the hits of the time window. Calls without token are counted like
+// in AllowResultContext.
+func (c *clusterLimitRedis) AllowIdempotentContext(ctx context.Context, clearText, token string) AllowResult {
+	if token == "" {
+		return c.AllowResultContext(ctx, clearText)
+	}
+
+	defer c.drain.start()()
+
+	ctx = c.sample(ctx, clearText)
+	s := hashedKey(ctx, clearText)
+	c.metrics.IncCounter(c.metricsPrefix + "total")
+	if c.killSwitch.active() {
+		c.incCounter("killswitch.allows")
+		maxHits, _ := c.groupLimits()
+		return AllowResult{Allowed: true, Limit: int(maxHits)}
+	}
+
+	key := c.prefixKey(s)
+	marker := key + idempotencyKeySuffix + getHashedKey(token)
+
+	start := time.Now()
+	var queryFailure bool
+	defer c.measureQuery(allowOperation, &queryFailure, start)
+
+	now := c.clock.adjust(start)
+	nowNanos := now.UnixNano()
+	clearBefore := now.Add(-c.timeWindow()).UnixNano()
+
+	maxHits, overridden := c.limit(clearText)
+	if overridden {
+		c.incCounter("override.hits")
+	}
+
+	dryRun := "0"
+	if c.dryRun {
+		dryRun = "1"
+	}
+
+	finishSpan := c.startSpan(ctx, allowIdempotentSpanName)
+	v, err := idempotentAllowScript.Run(
+		ctx,
+		c.ring,
+		[]string{key, marker},
+		clearBefore,
+		maxHits,
+		nowNanos,
+		nowNanos,
+		(c.timeWindow() + c.expireMargin).Milliseconds(),
+		dryRun,
+	).Result()
+	finishSpan(err != nil)
+
+	var res []int64
+	if err == nil {
+		res, err = idempotentScriptResult(v)
+	}
+
+	if err != nil {
+		log.Errorf("Failed to check the idempotent ratelimit call: %v", err)
+		queryFailure = true
+		if c.failClosed && !c.dryRun {
+			return c.backendErrorResult(maxHits)
+		}
+
+		return AllowResult{Allowed: true, Limit: int(maxHits)}
+	}
+
+	allowed, count, repeated := res[0] == 1, res[1], res[2] == 1
+	if repeated {
+		c.incCounter("idempotent.repeats")
+	}
+
+	result := AllowResult{Allowed: allowed, Limit: int(maxHits), Count: int(count)}
+	if allowed {
+		result.Remaining = int(maxHits - count)
+		if result.Remaining < 0 {
+			result.Remaining = 0
+		}
+
+		if !repeated {
+			c.incCounter("allows")
+		}
+
+		return result
+	}
+
+	result.Count = 0
+	if c.dryRun {
+		if !repeated {
+			c.incCounter("dryrun.forbids")
+		}
+
+		result.Allowed = true
+		result.DryRunForbidden = true
+		return result
+	}
+
+	if !repeated {
+		c.incCounter("forbids")
+		c.recordDenied(ctx, key)
+	}
+
+	return result
+}
+
+// idempotentScriptResult converts the result of the
+// idempotentAllowScript.
+func idempotentScriptResult(v interface{}) ([]int64, error) {
+	values, ok := v.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil, errIdempotentScriptResult
+	}
+
+	res := make([]int64, len(values))
+	for i, vi := range values {
+		if res[i], ok = vi.(int64); !ok {
+			return nil, errIdempotentScriptResult
+		}
+	}
+
+	return res, nil
+}
+
+// AllowIdempotentContext doesn't support the idempotency tokens for
+// the groups with a parent budget, the calls are counted like in
+// AllowResultContext.
+func (c *clusterLimitHierarchical) AllowIdempotentContext(ctx context.Context, clearText, _ string) AllowResult {
+	return c.AllowResultContext(ctx, clearText)
+}
+
+// AllowIdempotentContext doesn't support the idempotency tokens for
+// the groups with several time windows, the calls are counted like in
+// AllowResultContext.
+func (c *clusterLimitMultiWindow) AllowIdempotentContext(ctx context.Context, clearText, _ string) AllowResult {
+	return c.AllowResultContext(ctx, clearText)
+}
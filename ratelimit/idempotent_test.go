@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestIdempotentScriptResult(t *testing.T) {
+	if res, err := idempotentScriptResult([]interface{}{int64(1), int64(2), int64(0)}); err != nil || res[0] != 1 || res[1] != 2 || res[2] != 0 {
+		t.Errorf("unexpected result: %v, %v", res, err)
+	}
+
+	for _, v := range []interface{}{nil, int64(1), []interface{}{int64(1), int64(2)}, []interface{}{int64(1), "2", int64(0)}} {
+		if _, err := idempotentScriptResult(v); err == nil {
+			t.Errorf("failed to fail for %v", v)
+		}
+	}
+}
+
+func TestAllowIdempotentFailure(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	settings := Settings{Type: ClusterClientRatelimit, MaxHits: 10, TimeWindow: time.Minute, Group: "A"}
+	for _, failClosed := range []bool{false, true} {
+		r := newRingOf(client, &RedisOptions{FailClosed: failClosed}, redisMetricsPrefix)
+		r.external = true // skips the ping of the unreachable shard
+
+		c := newClusterRateLimiterRedis(settings, r, settings.Group)
+		result := c.AllowIdempotentContext(context.Background(), "clientA", "token")
+		if result.Allowed == failClosed || result.BackendError != failClosed {
+			t.Errorf("unexpected result, fail closed: %v, result: %+v", failClosed, result)
+		}
+	}
+}
+
+func TestRatelimitAllowIdempotentFallback(t *testing.T) {
+	l := newRatelimit(Settings{Type: ClientRatelimit, MaxHits: 1, TimeWindow: time.Minute}, nil, nil)
+	defer l.Close()
+
+	// ratelimits without support count every call
+	if !l.AllowIdempotent(context.Background(), "clientA", "token").Allowed {
+		t.Error("first call denied")
+	}
+
+	if l.AllowIdempotent(context.Background(), "clientA", "token").Allowed {
+		t.Error("repeated call allowed")
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	killSwitchKeyFormat = swarmPrefix + "killswitch.%s"
+
+	killSwitchTimeout = time.Second
+)
+
+// killSwitch caches the state of the kill switch of a cluster
+// ratelimit group, stored in the redis key ratelimit.killswitch.<group>.
+// When the key is set to true, e.g. 1, the ratelimit of the group
+// allows all requests. The state is refreshed in the background, when
+// it is older than the refresh interval, so the lookup never waits for
+// redis. When the key can't be read, the switch is off, and the
+// ratelimit stays active.
+type killSwitch struct {
+	ring     *redis.Ring
+	key      string
+	interval time.Duration
+
+	mu         sync.Mutex
+	on         bool
+	updated    time.Time
+	refreshing bool
+}
+
+func newKillSwitch(r *redis.Ring, key string, interval time.Duration) *killSwitch {
+	return &killSwitch{
+		ring:     r,
+		key:      key,
+		interval: interval,
+	}
+}
+
+// active tells whether the kill switch is on. It is off, when the
+// kill switch is not configured.
+func (k *killSwitch) active() bool {
+	if k == nil {
+		return false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.refreshing && time.Since(k.updated) >= k.interval {
+		k.refreshing = true
+		go k.refresh()
+	}
+
+	return k.on
+}
+
+// refresh loads the state of the kill switch from redis. Missing keys,
+// invalid values and failures turn the switch off.
+func (k *killSwitch) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), killSwitchTimeout)
+	defer cancel()
+
+	var on bool
+	v, err := k.ring.Get(ctx, k.key).Result()
+	switch {
+	case err == redis.Nil:
+	case err != nil:
+		log.Errorf("Failed to load the ratelimit kill switch %s, the ratelimit stays active: %v", k.key, err)
+	default:
+		var perr error
+		on, perr = strconv.ParseBool(v)
+		if perr != nil {
+			log.Errorf("Invalid ratelimit kill switch %s, the ratelimit stays active: %q", k.key, v)
+		}
+	}
+
+	// logged on every refresh, so the switch is not left on silently
+	if on {
+		log.Warnf("Ratelimit kill switch %s is on, all requests of the group are allowed.", k.key)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.on && !on {
+		log.Infof("Ratelimit kill switch %s is off.", k.key)
+	}
+
+	k.refreshing = false
+	k.updated = time.Now()
+	k.on = on
+}
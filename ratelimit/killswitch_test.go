@@ -0,0 +1,27 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestKillSwitchFailSafe(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	k := newKillSwitch(client, "ratelimit.killswitch.A", time.Millisecond)
+	k.on = true
+
+	// the switch is turned off, when it can't be read
+	k.refresh()
+	if k.active() {
+		t.Error("kill switch active after a failed read")
+	}
+
+	var nilSwitch *killSwitch
+	if nilSwitch.active() {
+		t.Error("kill switch active without configuration")
+	}
+}
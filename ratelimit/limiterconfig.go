@@ -0,0 +1,241 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// RedisBackendRing is the type of the redis backends of the
+	// cluster ratelimits using a redis ring.
+	RedisBackendRing = "ring"
+
+	algorithmSlidingWindow = "sliding-window"
+	algorithmHierarchical  = "hierarchical-sliding-window"
+	algorithmMultiWindow   = "multi-window-sliding-window"
+
+	// the requests are allowed, when redis fails
+	failureModeOpen = "fail-open"
+	// the requests are denied, when redis fails
+	failureModeClosed = "fail-closed"
+)
+
+var (
+	errConfigNotSupported = errors.New("the configuration is only available for the redis based cluster ratelimits")
+	errUnknownGroup       = errors.New("unknown cluster ratelimit group")
+)
+
+// LimiterConfig is a read-only snapshot of the effective configuration
+// of a redis based cluster ratelimit group, e.g. for debugging why the
+// requests of a group are ratelimited.
+type LimiterConfig struct {
+	Group                string        `json:"group"`
+	Algorithm            string        `json:"algorithm"`
+	MaxHits              int64         `json:"maxHits"`
+	TimeWindow           time.Duration `json:"-"`
+	ExpireMargin         time.Duration `json:"-"`
+	KeyPrefix            string        `json:"keyPrefix"`
+	FailureMode          string        `json:"failureMode"`
+	DryRun               bool          `json:"dryRun"`
+	RetryAfterMultiplier float64       `json:"retryAfterMultiplier,omitempty"`
+	Overrides            bool          `json:"overrides"`
+	KillSwitch           bool          `json:"killSwitch"`
+	DynamicLimits        bool          `json:"dynamicLimits"`
+	ServerTime           bool          `json:"serverTime"`
+	BatchWindow          time.Duration `json:"-"`
+
+	// Windows are the additional time windows of the multi-window
+	// groups.
+	Windows string `json:"windows,omitempty"`
+
+	// Parent, ParentMaxHits and Reserved are set for the groups with
+	// a parent budget.
+	Parent        string `json:"parent,omitempty"`
+	ParentMaxHits int64  `json:"parentMaxHits,omitempty"`
+	Reserved      int64  `json:"reserved,omitempty"`
+
+	// Backend is the type of the redis backend, and Shards are the
+	// addresses of its shards.
+	Backend string   `json:"backend"`
+	Shards  []string `json:"shards"`
+}
+
+// MarshalJSON renders the durations of the configuration in the
+// format of time.Duration.String, e.g. 1m0s.
+func (c LimiterConfig) MarshalJSON() ([]byte, error) {
+	type config LimiterConfig
+	return json.Marshal(struct {
+		config
+		TimeWindow   string `json:"timeWindow"`
+		ExpireMargin string `json:"expireMargin"`
+		BatchWindow  string `json:"batchWindow,omitempty"`
+	}{
+		config:       config(c),
+		TimeWindow:   c.TimeWindow.String(),
+		ExpireMargin: c.ExpireMargin.String(),
+		BatchWindow:  durationString(c.BatchWindow),
+	})
+}
+
+func durationString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+
+	return d.String()
+}
+
+// configLimiter extends limiter with a Config method, that returns the
+// snapshot of its configuration.
+type configLimiter interface {
+	limiter
+	Config() LimiterConfig
+}
+
+// Config returns the snapshot of the configuration of the cluster
+// ratelimit group.
+func (c *clusterLimitRedis) Config() LimiterConfig {
+	maxHits, window := c.groupLimits()
+	lc := LimiterConfig{
+		Group:                c.group,
+		Algorithm:            algorithmSlidingWindow,
+		MaxHits:              maxHits,
+		TimeWindow:           window,
+		ExpireMargin:         c.expireMargin,
+		KeyPrefix:            c.prefixKey(""),
+		FailureMode:          failureModeOpen,
+		DryRun:               c.dryRun,
+		RetryAfterMultiplier: c.retryAfterMultiplier,
+		Overrides:            c.overrides != nil,
+		KillSwitch:           c.killSwitch.active(),
+		DynamicLimits:        c.limits != nil,
+		ServerTime:           c.clock != nil,
+		Backend:              RedisBackendRing,
+		Shards:               []string{},
+	}
+
+	if c.failClosed {
+		lc.FailureMode = failureModeClosed
+	}
+
+	if c.batcher != nil {
+		lc.BatchWindow = c.batcher.window
+	}
+
+	for _, addr := range c.ring.Options().Addrs {
+		lc.Shards = append(lc.Shards, addr)
+	}
+
+	sort.Strings(lc.Shards)
+	return lc
+}
+
+// Config returns the snapshot of the configuration of the group and
+// its parent budget.
+func (c *clusterLimitHierarchical) Config() LimiterConfig {
+	lc := c.clusterLimitRedis.Config()
+	lc.Algorithm = algorithmHierarchical
+	lc.Parent = c.parentName
+	lc.ParentMaxHits = c.parent.maxHits
+	lc.Reserved = c.reserved
+	return lc
+}
+
+// Config returns the snapshot of the configuration of the group and
+// its additional windows.
+func (c *clusterLimitMultiWindow) Config() LimiterConfig {
+	lc := c.clusterLimitRedis.Config()
+	lc.Algorithm = algorithmMultiWindow
+
+	windows := make([]Window, 0, len(c.windows)-1)
+	for _, w := range c.windows[1:] {
+		windows = append(windows, Window{MaxHits: int(w.maxHits), TimeWindow: w.window})
+	}
+
+	lc.Windows = FormatWindows(windows)
+	return lc
+}
+
+// Config returns the snapshot of the configuration of the ratelimit.
+// It is only supported by the redis based cluster ratelimits.
+func (l *Ratelimit) Config() (LimiterConfig, error) {
+	if l == nil {
+		return LimiterConfig{}, errConfigNotSupported
+	}
+
+	implc, ok := l.impl.(configLimiter)
+	if !ok {
+		return LimiterConfig{}, errConfigNotSupported
+	}
+
+	return implc.Config(), nil
+}
+
+// GroupConfig returns the snapshot of the configuration of the redis
+// based cluster ratelimit group. The group is known, after the first
+// ratelimit of the group was created.
+func (r *Registry) GroupConfig(group string) (LimiterConfig, error) {
+	r.Lock()
+	s, ok := r.groups[group]
+	rl := r.lookup[s]
+	r.Unlock()
+
+	if !ok || rl == nil {
+		return LimiterConfig{}, errUnknownGroup
+	}
+
+	return rl.Config()
+}
+
+// groupConfigs returns the snapshots of the configuration of all the
+// known redis based cluster ratelimit groups, sorted by the group.
+func (r *Registry) groupConfigs() []LimiterConfig {
+	r.Lock()
+	var rls []*Ratelimit
+	for _, s := range r.groups {
+		if rl := r.lookup[s]; rl != nil {
+			rls = append(rls, rl)
+		}
+	}
+	r.Unlock()
+
+	configs := []LimiterConfig{}
+	for _, rl := range rls {
+		if c, err := rl.Config(); err == nil {
+			configs = append(configs, c)
+		}
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Group < configs[j].Group })
+	return configs
+}
+
+// ConfigHandler responds with the snapshot of the configuration of the
+// redis based cluster ratelimit group of the group query parameter as
+// JSON, or without the parameter, with the list of all the known
+// groups. It responds with 404 for unknown groups. It is read-only, and
+// meant for the support endpoints.
+func (r *Registry) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var v interface{}
+		if group := req.URL.Query().Get("group"); group != "" {
+			c, err := r.GroupConfig(group)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			v = c
+		} else {
+			v = r.groupConfigs()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,337 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	limitsKeyFormat = swarmPrefix + "limits.%s"
+
+	limitsTimeout = time.Second
+
+	defaultLimitsFileRefreshInterval = 10 * time.Second
+)
+
+// GroupLimits are the limits of a cluster ratelimit group. The zero
+// fields keep the limits of the ratelimit settings of the group.
+type GroupLimits struct {
+	MaxHits    int           `yaml:"maxHits"`
+	TimeWindow time.Duration `yaml:"timeWindow"`
+}
+
+func (l GroupLimits) String() string {
+	return fmt.Sprintf("maxHits: %d, timeWindow: %s", l.MaxHits, l.TimeWindow)
+}
+
+// LimitsProvider provides the limits of the cluster ratelimit groups,
+// e.g. from a central configuration watched by all the instances, so
+// that the limits can be changed without restart. Limits is called
+// for every ratelimit call, so it must not block, the implementations
+// cache the limits. When it returns false, because the group has no
+// limits or the provider is unavailable, the limits of the ratelimit
+// settings are used.
+type LimitsProvider interface {
+	Limits(group string) (GroupLimits, bool)
+}
+
+// FileLimitsOptions configures the FileLimits.
+type FileLimitsOptions struct {
+	// RefreshInterval defines how often the file is checked for
+	// changes. Defaults to 10 seconds.
+	RefreshInterval time.Duration
+
+	// Debounce is the duration, that a changed file has to stay
+	// unchanged, before it is applied, so that a series of rapid
+	// changes is applied once. Defaults to the RefreshInterval.
+	Debounce time.Duration
+}
+
+// FileLimits is a LimitsProvider, that loads the limits of the groups
+// from a YAML file, and watches it for changes, e.g.:
+//
+//	my-group:
+//	  maxHits: 100
+//	  timeWindow: 1m
+//
+// When the file can't be read or is invalid, the provider is
+// unavailable, and the groups use the limits of their settings. The
+// file is watched in the background, so on tear down make sure to
+// Close() it.
+type FileLimits struct {
+	path     string
+	interval time.Duration
+	debounce time.Duration
+
+	mu     sync.RWMutex
+	limits map[string]GroupLimits
+
+	// the state of the watcher, accessed only by its goroutine
+	applied   []byte
+	appliedOK bool
+	pending   []byte
+	pendingOK bool
+	changed   time.Time
+
+	quit chan struct{}
+	once sync.Once
+}
+
+// NewFileLimits creates a FileLimits, loads the file, and starts
+// watching it.
+func NewFileLimits(path string, o FileLimitsOptions) *FileLimits {
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = defaultLimitsFileRefreshInterval
+	}
+
+	if o.Debounce <= 0 {
+		o.Debounce = o.RefreshInterval
+	}
+
+	f := &FileLimits{
+		path:     path,
+		interval: o.RefreshInterval,
+		debounce: o.Debounce,
+		quit:     make(chan struct{}),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Errorf("Failed to read the ratelimit limits file %s: %v", path, err)
+	}
+
+	f.applied, f.appliedOK = b, err == nil
+	f.pending, f.pendingOK = b, err == nil
+	f.apply(b, err == nil)
+
+	go f.watch()
+	return f
+}
+
+// Limits returns the limits of the group from the file.
+func (f *FileLimits) Limits(group string) (GroupLimits, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	l, ok := f.limits[group]
+	return l, ok
+}
+
+func (f *FileLimits) watch() {
+	for {
+		select {
+		case <-time.After(f.interval):
+			f.check(time.Now())
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// check reads the file, and applies it, when it changed, and it was
+// not changed again within the debounce duration.
+func (f *FileLimits) check(now time.Time) {
+	b, err := ioutil.ReadFile(f.path)
+	ok := err == nil
+	if ok != f.pendingOK || !bytes.Equal(b, f.pending) {
+		if !ok {
+			log.Errorf("Failed to read the ratelimit limits file %s: %v", f.path, err)
+		}
+
+		f.pending, f.pendingOK, f.changed = b, ok, now
+		return
+	}
+
+	if ok == f.appliedOK && bytes.Equal(b, f.applied) || now.Sub(f.changed) < f.debounce {
+		return
+	}
+
+	f.applied, f.appliedOK = b, ok
+	f.apply(b, ok)
+}
+
+// apply parses the limits, and logs the changes of the limits of the
+// groups.
+func (f *FileLimits) apply(b []byte, ok bool) {
+	var limits map[string]GroupLimits
+	if ok {
+		var err error
+		if limits, err = parseLimits(b); err != nil {
+			log.Errorf("Invalid ratelimit limits file %s, using the limits of the settings: %v", f.path, err)
+		}
+	}
+
+	f.mu.Lock()
+	previous := f.limits
+	f.limits = limits
+	f.mu.Unlock()
+
+	logLimitsChanges(previous, limits)
+}
+
+// Close stops watching the file.
+func (f *FileLimits) Close() {
+	f.once.Do(func() { close(f.quit) })
+}
+
+func parseLimits(b []byte) (map[string]GroupLimits, error) {
+	limits := make(map[string]GroupLimits)
+	if err := yaml.UnmarshalStrict(b, &limits); err != nil {
+		return nil, err
+	}
+
+	for group, l := range limits {
+		if l.MaxHits < 0 || l.TimeWindow < 0 {
+			return nil, fmt.Errorf("invalid limits of group %s: %v", group, l)
+		}
+	}
+
+	return limits, nil
+}
+
+func logLimitsChanges(previous, current map[string]GroupLimits) {
+	var groups []string
+	for group, l := range current {
+		if pl, ok := previous[group]; !ok || pl != l {
+			groups = append(groups, group)
+		}
+	}
+
+	for group := range previous {
+		if _, ok := current[group]; !ok {
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Strings(groups)
+	for _, group := range groups {
+		if l, ok := current[group]; ok {
+			log.Infof("Applied the ratelimit limits of group %s: %v", group, l)
+		} else {
+			log.Infof("Removed the ratelimit limits of group %s, using the limits of the settings", group)
+		}
+	}
+}
+
+// redisLimits is a LimitsProvider, that loads the limits of the groups
+// from the redis hashes ratelimit.limits.<group>, with the fields
+// maxHits and timeWindow, e.g. 100 and 1m. The limits of a group are
+// cached, and refreshed in the background, when they are older than
+// the refresh interval, so the lookup never waits for redis. Before the
+// first refresh, when the hash doesn't exist, and when redis fails,
+// the group uses the limits of its settings.
+type redisLimits struct {
+	ring     *redis.Ring
+	interval time.Duration
+
+	mu     sync.Mutex
+	groups map[string]*cachedLimits
+}
+
+type cachedLimits struct {
+	limits     GroupLimits
+	ok         bool
+	updated    time.Time
+	refreshing bool
+}
+
+func newRedisLimits(r *redis.Ring, interval time.Duration) *redisLimits {
+	return &redisLimits{
+		ring:     r,
+		interval: interval,
+		groups:   make(map[string]*cachedLimits),
+	}
+}
+
+// Limits returns the cached limits of the group.
+func (r *redisLimits) Limits(group string) (GroupLimits, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.groups[group]
+	if !ok {
+		c = &cachedLimits{}
+		r.groups[group] = c
+	}
+
+	if !c.refreshing && time.Since(c.updated) >= r.interval {
+		c.refreshing = true
+		go r.refresh(group)
+	}
+
+	return c.limits, c.ok
+}
+
+// refresh loads the limits of the group from redis.
+func (r *redisLimits) refresh(group string) {
+	ctx, cancel := context.WithTimeout(context.Background(), limitsTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf(limitsKeyFormat, group)
+	m, err := r.ring.HGetAll(ctx, key).Result()
+
+	var l GroupLimits
+	ok := err == nil && len(m) > 0
+	if err != nil {
+		log.Errorf("Failed to load the ratelimit limits of %s, using the limits of the settings: %v", key, err)
+	} else if ok {
+		if l, err = redisGroupLimits(m); err != nil {
+			log.Errorf("Invalid ratelimit limits of %s, using the limits of the settings: %v", key, err)
+			ok = false
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.groups[group]
+	if ok != c.ok || l != c.limits {
+		var previous, current map[string]GroupLimits
+		if c.ok {
+			previous = map[string]GroupLimits{group: c.limits}
+		}
+
+		if ok {
+			current = map[string]GroupLimits{group: l}
+		}
+
+		logLimitsChanges(previous, current)
+	}
+
+	c.limits, c.ok = l, ok
+	c.updated = time.Now()
+	c.refreshing = false
+}
+
+func redisGroupLimits(m map[string]string) (GroupLimits, error) {
+	var l GroupLimits
+	if v, ok := m["maxHits"]; ok {
+		maxHits, err := strconv.Atoi(v)
+		if err != nil || maxHits < 0 {
+			return GroupLimits{}, fmt.Errorf("invalid maxHits: %q", v)
+		}
+
+		l.MaxHits = maxHits
+	}
+
+	if v, ok := m["timeWindow"]; ok {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < 0 {
+			return GroupLimits{}, fmt.Errorf("invalid timeWindow: %q", v)
+		}
+
+		l.TimeWindow = window
+	}
+
+	return l, nil
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type staticLimits map[string]GroupLimits
+
+func (s staticLimits) Limits(group string) (GroupLimits, bool) {
+	l, ok := s[group]
+	return l, ok
+}
+
+func TestGroupLimits(t *testing.T) {
+	c := &clusterLimitRedis{
+		group:   "A",
+		maxHits: 10,
+		window:  time.Minute,
+	}
+
+	check := func(t *testing.T, maxHits int64, window time.Duration) {
+		if m, _ := c.limit("key"); m != maxHits {
+			t.Errorf("unexpected max hits: %d != %d", m, maxHits)
+		}
+
+		if w := c.timeWindow(); w != window {
+			t.Errorf("unexpected time window: %s != %s", w, window)
+		}
+	}
+
+	t.Run("without provider", func(t *testing.T) {
+		check(t, 10, time.Minute)
+	})
+
+	t.Run("group without limits", func(t *testing.T) {
+		c.limits = staticLimits{"B": {MaxHits: 20}}
+		check(t, 10, time.Minute)
+	})
+
+	t.Run("partial limits", func(t *testing.T) {
+		c.limits = staticLimits{"A": {MaxHits: 20}}
+		check(t, 20, time.Minute)
+	})
+
+	t.Run("full limits", func(t *testing.T) {
+		c.limits = staticLimits{"A": {MaxHits: 20, TimeWindow: time.Hour}}
+		check(t, 20, time.Hour)
+	})
+}
+
+func TestFileLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "limits.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(t *testing.T, group string, expected GroupLimits, expectedOK bool, f *FileLimits) {
+		t.Helper()
+		l, ok := f.Limits(group)
+		if ok != expectedOK || l != expected {
+			t.Errorf("unexpected limits of %s: %v %v, expected: %v %v", group, l, ok, expected, expectedOK)
+		}
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		f := NewFileLimits(filepath.Join(dir, "missing.yaml"), FileLimitsOptions{RefreshInterval: time.Hour})
+		defer f.Close()
+		expect(t, "A", GroupLimits{}, false, f)
+	})
+
+	write("A:\n  maxHits: 100\n  timeWindow: 1m\n")
+	f := NewFileLimits(path, FileLimitsOptions{RefreshInterval: time.Hour, Debounce: 10 * time.Second})
+	defer f.Close()
+
+	t.Run("initial load", func(t *testing.T) {
+		expect(t, "A", GroupLimits{MaxHits: 100, TimeWindow: time.Minute}, true, f)
+		expect(t, "B", GroupLimits{}, false, f)
+	})
+
+	now := time.Now()
+	t.Run("debounce rapid changes", func(t *testing.T) {
+		write("A:\n  maxHits: 200\n")
+		f.check(now)
+		expect(t, "A", GroupLimits{MaxHits: 100, TimeWindow: time.Minute}, true, f)
+
+		write("A:\n  maxHits: 300\nB:\n  timeWindow: 1h\n")
+		f.check(now.Add(5 * time.Second))
+		f.check(now.Add(12 * time.Second))
+		expect(t, "A", GroupLimits{MaxHits: 100, TimeWindow: time.Minute}, true, f)
+
+		f.check(now.Add(15 * time.Second))
+		expect(t, "A", GroupLimits{MaxHits: 300}, true, f)
+		expect(t, "B", GroupLimits{TimeWindow: time.Hour}, true, f)
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		write("A:\n  maxHits: -1\n")
+		f.check(now.Add(20 * time.Second))
+		f.check(now.Add(30 * time.Second))
+		expect(t, "A", GroupLimits{}, false, f)
+		expect(t, "B", GroupLimits{}, false, f)
+	})
+
+	t.Run("removed file", func(t *testing.T) {
+		write("A:\n  maxHits: 400\n")
+		f.check(now.Add(40 * time.Second))
+		f.check(now.Add(50 * time.Second))
+		expect(t, "A", GroupLimits{MaxHits: 400}, true, f)
+
+		os.Remove(path)
+		f.check(now.Add(60 * time.Second))
+		f.check(now.Add(70 * time.Second))
+		expect(t, "A", GroupLimits{}, false, f)
+	})
+}
+
+func TestRedisGroupLimits(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		hash     map[string]string
+		expected GroupLimits
+		fail     bool
+	}{{
+		msg:      "max hits and time window",
+		hash:     map[string]string{"maxHits": "100", "timeWindow": "1m"},
+		expected: GroupLimits{MaxHits: 100, TimeWindow: time.Minute},
+	}, {
+		msg:      "max hits",
+		hash:     map[string]string{"maxHits": "100"},
+		expected: GroupLimits{MaxHits: 100},
+	}, {
+		msg:  "invalid max hits",
+		hash: map[string]string{"maxHits": "many"},
+		fail: true,
+	}, {
+		msg:  "negative time window",
+		hash: map[string]string{"timeWindow": "-1m"},
+		fail: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			l, err := redisGroupLimits(ti.hash)
+			if ti.fail {
+				if err == nil {
+					t.Error("failed to fail")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if l != ti.expected {
+				t.Errorf("unexpected limits: %v, expected: %v", l, ti.expected)
+			}
+		})
+	}
+}
+
+func TestRedisLimitsFailSafe(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := newRedisLimits(client, time.Hour)
+	r.groups["A"] = &cachedLimits{limits: GroupLimits{MaxHits: 100}, ok: true, updated: time.Now()}
+	if _, ok := r.Limits("A"); !ok {
+		t.Fatal("failed to get the cached limits")
+	}
+
+	// the limits of the settings are used, when redis fails
+	r.refresh("A")
+	if l, ok := r.Limits("A"); ok {
+		t.Errorf("unexpected limits after a failed refresh: %v", l)
+	}
+}
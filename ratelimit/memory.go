@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const minMemoryEvictInterval = time.Second
+
+// clusterLimitMemory is a sliding window ratelimit calculated in the
+// memory of the instance. It can be used instead of the redis based
+// cluster ratelimit by single instance deployments. The hits of a key
+// are capped to maxHits, and the keys without hits in the last time
+// window are evicted periodically.
+type clusterLimitMemory struct {
+	group   string
+	maxHits int
+	window  time.Duration
+	dryRun  bool
+
+	retryAfterMultiplier float64
+
+	mu     sync.Mutex
+	hits   map[string][]time.Time
+	denied map[string]deniedHits
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// deniedHits counts the denied requests of a key, starting with the
+// first denied request.
+type deniedHits struct {
+	count int64
+	since time.Time
+}
+
+// newClusterRateLimiterMemory creates a clusterLimitMemory for the
+// Settings. The idle keys are evicted every CleanInterval, or every
+// TimeWindow, if CleanInterval is not set.
+func newClusterRateLimiterMemory(s Settings, group string) *clusterLimitMemory {
+	c := &clusterLimitMemory{
+		group:   group,
+		maxHits: s.MaxHits,
+		window:  s.TimeWindow,
+		dryRun:  s.DryRun,
+		hits:    make(map[string][]time.Time),
+		denied:  make(map[string]deniedHits),
+		quit:    make(chan struct{}),
+
+		retryAfterMultiplier: s.RetryAfterMultiplier,
+	}
+
+	interval := s.CleanInterval
+	if interval <= 0 {
+		interval = s.TimeWindow
+	}
+
+	if interval < minMemoryEvictInterval {
+		interval = minMemoryEvictInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.evict(now)
+			case <-c.quit:
+				log.Debugf("%s: quit in-memory clusterRatelimit", group)
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// evict removes the keys without hits in the time window before now.
+func (c *clusterLimitMemory) evict(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clearBefore := now.Add(-c.window)
+	for key, hits := range c.hits {
+		if len(hits) == 0 || !hits[len(hits)-1].After(clearBefore) {
+			delete(c.hits, key)
+		}
+	}
+
+	for key, d := range c.denied {
+		if !d.since.After(clearBefore) {
+			delete(c.denied, key)
+		}
+	}
+}
+
+// recordDenied counts the denied request of the key, when the retry
+// after is weighted. It has to be called with the lock held.
+func (c *clusterLimitMemory) recordDenied(key string, now time.Time) {
+	if c.retryAfterMultiplier <= 1 {
+		return
+	}
+
+	d, ok := c.denied[key]
+	if !ok || !d.since.After(now.Add(-c.window)) {
+		d = deniedHits{since: now}
+	}
+
+	d.count++
+	c.denied[key] = d
+}
+
+// current returns the hits of the key in the time window before now.
+// It has to be called with the lock held.
+func (c *clusterLimitMemory) current(key string, now time.Time) []time.Time {
+	hits := c.hits[key]
+	clearBefore := now.Add(-c.window)
+
+	var i int
+	for i < len(hits) && !hits[i].After(clearBefore) {
+		i++
+	}
+
+	if i > 0 {
+		hits = hits[i:]
+		c.hits[key] = hits
+	}
+
+	return hits
+}
+
+// AllowResultContext returns the decision about the request of the
+// key, and records the hit, when the request is allowed. In dry-run
+// mode, all requests are allowed, and the hits are capped to maxHits.
+func (c *clusterLimitMemory) AllowResultContext(ctx context.Context, clearText string) AllowResult {
+	return c.AllowNResultContext(ctx, clearText, 1)
+}
+
+// AllowNResultContext is like AllowResultContext, but the request
+// counts as n hits.
+func (c *clusterLimitMemory) AllowNResultContext(_ context.Context, clearText string, n int) AllowResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	hits := c.current(clearText, now)
+	result := AllowResult{Allowed: true, Limit: c.maxHits}
+	if len(hits)+n > c.maxHits {
+		if !c.dryRun {
+			c.recordDenied(clearText, now)
+			result.Allowed = false
+			if len(hits) < c.maxHits {
+				result.Remaining = c.maxHits - len(hits)
+			}
+			return result
+		}
+
+		result.DryRunForbidden = true
+		if drop := len(hits) + n - c.maxHits; drop < len(hits) {
+			hits = hits[drop:]
+		} else {
+			hits = nil
+		}
+	} else {
+		result.Remaining = c.maxHits - len(hits) - n
+		result.Count = len(hits) + n
+	}
+
+	for i := 0; i < n && len(hits) < c.maxHits; i++ {
+		hits = append(hits, now)
+	}
+
+	c.hits[clearText] = hits
+	return result
+}
+
+// AllowContext returns true, if the request of the key is allowed.
+func (c *clusterLimitMemory) AllowContext(ctx context.Context, clearText string) bool {
+	return c.AllowResultContext(ctx, clearText).Allowed
+}
+
+// Allow is like AllowContext, but not using a context.
+func (c *clusterLimitMemory) Allow(clearText string) bool {
+	return c.AllowContext(context.Background(), clearText)
+}
+
+// Close stops the eviction of the idle keys.
+func (c *clusterLimitMemory) Close() {
+	c.once.Do(func() { close(c.quit) })
+}
+
+// Oldest returns the oldest hit of the key in the time window.
+func (c *clusterLimitMemory) Oldest(clearText string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hits := c.current(clearText, time.Now())
+	if len(hits) == 0 {
+		return time.Time{}
+	}
+
+	return hits[0]
+}
+
+// Delta returns the time.Duration until the next call is allowed,
+// negative means immediate calls are allowed.
+func (c *clusterLimitMemory) Delta(clearText string) time.Duration {
+	return c.DurationUntilAllowed(context.Background(), clearText)
+}
+
+// DurationUntilAllowed returns the duration until the next call is
+// allowed, negative means immediate calls are allowed.
+func (c *clusterLimitMemory) DurationUntilAllowed(_ context.Context, clearText string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	hits := c.current(clearText, now)
+	if len(hits) < c.maxHits {
+		return -c.window
+	}
+
+	return c.window - now.Sub(hits[0])
+}
+
+// Resize is noop to implement the limiter interface.
+func (*clusterLimitMemory) Resize(string, int) {}
+
+// RetryAfter returns the seconds until the next call is allowed, but
+// at least 1, like the redis based cluster ratelimit. With
+// Settings.RetryAfterMultiplier, the result is scaled by the number of
+// denied requests.
+func (c *clusterLimitMemory) RetryAfter(clearText string) int {
+	res := 1
+	if s := int(c.Delta(clearText) / time.Second); s > 0 {
+		res = s + 1
+	}
+
+	if c.retryAfterMultiplier <= 1 {
+		return res
+	}
+
+	c.mu.Lock()
+	d, ok := c.denied[clearText]
+	c.mu.Unlock()
+	if !ok || !d.since.After(time.Now().Add(-c.window)) {
+		return res
+	}
+
+	return weightedRetryAfter(res, c.retryAfterMultiplier, d.count, int64(c.maxHits), c.window)
+}
@@ -0,0 +1,243 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClusterLimitMemory(t *testing.T) {
+	s := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    3,
+		TimeWindow: time.Second,
+		Group:      "memory",
+		InMemory:   true,
+	}
+
+	c := newClusterRateLimiterMemory(s, s.Group)
+	defer c.Close()
+
+	for i := 0; i < s.MaxHits; i++ {
+		r := c.AllowResultContext(context.Background(), "foo")
+		if !r.Allowed {
+			t.Fatalf("request %d not allowed", i)
+		}
+
+		if r.Remaining != s.MaxHits-i-1 {
+			t.Errorf("unexpected remaining hits after request %d: %d", i, r.Remaining)
+		}
+	}
+
+	if c.Allow("foo") {
+		t.Error("request allowed over the limit")
+	}
+
+	if !c.Allow("bar") {
+		t.Error("request of a different key not allowed")
+	}
+
+	if d := c.Delta("foo"); d <= 0 || d > s.TimeWindow {
+		t.Errorf("unexpected delta: %s", d)
+	}
+
+	if d := c.Delta("baz"); d >= 0 {
+		t.Errorf("unexpected delta of an unknown key: %s", d)
+	}
+
+	if ra := c.RetryAfter("foo"); ra != 1 {
+		t.Errorf("unexpected retry after: %d", ra)
+	}
+
+	if o := c.Oldest("foo"); o.IsZero() || time.Since(o) > s.TimeWindow {
+		t.Errorf("unexpected oldest hit: %s", o)
+	}
+
+	if o := c.Oldest("baz"); !o.IsZero() {
+		t.Errorf("unexpected oldest hit of an unknown key: %s", o)
+	}
+
+	// the hits slide out of the time window
+	c.mu.Lock()
+	for i := range c.hits["foo"] {
+		c.hits["foo"][i] = c.hits["foo"][i].Add(-s.TimeWindow)
+	}
+	c.mu.Unlock()
+
+	if !c.Allow("foo") {
+		t.Error("request not allowed after the time window")
+	}
+
+	c.evict(time.Now().Add(2 * s.TimeWindow))
+	if len(c.hits) != 0 {
+		t.Errorf("idle keys not evicted: %d", len(c.hits))
+	}
+}
+
+func TestClusterLimitMemoryDryRun(t *testing.T) {
+	s := Settings{
+		Type:       ClusterServiceRatelimit,
+		MaxHits:    1,
+		TimeWindow: time.Minute,
+		Group:      "memory-dryrun",
+		InMemory:   true,
+		DryRun:     true,
+	}
+
+	c := newClusterRateLimiterMemory(s, s.Group)
+	defer c.Close()
+
+	if r := c.AllowResultContext(context.Background(), "foo"); !r.Allowed || r.DryRunForbidden {
+		t.Errorf("unexpected result of the first request: %+v", r)
+	}
+
+	for i := 0; i < 3; i++ {
+		if r := c.AllowResultContext(context.Background(), "foo"); !r.Allowed || !r.DryRunForbidden {
+			t.Errorf("unexpected result of the dry-run request: %+v", r)
+		}
+	}
+
+	if n := len(c.hits["foo"]); n != s.MaxHits {
+		t.Errorf("hits not capped in dry-run mode: %d", n)
+	}
+}
+
+func TestInMemoryRegistry(t *testing.T) {
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	s := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "memory-registry",
+	}
+
+	rl := r.Get(s)
+	defer rl.Close()
+
+	if _, ok := rl.impl.(*clusterLimitMemory); !ok {
+		t.Fatalf("unexpected limiter: %T", rl.impl)
+	}
+
+	if rl != r.Get(s) {
+		t.Error("limiter not reused for the same settings")
+	}
+
+	if _, ok := r.Get(Settings{Type: ClientRatelimit, MaxHits: 1, TimeWindow: time.Second}).impl.(*clusterLimitMemory); ok {
+		t.Error("in-memory limiter used for a local ratelimit")
+	}
+}
+
+func TestClusterLimitMemoryWeightedRetryAfter(t *testing.T) {
+	s := Settings{
+		Type:                 ClusterClientRatelimit,
+		MaxHits:              4,
+		TimeWindow:           10 * time.Second,
+		Group:                "memory-weighted",
+		InMemory:             true,
+		RetryAfterMultiplier: 3,
+	}
+
+	c := newClusterRateLimiterMemory(s, s.Group)
+	defer c.Close()
+
+	for i := 0; i < s.MaxHits; i++ {
+		c.Allow("foo")
+	}
+
+	if r := c.RetryAfter("foo"); r != 10 {
+		t.Errorf("unexpected retry after without denied requests: %d", r)
+	}
+
+	// half of max hits over the limit
+	c.Allow("foo")
+	c.Allow("foo")
+	if r := c.RetryAfter("foo"); r != 20 {
+		t.Errorf("unexpected weighted retry after: %d", r)
+	}
+
+	// capped to multiplier times the time window
+	for i := 0; i < 20; i++ {
+		c.Allow("foo")
+	}
+
+	if r := c.RetryAfter("foo"); r != 30 {
+		t.Errorf("unexpected capped retry after: %d", r)
+	}
+
+	c.evict(time.Now().Add(2 * s.TimeWindow))
+	if len(c.denied) != 0 {
+		t.Errorf("denied requests not evicted: %d", len(c.denied))
+	}
+}
+
+func TestClusterLimitMemoryAllowN(t *testing.T) {
+	s := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    5,
+		TimeWindow: time.Minute,
+		Group:      "memory",
+		InMemory:   true,
+	}
+
+	c := newClusterRateLimiterMemory(s, s.Group)
+	defer c.Close()
+
+	ctx := context.Background()
+	if r := c.AllowNResultContext(ctx, "foo", 3); !r.Allowed || r.Remaining != 2 {
+		t.Errorf("unexpected result of the first request: %+v", r)
+	}
+
+	if r := c.AllowNResultContext(ctx, "foo", 3); r.Allowed {
+		t.Error("request allowed over the limit")
+	}
+
+	if r := c.AllowNResultContext(ctx, "foo", 2); !r.Allowed || r.Remaining != 0 {
+		t.Errorf("unexpected result of the request up to the limit: %+v", r)
+	}
+
+	if c.Allow("foo") {
+		t.Error("request allowed over the limit")
+	}
+
+	// the dry-run mode caps the hits to max hits
+	s.DryRun = true
+	c = newClusterRateLimiterMemory(s, s.Group)
+	defer c.Close()
+
+	if r := c.AllowNResultContext(ctx, "foo", 7); !r.Allowed || !r.DryRunForbidden {
+		t.Errorf("unexpected result in dry-run mode: %+v", r)
+	}
+
+	if n := len(c.hits["foo"]); n != s.MaxHits {
+		t.Errorf("unexpected number of hits: %d", n)
+	}
+}
+
+func TestClusterLimitMemorySoftLimit(t *testing.T) {
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	rl := r.Get(Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    5,
+		TimeWindow: time.Minute,
+		Group:      "memory-soft-limit",
+		SoftLimit:  0.8,
+	})
+	defer rl.Close()
+
+	for i, expected := range []AllowResult{
+		{Allowed: true, Limit: 5, Remaining: 4, Count: 1},
+		{Allowed: true, Limit: 5, Remaining: 3, Count: 2},
+		{Allowed: true, Limit: 5, Remaining: 2, Count: 3},
+		{Allowed: true, Limit: 5, Remaining: 1, Count: 4, SoftLimited: true},
+		{Allowed: true, Limit: 5, Remaining: 0, Count: 5, SoftLimited: true},
+		{Allowed: false, Limit: 5},
+	} {
+		if result := rl.AllowResultContext(context.Background(), "foo"); result != expected {
+			t.Errorf("unexpected result of request %d: %+v != %+v", i+1, result, expected)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const windowGroupFormat = "window.%s.%s"
+
+// Window is an additional time window of a multi-window cluster
+// ratelimit.
+type Window struct {
+	MaxHits    int
+	TimeWindow time.Duration
+}
+
+// String returns the window in the format of ParseWindows, e.g.
+// 100/1m0s.
+func (w Window) String() string {
+	return fmt.Sprintf("%d/%s", w.MaxHits, w.TimeWindow)
+}
+
+// FormatWindows returns the windows in the format of
+// Settings.Windows.
+func FormatWindows(windows []Window) string {
+	s := make([]string, len(windows))
+	for i, w := range windows {
+		s[i] = w.String()
+	}
+
+	return strings.Join(s, ",")
+}
+
+// ParseWindows parses the comma separated max-hits/time-window pairs
+// of Settings.Windows, e.g. 100/1m,1000/1h.
+func ParseWindows(s string) ([]Window, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var windows []Window
+	for _, ws := range strings.Split(s, ",") {
+		p := strings.Split(strings.TrimSpace(ws), "/")
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid ratelimit window: %q", ws)
+		}
+
+		maxHits, err := strconv.Atoi(p[0])
+		if err != nil || maxHits < 0 {
+			return nil, fmt.Errorf("invalid max hits of ratelimit window: %q", ws)
+		}
+
+		timeWindow, err := time.ParseDuration(p[1])
+		if err != nil || timeWindow <= 0 {
+			return nil, fmt.Errorf("invalid time window of ratelimit window: %q", ws)
+		}
+
+		windows = append(windows, Window{MaxHits: maxHits, TimeWindow: timeWindow})
+	}
+
+	return windows, nil
+}
+
+// clusterLimitMultiWindow is a cluster ratelimit, that enforces
+// several time windows for the same key, e.g. 10 hits per second for
+// burst protection, and 100 hits per minute for sustained protection.
+// The hits of every window are stored in a separate sorted set, and a
+// request is denied, when it exceeds any of the windows.
+type clusterLimitMultiWindow struct {
+	*clusterLimitRedis
+	windows []*clusterLimitRedis
+}
+
+func newClusterLimitMultiWindow(s Settings, group limiter, r *ring) limiter {
+	groupRedis, ok := group.(*clusterLimitRedis)
+	if !ok {
+		log.Warnf("Ratelimit windows of group %s require redis, ignoring the windows.", s.Group)
+		return group
+	}
+
+	windows, err := ParseWindows(s.Windows)
+	if err != nil {
+		log.Errorf("Ignoring the ratelimit windows of group %s: %v.", s.Group, err)
+		return group
+	}
+
+	c := &clusterLimitMultiWindow{
+		clusterLimitRedis: groupRedis,
+		windows:           []*clusterLimitRedis{groupRedis},
+	}
+
+	for _, w := range windows {
+		ws := Settings{
+			Type:         s.Type,
+			MaxHits:      w.MaxHits,
+			TimeWindow:   w.TimeWindow,
+			Group:        fmt.Sprintf(windowGroupFormat, s.Group, w.TimeWindow),
+			ExpireMargin: s.ExpireMargin,
+		}
+
+		wr := newClusterRateLimiterRedis(ws, r, ws.Group)
+		if wr == nil {
+			return group
+		}
+
+		wr.limits = nil
+		c.windows = append(c.windows, wr)
+	}
+
+	// the limits of the groups with several windows are static
+	groupRedis.limits = nil
+	return c
+}
+
+// AllowContext returns true if the request is allowed by all the
+// windows.
+func (c *clusterLimitMultiWindow) AllowContext(ctx context.Context, clearText string) bool {
+	return c.AllowResultContext(ctx, clearText).Allowed
+}
+
+// Allow is like AllowContext, but not using a context.
+func (c *clusterLimitMultiWindow) Allow(clearText string) bool {
+	return c.AllowContext(context.Background(), clearText)
+}
+
+// AllowResultContext is like AllowContext, but returns the details of
+// the decision. The limit, count and remaining hits are the ones of
+// the window with the fewest remaining hits, and Window is the time
+// window, that denied the request.
+func (c *clusterLimitMultiWindow) AllowResultContext(ctx context.Context, clearText string) AllowResult {
+	return c.AllowNResultContext(ctx, clearText, 1)
+}
+
+// AllowNResultContext is like AllowResultContext, but the request
+// counts as n hits in all the windows.
+//
+// Performance considerations:
+//
+// It checks the sets of hits of the windows in order, until a window
+// denies the request. In case of allow, it records the hits in all the
+// sets.
+func (c *clusterLimitMultiWindow) AllowNResultContext(ctx context.Context, clearText string, n int) AllowResult {
+	defer c.drain.start()()
+
+	ctx = c.sample(ctx, clearText)
+	s := hashedKey(ctx, clearText)
+	c.metrics.IncCounter(c.metricsPrefix + "total")
+	if c.killSwitch.active() {
+		c.incCounter("killswitch.allows")
+		return AllowResult{Allowed: true, Limit: int(c.maxHits)}
+	}
+
+	start := time.Now()
+	var queryFailure bool
+	defer c.measureQuery(allowOperation, &queryFailure, start)
+
+	now := c.clock.adjust(start)
+	nowNanos := now.UnixNano()
+	result := AllowResult{Allowed: true, Limit: int(c.maxHits)}
+	remaining := int64(-1)
+
+	var tripped *clusterLimitRedis
+	for _, w := range c.windows {
+		maxHits, _ := w.limit(clearText)
+		count, err := w.checkCard(ctx, w.prefixKey(s), now.Add(-w.window).UnixNano(), n, maxHits)
+		if err != nil {
+			log.Errorf("Failed to get redis cardinality of the %s window: %v", w.window, err)
+			queryFailure = true
+			if c.failClosed && !c.dryRun {
+				return c.backendErrorResult(maxHits)
+			}
+
+			continue
+		}
+
+		if count+int64(n) > maxHits {
+			tripped = w
+			result.Limit = int(maxHits)
+			break
+		}
+
+		if r := maxHits - count - int64(n); remaining < 0 || r < remaining {
+			remaining = r
+			result.Limit = int(maxHits)
+			result.Remaining = int(r)
+			result.Count = int(count) + n
+		}
+	}
+
+	if tripped != nil {
+		result.Window = tripped.window
+		result.Remaining, result.Count = 0, 0
+		if !c.dryRun {
+			c.incCounter("forbids")
+			log.Debugf("redis disallow request in the %s window", tripped.window)
+			c.recordDenied(ctx, c.prefixKey(s))
+			result.Allowed = false
+			return result
+		}
+
+		c.incCounter("dryrun.forbids")
+		result.DryRunForbidden = true
+	}
+
+	members := make([]interface{}, n)
+	for i := range members {
+		members[i] = nowNanos + int64(i)
+	}
+
+	var failed bool
+	for _, w := range c.windows {
+		zaddErr, err := w.record(ctx, w.prefixKey(s), nowNanos, members...)
+		if zaddErr != nil || err != nil {
+			queryFailure = true
+		}
+
+		failed = failed || err != nil
+	}
+
+	if !failed && !result.DryRunForbidden {
+		c.incCounter("allows")
+	}
+
+	return result
+}
+
+// RetryAfterContext returns the longest wait of the windows, that deny
+// the next request.
+func (c *clusterLimitMultiWindow) RetryAfterContext(ctx context.Context, clearText string) int {
+	var res int
+	for _, w := range c.windows {
+		if r := w.RetryAfterContext(ctx, clearText); r > res {
+			res = r
+		}
+	}
+
+	return res
+}
+
+// RetryAfter is like RetryAfterContext, but not using a context.
+func (c *clusterLimitMultiWindow) RetryAfter(clearText string) int {
+	return c.RetryAfterContext(context.Background(), clearText)
+}
+
+// DurationUntilAllowed returns the longest duration until one of the
+// windows, that deny the next call, admits it. 0 means immediate calls
+// are allowed. Unlike the single window ratelimit, it doesn't use the
+// oldest hit of the windows, because the long windows are rarely
+// exhausted.
+func (c *clusterLimitMultiWindow) DurationUntilAllowed(ctx context.Context, clearText string) time.Duration {
+	ctx = c.sample(ctx, clearText)
+	now := c.clock.adjust(time.Now())
+
+	var res time.Duration
+	for _, w := range c.windows {
+		admitted, err := w.nextAdmitted(ctx, clearText, now)
+		if err != nil {
+			log.Errorf("Failed to get the duration until the next call is allowed in the %s window: %v", w.window, err)
+			continue
+		}
+
+		if d := admitted.Sub(now); !admitted.IsZero() && d > res {
+			res = d
+		}
+	}
+
+	return res
+}
+
+// Delta is like DurationUntilAllowed, but not using a context.
+func (c *clusterLimitMultiWindow) Delta(clearText string) time.Duration {
+	return c.DurationUntilAllowed(context.Background(), clearText)
+}
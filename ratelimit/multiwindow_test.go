@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("100/1m, 1000/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Window{{MaxHits: 100, TimeWindow: time.Minute}, {MaxHits: 1000, TimeWindow: time.Hour}}
+	if !reflect.DeepEqual(windows, expected) {
+		t.Errorf("unexpected windows: %v", windows)
+	}
+
+	if s := FormatWindows(windows); s != "100/1m0s,1000/1h0m0s" {
+		t.Errorf("unexpected format: %s", s)
+	}
+
+	if windows, err := ParseWindows(""); err != nil || windows != nil {
+		t.Errorf("unexpected windows: %v, %v", windows, err)
+	}
+
+	for _, s := range []string{"100", "100/1m/1h", "x/1m", "-1/1m", "100/x", "100/0s"} {
+		if _, err := ParseWindows(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestMultiWindowWithoutRedis(t *testing.T) {
+	s := Settings{Type: ClusterServiceRatelimit, MaxHits: 10, TimeWindow: time.Second, Group: "A", Windows: "100/1m"}
+	group := voidRatelimit{}
+	if l := newClusterLimitMultiWindow(s, group, nil); l != group {
+		t.Errorf("unexpected limiter without redis: %v", l)
+	}
+
+	if s.String() != "ratelimit(type=clusterService,max-hits=10,time-window=1s,group=A,windows=100/1m)" {
+		t.Errorf("unexpected settings string: %s", s)
+	}
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// oldestCacheSize is the maximum number of keys in the oldest cache.
+// When it's full, the expired entries are removed, and when it's still
+// full, the new keys are not cached.
+const oldestCacheSize = 10000
+
+type oldestCacheEntry struct {
+	admitted time.Time
+	expiry   time.Time
+}
+
+// oldestCache caches the time, when the oldest hit admitting the next
+// request of a key expires, as returned by the RetryAfter query, for a
+// short TTL. Under sustained over-limit traffic, every denied request
+// calls RetryAfter, and the cache saves the redis query of the repeated
+// calls of the same key within the TTL. The hits of other instances
+// are seen after the TTL, the hits recorded by this instance
+// invalidate the key immediately.
+type oldestCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]oldestCacheEntry
+}
+
+// newOldestCache returns nil, when the ttl is not positive, which is a
+// valid cache, that never caches.
+func newOldestCache(ttl time.Duration) *oldestCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &oldestCache{
+		ttl:     ttl,
+		entries: make(map[string]oldestCacheEntry),
+	}
+}
+
+// get returns the cached time of the key, when it's not expired.
+func (c *oldestCache) get(key string, now time.Time) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if !now.Before(e.expiry) {
+		delete(c.entries, key)
+		return time.Time{}, false
+	}
+
+	return e.admitted, true
+}
+
+// set caches the time of the key for the TTL.
+func (c *oldestCache) set(key string, admitted, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= oldestCacheSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expiry) {
+				delete(c.entries, k)
+			}
+		}
+
+		if len(c.entries) >= oldestCacheSize {
+			return
+		}
+	}
+
+	c.entries[key] = oldestCacheEntry{admitted: admitted, expiry: now.Add(c.ttl)}
+}
+
+// invalidate removes the key, when its hits changed.
+func (c *oldestCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOldestCache(t *testing.T) {
+	now := time.Now()
+	admitted := now.Add(3 * time.Second)
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newOldestCache(0)
+		c.set("A", admitted, now)
+		if _, ok := c.get("A", now); ok {
+			t.Error("unexpected cached key")
+		}
+
+		c.invalidate("A")
+	})
+
+	t.Run("cached within the ttl", func(t *testing.T) {
+		c := newOldestCache(200 * time.Millisecond)
+		c.set("A", admitted, now)
+		if a, ok := c.get("A", now.Add(100*time.Millisecond)); !ok || !a.Equal(admitted) {
+			t.Errorf("unexpected cached time: %v, %v", a, ok)
+		}
+
+		if _, ok := c.get("B", now); ok {
+			t.Error("unexpected cached key")
+		}
+
+		if _, ok := c.get("A", now.Add(200*time.Millisecond)); ok {
+			t.Error("unexpected cached key after the ttl")
+		}
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		c := newOldestCache(200 * time.Millisecond)
+		c.set("A", admitted, now)
+		c.invalidate("A")
+		if _, ok := c.get("A", now); ok {
+			t.Error("unexpected cached key after the invalidation")
+		}
+	})
+
+	t.Run("full", func(t *testing.T) {
+		c := newOldestCache(200 * time.Millisecond)
+		for i := 0; i < oldestCacheSize; i++ {
+			c.set(fmt.Sprint(i), admitted, now)
+		}
+
+		c.set("A", admitted, now)
+		if _, ok := c.get("A", now); ok {
+			t.Error("unexpected cached key in a full cache")
+		}
+
+		// the expired keys make room
+		later := now.Add(time.Second)
+		c.set("A", admitted, later)
+		if _, ok := c.get("A", later); !ok {
+			t.Error("failed to cache after the expiry")
+		}
+	})
+}
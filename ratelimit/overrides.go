@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	overridesKeyFormat = swarmPrefix + "overrides.%s"
+
+	overridesTimeout = time.Second
+)
+
+// limitOverrides caches the per key max hits of a cluster ratelimit
+// group, stored in the redis hash ratelimit.overrides.<group>, where
+// the fields are the clear text keys, e.g. the client ids, and the
+// values are the max hits. The cache is refreshed in the background,
+// when it is older than the refresh interval, so the lookup never
+// waits for redis, and the calls use the stale overrides, or before
+// the first refresh, the max hits of the group.
+type limitOverrides struct {
+	ring     *redis.Ring
+	key      string
+	interval time.Duration
+
+	mu         sync.Mutex
+	values     map[string]int64
+	updated    time.Time
+	refreshing bool
+}
+
+func newLimitOverrides(r *redis.Ring, key string, interval time.Duration) *limitOverrides {
+	return &limitOverrides{
+		ring:     r,
+		key:      key,
+		interval: interval,
+	}
+}
+
+// get returns the max hits of the clear text key, if it has an
+// override.
+func (o *limitOverrides) get(clearText string) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.refreshing && time.Since(o.updated) >= o.interval {
+		o.refreshing = true
+		go o.refresh()
+	}
+
+	maxHits, ok := o.values[clearText]
+	return maxHits, ok
+}
+
+// refresh loads the overrides from redis. On failure, the previous
+// overrides are kept until the next refresh.
+func (o *limitOverrides) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), overridesTimeout)
+	defer cancel()
+
+	m, err := o.ring.HGetAll(ctx, o.key).Result()
+	values := make(map[string]int64, len(m))
+	if err == nil {
+		for k, v := range m {
+			maxHits, perr := strconv.ParseInt(v, 10, 64)
+			if perr != nil || maxHits <= 0 {
+				log.Errorf("Invalid ratelimit override of %s in %s: %q", k, o.key, v)
+				continue
+			}
+
+			values[k] = maxHits
+		}
+	} else {
+		log.Errorf("Failed to load the ratelimit overrides of %s: %v", o.key, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.refreshing = false
+	o.updated = time.Now()
+	if err == nil {
+		o.values = values
+	}
+}
@@ -5,11 +5,17 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 	circularbuffer "github.com/szuecs/rate-limit-buffer"
 	"github.com/zalando/skipper/net"
@@ -23,6 +29,19 @@ const (
 	// long a client should wait before making a new request
 	RetryAfterHeader = "Retry-After"
 
+	// LimitHeader is the name of the header, which will be used to
+	// indicate the number of allowed requests per time window
+	LimitHeader = "X-RateLimit-Limit"
+
+	// RemainingHeader is the name of the header, which will be used to
+	// indicate the number of remaining requests in the time window
+	RemainingHeader = "X-RateLimit-Remaining"
+
+	// WarningHeader is the name of the header, which will be used to
+	// warn the clients, that exceeded the soft limit, before they are
+	// ratelimited
+	WarningHeader = "X-RateLimit-Warning"
+
 	// ServiceRatelimitName is the name of the Ratelimit filter, which will be shown in log
 	ServiceRatelimitName = "ratelimit"
 
@@ -38,6 +57,27 @@ const (
 	// ClusterClientRatelimitName is the name of the ClusterClientRatelimit filter, which will be shown in log
 	ClusterClientRatelimitName = "clusterClientRatelimit"
 
+	// ClusterServiceRatelimitDryRunName is the name of the ClusterServiceRatelimit filter in dry-run mode
+	ClusterServiceRatelimitDryRunName = "clusterRatelimitDryRun"
+
+	// ClusterClientRatelimitDryRunName is the name of the ClusterClientRatelimit filter in dry-run mode
+	ClusterClientRatelimitDryRunName = "clusterClientRatelimitDryRun"
+
+	// ClusterHierarchicalRatelimitName is the name of the ClusterServiceRatelimit filter with a parent budget
+	ClusterHierarchicalRatelimitName = "clusterHierarchicalRatelimit"
+
+	// ClusterMultiWindowRatelimitName is the name of the cluster ratelimit filter with several time windows
+	ClusterMultiWindowRatelimitName = "clusterMultiWindowRatelimit"
+
+	// ClusterRequestDedupeName is the name of the cluster ratelimit filter limiting the identical requests
+	ClusterRequestDedupeName = "clusterRequestDedupe"
+
+	// ClusterClientCertRatelimitName is the name of the cluster ratelimit filter limiting the clients by their TLS client certificate
+	ClusterClientCertRatelimitName = "clusterClientCertRatelimit"
+
+	// ClusterConcurrencyLimitName is the name of the filter limiting the requests in flight across the cluster
+	ClusterConcurrencyLimitName = "clusterConcurrencyLimit"
+
 	// DisableRatelimitName is the name of the DisableRatelimit, which will be shown in log
 	DisableRatelimitName = "disableRatelimit"
 
@@ -251,6 +291,233 @@ func (t TupleLookuper) String() string {
 	return "TupleLookuper"
 }
 
+// RouteLookuper is implemented by the Lookupers, that select the
+// bucket also by the path template of the matched route.
+type RouteLookuper interface {
+	Lookuper
+
+	// LookupRoute is like Lookup, with the path template of the
+	// matched route, e.g. /users/:id, or an empty string.
+	LookupRoute(req *http.Request, pathTemplate string) string
+}
+
+type templatePart func(req *http.Request, pathTemplate string) string
+
+// TemplateLookuper implements Lookuper interface and will select a
+// bucket by a template, that combines literal text with the
+// placeholders {client-ip}, {host}, {method}, {path},
+// {path-template}, {header:<name>} and {query:<name>}, for example:
+//
+//	{client-ip}:{header:X-Api-Version}:{path}
+//
+// The {path-template} placeholder is rendered as the path pattern of
+// the matched route, e.g. /users/:id/orders/:orderId, so the requests
+// of all the resources matched by the route share the bucket. It is
+// only available with LookupRoute, and empty otherwise.
+type TemplateLookuper struct {
+	// pointer is required to be hashable from Registry lookup table
+	parts *[]templatePart
+}
+
+func templatePlaceholder(p string) (templatePart, error) {
+	switch {
+	case p == "client-ip":
+		return func(req *http.Request, _ string) string { return net.RemoteHost(req).String() }, nil
+	case p == "host":
+		return func(req *http.Request, _ string) string { return req.Host }, nil
+	case p == "method":
+		return func(req *http.Request, _ string) string { return req.Method }, nil
+	case p == "path":
+		return func(req *http.Request, _ string) string { return req.URL.Path }, nil
+	case p == "path-template":
+		return func(_ *http.Request, pathTemplate string) string { return pathTemplate }, nil
+	case strings.HasPrefix(p, "header:") && len(p) > len("header:"):
+		name := http.CanonicalHeaderKey(p[len("header:"):])
+		return func(req *http.Request, _ string) string { return req.Header.Get(name) }, nil
+	case strings.HasPrefix(p, "query:") && len(p) > len("query:"):
+		name := p[len("query:"):]
+		return func(req *http.Request, _ string) string { return req.URL.Query().Get(name) }, nil
+	default:
+		return nil, fmt.Errorf("unknown placeholder in ratelimit template: {%s}", p)
+	}
+}
+
+// NewTemplateLookuper returns a TemplateLookuper rendering the
+// template, or an error, when the template contains unknown or
+// unterminated placeholders.
+func NewTemplateLookuper(template string) (TemplateLookuper, error) {
+	var parts []templatePart
+	for rest := template; rest != ""; {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			literal := rest
+			parts = append(parts, func(*http.Request, string) string { return literal })
+			break
+		}
+
+		if rest[start] == '}' {
+			return TemplateLookuper{}, fmt.Errorf("unexpected '}' in ratelimit template: %s", template)
+		}
+
+		if start > 0 {
+			literal := rest[:start]
+			parts = append(parts, func(*http.Request, string) string { return literal })
+		}
+
+		end := strings.IndexAny(rest[start+1:], "{}")
+		if end < 0 || rest[start+1+end] != '}' {
+			return TemplateLookuper{}, fmt.Errorf("unterminated placeholder in ratelimit template: %s", template)
+		}
+
+		part, err := templatePlaceholder(rest[start+1 : start+1+end])
+		if err != nil {
+			return TemplateLookuper{}, err
+		}
+
+		parts = append(parts, part)
+		rest = rest[start+end+2:]
+	}
+
+	return TemplateLookuper{parts: &parts}, nil
+}
+
+// Lookup returns the rendered template, with an empty path template.
+func (t TemplateLookuper) Lookup(req *http.Request) string {
+	return t.LookupRoute(req, "")
+}
+
+// LookupRoute returns the rendered template.
+func (t TemplateLookuper) LookupRoute(req *http.Request, pathTemplate string) string {
+	if t.parts == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, p := range *t.parts {
+		b.WriteString(p(req, pathTemplate))
+	}
+
+	return b.String()
+}
+
+func (t TemplateLookuper) String() string {
+	return "TemplateLookuper"
+}
+
+// ErrRequestBodyTooLarge is returned by the RequestFingerprintLookuper,
+// when the body of the request is larger than its maximum body size.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// RequestFingerprintLookuper implements Lookuper interface and will
+// select a bucket by the method, host, path, query and the SHA-256 hash
+// of the body of the request, so that identical requests share the
+// bucket.
+type RequestFingerprintLookuper struct {
+	maxBodySize int64
+}
+
+// NewRequestFingerprintLookuper returns a RequestFingerprintLookuper,
+// that hashes bodies of at most maxBodySize bytes. When maxBodySize is
+// 0, the body is not part of the fingerprint.
+func NewRequestFingerprintLookuper(maxBodySize int64) RequestFingerprintLookuper {
+	return RequestFingerprintLookuper{maxBodySize: maxBodySize}
+}
+
+type fingerprintBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Lookup returns the fingerprint of the request, or an empty string,
+// when the body could not be read or it is larger than the maximum
+// body size. The read part of the body is restored, so the body is
+// forwarded unchanged.
+func (f RequestFingerprintLookuper) Lookup(req *http.Request) string {
+	fp, err := f.LookupBody(req)
+	if err != nil {
+		log.Debugf("Failed to get the request fingerprint: %v", err)
+		return ""
+	}
+
+	return fp
+}
+
+// LookupBody returns the fingerprint of the request like Lookup, and
+// ErrRequestBodyTooLarge, when the body is larger than the maximum body
+// size.
+func (f RequestFingerprintLookuper) LookupBody(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody && f.maxBodySize > 0 {
+		if req.ContentLength > f.maxBodySize {
+			return "", ErrRequestBodyTooLarge
+		}
+
+		// one byte over the limit tells the bodies larger than the
+		// limit
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(req.Body, f.maxBodySize+1))
+		req.Body = &fingerprintBody{
+			Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), req.Body),
+			Closer: req.Body,
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if n > f.maxBodySize {
+			return "", ErrRequestBodyTooLarge
+		}
+
+		h.Write(buf.Bytes())
+	}
+
+	return req.Method + " " + req.Host + req.URL.RequestURI() + " " + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (RequestFingerprintLookuper) String() string {
+	return "RequestFingerprintLookuper"
+}
+
+// ClientCertLookuper implements Lookuper interface and will select a
+// bucket by the verified TLS client certificate of the request, e.g.
+// for the clients of mTLS-fronted APIs, that share IPs. The key is the
+// hex encoded SHA-256 fingerprint of the certificate, or its subject,
+// so the renewed certificates of a client share the bucket. The
+// certificate has to be verified by the TLS config of the listener,
+// with tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert,
+// the requests with unverified or without certificates have no key.
+type ClientCertLookuper struct {
+	subject bool
+}
+
+// NewClientCertLookuper returns a ClientCertLookuper, that selects the
+// bucket by the subject of the certificate, when subject is true, and
+// by its fingerprint, otherwise.
+func NewClientCertLookuper(subject bool) ClientCertLookuper {
+	return ClientCertLookuper{subject: subject}
+}
+
+// Lookup returns the fingerprint or the subject of the verified client
+// certificate, or an empty string, when the request has none.
+func (l ClientCertLookuper) Lookup(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := req.TLS.PeerCertificates[0]
+	if l.subject {
+		return cert.Subject.String()
+	}
+
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+func (ClientCertLookuper) String() string {
+	return "ClientCertLookuper"
+}
+
 // Settings configures the chosen rate limiter
 type Settings struct {
 	// Type of the chosen rate limiter
@@ -277,6 +544,67 @@ type Settings struct {
 	// A ratelimit group considers all hits to the same group as
 	// one target.
 	Group string `yaml:"group"`
+
+	// Parent is the name of a budget shared by cluster ratelimit
+	// groups of Type ClusterServiceRatelimit or
+	// ClusterClientRatelimit. It requires redis.
+	Parent string `yaml:"parent"`
+
+	// ParentMaxHits is the maximum number of hits for the
+	// TimeWindow allowed in the parent budget.
+	ParentMaxHits int `yaml:"parent-max-hits"`
+
+	// Reserved is the number of hits for the TimeWindow, that the
+	// group is allowed without checking the parent budget.
+	Reserved int `yaml:"reserved"`
+
+	// InMemory calculates the cluster ratelimits of Type
+	// ClusterServiceRatelimit or ClusterClientRatelimit in the memory
+	// of the instance instead of the swarm or redis, for single
+	// instance deployments.
+	InMemory bool `yaml:"in-memory"`
+
+	// DryRun enables the shadow mode of the rate limiter. The hits
+	// are recorded and the decision is calculated, but all requests
+	// are allowed.
+	DryRun bool `yaml:"dry-run"`
+
+	// RetryAfterMultiplier scales the retry after of the cluster
+	// ratelimits of Type ClusterServiceRatelimit or
+	// ClusterClientRatelimit by how far the denied requests exceed
+	// MaxHits. With a multiplier of 2, a client sending twice the
+	// allowed requests waits twice as long. Values up to 1 disable
+	// the scaling.
+	RetryAfterMultiplier float64 `yaml:"retry-after-multiplier"`
+
+	// SoftLimit is the fraction of MaxHits, e.g. 0.8, after which the
+	// allowed requests are marked as SoftLimited, so the clients can
+	// be warned before they are ratelimited. It is supported by the
+	// cluster ratelimits of Type ClusterServiceRatelimit or
+	// ClusterClientRatelimit with redis or in memory. 0 disables the
+	// soft limit.
+	SoftLimit float64 `yaml:"soft-limit"`
+
+	// ExpireMargin is added to the TimeWindow for the expiry of the
+	// redis keys of the cluster ratelimits of Type
+	// ClusterServiceRatelimit or ClusterClientRatelimit. Defaults to
+	// 1s. It can be lowered, e.g. to a few milliseconds for short
+	// time windows, to not keep the keys longer than necessary.
+	ExpireMargin time.Duration `yaml:"expire-margin"`
+
+	// Windows are the additional time windows of the cluster
+	// ratelimits of Type ClusterServiceRatelimit or
+	// ClusterClientRatelimit, enforced for the same key, as comma
+	// separated max-hits/time-window pairs, e.g. 100/1m0s, see
+	// ParseWindows. The requests are denied, when they exceed MaxHits
+	// in the TimeWindow, or any of the windows. It requires redis.
+	Windows string `yaml:"windows"`
+
+	// NormalizeKeys lowercases the keys, and strips the surrounding
+	// whitespace and a trailing dot, before they are hashed, so the
+	// keys derived from e.g. the Host header, that differ only in
+	// case, end up in the same bucket.
+	NormalizeKeys bool `yaml:"normalize-keys"`
 }
 
 func (s Settings) Empty() bool {
@@ -284,6 +612,36 @@ func (s Settings) Empty() bool {
 }
 
 func (s Settings) String() string {
+	if s.NormalizeKeys {
+		d := s
+		d.NormalizeKeys = false
+		return strings.TrimSuffix(d.String(), ")") + ",normalize-keys)"
+	}
+
+	if s.DryRun {
+		d := s
+		d.DryRun = false
+		return strings.TrimSuffix(d.String(), ")") + ",dry-run)"
+	}
+
+	if s.RetryAfterMultiplier > 1 {
+		d := s
+		d.RetryAfterMultiplier = 0
+		return strings.TrimSuffix(d.String(), ")") + fmt.Sprintf(",retry-after-multiplier=%g)", s.RetryAfterMultiplier)
+	}
+
+	if s.SoftLimit > 0 {
+		d := s
+		d.SoftLimit = 0
+		return strings.TrimSuffix(d.String(), ")") + fmt.Sprintf(",soft-limit=%g)", s.SoftLimit)
+	}
+
+	if s.Windows != "" && (s.Type == ClusterServiceRatelimit || s.Type == ClusterClientRatelimit) {
+		d := s
+		d.Windows = ""
+		return strings.TrimSuffix(d.String(), ")") + fmt.Sprintf(",windows=%s)", s.Windows)
+	}
+
 	switch s.Type {
 	case DisableRatelimit:
 		return "disable"
@@ -294,6 +652,13 @@ func (s Settings) String() string {
 	case ClientRatelimit:
 		return fmt.Sprintf("ratelimit(type=client,max-hits=%d,time-window=%s)", s.MaxHits, s.TimeWindow)
 	case ClusterServiceRatelimit:
+		if s.Parent != "" {
+			return fmt.Sprintf(
+				"ratelimit(type=clusterService,max-hits=%d,time-window=%s,group=%s,parent=%s,parent-max-hits=%d,reserved=%d)",
+				s.MaxHits, s.TimeWindow, s.Group, s.Parent, s.ParentMaxHits, s.Reserved,
+			)
+		}
+
 		return fmt.Sprintf("ratelimit(type=clusterService,max-hits=%d,time-window=%s,group=%s)", s.MaxHits, s.TimeWindow, s.Group)
 	case ClusterClientRatelimit:
 		return fmt.Sprintf("ratelimit(type=clusterClient,max-hits=%d,time-window=%s,group=%s)", s.MaxHits, s.TimeWindow, s.Group)
@@ -335,6 +700,84 @@ type contextLimiter interface {
 	AllowContext(context.Context, string) bool
 }
 
+// durationLimiter extends limiter with a DurationUntilAllowed method
+// that accepts an additional context.Context, e.g. to support
+// OpenTracing.
+type durationLimiter interface {
+	limiter
+	DurationUntilAllowed(context.Context, string) time.Duration
+}
+
+// retryAfterLimiter extends limiter with a RetryAfterContext method
+// that accepts an additional context.Context, e.g. to support
+// OpenTracing.
+type retryAfterLimiter interface {
+	limiter
+	RetryAfterContext(context.Context, string) int
+}
+
+var errActiveKeysNotSupported = errors.New("active keys are only supported by the redis based cluster ratelimits")
+
+// activeKeysLimiter extends limiter with an ActiveKeys method, that
+// lists the keys with recorded hits.
+type activeKeysLimiter interface {
+	limiter
+	ActiveKeys(context.Context) ([]ActiveKey, error)
+}
+
+// resultLimiter extends limiter with an AllowResultContext method,
+// that returns the details of the decision.
+type resultLimiter interface {
+	limiter
+	AllowResultContext(context.Context, string) AllowResult
+}
+
+// allowNLimiter extends limiter with an AllowNResultContext method,
+// that counts the request as n hits.
+type allowNLimiter interface {
+	limiter
+	AllowNResultContext(context.Context, string, int) AllowResult
+}
+
+// AllowResult describes the decision of a ratelimiter about a
+// request, and is used to render the ratelimit response headers.
+type AllowResult struct {
+	// Allowed is true, when the request is not ratelimited
+	Allowed bool
+
+	// Limit is the number of allowed requests per time window
+	Limit int
+
+	// Remaining is the number of requests remaining in the time
+	// window
+	Remaining int
+
+	// RetryAfter is the number of seconds to wait before making a
+	// new request
+	RetryAfter int
+
+	// DryRunForbidden is true, when the request was allowed by a
+	// rate limiter in dry-run mode, but would have been denied
+	DryRunForbidden bool
+
+	// Count is the number of hits in the time window including the
+	// allowed request, or 0, when it is not known
+	Count int
+
+	// SoftLimited is true, when the request was allowed, but the
+	// Count exceeded the soft limit of the settings
+	SoftLimited bool
+
+	// Window is the time window of a multi-window cluster ratelimit,
+	// that denied the request, or would have in dry-run mode
+	Window time.Duration
+
+	// BackendError is true, when the request was denied, because the
+	// hits couldn't be counted, and the ratelimit fails closed, not
+	// because the request exceeded the limit
+	BackendError bool
+}
+
 // Ratelimit is a proxy object that delegates to limiter
 // implemetations and stores settings for the ratelimiter
 type Ratelimit struct {
@@ -348,17 +791,24 @@ func (l *Ratelimit) Allow(s string) bool {
 	if l == nil {
 		return true
 	}
-	return l.impl.Allow(s)
+	return l.impl.Allow(l.key(s))
 }
 
 // AllowContext is like Allow but accepts an optional context.Context, e.g. to
 // support OpenTracing. When the context handling is not provided by the
-// implementation, it falls back to the normal Allow method.
+// implementation, it falls back to the normal Allow method. The
+// decision is set as tags on the span of the context, like by the
+// other Allow* methods accepting a context.
 func (l *Ratelimit) AllowContext(ctx context.Context, s string) bool {
 	if l == nil {
 		return true
 	}
 
+	s = l.key(s)
+	return l.tagDecision(ctx, AllowResult{Allowed: l.allowContext(ctx, s)}).Allowed
+}
+
+func (l *Ratelimit) allowContext(ctx context.Context, s string) bool {
 	if ctx == nil {
 		return l.impl.Allow(s)
 	}
@@ -371,6 +821,157 @@ func (l *Ratelimit) AllowContext(ctx context.Context, s string) bool {
 	return implc.AllowContext(ctx, s)
 }
 
+// AllowResultContext is like AllowContext, but returns the details of
+// the decision. When the rate limiter is in dry-run mode, the request
+// is always allowed, and DryRunForbidden tells whether it would have
+// been denied.
+func (l *Ratelimit) AllowResultContext(ctx context.Context, s string) AllowResult {
+	if l == nil {
+		return AllowResult{Allowed: true}
+	}
+
+	return l.allowResult(ctx, l.key(s))
+}
+
+func (l *Ratelimit) allowResult(ctx context.Context, s string) AllowResult {
+	if implr, ok := l.impl.(resultLimiter); ok && ctx != nil {
+		return l.tagDecision(ctx, l.softLimit(implr.AllowResultContext(ctx, s)))
+	}
+
+	r := AllowResult{Allowed: l.allowContext(ctx, s), Limit: l.settings.MaxHits}
+	if !r.Allowed && l.settings.DryRun {
+		r.Allowed = true
+		r.DryRunForbidden = true
+	}
+
+	return l.tagDecision(ctx, r)
+}
+
+// AllowN is like AllowResultContext, but the request counts as n hits,
+// e.g. for a request declaring its cost. The request is denied, if the
+// n hits exceed the remaining hits of the time window. Only the redis
+// and in-memory cluster ratelimits support it, the other ratelimits
+// and n less than 2 count the request once.
+func (l *Ratelimit) AllowN(ctx context.Context, s string, n int) AllowResult {
+	if l == nil {
+		return AllowResult{Allowed: true}
+	}
+
+	s = l.key(s)
+	if impln, ok := l.impl.(allowNLimiter); ok && ctx != nil && n > 1 {
+		return l.tagDecision(ctx, l.softLimit(impln.AllowNResultContext(ctx, s, n)))
+	}
+
+	return l.AllowResultContext(ctx, s)
+}
+
+// AllowIdempotent is like AllowResultContext, but the calls with the
+// same idempotency token, e.g. the retries of a request, within the
+// time window consume only one hit, and get the decision of the first
+// call. Only the redis based cluster ratelimits support it, the other
+// ratelimits count every call.
+func (l *Ratelimit) AllowIdempotent(ctx context.Context, s, token string) AllowResult {
+	if l == nil {
+		return AllowResult{Allowed: true}
+	}
+
+	s = l.key(s)
+	if impli, ok := l.impl.(idempotentLimiter); ok && ctx != nil {
+		return l.tagDecision(ctx, l.softLimit(impli.AllowIdempotentContext(ctx, s, token)))
+	}
+
+	return l.AllowResultContext(ctx, s)
+}
+
+// AllowHashed is like AllowResultContext, but the key is already
+// hashed by the caller, e.g. a composite limiter, that derives the key
+// of several dimensions, so the redis based cluster ratelimits use it
+// as is, only prefixed with the group, instead of hashing it again.
+// The caller guarantees, that the key is safe to use as part of a
+// Redis key, e.g. a hex encoded hash. The key is not normalized, and
+// the overrides of the max hits don't apply to it, because they match
+// the clear text keys. The other ratelimits use the key like a clear
+// text key.
+func (l *Ratelimit) AllowHashed(ctx context.Context, hashedKey string) AllowResult {
+	if l == nil {
+		return AllowResult{Allowed: true}
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return l.allowResult(withPreHashedKey(ctx, hashedKey), hashedKey)
+}
+
+// key normalizes the key, when it is enabled by the settings.
+func (l *Ratelimit) key(s string) string {
+	if !l.settings.NormalizeKeys {
+		return s
+	}
+
+	return normalizeKey(s)
+}
+
+// normalizeKey lowercases the key, and strips the surrounding
+// whitespace and a trailing dot, e.g. of a fully qualified hostname.
+func normalizeKey(s string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+}
+
+// tagDecision sets the decision of the ratelimit on the span of the
+// request, so the traces of the denied requests can be searched for
+// directly. The count is only set, when it is known.
+func (l *Ratelimit) tagDecision(ctx context.Context, r AllowResult) AllowResult {
+	if ctx == nil {
+		return r
+	}
+
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return r
+	}
+
+	span.SetTag("ratelimit.allowed", r.Allowed)
+	if r.Count > 0 {
+		span.SetTag("ratelimit.count", r.Count)
+	}
+
+	if l.settings.Group != "" {
+		span.SetTag("ratelimit.group", l.settings.Group)
+	}
+
+	return r
+}
+
+// softLimit marks the allowed result as SoftLimited, when its count
+// reached the soft limit of the settings.
+func (l *Ratelimit) softLimit(r AllowResult) AllowResult {
+	if r.Allowed && l.settings.SoftLimit > 0 && r.Count > 0 &&
+		float64(r.Count) >= l.settings.SoftLimit*float64(r.Limit) {
+		r.SoftLimited = true
+	}
+
+	return r
+}
+
+// ActiveKeys returns the hashed keys with recorded hits and their
+// number of hits. It is only supported by the redis based cluster
+// ratelimits, and it is meant for admin tooling, because it scans the
+// whole keyspace of redis.
+func (l *Ratelimit) ActiveKeys(ctx context.Context) ([]ActiveKey, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	impla, ok := l.impl.(activeKeysLimiter)
+	if !ok {
+		return nil, errActiveKeysNotSupported
+	}
+
+	return impla.ActiveKeys(ctx)
+}
+
 // Close will stop any cleanup goroutines in underlying limiter implementation.
 func (l *Ratelimit) Close() {
 	l.impl.Close()
@@ -381,15 +982,52 @@ func (l *Ratelimit) RetryAfter(s string) int {
 	if l == nil {
 		return 0
 	}
-	return l.impl.RetryAfter(s)
+	return l.impl.RetryAfter(l.key(s))
+}
+
+// RetryAfterContext is like RetryAfter but accepts an optional
+// context.Context, e.g. to support OpenTracing. When the context
+// handling is not provided by the implementation, it falls back to the
+// normal RetryAfter method.
+func (l *Ratelimit) RetryAfterContext(ctx context.Context, s string) int {
+	if l == nil {
+		return 0
+	}
+
+	s = l.key(s)
+	implr, ok := l.impl.(retryAfterLimiter)
+	if !ok || ctx == nil {
+		return l.impl.RetryAfter(s)
+	}
+
+	return implr.RetryAfterContext(ctx, s)
 }
 
 func (l *Ratelimit) Delta(s string) time.Duration {
-	return l.impl.Delta(s)
+	return l.impl.Delta(l.key(s))
+}
+
+// DurationUntilAllowed returns the duration until the next request is
+// allowed, negative means immediate requests are allowed. Unlike
+// RetryAfter, the duration is not rounded to whole seconds. When the
+// context handling is not provided by the implementation, it falls back
+// to the Delta method.
+func (l *Ratelimit) DurationUntilAllowed(ctx context.Context, s string) time.Duration {
+	if l == nil {
+		return -1 * time.Second
+	}
+
+	s = l.key(s)
+	impld, ok := l.impl.(durationLimiter)
+	if !ok || ctx == nil {
+		return l.impl.Delta(s)
+	}
+
+	return impld.DurationUntilAllowed(ctx, s)
 }
 
 func (l *Ratelimit) Resize(s string, i int) {
-	l.impl.Resize(s, i)
+	l.impl.Resize(l.key(s), i)
 }
 
 type voidRatelimit struct{}
@@ -426,6 +1064,30 @@ func newRatelimit(s Settings, sw Swarmer, redisRing *ring) *Ratelimit {
 	}
 }
 
+// weightedRetryAfter scales the seconds to wait by how far the
+// requests exceed maxHits, counting the denied requests. With a
+// multiplier of 2, twice the allowed requests double the wait. The
+// result is capped to multiplier times the time window, but it is never
+// less than retryAfter.
+func weightedRetryAfter(retryAfter int, multiplier float64, denied, maxHits int64, window time.Duration) int {
+	if multiplier <= 1 || denied <= 0 || maxHits <= 0 {
+		return retryAfter
+	}
+
+	over := float64(denied) / float64(maxHits)
+	weighted := math.Round(float64(retryAfter) * (1 + (multiplier-1)*over))
+	max := math.Ceil(multiplier * window.Seconds())
+	if weighted > max {
+		weighted = max
+	}
+
+	if int(weighted) < retryAfter {
+		return retryAfter
+	}
+
+	return int(weighted)
+}
+
 func Headers(s *Settings, retryAfter int) http.Header {
 	limitPerHour := int64(s.MaxHits) * int64(time.Hour) / int64(s.TimeWindow)
 	return http.Header{
@@ -434,7 +1096,87 @@ func Headers(s *Settings, retryAfter int) http.Header {
 	}
 }
 
+// RetryAfterDate returns the Retry-After value of retryAfter seconds
+// as HTTP-date, see RFC 7231. The HTTP-date has the precision of
+// seconds, so now is rounded up to the next full second, and the date
+// is not earlier than the delay in seconds from now.
+func RetryAfterDate(now time.Time, retryAfter int) string {
+	t := now.Truncate(time.Second)
+	if t.Before(now) {
+		t = t.Add(time.Second)
+	}
+
+	return t.Add(time.Duration(retryAfter) * time.Second).UTC().Format(http.TimeFormat)
+}
+
+// ResultHeaders returns the headers of a ratelimited response, which
+// include the X-RateLimit-Limit and X-RateLimit-Remaining headers of
+// the result in addition to Headers. The remaining requests of a
+// denied request are not 0, when it counted as multiple hits.
+func ResultHeaders(s *Settings, r AllowResult) http.Header {
+	remaining := r.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	h := Headers(s, r.RetryAfter)
+	h.Set(LimitHeader, strconv.Itoa(r.Limit))
+	h.Set(RemainingHeader, strconv.Itoa(remaining))
+	return h
+}
+
 func getHashedKey(clearText string) string {
 	h := sha256.Sum256([]byte(clearText))
 	return hex.EncodeToString(h[:])
 }
+
+type hashedKeyMemoKey struct{}
+
+// hashedKeyMemo stores the last hashed key of a request.
+type hashedKeyMemo struct {
+	mu        sync.Mutex
+	clearText string
+	hashed    string
+}
+
+// WithHashedKeyMemo returns a context, that memoizes the hashed key
+// of the ratelimit calls made with it, so the key is hashed only once,
+// when the same request calls e.g. AllowContext and
+// RetryAfterContext. The context is meant to be used for a single
+// request.
+func WithHashedKeyMemo(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(hashedKeyMemoKey{}).(*hashedKeyMemo); ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, hashedKeyMemoKey{}, &hashedKeyMemo{})
+}
+
+// withPreHashedKey returns a context, that memoizes the key as its own
+// hash, so the ratelimit calls made with it don't hash the key.
+func withPreHashedKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashedKeyMemoKey{}, &hashedKeyMemo{clearText: key, hashed: key})
+}
+
+// hashedKey returns the hashed key, memoized, when the context was
+// created with WithHashedKeyMemo or withPreHashedKey.
+func hashedKey(ctx context.Context, clearText string) string {
+	if ctx == nil {
+		return getHashedKey(clearText)
+	}
+
+	m, ok := ctx.Value(hashedKeyMemoKey{}).(*hashedKeyMemo)
+	if !ok {
+		return getHashedKey(clearText)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.hashed == "" || m.clearText != clearText {
+		m.clearText = clearText
+		m.hashed = getHashedKey(clearText)
+	}
+
+	return m.hashed
+}
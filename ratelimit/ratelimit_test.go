@@ -1,10 +1,26 @@
 package ratelimit
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
 )
 
 func checkRatelimitted(t *testing.T, rl *Ratelimit, client string) {
@@ -62,6 +78,22 @@ func TestServiceRatelimit(t *testing.T) {
 	})
 }
 
+func TestDurationUntilAllowed(t *testing.T) {
+	t.Run("nil ratelimit allows immediately", func(t *testing.T) {
+		var rl *Ratelimit
+		if d := rl.DurationUntilAllowed(context.Background(), "foo"); d >= 0 {
+			t.Errorf("unexpected duration: %v", d)
+		}
+	})
+
+	t.Run("falls back to delta", func(t *testing.T) {
+		rl := newRatelimit(Settings{Type: DisableRatelimit}, nil, nil)
+		if d := rl.DurationUntilAllowed(context.Background(), "foo"); d != rl.Delta("foo") {
+			t.Errorf("unexpected duration: %v", d)
+		}
+	})
+}
+
 func TestLocalRatelimit(t *testing.T) {
 	s := Settings{
 		Type:          LocalRatelimit,
@@ -205,6 +237,197 @@ func TestTupleLookuper(t *testing.T) {
 	})
 }
 
+func TestTemplateLookuper(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.org/foo?tenant=bar", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+
+	req.RemoteAddr = "192.168.0.1:8080"
+	req.Header.Set("X-Api-Version", "v2")
+
+	for _, ti := range []struct {
+		template string
+		expected string
+		fail     bool
+	}{{
+		template: "{client-ip}:{header:x-api-version}:{path}",
+		expected: "192.168.0.1:v2:/foo",
+	}, {
+		template: "{method} {host}{path}?{query:tenant}",
+		expected: "GET example.org/foo?bar",
+	}, {
+		template: "static",
+		expected: "static",
+	}, {
+		template: "{header:X-Missing}-{query:missing}",
+		expected: "-",
+	}, {
+		template: "{client-ip}:{unknown}",
+		fail:     true,
+	}, {
+		template: "{header:}",
+		fail:     true,
+	}, {
+		template: "{client-ip",
+		fail:     true,
+	}, {
+		template: "{client-{ip}}",
+		fail:     true,
+	}, {
+		template: "client-ip}",
+		fail:     true,
+	}} {
+		t.Run(ti.template, func(t *testing.T) {
+			l, err := NewTemplateLookuper(ti.template)
+			if ti.fail {
+				if err == nil {
+					t.Error("Failed to fail")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := l.Lookup(req); got != ti.expected {
+				t.Errorf("Failed to lookup request: %q != %q", got, ti.expected)
+			}
+		})
+	}
+}
+
+func TestTemplateLookuperPathTemplate(t *testing.T) {
+	l, err := NewTemplateLookuper("{client-ip}:{path-template}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/users/1/orders/2", "/users/3/orders/4"} {
+		req, err := http.NewRequest("GET", "https://example.org"+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = "192.168.0.1:8080"
+		if got := l.LookupRoute(req, "/users/:id/orders/:orderId"); got != "192.168.0.1:/users/:id/orders/:orderId" {
+			t.Errorf("Failed to lookup the path template: %q", got)
+		}
+
+		if got := l.Lookup(req); got != "192.168.0.1:" {
+			t.Errorf("Failed to lookup without path template: %q", got)
+		}
+	}
+}
+
+func TestClientCertLookuper(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("cert"), Subject: pkix.Name{CommonName: "client-a", Organization: []string{"example"}}}
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		subject  bool
+		state    *tls.ConnectionState
+		expected string
+	}{{
+		msg:      "fingerprint",
+		state:    verified,
+		expected: getHashedKey("cert"),
+	}, {
+		msg:      "subject",
+		subject:  true,
+		state:    verified,
+		expected: "CN=client-a,O=example",
+	}, {
+		msg: "no TLS",
+	}, {
+		msg:   "no client certificate",
+		state: &tls.ConnectionState{},
+	}, {
+		msg:   "unverified client certificate",
+		state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.TLS = ti.state
+			if key := NewClientCertLookuper(ti.subject).Lookup(req); key != ti.expected {
+				t.Errorf("unexpected key: %q, expected: %q", key, ti.expected)
+			}
+		})
+	}
+}
+
+func TestRequestFingerprintLookuper(t *testing.T) {
+	l := NewRequestFingerprintLookuper(8)
+	lookup := func(method, url, body string) (string, string) {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		fp := l.Lookup(req)
+
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fp, string(b)
+	}
+
+	fp, body := lookup("POST", "https://example.org/foo?bar=baz", "payload")
+	if body != "payload" {
+		t.Errorf("Failed to restore the body: %q", body)
+	}
+
+	if same, _ := lookup("POST", "https://example.org/foo?bar=baz", "payload"); same != fp {
+		t.Errorf("Failed to get the same fingerprint: %q != %q", same, fp)
+	}
+
+	for _, ti := range []struct {
+		msg    string
+		method string
+		url    string
+		body   string
+	}{
+		{"method", "PUT", "https://example.org/foo?bar=baz", "payload"},
+		{"host", "POST", "https://example.com/foo?bar=baz", "payload"},
+		{"path", "POST", "https://example.org/bar?bar=baz", "payload"},
+		{"query", "POST", "https://example.org/foo?bar=qux", "payload"},
+		{"body", "POST", "https://example.org/foo?bar=baz", "other"},
+	} {
+		if other, _ := lookup(ti.method, ti.url, ti.body); other == fp {
+			t.Errorf("Failed to get a different fingerprint for a different %s", ti.msg)
+		}
+	}
+
+	if limit, _ := lookup("POST", "https://example.org/foo", "12345678"); limit == "" {
+		t.Error("Failed to get the fingerprint of a body of the maximum size")
+	}
+
+	long := "123456789"
+	fp, body = lookup("POST", "https://example.org/foo", long)
+	if fp != "" {
+		t.Errorf("Failed to reject the body over the maximum size: %q", fp)
+	}
+
+	if body != long {
+		t.Errorf("Failed to restore the long body: %q", body)
+	}
+
+	req := httptest.NewRequest("POST", "https://example.org/foo", strings.NewReader(long))
+	if _, err := l.LookupBody(req); err != ErrRequestBodyTooLarge {
+		t.Errorf("Failed to get the error of the body over the maximum size: %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "https://example.org/foo", ioutil.NopCloser(strings.NewReader(long)))
+	req.ContentLength = -1
+	if _, err := l.LookupBody(req); err != ErrRequestBodyTooLarge {
+		t.Errorf("Failed to get the error of the body of unknown length over the maximum size: %v", err)
+	}
+}
+
 func BenchmarkServiceRatelimit(b *testing.B) {
 	maxint := 1 << 21
 	s := Settings{
@@ -328,3 +551,828 @@ func TestSettingsRatelimit(t *testing.T) {
 		}
 	})
 }
+
+func TestWeightedRetryAfter(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		retryAfter int
+		multiplier float64
+		denied     int64
+		expected   int
+	}{{
+		msg:        "multiplier of 1",
+		retryAfter: 5,
+		multiplier: 1,
+		denied:     20,
+		expected:   5,
+	}, {
+		msg:        "no denied requests",
+		retryAfter: 5,
+		multiplier: 2,
+		expected:   5,
+	}, {
+		msg:        "barely over the limit",
+		retryAfter: 5,
+		multiplier: 2,
+		denied:     1,
+		expected:   6,
+	}, {
+		msg:        "twice the limit",
+		retryAfter: 5,
+		multiplier: 2,
+		denied:     10,
+		expected:   10,
+	}, {
+		msg:        "capped to the time window",
+		retryAfter: 5,
+		multiplier: 2,
+		denied:     100,
+		expected:   20,
+	}, {
+		msg:        "minimum wait barely over the limit",
+		retryAfter: 1,
+		multiplier: 1.5,
+		denied:     1,
+		expected:   1,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			if r := weightedRetryAfter(ti.retryAfter, ti.multiplier, ti.denied, 10, 10*time.Second); r != ti.expected {
+				t.Errorf("unexpected retry after: %d, expected: %d", r, ti.expected)
+			}
+		})
+	}
+}
+
+func TestDryRunRatelimit(t *testing.T) {
+	s := Settings{
+		Type:          ClientRatelimit,
+		MaxHits:       1,
+		TimeWindow:    time.Minute,
+		CleanInterval: time.Minute,
+		DryRun:        true,
+	}
+
+	rl := newRatelimit(s, nil, nil)
+	defer rl.Close()
+
+	if r := rl.AllowResultContext(context.Background(), "foo"); !r.Allowed || r.DryRunForbidden {
+		t.Errorf("unexpected result within the limit: %+v", r)
+	}
+
+	if r := rl.AllowResultContext(context.Background(), "foo"); !r.Allowed || !r.DryRunForbidden {
+		t.Errorf("unexpected result over the limit: %+v", r)
+	}
+
+	if s.String() != "ratelimit(type=client,max-hits=1,time-window=1m0s,dry-run)" {
+		t.Errorf("unexpected settings string: %s", s)
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	ctx := context.Background()
+
+	// the local ratelimits count the request once
+	rl := newRatelimit(Settings{Type: ClientRatelimit, MaxHits: 2, TimeWindow: time.Minute, CleanInterval: time.Minute}, nil, nil)
+	defer rl.Close()
+
+	if r := rl.AllowN(ctx, "foo", 5); !r.Allowed {
+		t.Errorf("unexpected result of the local ratelimit: %+v", r)
+	}
+
+	if r := rl.AllowN(ctx, "foo", 5); !r.Allowed {
+		t.Errorf("unexpected result of the local ratelimit within the limit: %+v", r)
+	}
+
+	rl = newRatelimit(Settings{Type: ClusterClientRatelimit, MaxHits: 4, TimeWindow: time.Minute, Group: "A", InMemory: true}, nil, nil)
+	defer rl.Close()
+
+	if r := rl.AllowN(ctx, "foo", 3); !r.Allowed || r.Remaining != 1 {
+		t.Errorf("unexpected result of the cluster ratelimit: %+v", r)
+	}
+
+	if r := rl.AllowN(ctx, "foo", 2); r.Allowed {
+		t.Errorf("unexpected result of the cluster ratelimit over the limit: %+v", r)
+	}
+
+	if r := rl.AllowN(ctx, "foo", 0); !r.Allowed || r.Remaining != 0 {
+		t.Errorf("unexpected result of the cluster ratelimit without cost: %+v", r)
+	}
+
+	if r := (*Ratelimit)(nil).AllowN(ctx, "foo", 3); !r.Allowed {
+		t.Errorf("unexpected result of nil ratelimit: %+v", r)
+	}
+}
+
+func TestHierarchicalRatelimitWithoutRedis(t *testing.T) {
+	s := Settings{
+		Type:          ClusterServiceRatelimit,
+		MaxHits:       10,
+		TimeWindow:    time.Minute,
+		Group:         "A",
+		Parent:        "P",
+		ParentMaxHits: 100,
+		Reserved:      5,
+	}
+
+	group := voidRatelimit{}
+	if l := newClusterLimitHierarchical(s, group, nil); l != group {
+		t.Errorf("unexpected limiter without redis: %v", l)
+	}
+
+	if s.String() != "ratelimit(type=clusterService,max-hits=10,time-window=1m0s,group=A,parent=P,parent-max-hits=100,reserved=5)" {
+		t.Errorf("unexpected settings string: %s", s)
+	}
+}
+
+func TestRedisFailClosed(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	s := Settings{
+		Type:          ClusterServiceRatelimit,
+		MaxHits:       10,
+		TimeWindow:    time.Minute,
+		Group:         "A",
+		Parent:        "P",
+		ParentMaxHits: 100,
+		Windows:       "100/1h",
+	}
+
+	for _, ti := range []struct {
+		msg        string
+		failClosed bool
+		dryRun     bool
+		allowed    bool
+		mode       string
+	}{{
+		msg:     "fail open",
+		allowed: true,
+		mode:    "fail-open",
+	}, {
+		msg:        "fail closed",
+		failClosed: true,
+		allowed:    false,
+		mode:       "fail-closed",
+	}, {
+		msg:        "fail closed in dry-run mode",
+		failClosed: true,
+		dryRun:     true,
+		allowed:    true,
+		mode:       "fail-closed",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			r := newRingOf(client, &RedisOptions{FailClosed: ti.failClosed}, redisMetricsPrefix)
+			r.external = true // skips the ping of the unreachable shard
+			s := s
+			s.DryRun = ti.dryRun
+
+			for name, l := range map[string]interface {
+				resultLimiter
+				Config() LimiterConfig
+			}{
+				"sliding window": newClusterRateLimiterRedis(s, r, s.Group),
+				"hierarchical":   newClusterLimitHierarchical(s, newClusterRateLimiterRedis(s, r, s.Group), r).(*clusterLimitHierarchical),
+				"multi-window":   newClusterLimitMultiWindow(s, newClusterRateLimiterRedis(s, r, s.Group), r).(*clusterLimitMultiWindow),
+			} {
+				result := l.AllowResultContext(context.Background(), "foo")
+				if result.Allowed != ti.allowed {
+					t.Errorf("%s: unexpected allowed: %v", name, result.Allowed)
+				}
+
+				if result.BackendError == ti.allowed {
+					t.Errorf("%s: unexpected backend error: %v", name, result.BackendError)
+				}
+
+				if mode := l.Config().FailureMode; mode != ti.mode {
+					t.Errorf("%s: unexpected failure mode: %s", name, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisGroupMetrics(t *testing.T) {
+	for _, ti := range []struct {
+		msg          string
+		groupMetrics bool
+		expected     map[string]int64
+	}{{
+		msg:      "global counters",
+		expected: map[string]int64{"swarm.redis.allows": 1},
+	}, {
+		msg:          "group counters",
+		groupMetrics: true,
+		expected:     map[string]int64{"swarm.redis.allows": 1, "swarm.redis.allows.A": 1},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			m := &metricstest.MockMetrics{}
+			r := newRingOf(nil, &RedisOptions{GroupMetrics: ti.groupMetrics, Metrics: m}, redisMetricsPrefix)
+			r.external = true
+
+			c := newClusterRateLimiterRedis(Settings{MaxHits: 1, TimeWindow: time.Second}, r, "A")
+			c.incCounter("allows")
+
+			m.WithCounters(func(counters map[string]int64) {
+				if !reflect.DeepEqual(counters, ti.expected) {
+					t.Errorf("unexpected counters: %v", counters)
+				}
+			})
+		})
+	}
+}
+
+type labeledMetrics struct {
+	*metricstest.MockMetrics
+	measures []string
+	counters []string
+}
+
+func (m *labeledMetrics) MeasureSinceWithLabels(key string, labels metrics.Labels, _ time.Time) {
+	m.measures = append(m.measures, fmt.Sprintf("%s%v", key, labels))
+}
+
+func (m *labeledMetrics) IncCounterWithLabels(key string, labels metrics.Labels) {
+	m.counters = append(m.counters, fmt.Sprintf("%s%v", key, labels))
+}
+
+func TestRedisLabeledMetrics(t *testing.T) {
+	t.Run("dotted", func(t *testing.T) {
+		m := &metricstest.MockMetrics{}
+		r := newRingOf(nil, &RedisOptions{GroupMetrics: true, Metrics: m}, redisMetricsPrefix)
+		r.external = true
+
+		c := newClusterRateLimiterRedis(Settings{MaxHits: 1, TimeWindow: time.Second}, r, "A")
+		fail := true
+		c.measureQuery(allowOperation, &fail, time.Now())
+		c.measureQuery(retryAfterOperation, nil, time.Now())
+		c.incCounter("forbids")
+
+		m.WithMeasures(func(measures map[string][]time.Duration) {
+			for _, key := range []string{"swarm.redis.query.allow.failure.A", "swarm.redis.query.retryafter.success.A"} {
+				if len(measures[key]) != 1 {
+					t.Errorf("missing measure %s: %v", key, measures)
+				}
+			}
+		})
+
+		m.WithCounters(func(counters map[string]int64) {
+			expected := map[string]int64{"swarm.redis.forbids": 1, "swarm.redis.forbids.A": 1}
+			if !reflect.DeepEqual(counters, expected) {
+				t.Errorf("unexpected counters: %v", counters)
+			}
+		})
+	})
+
+	t.Run("labeled", func(t *testing.T) {
+		m := &labeledMetrics{MockMetrics: &metricstest.MockMetrics{}}
+		r := newRingOf(nil, &RedisOptions{Metrics: m}, redisMetricsPrefix)
+		r.external = true
+
+		c := newClusterRateLimiterRedis(Settings{MaxHits: 1, TimeWindow: time.Second}, r, "A")
+		fail := true
+		c.measureQuery(allowOperation, &fail, time.Now())
+		c.measureQuery(retryAfterOperation, nil, time.Now())
+		c.incCounter("forbids")
+
+		expectedMeasures := []string{
+			"swarm.redis.query" + fmt.Sprint(metrics.Labels{"operation": "allow", "result": "failure", "group": "A"}),
+			"swarm.redis.query" + fmt.Sprint(metrics.Labels{"operation": "retryafter", "result": "success", "group": "A"}),
+		}
+
+		if !reflect.DeepEqual(m.measures, expectedMeasures) {
+			t.Errorf("unexpected measures: %v", m.measures)
+		}
+
+		expectedCounters := []string{"swarm.redis.ratelimit" + fmt.Sprint(metrics.Labels{"result": "forbids", "group": "A"})}
+		if !reflect.DeepEqual(m.counters, expectedCounters) {
+			t.Errorf("unexpected counters: %v", m.counters)
+		}
+
+		m.WithCounters(func(counters map[string]int64) {
+			if len(counters) != 0 {
+				t.Errorf("unexpected dotted counters: %v", counters)
+			}
+		})
+	})
+}
+
+func TestRedisDefaultMetrics(t *testing.T) {
+	if r := newRingOf(nil, &RedisOptions{}, redisMetricsPrefix); r.metrics != metrics.Default {
+		t.Errorf("unexpected metrics: %v", r.metrics)
+	}
+}
+
+func TestActiveKeysNotSupported(t *testing.T) {
+	rl := newRatelimit(Settings{Type: ServiceRatelimit, MaxHits: 1, TimeWindow: time.Second}, nil, nil)
+	if _, err := rl.ActiveKeys(context.Background()); err != errActiveKeysNotSupported {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRedisTraceSampling(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("proxy")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	// spans returns the number of query spans created in a call
+	spans := func(c *clusterLimitRedis, key string) int {
+		tracer.Reset()
+		ctx := c.sample(ctx, key)
+		for _, name := range []string{allowCheckRemRangeSpanName, allowCheckRemRankSpanName, allowCheckSpanName, allowAddSpanName, allowExpireSpanName} {
+			c.startSpan(ctx, name)(false)
+		}
+
+		return len(tracer.FinishedSpans())
+	}
+
+	t.Run("all", func(t *testing.T) {
+		c := &clusterLimitRedis{tracer: tracer}
+		if n := spans(c, "foo"); n != 5 {
+			t.Errorf("unexpected number of spans: %d", n)
+		}
+	})
+
+	for _, byKey := range []bool{false, true} {
+		t.Run(fmt.Sprintf("by key %v", byKey), func(t *testing.T) {
+			c := &clusterLimitRedis{tracer: tracer, sampleRate: 0.25, sampleByKey: byKey}
+
+			var sampled int
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(i)
+				n := spans(c, key)
+				if n != 0 && n != 5 {
+					t.Fatalf("unexpected number of spans of a call: %d", n)
+				}
+
+				if byKey && spans(c, key) != n {
+					t.Fatalf("inconsistent sampling of key %s", key)
+				}
+
+				if n == 5 {
+					sampled++
+				}
+			}
+
+			if sampled < 150 || sampled > 350 {
+				t.Errorf("unexpected number of sampled calls: %d", sampled)
+			}
+		})
+	}
+}
+
+func TestRedisSpanNamesAndTags(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("proxy")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	for _, ti := range []struct {
+		msg      string
+		options  RedisOptions
+		expected []string
+	}{{
+		msg:      "default",
+		expected: []string{allowCheckSpanName, allowAddSpanName},
+	}, {
+		msg:      "prefix",
+		options:  RedisOptions{TraceSpanPrefix: "skipper."},
+		expected: []string{"skipper.redis_allow_check_card", "skipper.redis_allow_add_card"},
+	}, {
+		msg: "mapping",
+		options: RedisOptions{
+			TraceSpanPrefix: "skipper.",
+			TraceSpanNames:  map[string]string{allowCheckSpanName: "ratelimit.check"},
+		},
+		expected: []string{"ratelimit.check", "skipper.redis_allow_add_card"},
+	}, {
+		msg: "tags",
+		options: RedisOptions{
+			TraceTags: map[string]string{"environment": "production", "cluster": "eu-1"},
+		},
+		expected: []string{allowCheckSpanName, allowAddSpanName},
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			tracer.Reset()
+			o := ti.options
+			o.Tracer = tracer
+			r := newRingOf(redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}}), &o, redisMetricsPrefix)
+			defer r.ring.Close()
+			r.external = true
+
+			c := newClusterRateLimiterRedis(Settings{MaxHits: 10, TimeWindow: time.Minute, Group: "A"}, r, "A")
+			c.startSpan(ctx, allowCheckSpanName)(false)
+			c.startSpan(ctx, allowAddSpanName)(false)
+
+			spans := tracer.FinishedSpans()
+			if len(spans) != len(ti.expected) {
+				t.Fatalf("unexpected number of spans: %d", len(spans))
+			}
+
+			for i, span := range spans {
+				if span.OperationName != ti.expected[i] {
+					t.Errorf("unexpected span name: %s != %s", span.OperationName, ti.expected[i])
+				}
+
+				if span.Tag("group") != "A" {
+					t.Errorf("unexpected group tag: %v", span.Tag("group"))
+				}
+
+				for k, v := range ti.options.TraceTags {
+					if span.Tag(k) != v {
+						t.Errorf("unexpected %s tag: %v", k, span.Tag(k))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRedisAddrTimeouts(t *testing.T) {
+	r := newRing(&RedisOptions{
+		Addrs:        []string{"127.0.0.1:16379", "127.0.0.1:16380"},
+		ReadTimeout:  25 * time.Millisecond,
+		WriteTimeout: 25 * time.Millisecond,
+		AddrTimeouts: map[string]RedisTimeouts{
+			"127.0.0.1:16380": {ReadTimeout: 200 * time.Millisecond},
+		},
+	})
+	defer r.Close()
+
+	var mu sync.Mutex
+	timeouts := make(map[string][2]time.Duration)
+	r.ring.ForEachShard(context.Background(), func(_ context.Context, c *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		o := c.Options()
+		timeouts[o.Addr] = [2]time.Duration{o.ReadTimeout, o.WriteTimeout}
+		return nil
+	})
+
+	if got := timeouts["127.0.0.1:16379"]; got != [2]time.Duration{25 * time.Millisecond, 25 * time.Millisecond} {
+		t.Errorf("unexpected timeouts of the shard without overrides: %v", got)
+	}
+
+	if got := timeouts["127.0.0.1:16380"]; got != [2]time.Duration{200 * time.Millisecond, 25 * time.Millisecond} {
+		t.Errorf("unexpected timeouts of the shard with overrides: %v", got)
+	}
+}
+
+func TestRedisTLSClientConfig(t *testing.T) {
+	for _, ti := range []struct {
+		msg          string
+		options      *RedisOptions
+		expectErr    bool
+		expectNil    bool
+		minVersion   uint16
+		cipherSuites []uint16
+	}{{
+		msg:       "tls disabled",
+		options:   &RedisOptions{},
+		expectNil: true,
+	}, {
+		msg:        "tls enabled",
+		options:    &RedisOptions{EnableTLS: true},
+		minVersion: tls.VersionTLS12,
+	}, {
+		msg:        "min version of the base config raised to 1.2",
+		options:    &RedisOptions{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS10}},
+		minVersion: tls.VersionTLS12,
+	}, {
+		msg:        "tls 1.3",
+		options:    &RedisOptions{TLSMinVersion: "1.3"},
+		minVersion: tls.VersionTLS13,
+	}, {
+		msg:       "unsupported version",
+		options:   &RedisOptions{TLSMinVersion: "1.1"},
+		expectErr: true,
+	}, {
+		msg:          "cipher suites",
+		options:      &RedisOptions{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		minVersion:   tls.VersionTLS12,
+		cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}, {
+		msg:       "insecure cipher suite",
+		options:   &RedisOptions{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		expectErr: true,
+	}, {
+		msg:       "cipher suites with tls 1.3",
+		options:   &RedisOptions{TLSMinVersion: "1.3", TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		expectErr: true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			c, err := ti.options.TLSClientConfig()
+			if ti.expectErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ti.expectNil {
+				if c != nil {
+					t.Errorf("unexpected TLS config: %v", c)
+				}
+
+				return
+			}
+
+			if c.MinVersion != ti.minVersion {
+				t.Errorf("unexpected min version: %x", c.MinVersion)
+			}
+
+			if !reflect.DeepEqual(c.CipherSuites, ti.cipherSuites) {
+				t.Errorf("unexpected cipher suites: %v", c.CipherSuites)
+			}
+		})
+	}
+}
+
+func TestRedisTLSMinVersion(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+
+	handshake := func(minVersion string) error {
+		c, err := (&RedisOptions{TLSConfig: &tls.Config{RootCAs: roots}, TLSMinVersion: minVersion}).TLSClientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := tls.Dial("tcp", s.Listener.Addr().String(), c)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	if err := handshake("1.2"); err != nil {
+		t.Errorf("unexpected error of a 1.2 handshake: %v", err)
+	}
+
+	if err := handshake("1.3"); err == nil {
+		t.Error("1.2 handshake not rejected by a 1.3 only config")
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:16379"}, TLSMinVersion: "1.3"})
+	defer r.Close()
+	if c := r.ring.Options().TLSConfig; c == nil || c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("unexpected TLS config of the ring: %v", c)
+	}
+
+	shared := NewRedisRing(&RedisOptions{Addrs: []string{"127.0.0.1:16379"}, TLSMinVersion: "1.3", ReadTimeout: time.Second})
+	defer shared.Close()
+	if o := shared.Options(); o.TLSConfig == nil || o.TLSConfig.MinVersion != tls.VersionTLS13 || o.ReadTimeout != time.Second {
+		t.Errorf("unexpected options of the shared ring: %v", o)
+	}
+}
+
+func TestHashedKeyMemo(t *testing.T) {
+	if hashedKey(context.Background(), "foo") != getHashedKey("foo") {
+		t.Error("unexpected hashed key without memo")
+	}
+
+	ctx := WithHashedKeyMemo(context.Background())
+	if WithHashedKeyMemo(ctx) != ctx {
+		t.Error("memo of the context was replaced")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i % 2)
+			for j := 0; j < 100; j++ {
+				if hashedKey(ctx, key) != getHashedKey(key) {
+					t.Errorf("unexpected memoized key of %s", key)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestAllowHashed(t *testing.T) {
+	key := getHashedKey("clientA")
+	if hashedKey(withPreHashedKey(context.Background(), key), key) != key {
+		t.Error("pre-hashed key was hashed again")
+	}
+
+	var nilLimit *Ratelimit
+	if !nilLimit.AllowHashed(context.Background(), key).Allowed {
+		t.Error("request denied without ratelimit")
+	}
+
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	rl := r.Get(Settings{
+		Type:          ClusterClientRatelimit,
+		MaxHits:       1,
+		TimeWindow:    time.Minute,
+		Group:         "hashed",
+		NormalizeKeys: true,
+	})
+
+	upper := strings.ToUpper(key)
+	if !rl.AllowHashed(nil, upper).Allowed {
+		t.Error("first request denied")
+	}
+
+	if rl.AllowHashed(context.Background(), upper).Allowed {
+		t.Error("request allowed over the limit")
+	}
+
+	// the pre-hashed keys are not normalized
+	if !rl.AllowHashed(context.Background(), key).Allowed {
+		t.Error("request of another key denied")
+	}
+}
+
+func BenchmarkHashedKey(b *testing.B) {
+	// composite key of a template lookuper
+	key := strings.Repeat("GET|api.example.org|/api/v1/resources|", 16)
+
+	b.Run("without memo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ctx := context.Background()
+			hashedKey(ctx, key)
+			hashedKey(ctx, key)
+		}
+	})
+
+	b.Run("with memo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ctx := WithHashedKeyMemo(context.Background())
+			hashedKey(ctx, key)
+			hashedKey(ctx, key)
+		}
+	})
+
+	b.Run("parallel with memo", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ctx := WithHashedKeyMemo(context.Background())
+				hashedKey(ctx, key)
+				hashedKey(ctx, key)
+			}
+		})
+	})
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		now        time.Time
+		retryAfter int
+		expected   string
+	}{{
+		msg:        "full second",
+		now:        time.Date(2021, 3, 4, 10, 20, 30, 0, time.UTC),
+		retryAfter: 10,
+		expected:   "Thu, 04 Mar 2021 10:20:40 GMT",
+	}, {
+		msg:        "rounded up",
+		now:        time.Date(2021, 3, 4, 10, 20, 30, 100, time.UTC),
+		retryAfter: 10,
+		expected:   "Thu, 04 Mar 2021 10:20:41 GMT",
+	}, {
+		msg:        "other time zone",
+		now:        time.Date(2021, 3, 4, 11, 20, 30, 0, time.FixedZone("CET", 3600)),
+		retryAfter: 90,
+		expected:   "Thu, 04 Mar 2021 10:22:00 GMT",
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			d := RetryAfterDate(ti.now, ti.retryAfter)
+			if d != ti.expected {
+				t.Errorf("unexpected date: %s != %s", d, ti.expected)
+			}
+
+			// the date represents the same instant as the delay in
+			// seconds, within the precision of the HTTP-date
+			parsed, err := http.ParseTime(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			delay := parsed.Sub(ti.now)
+			seconds := time.Duration(ti.retryAfter) * time.Second
+			if delay < seconds || delay >= seconds+time.Second {
+				t.Errorf("date %s doesn't match the delay of %d seconds: %v", d, ti.retryAfter, delay)
+			}
+		})
+	}
+}
+
+func TestResetTime(t *testing.T) {
+	now := time.Now()
+	for _, ti := range []struct {
+		msg      string
+		oldest   time.Time
+		expected time.Time
+	}{{
+		msg:      "no hits",
+		expected: now,
+	}, {
+		msg:      "hit in the window",
+		oldest:   now.Add(-20 * time.Second),
+		expected: now.Add(40 * time.Second),
+	}, {
+		msg:      "expired hit",
+		oldest:   now.Add(-2 * time.Minute),
+		expected: now,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			if got := resetTime(ti.oldest, time.Minute, now); !got.Equal(ti.expected) {
+				t.Errorf("unexpected reset time: %v, expected: %v", got, ti.expected)
+			}
+		})
+	}
+}
+
+func TestDecisionSpanTags(t *testing.T) {
+	s := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    1,
+		TimeWindow: time.Minute,
+		Group:      "tagged",
+		InMemory:   true,
+	}
+
+	rl := newRatelimit(s, nil, nil)
+	defer rl.Close()
+
+	tracer := mocktracer.New()
+	allow := func(allow func(context.Context) bool) map[string]interface{} {
+		span := tracer.StartSpan("proxy").(*mocktracer.MockSpan)
+		allow(opentracing.ContextWithSpan(context.Background(), span))
+		return span.Tags()
+	}
+
+	tags := allow(func(ctx context.Context) bool { return rl.AllowResultContext(ctx, "foo").Allowed })
+	if tags["ratelimit.allowed"] != true || tags["ratelimit.count"] != 1 || tags["ratelimit.group"] != "tagged" {
+		t.Errorf("unexpected tags of the allowed request: %v", tags)
+	}
+
+	tags = allow(func(ctx context.Context) bool { return rl.AllowContext(ctx, "foo") })
+	if tags["ratelimit.allowed"] != false || tags["ratelimit.group"] != "tagged" {
+		t.Errorf("unexpected tags of the denied request: %v", tags)
+	}
+
+	// without a span of the request
+	if rl.AllowContext(context.Background(), "foo") {
+		t.Error("request allowed over the limit")
+	}
+}
+
+func TestNormalizeKeys(t *testing.T) {
+	for _, ti := range []struct {
+		msg       string
+		normalize bool
+		shared    bool
+	}{{
+		msg:    "disabled",
+		shared: false,
+	}, {
+		msg:       "enabled",
+		normalize: true,
+		shared:    true,
+	}} {
+		t.Run(ti.msg, func(t *testing.T) {
+			rl := newRatelimit(Settings{
+				Type:          ClusterClientRatelimit,
+				MaxHits:       1,
+				TimeWindow:    time.Minute,
+				Group:         "normalize",
+				InMemory:      true,
+				NormalizeKeys: ti.normalize,
+			}, nil, nil)
+			defer rl.Close()
+
+			if !rl.AllowContext(context.Background(), "Example.com") {
+				t.Fatal("first request not allowed")
+			}
+
+			for _, key := range []string{"example.com.", " EXAMPLE.COM "} {
+				if d := rl.Delta(key); d > 0 != ti.shared {
+					t.Errorf("unexpected delta for %q: %v", key, d)
+				}
+
+				if allowed := rl.AllowContext(context.Background(), key); allowed == ti.shared {
+					t.Errorf("unexpected decision for %q: %v", key, allowed)
+				}
+			}
+		})
+	}
+}
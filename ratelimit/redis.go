@@ -2,9 +2,15 @@ package ratelimit
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -23,6 +29,11 @@ type RedisOptions struct {
 	ReadTimeout time.Duration
 	// WriteTimeout for redis socket writes
 	WriteTimeout time.Duration
+	// AddrTimeouts overrides the ReadTimeout and WriteTimeout of
+	// the shards by address, e.g. for a shard in a remote region.
+	// The shards not listed, and the zero timeouts, use the global
+	// timeouts.
+	AddrTimeouts map[string]RedisTimeouts
 	// PoolTimeout is the max time.Duration to get a connection from pool
 	PoolTimeout time.Duration
 	// MinIdleConns is the minimum number of socket connections to redis
@@ -34,22 +45,208 @@ type RedisOptions struct {
 	ConnMetricsInterval time.Duration
 	// Tracer provides OpenTracing for Redis queries.
 	Tracer opentracing.Tracer
+	// Metrics receives the metrics of the cluster ratelimits and the
+	// redis connections, e.g. to route them through a custom metrics
+	// pipeline. Defaults to metrics.Default.
+	Metrics metrics.Metrics
+	// TraceSampleRate is the fraction of the ratelimit calls, that
+	// create spans for the Redis queries, between 0 and 1. The spans
+	// of the queries of a single call are either all or none created.
+	// 0 creates spans for all calls.
+	TraceSampleRate float64
+	// TraceSampleByKey samples the calls deterministically by the
+	// ratelimit key instead of randomly, so the calls of the same
+	// client are either all or none traced.
+	TraceSampleByKey bool
+	// TraceSpanPrefix is prepended to the names of the spans of the
+	// Redis queries, e.g. "skipper." makes redis_allow_check_card
+	// skipper.redis_allow_check_card.
+	TraceSpanPrefix string
+	// TraceSpanNames replaces the names of the spans of the Redis
+	// queries, e.g. redis_allow_check_card, with the mapped names.
+	// The mapped names are not prefixed with TraceSpanPrefix.
+	TraceSpanNames map[string]string
+	// TraceTags are static tags, e.g. the environment or the
+	// cluster, set on all the spans of the Redis queries.
+	TraceTags map[string]string
+	// ZAddRetries is the number of retries of a failed ZADD, that
+	// records a hit, within a single ratelimit call. A missed ZADD
+	// undercounts the hits, so it defaults to DefaultZAddRetries,
+	// negative values disable the retries.
+	ZAddRetries int
+	// ZAddRetryDelay is the delay before a ZADD retry. Defaults to
+	// DefaultZAddRetryDelay. The retries are not started after the
+	// deadline of the request context.
+	ZAddRetryDelay time.Duration
+	// Rings are the shards of additional redis rings. The cluster
+	// ratelimit groups are distributed across the ring of Addrs and
+	// the additional rings by the hash of the group name.
+	Rings [][]string
+	// GroupRings assigns cluster ratelimit groups to a ring, e.g. to
+	// isolate large tenants. 0 is the ring of Addrs, 1 to N are the
+	// additional Rings in order.
+	GroupRings map[string]int
+	// EnableTLS enables TLS for the connections to the redis shards.
+	// TLS is also enabled by setting TLSConfig, TLSMinVersion or
+	// TLSCipherSuites.
+	EnableTLS bool
+	// TLSConfig is the base TLS configuration of the connections to
+	// the redis shards. TLSMinVersion and TLSCipherSuites override
+	// the fields of a copy of it.
+	TLSConfig *tls.Config
+	// TLSMinVersion is the minimum TLS version of the connections to
+	// the redis shards, "1.2" or "1.3". Defaults to 1.2.
+	TLSMinVersion string
+	// TLSCipherSuites restricts the TLS 1.2 cipher suites by their
+	// names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the
+	// secure cipher suites of crypto/tls are supported. The TLS 1.3
+	// cipher suites are not configurable.
+	TLSCipherSuites []string
+	// GroupMetrics enables the allows, forbids and dryrun.forbids
+	// counters per cluster ratelimit group in addition to the global
+	// counters, e.g. swarm.redis.allows.<group>. It creates metrics
+	// for every group, so it should not be enabled with thousands of
+	// groups.
+	GroupMetrics bool
+	// BatchWindow enables the batching of the checks of the cluster
+	// ratelimit calls. The checks of the concurrent calls within the
+	// window, e.g. 500µs, are sent to redis in a single pipeline,
+	// trading a little latency for fewer roundtrips. 0 disables the
+	// batching.
+	BatchWindow time.Duration
+	// BatchSize is the maximum number of checks of a batch, a full
+	// batch is sent before the end of the BatchWindow. Defaults to
+	// DefaultBatchSize.
+	BatchSize int
+	// RetryAfterCacheTTL enables caching the result of the RetryAfter
+	// query per key for the TTL, e.g. 200ms, so that the repeated
+	// RetryAfter calls of the denied requests of a key don't query
+	// redis every time. The hits recorded by the same instance
+	// invalidate the cached key, the hits of other instances are seen
+	// after the TTL. 0 disables the cache.
+	RetryAfterCacheTTL time.Duration
+	// OverridesRefreshInterval enables the per key overrides of the
+	// max hits of the cluster ratelimit groups, stored in the redis
+	// hash ratelimit.overrides.<group>, where the fields are the clear
+	// text keys, e.g. the client ids, and the values are the max hits.
+	// The overrides are cached, and refreshed in the background after
+	// the interval. 0 disables the overrides.
+	OverridesRefreshInterval time.Duration
+	// KillSwitchRefreshInterval enables the kill switches of the
+	// cluster ratelimit groups, stored in the redis keys
+	// ratelimit.killswitch.<group>. When the key of a group is set to
+	// true, e.g. 1, its ratelimit allows all requests. The state of
+	// the switches is cached, and refreshed in the background after
+	// the interval. 0 disables the kill switches.
+	KillSwitchRefreshInterval time.Duration
+	// LimitsProvider provides the max hits and the time windows of
+	// the cluster ratelimit groups, that replace the limits of the
+	// ratelimit settings, e.g. a FileLimits, so the limits can be
+	// changed without restart. The groups with a parent budget or
+	// several time windows use the limits of their settings.
+	LimitsProvider LimitsProvider
+	// LimitsRefreshInterval enables the limits of the cluster
+	// ratelimit groups stored in the redis hashes
+	// ratelimit.limits.<group>, with the fields maxHits and
+	// timeWindow. The limits are cached, and refreshed in the
+	// background after the interval. It takes precedence over the
+	// LimitsProvider. 0 disables the limits stored in redis.
+	LimitsRefreshInterval time.Duration
+	// UseServerTime makes the cluster ratelimits use the clock of
+	// the redis shards instead of the local clock for the scores of
+	// the hits and the boundaries of the time windows, so skewed
+	// clocks of the instances don't evict each others hits. The
+	// offset to the clock of the slowest shard is measured with the
+	// TIME command of all the shards, once when the first ratelimit
+	// of the ring is created, and then in the background every 10s,
+	// which costs one extra roundtrip per shard and interval.
+	UseServerTime bool
+	// FailClosed makes the cluster ratelimits deny the requests,
+	// when the hits can't be counted, because redis fails, instead
+	// of allowing them. The denied requests are marked with
+	// AllowResult.BackendError, to tell them apart from the requests
+	// over the limit.
+	FailClosed bool
+	// DrainTimeout is the maximum time, that closing the redis rings
+	// waits for the queries of the in-flight ratelimit calls, so a
+	// recorded hit is not left without the expiry of its key during
+	// restarts. Defaults to DefaultDrainTimeout, negative values
+	// disable the draining.
+	DrainTimeout time.Duration
+}
+
+// RedisTimeouts are the socket timeouts of a redis shard.
+type RedisTimeouts struct {
+	// ReadTimeout for redis socket reads
+	ReadTimeout time.Duration
+	// WriteTimeout for redis socket writes
+	WriteTimeout time.Duration
 }
 
 type ring struct {
-	ring    *redis.Ring
-	metrics metrics.Metrics
-	tracer  opentracing.Tracer
+	ring          *redis.Ring
+	metrics       metrics.Metrics
+	metricsPrefix string
+	tracer        opentracing.Tracer
+	sampleRate    float64
+	sampleByKey   bool
+	spanPrefix    string
+	spanNames     map[string]string
+	spanTags      map[string]string
+	zaddRetries   int
+	zaddDelay     time.Duration
+	groupMetrics  bool
+	batcher       *checkBatcher
+	oldestCache   *oldestCache
+	overrides     time.Duration
+	killSwitch    time.Duration
+	limits        LimitsProvider
+	clock         *serverClock
+	failClosed    bool
+	drain         *drain
+	drainTimeout  time.Duration
+	external      bool
+	quit          chan struct{}
+	done          chan struct{}
+	once          sync.Once
+	err           error
+}
+
+// ringSet selects the redis ring of a cluster ratelimit group.
+type ringSet struct {
+	rings  []*ring
+	groups map[string]int
 }
 
 // clusterLimitRedis stores all data required for the cluster ratelimit.
 type clusterLimitRedis struct {
-	group   string
-	maxHits int64
-	window  time.Duration
-	ring    *redis.Ring
-	metrics metrics.Metrics
-	tracer  opentracing.Tracer
+	group         string
+	maxHits       int64
+	window        time.Duration
+	expireMargin  time.Duration
+	ring          *redis.Ring
+	metrics       metrics.Metrics
+	metricsPrefix string
+	tracer        opentracing.Tracer
+	sampleRate    float64
+	sampleByKey   bool
+	spanPrefix    string
+	spanNames     map[string]string
+	spanTags      map[string]string
+	zaddRetries   int
+	zaddDelay     time.Duration
+	groupMetrics  bool
+	batcher       *checkBatcher
+	oldestCache   *oldestCache
+	overrides     *limitOverrides
+	killSwitch    *killSwitch
+	limits        LimitsProvider
+	clock         *serverClock
+	failClosed    bool
+	drain         *drain
+	dryRun        bool
+
+	retryAfterMultiplier float64
 }
 
 const (
@@ -59,67 +256,375 @@ const (
 	DefaultMinConns     = 100
 	DefaultMaxConns     = 100
 
-	defaultConnMetricsInterval       = 60 * time.Second
-	redisMetricsPrefix               = "swarm.redis."
-	allowMetricsFormat               = redisMetricsPrefix + "query.allow.%s"
-	retryAfterMetricsFormat          = redisMetricsPrefix + "query.retryafter.%s"
-	allowMetricsFormatWithGroup      = redisMetricsPrefix + "query.allow.%s.%s"
-	retryAfterMetricsFormatWithGroup = redisMetricsPrefix + "query.retryafter.%s.%s"
+	DefaultZAddRetries    = 1
+	DefaultZAddRetryDelay = 2 * time.Millisecond
+
+	defaultConnMetricsInterval  = 60 * time.Second
+	zsetCapBuffer               = 10
+	expireMargin                = time.Second
+	deniedKeySuffix             = ".denied"
+	redisMetricsPrefix          = "swarm.redis."
+	queryMetricsKey             = redisMetricsPrefix + "query"
+	queryMetricsFormat          = queryMetricsKey + ".%s.%s"
+	queryMetricsFormatWithGroup = queryMetricsKey + ".%s.%s.%s"
+	allowOperation              = "allow"
+	retryAfterOperation         = "retryafter"
+	ratelimitMetricsName        = "ratelimit"
 
 	allowAddSpanName           = "redis_allow_add_card"
 	allowExpireSpanName        = "redis_allow_expire"
 	allowCheckSpanName         = "redis_allow_check_card"
 	allowCheckRemRangeSpanName = "redis_allow_check_rem_range"
+	allowCheckRemRankSpanName  = "redis_allow_check_rem_rank"
+	allowCheckBatchSpanName    = "redis_allow_check_batch"
 	oldestScoreSpanName        = "redis_oldest_score"
+	deniedSpanName             = "redis_denied"
+	retryAfterScriptSpanName   = "redis_retry_after_script"
 )
 
-func newRing(ro *RedisOptions, quit <-chan struct{}) *ring {
-	var r *ring
+// retryAfterScript drops the hits of the key before the time window,
+// and returns the score of the hit, whose expiry admits the next
+// request, or nil, if the next request is admitted already. With
+// count hits in the time window, it is the hit at rank count-maxHits,
+// because after its expiry maxHits-1 hits are left.
+//
+// KEYS[1]: the key, ARGV[1]: clear before in nanoseconds, ARGV[2]: max hits
+var retryAfterScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '0.0', ARGV[1])
+local rank = redis.call('ZCARD', KEYS[1]) - tonumber(ARGV[2])
+if rank < 0 then
+	return false
+end
+local hit = redis.call('ZRANGE', KEYS[1], rank, rank, 'WITHSCORES')
+return hit[2]
+`)
+
+var redisTLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSClientConfig returns the TLS configuration of the connections to
+// the redis shards, or nil, when TLS is not enabled. It fails for
+// unsupported TLS versions and unknown cipher suites, so it can be used
+// to validate the options at startup.
+func (ro *RedisOptions) TLSClientConfig() (*tls.Config, error) {
+	if ro == nil || !ro.EnableTLS && ro.TLSConfig == nil && ro.TLSMinVersion == "" && len(ro.TLSCipherSuites) == 0 {
+		return nil, nil
+	}
+
+	c := &tls.Config{}
+	if ro.TLSConfig != nil {
+		c = ro.TLSConfig.Clone()
+	}
+
+	if c.MinVersion < tls.VersionTLS12 {
+		c.MinVersion = tls.VersionTLS12
+	}
+
+	if ro.TLSMinVersion != "" {
+		v, ok := redisTLSVersions[ro.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported redis TLS min version %q, supported versions are 1.2 and 1.3", ro.TLSMinVersion)
+		}
+
+		c.MinVersion = v
+	}
 
+	if len(ro.TLSCipherSuites) == 0 {
+		return c, nil
+	}
+
+	if c.MinVersion >= tls.VersionTLS13 {
+		return nil, errors.New("redis TLS cipher suites are not configurable with TLS 1.3")
+	}
+
+	suites := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+
+	c.CipherSuites = nil
+	for _, name := range ro.TLSCipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported redis TLS cipher suite %q", name)
+		}
+
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+
+	return c, nil
+}
+
+// applyAddrTimeouts sets the timeouts of the shard options, when there
+// are overrides for the address of the shard.
+func applyAddrTimeouts(opt *redis.Options, timeouts map[string]RedisTimeouts) {
+	t, ok := timeouts[opt.Addr]
+	if !ok {
+		return
+	}
+
+	if t.ReadTimeout > 0 {
+		opt.ReadTimeout = t.ReadTimeout
+	}
+
+	if t.WriteTimeout > 0 {
+		opt.WriteTimeout = t.WriteTimeout
+	}
+}
+
+func newRing(ro *RedisOptions) *ring {
+	if ro == nil {
+		return nil
+	}
+
+	return createRing(ro, ro.Addrs, redisMetricsPrefix)
+}
+
+// NewRedisRing creates a redis ring of the shards in ro.Addrs, with the
+// same timeouts, pool and TLS settings as the ring of the cluster
+// ratelimiters. The caller has to Close() the ring.
+func NewRedisRing(ro *RedisOptions) *redis.Ring {
+	return redis.NewRing(newRingOptions(ro, ro.Addrs))
+}
+
+func createRing(ro *RedisOptions, addrs []string, metricsPrefix string) *ring {
+	connMetricsInterval := ro.ConnMetricsInterval
+	if connMetricsInterval <= 0 {
+		connMetricsInterval = defaultConnMetricsInterval
+	}
+
+	r := newRingOf(redis.NewRing(newRingOptions(ro, addrs)), ro, metricsPrefix)
+	r.startMetrics(connMetricsInterval)
+	return r
+}
+
+func newRingOptions(ro *RedisOptions, addrs []string) *redis.RingOptions {
 	ringOptions := &redis.RingOptions{
 		Addrs: map[string]string{},
 	}
 
-	if ro != nil {
-		for idx, addr := range ro.Addrs {
-			ringOptions.Addrs[fmt.Sprintf("redis%d", idx)] = addr
-		}
-		ringOptions.ReadTimeout = ro.ReadTimeout
-		ringOptions.WriteTimeout = ro.WriteTimeout
-		ringOptions.PoolTimeout = ro.PoolTimeout
-		ringOptions.MinIdleConns = ro.MinIdleConns
-		ringOptions.PoolSize = ro.MaxIdleConns
-
-		if ro.ConnMetricsInterval <= 0 {
-			ro.ConnMetricsInterval = defaultConnMetricsInterval
+	for idx, addr := range addrs {
+		ringOptions.Addrs[fmt.Sprintf("redis%d", idx)] = addr
+	}
+	ringOptions.ReadTimeout = ro.ReadTimeout
+	ringOptions.WriteTimeout = ro.WriteTimeout
+	ringOptions.PoolTimeout = ro.PoolTimeout
+	ringOptions.MinIdleConns = ro.MinIdleConns
+	ringOptions.PoolSize = ro.MaxIdleConns
+
+	tlsConfig, err := ro.TLSClientConfig()
+	if err != nil {
+		// the options are validated at startup, but never fall back
+		// to plain text connections
+		log.Errorf("Invalid redis TLS configuration, using the defaults: %v", err)
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	ringOptions.TLSConfig = tlsConfig
+
+	if len(ro.AddrTimeouts) > 0 {
+		ringOptions.NewClient = func(_ string, opt *redis.Options) *redis.Client {
+			applyAddrTimeouts(opt, ro.AddrTimeouts)
+			return redis.NewClient(opt)
 		}
+	}
+
+	return ringOptions
+}
+
+// newExternalRing wraps a redis ring owned by the caller. The ping on
+// the creation of the ratelimiters is skipped, the connection metrics
+// are only updated, when ConnMetricsInterval is set, and Close doesn't
+// close the redis ring. Only the ratelimit related fields of the
+// RedisOptions are used, it can be nil.
+func newExternalRing(client *redis.Ring, ro *RedisOptions) *ring {
+	if ro == nil {
+		ro = &RedisOptions{}
+	}
 
-		r = new(ring)
-		r.ring = redis.NewRing(ringOptions)
+	r := newRingOf(client, ro, redisMetricsPrefix)
+	r.external = true
+	if ro.ConnMetricsInterval > 0 {
+		r.startMetrics(ro.ConnMetricsInterval)
+	} else {
+		close(r.done)
+	}
+
+	return r
+}
+
+func newRingOf(client *redis.Ring, ro *RedisOptions, metricsPrefix string) *ring {
+	r := new(ring)
+	r.ring = client
+	r.metrics = ro.Metrics
+	if r.metrics == nil {
 		r.metrics = metrics.Default
-		r.tracer = ro.Tracer
-
-		go func() {
-			for {
-				select {
-				case <-time.After(ro.ConnMetricsInterval):
-					stats := r.ring.PoolStats()
-					r.metrics.UpdateGauge(redisMetricsPrefix+"hits", float64(stats.Hits))
-					r.metrics.UpdateGauge(redisMetricsPrefix+"idleconns", float64(stats.IdleConns))
-					r.metrics.UpdateGauge(redisMetricsPrefix+"misses", float64(stats.Misses))
-					r.metrics.UpdateGauge(redisMetricsPrefix+"staleconns", float64(stats.StaleConns))
-					r.metrics.UpdateGauge(redisMetricsPrefix+"timeouts", float64(stats.Timeouts))
-					r.metrics.UpdateGauge(redisMetricsPrefix+"totalconns", float64(stats.TotalConns))
-				case <-quit:
-					r.ring.Close()
-					return
-				}
-			}
-		}()
 	}
+	r.metricsPrefix = metricsPrefix
+	r.tracer = ro.Tracer
+	r.sampleRate = ro.TraceSampleRate
+	r.sampleByKey = ro.TraceSampleByKey
+	r.spanPrefix = ro.TraceSpanPrefix
+	r.spanNames = ro.TraceSpanNames
+	r.spanTags = ro.TraceTags
+	r.zaddRetries = ro.ZAddRetries
+	if r.zaddRetries == 0 {
+		r.zaddRetries = DefaultZAddRetries
+	}
+	r.zaddDelay = ro.ZAddRetryDelay
+	if r.zaddDelay <= 0 {
+		r.zaddDelay = DefaultZAddRetryDelay
+	}
+	r.groupMetrics = ro.GroupMetrics
+	if ro.BatchWindow > 0 {
+		r.batcher = newCheckBatcher(r, ro.BatchWindow, ro.BatchSize)
+	}
+	r.oldestCache = newOldestCache(ro.RetryAfterCacheTTL)
+	r.overrides = ro.OverridesRefreshInterval
+	r.killSwitch = ro.KillSwitchRefreshInterval
+	r.limits = ro.LimitsProvider
+	if ro.LimitsRefreshInterval > 0 {
+		r.limits = newRedisLimits(client, ro.LimitsRefreshInterval)
+	}
+	if ro.UseServerTime {
+		r.clock = newServerClock(client, serverClockRefreshInterval)
+	}
+	r.failClosed = ro.FailClosed
+	r.drain = &drain{}
+	r.drainTimeout = ro.DrainTimeout
+	if r.drainTimeout == 0 {
+		r.drainTimeout = DefaultDrainTimeout
+	}
+	r.quit = make(chan struct{})
+	r.done = make(chan struct{})
 	return r
 }
 
+// startMetrics updates the connection metrics of the ring periodically
+// until Close.
+func (r *ring) startMetrics(interval time.Duration) {
+	go func() {
+		defer close(r.done)
+		for {
+			select {
+			case <-time.After(interval):
+				r.updateMetrics()
+			case <-r.quit:
+				r.updateMetrics()
+				return
+			}
+		}
+	}()
+}
+
+// newExternalRingSet creates a ring set of a single redis ring owned
+// by the caller.
+func newExternalRingSet(client *redis.Ring, ro *RedisOptions) *ringSet {
+	return &ringSet{
+		rings:  []*ring{newExternalRing(client, ro)},
+		groups: make(map[string]int),
+	}
+}
+
+// newRingSet creates the ring of Addrs and the additional Rings.
+// The connection metrics of the additional rings are prefixed with
+// swarm.redis.ring<N>.
+func newRingSet(ro *RedisOptions) *ringSet {
+	if ro == nil {
+		return nil
+	}
+
+	rs := &ringSet{
+		rings:  []*ring{newRing(ro)},
+		groups: make(map[string]int),
+	}
+
+	for i, addrs := range ro.Rings {
+		prefix := fmt.Sprintf("%sring%d.", redisMetricsPrefix, i+1)
+		rs.rings = append(rs.rings, createRing(ro, addrs, prefix))
+	}
+
+	for group, idx := range ro.GroupRings {
+		if idx < 0 || idx >= len(rs.rings) {
+			log.Errorf("Invalid redis ring %d for ratelimit group %s, there are %d rings.", idx, group, len(rs.rings))
+			continue
+		}
+
+		rs.groups[group] = idx
+	}
+
+	return rs
+}
+
+// get returns the ring assigned to the group, or if not assigned, the
+// ring selected by the hash of the group name. The same group is
+// always mapped to the same ring, as long as the rings don't change.
+func (rs *ringSet) get(group string) *ring {
+	if rs == nil {
+		return nil
+	}
+
+	if idx, ok := rs.groups[group]; ok {
+		return rs.rings[idx]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	return rs.rings[h.Sum32()%uint32(len(rs.rings))]
+}
+
+// Close closes all rings, and returns the first error.
+func (rs *ringSet) Close() error {
+	if rs == nil {
+		return nil
+	}
+
+	var err error
+	for _, r := range rs.rings {
+		if rerr := r.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+func (r *ring) updateMetrics() {
+	stats := r.ring.PoolStats()
+	r.metrics.UpdateGauge(r.metricsPrefix+"hits", float64(stats.Hits))
+	r.metrics.UpdateGauge(r.metricsPrefix+"idleconns", float64(stats.IdleConns))
+	r.metrics.UpdateGauge(r.metricsPrefix+"misses", float64(stats.Misses))
+	r.metrics.UpdateGauge(r.metricsPrefix+"staleconns", float64(stats.StaleConns))
+	r.metrics.UpdateGauge(r.metricsPrefix+"timeouts", float64(stats.Timeouts))
+	r.metrics.UpdateGauge(r.metricsPrefix+"totalconns", float64(stats.TotalConns))
+}
+
+// Close stops the connection metrics goroutine, after it updated the
+// metrics for the last time, and closes the redis ring, unless it is
+// owned by the caller. Before closing the redis ring, it waits for the
+// in-flight ratelimit calls up to the drain timeout. It is safe to call
+// Close multiple times, it returns the same error.
+func (r *ring) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.once.Do(func() {
+		close(r.quit)
+		<-r.done
+		if !r.external {
+			if r.drainTimeout > 0 {
+				r.drain.wait(r.drainTimeout)
+			}
+
+			r.err = r.ring.Close()
+		}
+	})
+
+	return r.err
+}
+
 // newClusterRateLimiterRedis creates a new clusterLimitRedis for given
 // Settings. Group is used to identify the ratelimit instance, is used
 // in log messages and has to be the same in all skipper instances.
@@ -129,18 +634,56 @@ func newClusterRateLimiterRedis(s Settings, r *ring, group string) *clusterLimit
 	}
 
 	rl := &clusterLimitRedis{
-		group:   group,
-		maxHits: int64(s.MaxHits),
-		window:  s.TimeWindow,
-		ring:    r.ring,
-		metrics: r.metrics,
-		tracer:  r.tracer,
+		group:         group,
+		maxHits:       int64(s.MaxHits),
+		window:        s.TimeWindow,
+		expireMargin:  s.ExpireMargin,
+		ring:          r.ring,
+		metrics:       r.metrics,
+		metricsPrefix: r.metricsPrefix,
+		tracer:        r.tracer,
+		sampleRate:    r.sampleRate,
+		sampleByKey:   r.sampleByKey,
+		spanPrefix:    r.spanPrefix,
+		spanNames:     r.spanNames,
+		spanTags:      r.spanTags,
+		zaddRetries:   r.zaddRetries,
+		zaddDelay:     r.zaddDelay,
+		groupMetrics:  r.groupMetrics,
+		batcher:       r.batcher,
+		oldestCache:   r.oldestCache,
+		clock:         r.clock,
+		failClosed:    r.failClosed,
+		drain:         r.drain,
+		dryRun:        s.DryRun,
+
+		retryAfterMultiplier: s.RetryAfterMultiplier,
 	}
 
 	if rl.tracer == nil {
 		rl.tracer = &opentracing.NoopTracer{}
 	}
 
+	if rl.expireMargin <= 0 {
+		rl.expireMargin = expireMargin
+	}
+
+	if r.overrides > 0 && group != "" {
+		rl.overrides = newLimitOverrides(r.ring, fmt.Sprintf(overridesKeyFormat, group), r.overrides)
+	}
+
+	if r.killSwitch > 0 && group != "" {
+		rl.killSwitch = newKillSwitch(r.ring, fmt.Sprintf(killSwitchKeyFormat, group), r.killSwitch)
+	}
+
+	if group != "" {
+		rl.limits = r.limits
+	}
+
+	if r.external {
+		return rl
+	}
+
 	var err error
 
 	err = backoff.Retry(func() error {
@@ -156,6 +699,7 @@ func newClusterRateLimiterRedis(s Settings, r *ring, group string) *clusterLimit
 		return nil
 	}
 	log.Debug("Redis ring is reachable")
+	rl.clock.start()
 
 	return rl
 }
@@ -164,25 +708,136 @@ func (c *clusterLimitRedis) prefixKey(clearText string) string {
 	return fmt.Sprintf(swarmKeyFormat, c.group, clearText)
 }
 
-func (c *clusterLimitRedis) measureQuery(format, groupFormat string, fail *bool, start time.Time) {
+// groupLimits returns the max hits and the time window of the group
+// from the limits provider, or when it has no limits for the group,
+// the limits of the settings.
+func (c *clusterLimitRedis) groupLimits() (int64, time.Duration) {
+	maxHits, window := c.maxHits, c.window
+	if c.limits == nil {
+		return maxHits, window
+	}
+
+	if l, ok := c.limits.Limits(c.group); ok {
+		if l.MaxHits > 0 {
+			maxHits = int64(l.MaxHits)
+		}
+
+		if l.TimeWindow > 0 {
+			window = l.TimeWindow
+		}
+	}
+
+	return maxHits, window
+}
+
+// timeWindow returns the effective time window of the group.
+func (c *clusterLimitRedis) timeWindow() time.Duration {
+	_, window := c.groupLimits()
+	return window
+}
+
+// limit returns the max hits of the clear text key, and whether it is
+// overridden.
+func (c *clusterLimitRedis) limit(clearText string) (int64, bool) {
+	if c.overrides != nil {
+		if maxHits, ok := c.overrides.get(clearText); ok {
+			return maxHits, true
+		}
+	}
+
+	maxHits, _ := c.groupLimits()
+	return maxHits, false
+}
+
+// measureQuery measures the duration of the query of the operation.
+// When the metrics backend supports labels, the operation, the result
+// and the group are labels of a single metric, otherwise they are part
+// of the key, e.g. swarm.redis.query.allow.success.group.
+func (c *clusterLimitRedis) measureQuery(operation string, fail *bool, start time.Time) {
 	result := "success"
 	if fail != nil && *fail {
 		result = "failure"
 	}
 
+	if lm, ok := c.metrics.(metrics.LabeledMetrics); ok {
+		lm.MeasureSinceWithLabels(queryMetricsKey, metrics.Labels{
+			"operation": operation,
+			"result":    result,
+			"group":     c.group,
+		}, start)
+
+		return
+	}
+
 	var key string
 	if c.group == "" {
-		key = fmt.Sprintf(format, result)
+		key = fmt.Sprintf(queryMetricsFormat, operation, result)
 	} else {
-		key = fmt.Sprintf(groupFormat, result, c.group)
+		key = fmt.Sprintf(queryMetricsFormatWithGroup, operation, result, c.group)
 	}
 
 	c.metrics.MeasureSince(key, start)
 }
 
+// incCounter increments the counter of the name, and with group
+// metrics enabled, the counter of the group as well. When the metrics
+// backend supports labels, the name and the group are labels of a
+// single counter.
+func (c *clusterLimitRedis) incCounter(name string) {
+	if lm, ok := c.metrics.(metrics.LabeledMetrics); ok {
+		lm.IncCounterWithLabels(c.metricsPrefix+ratelimitMetricsName, metrics.Labels{
+			"result": name,
+			"group":  c.group,
+		})
+
+		return
+	}
+
+	c.metrics.IncCounter(c.metricsPrefix + name)
+	if c.groupMetrics && c.group != "" {
+		c.metrics.IncCounter(c.metricsPrefix + name + "." + c.group)
+	}
+}
+
+// notSampledKey marks the context of a ratelimit call, that is not
+// sampled for tracing.
+type notSampledKey struct{}
+
+// sample decides once per ratelimit call, whether the spans of its
+// queries are created, and returns the context marked accordingly.
+func (c *clusterLimitRedis) sample(ctx context.Context, clearText string) context.Context {
+	if ctx == nil || c.sampleRate <= 0 || c.sampleRate >= 1 {
+		return ctx
+	}
+
+	var p float64
+	if c.sampleByKey {
+		h := fnv.New32a()
+		h.Write([]byte(clearText))
+		p = float64(h.Sum32()) / math.MaxUint32
+	} else {
+		p = rand.Float64()
+	}
+
+	if p < c.sampleRate {
+		return ctx
+	}
+
+	return context.WithValue(ctx, notSampledKey{}, true)
+}
+
+// spanName returns the configured name of the span of a Redis query.
+func (c *clusterLimitRedis) spanName(name string) string {
+	if n, ok := c.spanNames[name]; ok {
+		return n
+	}
+
+	return c.spanPrefix + name
+}
+
 func (c *clusterLimitRedis) startSpan(ctx context.Context, spanName string) func(bool) {
 	nop := func(bool) {}
-	if ctx == nil {
+	if ctx == nil || ctx.Value(notSampledKey{}) != nil {
 		return nop
 	}
 
@@ -191,12 +846,16 @@ func (c *clusterLimitRedis) startSpan(ctx context.Context, spanName string) func
 		return nop
 	}
 
-	span := c.tracer.StartSpan(spanName, opentracing.ChildOf(parentSpan.Context()))
+	span := c.tracer.StartSpan(c.spanName(spanName), opentracing.ChildOf(parentSpan.Context()))
 	ext.Component.Set(span, "skipper")
 	ext.SpanKind.Set(span, "client")
+	maxHits, window := c.groupLimits()
 	span.SetTag("group", c.group)
-	span.SetTag("max_hits", c.maxHits)
-	span.SetTag("window", c.window.String())
+	span.SetTag("max_hits", maxHits)
+	span.SetTag("window", window.String())
+	for k, v := range c.spanTags {
+		span.SetTag(k, v)
+	}
 
 	return func(failed bool) {
 		if failed {
@@ -214,60 +873,202 @@ func (c *clusterLimitRedis) startSpan(ctx context.Context, spanName string) func
 //
 // Performance considerations:
 //
-// In case of deny it will use ZREMRANGEBYSCORE and ZCARD commands in
-// one pipeline to remove old items in the list of hits.
+// In case of deny it will use ZREMRANGEBYSCORE, ZREMRANGEBYRANK and
+// ZCARD commands to remove old items in the list of hits, and to cap
+// the list to maxHits plus a small buffer.
 // In case of allow it will additionally use ZADD with a second
 // roundtrip.
 //
 // If a context is provided, it uses it for creating an OpenTracing span.
 func (c *clusterLimitRedis) AllowContext(ctx context.Context, clearText string) bool {
-	s := getHashedKey(clearText)
-	c.metrics.IncCounter(redisMetricsPrefix + "total")
+	return c.AllowResultContext(ctx, clearText).Allowed
+}
+
+// AllowResultContext is like AllowContext, but returns the details of
+// the decision. In dry-run mode, the requests that would be denied are
+// counted in the dryrun.forbids metric and recorded like the allowed
+// ones, and all requests are allowed.
+func (c *clusterLimitRedis) AllowResultContext(ctx context.Context, clearText string) AllowResult {
+	return c.AllowNResultContext(ctx, clearText, 1)
+}
+
+// AllowNResultContext is like AllowResultContext, but the request
+// counts as n hits, which are recorded with n members of the same
+// score.
+func (c *clusterLimitRedis) AllowNResultContext(ctx context.Context, clearText string, n int) AllowResult {
+	defer c.drain.start()()
+
+	ctx = c.sample(ctx, clearText)
+	s := hashedKey(ctx, clearText)
+	c.metrics.IncCounter(c.metricsPrefix + "total")
+	if c.killSwitch.active() {
+		c.incCounter("killswitch.allows")
+		maxHits, _ := c.groupLimits()
+		return AllowResult{Allowed: true, Limit: int(maxHits)}
+	}
+
 	key := c.prefixKey(s)
 
-	now := time.Now()
+	start := time.Now()
 	var queryFailure bool
-	defer c.measureQuery(allowMetricsFormat, allowMetricsFormatWithGroup, &queryFailure, now)
+	defer c.measureQuery(allowOperation, &queryFailure, start)
+
+	now := c.clock.adjust(start)
 
 	nowNanos := now.UnixNano()
-	clearBefore := now.Add(-c.window).UnixNano()
+	clearBefore := now.Add(-c.timeWindow()).UnixNano()
 
-	count, err := c.allowCheckCard(ctx, key, clearBefore)
+	maxHits, overridden := c.limit(clearText)
+	if overridden {
+		c.incCounter("override.hits")
+	}
+
+	count, err := c.checkCard(ctx, key, clearBefore, n, maxHits)
 	if err != nil {
 		log.Errorf("Failed to get redis cardinality: %v", err)
 		queryFailure = true
-		// we don't return here, as we still want to record the request with ZAdd, but we mark it as a
-		// failure for the metrics
+		if c.failClosed && !c.dryRun {
+			return c.backendErrorResult(maxHits)
+		}
+
+		// failing open, we don't return here, as we still want to record the request with ZAdd, but we
+		// mark it as a failure for the metrics
 	}
 
-	// we increase later with ZAdd, so max-1
-	if err == nil && count >= c.maxHits {
-		c.metrics.IncCounter(redisMetricsPrefix + "forbids")
-		log.Debugf("redis disallow request: %d >= %d = %v", count, c.maxHits, count > c.maxHits)
-		return false
+	result := AllowResult{Allowed: true, Limit: int(maxHits)}
+
+	// we increase later with ZAdd, so max-n
+	if err == nil && count+int64(n) > maxHits {
+		if !c.dryRun {
+			c.incCounter("forbids")
+			log.Debugf("redis disallow request: %d >= %d = %v", count, maxHits, count > maxHits)
+			c.recordDenied(ctx, key)
+			result.Allowed = false
+			if count < maxHits {
+				result.Remaining = int(maxHits - count)
+			}
+			return result
+		}
+
+		c.incCounter("dryrun.forbids")
+		log.Debugf("redis disallow request in dry-run mode: %d >= %d = %v", count, maxHits, count > maxHits)
+		result.DryRunForbidden = true
+	} else if err == nil {
+		result.Remaining = int(maxHits - count - int64(n))
+		result.Count = int(count) + n
 	}
 
-	finishSpan := c.startSpan(ctx, allowAddSpanName)
-	zaddResult := c.ring.ZAdd(ctx, key, &redis.Z{Member: nowNanos, Score: float64(nowNanos)})
-	err = zaddResult.Err()
-	finishSpan(err != nil)
-	if err != nil {
-		log.Errorf("Failed to ZAdd proceeding with Expire: %v", err)
+	// the members of the n hits are unique, and parse like the
+	// member of a single hit
+	members := make([]interface{}, n)
+	for i := range members {
+		members[i] = nowNanos + int64(i)
+	}
+
+	zaddErr, err := c.record(ctx, key, nowNanos, members...)
+	if zaddErr != nil || err != nil {
 		queryFailure = true
 	}
 
-	finishSpan = c.startSpan(ctx, allowExpireSpanName)
-	expireResult := c.ring.Expire(ctx, key, c.window+time.Second)
-	err = expireResult.Err()
+	if err != nil {
+		return result
+	}
+
+	if !result.DryRunForbidden {
+		c.incCounter("allows")
+	}
+
+	return result
+}
+
+// backendErrorResult returns the result of the requests denied,
+// because the hits couldn't be counted, and the ratelimit fails
+// closed.
+func (c *clusterLimitRedis) backendErrorResult(maxHits int64) AllowResult {
+	c.incCounter("failclosed.forbids")
+	return AllowResult{Limit: int(maxHits), BackendError: true}
+}
+
+// record adds the hits with the members to the set of the key, and
+// renews the expiry of the key. A failed ZAdd is logged, but doesn't
+// prevent the Expire. The expiry is set with millisecond precision to
+// support time windows shorter than a second.
+func (c *clusterLimitRedis) record(ctx context.Context, key string, nowNanos int64, members ...interface{}) (zaddErr, expireErr error) {
+	c.oldestCache.invalidate(key)
+	zaddErr = c.zadd(ctx, key, nowNanos, members...)
+	if zaddErr != nil {
+		log.Errorf("Failed to ZAdd proceeding with Expire: %v", zaddErr)
+	}
+
+	finishSpan := c.startSpan(ctx, allowExpireSpanName)
+	expireErr = c.ring.PExpire(ctx, key, c.timeWindow()+c.expireMargin).Err()
+	finishSpan(expireErr != nil)
+	if expireErr != nil {
+		log.Errorf("Failed to Expire: %v", expireErr)
+	}
+
+	return zaddErr, expireErr
+}
+
+// recordDenied counts the denied requests of the key, when the retry
+// after is weighted. The count starts with the first denied request,
+// and expires after the time window.
+func (c *clusterLimitRedis) recordDenied(ctx context.Context, key string) {
+	if c.retryAfterMultiplier <= 1 {
+		return
+	}
+
+	key += deniedKeySuffix
+	finishSpan := c.startSpan(ctx, deniedSpanName)
+	n, err := c.ring.Incr(ctx, key).Result()
+	if err == nil && n == 1 {
+		err = c.ring.PExpire(ctx, key, c.timeWindow()).Err()
+	}
+
 	finishSpan(err != nil)
 	if err != nil {
-		log.Errorf("Failed to Expire: %v", err)
-		queryFailure = true
-		return true
+		log.Errorf("Failed to count denied request: %v", err)
 	}
+}
 
-	c.metrics.IncCounter(redisMetricsPrefix + "allows")
-	return true
+// denied returns the number of denied requests of the key in the
+// current time window.
+func (c *clusterLimitRedis) denied(ctx context.Context, key string) (int64, error) {
+	finishSpan := c.startSpan(ctx, deniedSpanName)
+	n, err := c.ring.Get(ctx, key+deniedKeySuffix).Int64()
+	err = queryErr(err)
+	finishSpan(err != nil)
+	return n, err
+}
+
+// zadd records the hits, and retries a failed ZADD up to zaddRetries
+// times, as long as the retry can be started before the deadline of
+// the context.
+func (c *clusterLimitRedis) zadd(ctx context.Context, key string, nowNanos int64, members ...interface{}) error {
+	zs := make([]*redis.Z, len(members))
+	for i, m := range members {
+		zs[i] = &redis.Z{Member: m, Score: float64(nowNanos)}
+	}
+
+	for i := 0; ; i++ {
+		finishSpan := c.startSpan(ctx, allowAddSpanName)
+		err := c.ring.ZAdd(ctx, key, zs...).Err()
+		finishSpan(err != nil)
+		if err == nil || i >= c.zaddRetries {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= c.zaddDelay {
+			return err
+		}
+
+		log.Debugf("Retrying failed ZAdd: %v", err)
+		select {
+		case <-time.After(c.zaddDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
 }
 
 // Allow is like AllowContext, but not using a context.
@@ -275,26 +1076,62 @@ func (c *clusterLimitRedis) Allow(clearText string) bool {
 	return c.AllowContext(context.Background(), clearText)
 }
 
-func (c *clusterLimitRedis) allowCheckCard(ctx context.Context, key string, clearBefore int64) (int64, error) {
+// queryErr returns nil for redis.Nil, because a missing key means no
+// recorded hits, and it must not count as a query failure, and the
+// error otherwise.
+func queryErr(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	return err
+}
+
+// checkCard returns the number of hits of the key in the time window,
+// in a batch, when batching is enabled, counting the call as n hits.
+// The set of hits is capped by the max hits of the key.
+func (c *clusterLimitRedis) checkCard(ctx context.Context, key string, clearBefore int64, n int, maxHits int64) (int64, error) {
+	if c.batcher == nil {
+		return c.allowCheckCard(ctx, key, clearBefore, maxHits)
+	}
+
+	finishSpan := c.startSpan(ctx, allowCheckBatchSpanName)
+	count, err := c.batcher.check(ctx, key, clearBefore, maxHits+zsetCapBuffer+1, int64(n))
+	finishSpan(err != nil)
+	return count, err
+}
+
+func (c *clusterLimitRedis) allowCheckCard(ctx context.Context, key string, clearBefore, maxHits int64) (int64, error) {
 	// drop all elements of the set which occurred before one interval ago.
 	finishSpan := c.startSpan(ctx, allowCheckRemRangeSpanName)
 	zremRangeResult := c.ring.ZRemRangeByScore(ctx, key, "0.0", fmt.Sprint(float64(clearBefore)))
-	err := zremRangeResult.Err()
+	err := queryErr(zremRangeResult.Err())
 	finishSpan(err != nil)
 	if err != nil {
 		return 0, fmt.Errorf("zremrangebyscore: %w", err)
 	}
 
+	// cap the size of the set, keeping the latest maxHits plus a
+	// buffer for concurrent additions, to bound the memory of keys
+	// hit in a burst from multiple instances.
+	finishSpan = c.startSpan(ctx, allowCheckRemRankSpanName)
+	zremRankResult := c.ring.ZRemRangeByRank(ctx, key, 0, -(maxHits + zsetCapBuffer + 1))
+	err = queryErr(zremRankResult.Err())
+	finishSpan(err != nil)
+	if err != nil {
+		return 0, fmt.Errorf("zremrangebyrank: %w", err)
+	}
+
 	// get cardinality
 	finishSpan = c.startSpan(ctx, allowCheckSpanName)
-	zcardResult := c.ring.ZCard(ctx, key)
-	err = zcardResult.Err()
+	count, err := c.ring.ZCard(ctx, key).Result()
+	err = queryErr(err)
 	finishSpan(err != nil)
 	if err != nil {
 		return 0, fmt.Errorf("zcard: %w", err)
 	}
 
-	return zcardResult.Val(), nil
+	return count, nil
 }
 
 // Close can not decide to teardown redis ring, because it is not the
@@ -308,14 +1145,25 @@ func (c *clusterLimitRedis) deltaFrom(ctx context.Context, clearText string, fro
 	}
 
 	gap := from.Sub(oldest)
-	return c.window - gap, nil
+	return c.timeWindow() - gap, nil
 }
 
 // Delta returns the time.Duration until the next call is allowed,
 // negative means immediate calls are allowed
 func (c *clusterLimitRedis) Delta(clearText string) time.Duration {
-	now := time.Now()
-	d, err := c.deltaFrom(context.Background(), clearText, now)
+	return c.DurationUntilAllowed(context.Background(), clearText)
+}
+
+// DurationUntilAllowed returns the time.Duration until the next call
+// is allowed, negative means immediate calls are allowed. Unlike
+// RetryAfterContext, it doesn't round the duration to seconds, so it
+// can be used e.g. for client side backoff.
+//
+// If a context is provided, it uses it for creating an OpenTracing span.
+func (c *clusterLimitRedis) DurationUntilAllowed(ctx context.Context, clearText string) time.Duration {
+	ctx = c.sample(ctx, clearText)
+	now := c.clock.adjust(time.Now())
+	d, err := c.deltaFrom(ctx, clearText, now)
 	if err != nil {
 		log.Errorf("Failed to get the duration until the next call is allowed: %v", err)
 
@@ -328,20 +1176,24 @@ func (c *clusterLimitRedis) Delta(clearText string) time.Duration {
 }
 
 func (c *clusterLimitRedis) oldest(ctx context.Context, clearText string) (time.Time, error) {
-	s := getHashedKey(clearText)
+	s := hashedKey(ctx, clearText)
 	key := c.prefixKey(s)
-	now := time.Now()
+	now := c.clock.adjust(time.Now())
+
+	// the expired hits, that are not yet removed by Allow, are
+	// excluded, like the removal, the boundary is inclusive
+	clearBefore := now.Add(-c.timeWindow()).UnixNano()
 
 	finishSpan := c.startSpan(ctx, oldestScoreSpanName)
 	res := c.ring.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
-		Min:    "0.0",
+		Min:    "(" + fmt.Sprint(float64(clearBefore)),
 		Max:    fmt.Sprint(float64(now.UnixNano())),
 		Offset: 0,
 		Count:  1,
 	})
 
 	zs, err := res.Result()
-	if err != nil {
+	if err := queryErr(err); err != nil {
 		finishSpan(true)
 		return time.Time{}, err
 	}
@@ -369,7 +1221,8 @@ func (c *clusterLimitRedis) oldest(ctx context.Context, clearText string) (time.
 	return time.Unix(0, oldest), nil
 }
 
-// Oldest returns the oldest known request time.
+// Oldest returns the oldest known request time within the time
+// window, or the zero time, when there is none.
 //
 // Performance considerations:
 //
@@ -385,6 +1238,148 @@ func (c *clusterLimitRedis) Oldest(clearText string) time.Time {
 	return t
 }
 
+// ResetTime returns the time, when the current time window of the key
+// resets, i.e. the oldest hit in the window expires. Without hits in
+// the window, it returns the current time. It can be used e.g. for an
+// absolute X-RateLimit-Reset header.
+//
+// Performance considerations:
+//
+// It uses the same query as Oldest.
+func (c *clusterLimitRedis) ResetTime(clearText string) time.Time {
+	now := c.clock.adjust(time.Now())
+	oldest, err := c.oldest(context.Background(), clearText)
+	if err != nil {
+		log.Errorf("Failed to get the reset time of the time window: %v", err)
+		return now
+	}
+
+	return resetTime(oldest, c.timeWindow(), now)
+}
+
+// resetTime returns the time, when the window of the oldest hit
+// resets, or now, when there is no hit, or it is already expired.
+func resetTime(oldest time.Time, window time.Duration, now time.Time) time.Time {
+	if oldest.IsZero() {
+		return now
+	}
+
+	if reset := oldest.Add(window); reset.After(now) {
+		return reset
+	}
+
+	return now
+}
+
+// ActiveKey is a ratelimit key of a group, which has hits recorded.
+type ActiveKey struct {
+	// Key is the hashed identifier of the client, as returned by the
+	// Lookuper.
+	Key string
+
+	// Hits is the number of recorded hits in the last time window,
+	// including expired hits not cleaned up yet.
+	Hits int64
+}
+
+// ActiveKeys returns the keys of the group with recorded hits and their
+// current cardinality. The keys are matched by the key format of the
+// group, the prefix, the group and the separator, so the keys of a group
+// named like "<group>.<name>" are returned, too.
+//
+// Performance considerations:
+//
+// It will use SCAN on every shard of the ring to find the keys of the
+// group, and ZCARD for every found key, so it is O(keyspace). It is
+// meant for admin tooling, and not to be used in the request path.
+func (c *clusterLimitRedis) ActiveKeys(ctx context.Context) ([]ActiveKey, error) {
+	prefix := c.prefixKey("")
+
+	var (
+		mu   sync.Mutex
+		keys []ActiveKey
+	)
+
+	err := c.ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		var shardKeys []ActiveKey
+		iter := client.Scan(ctx, 0, prefix+"*", 0).Iterator()
+		for iter.Next(ctx) {
+			key := strings.TrimPrefix(iter.Val(), prefix)
+
+			// the denied counters and the idempotency markers of
+			// the keys are not sets of hits. The keys themselves
+			// may contain dots, when they are pre-hashed by the
+			// caller of AllowHashed.
+			if strings.HasSuffix(key, deniedKeySuffix) || strings.Contains(key, idempotencyKeySuffix) {
+				continue
+			}
+
+			// the key may expire after the scan
+			hits, err := client.ZCard(ctx, iter.Val()).Result()
+			if err := queryErr(err); err != nil {
+				return fmt.Errorf("zcard: %w", err)
+			}
+
+			if hits > 0 {
+				shardKeys = append(shardKeys, ActiveKey{Key: key, Hits: hits})
+			}
+		}
+
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+
+		mu.Lock()
+		keys = append(keys, shardKeys...)
+		mu.Unlock()
+		return nil
+	})
+
+	return keys, err
+}
+
+// nextAdmitted returns the time when the next request of the key will
+// be admitted, or the zero time if it is admitted already.
+//
+// Performance considerations:
+//
+// It runs retryAfterScript, so the trimming, the cardinality and the
+// score of the hit are evaluated in one roundtrip. With
+// RetryAfterCacheTTL, the result is cached.
+func (c *clusterLimitRedis) nextAdmitted(ctx context.Context, clearText string, now time.Time) (time.Time, error) {
+	key := c.prefixKey(hashedKey(ctx, clearText))
+	if admitted, ok := c.oldestCache.get(key, time.Now()); ok {
+		return admitted, nil
+	}
+
+	clearBefore := now.Add(-c.timeWindow()).UnixNano()
+	maxHits, _ := c.limit(clearText)
+
+	finishSpan := c.startSpan(ctx, retryAfterScriptSpanName)
+	score, err := retryAfterScript.Run(ctx, c.ring, []string{key}, clearBefore, maxHits).Text()
+	if errors.Is(err, redis.Nil) {
+		finishSpan(false)
+		c.oldestCache.set(key, time.Time{}, time.Now())
+		return time.Time{}, nil
+	}
+
+	if err != nil {
+		finishSpan(true)
+		return time.Time{}, fmt.Errorf("retry after script: %w", err)
+	}
+
+	nanos, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		finishSpan(true)
+		return time.Time{}, fmt.Errorf("failed to convert score to float64: %w", err)
+	}
+
+	finishSpan(false)
+	admitted := time.Unix(0, int64(nanos)).Add(c.timeWindow())
+	c.oldestCache.set(key, admitted, time.Now())
+	return admitted, nil
+}
+
 // Resize is noop to implement the limiter interface
 func (*clusterLimitRedis) Resize(string, int) {}
 
@@ -394,29 +1389,60 @@ func (*clusterLimitRedis) Resize(string, int) {}
 // because of how it's used in the proxy and the nature of cluster
 // ratelimits being not strongly consistent across calls to Allow()
 // and RetryAfter() (or AllowContext and RetryAfterContext accordingly).
+// For time windows shorter than a second, the exact wait is returned
+// by DurationUntilAllowed. Unlike Delta(), it waits for the expiry of
+// the hit, that admits the next request, not the oldest one. With
+// Settings.RetryAfterMultiplier, the result is scaled by the number of
+// denied requests.
 //
 // If a context is provided, it uses it for creating an OpenTracing span.
 func (c *clusterLimitRedis) RetryAfterContext(ctx context.Context, clearText string) int {
+	return c.retryAfter(ctx, clearText, c.nextAdmitted)
+}
+
+// retryAfter implements RetryAfterContext, with the time of the next
+// admitted request returned by nextAdmitted.
+func (c *clusterLimitRedis) retryAfter(
+	ctx context.Context,
+	clearText string,
+	nextAdmitted func(context.Context, string, time.Time) (time.Time, error),
+) int {
 	// If less than 1s to wait -> so set to 1
 	const minWait = 1
 
-	now := time.Now()
+	ctx = c.sample(ctx, clearText)
+
+	start := time.Now()
 	var queryFailure bool
-	defer c.measureQuery(retryAfterMetricsFormat, retryAfterMetricsFormatWithGroup, &queryFailure, now)
+	defer c.measureQuery(retryAfterOperation, &queryFailure, start)
 
-	retr, err := c.deltaFrom(ctx, clearText, now)
+	now := c.clock.adjust(start)
+
+	admitted, err := nextAdmitted(ctx, clearText, now)
 	if err != nil {
 		log.Errorf("Failed to get the duration to wait with the next request: %v", err)
 		queryFailure = true
 		return minWait
 	}
 
-	res := int(retr / time.Second)
-	if res > 0 {
-		return res + 1
+	res := minWait
+	if s := int(admitted.Sub(now) / time.Second); s > 0 {
+		res = s + 1
+	}
+
+	if c.retryAfterMultiplier > 1 {
+		denied, err := c.denied(ctx, c.prefixKey(hashedKey(ctx, clearText)))
+		if err != nil {
+			log.Errorf("Failed to get the denied requests: %v", err)
+			queryFailure = true
+			return res
+		}
+
+		maxHits, _ := c.limit(clearText)
+		res = weightedRetryAfter(res, c.retryAfterMultiplier, denied, maxHits, c.timeWindow())
 	}
 
-	return minWait
+	return res
 }
 
 // RetryAfter is like RetryAfterContext, but not using a context.
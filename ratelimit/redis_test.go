@@ -4,10 +4,21 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http/httptest"
 	"os/exec"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/zalando/skipper/metrics/metricstest"
 )
 
 func startRedis(port string) func() {
@@ -81,11 +92,11 @@ func Test_clusterLimitRedis_Allow(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			q := make(chan struct{})
-			defer close(q)
+			r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+			defer r.Close()
 			c := newClusterRateLimiterRedis(
 				tt.settings,
-				newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}}, q),
+				r,
 				tt.settings.Group,
 			)
 
@@ -147,11 +158,11 @@ func Test_clusterLimitRedis_Delta(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			q := make(chan struct{})
-			defer close(q)
+			r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+			defer r.Close()
 			c := newClusterRateLimiterRedis(
 				tt.settings,
-				newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}}, q),
+				r,
 				tt.settings.Group,
 			)
 
@@ -213,11 +224,11 @@ func Test_clusterLimitRedis_Oldest(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			q := make(chan struct{})
-			defer close(q)
+			r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+			defer r.Close()
 			c := newClusterRateLimiterRedis(
 				tt.settings,
-				newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}}, q),
+				r,
 				tt.settings.Group,
 			)
 
@@ -280,11 +291,11 @@ func Test_clusterLimitRedis_RetryAfter(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			q := make(chan struct{})
-			defer close(q)
+			r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+			defer r.Close()
 			c := newClusterRateLimiterRedis(
 				tt.settings,
-				newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}}, q),
+				r,
 				tt.settings.Group,
 			)
 
@@ -297,3 +308,1185 @@ func Test_clusterLimitRedis_RetryAfter(t *testing.T) {
 		})
 	}
 }
+
+func Test_clusterLimitRedis_ZSetCap(t *testing.T) {
+	redisPort := "16383"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	// simulate a burst recorded by other instances
+	ctx := context.Background()
+	key := c.prefixKey(getHashedKey("clientA"))
+	now := time.Now().UnixNano()
+	for i := 0; i < 10*settings.MaxHits; i++ {
+		n := now - int64(i)
+		if err := r.ring.ZAdd(ctx, key, &redis.Z{Member: n, Score: float64(n)}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.Allow("clientA") {
+		t.Error("unexpected allow")
+	}
+
+	count, err := r.ring.ZCard(ctx, key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count > int64(settings.MaxHits+zsetCapBuffer) {
+		t.Errorf("sorted set is not capped: %d", count)
+	}
+}
+
+func Test_clusterLimitRedis_DurationUntilAllowed(t *testing.T) {
+	redisPort := "16384"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: 3 * time.Second,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	if d := c.DurationUntilAllowed(context.Background(), "clientA"); d >= 0 {
+		t.Errorf("expected immediate allow without requests, got: %v", d)
+	}
+
+	c.Allow("clientA")
+	time.Sleep(500 * time.Millisecond)
+	c.Allow("clientA")
+
+	d := c.DurationUntilAllowed(context.Background(), "clientA")
+	if d <= 2*time.Second || d > 2500*time.Millisecond {
+		t.Errorf("unexpected duration: %v", d)
+	}
+
+	if c.RetryAfter("clientA") != 3 {
+		t.Errorf("unexpected retry after: %d", c.RetryAfter("clientA"))
+	}
+}
+
+func Test_clusterLimitRedis_DryRun(t *testing.T) {
+	redisPort := "16385"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Second,
+		Group:      "A",
+		DryRun:     true,
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	for i := 0; i < 2; i++ {
+		if res := c.AllowResultContext(context.Background(), "clientA"); !res.Allowed || res.DryRunForbidden {
+			t.Errorf("unexpected result within the limit: %+v", res)
+		}
+	}
+
+	res := c.AllowResultContext(context.Background(), "clientA")
+	if !res.Allowed || !res.DryRunForbidden {
+		t.Errorf("unexpected result over the limit: %+v", res)
+	}
+
+	if o := c.Oldest("clientA"); o.IsZero() {
+		t.Error("failed to record the hits")
+	}
+}
+
+func Test_clusterLimitHierarchical(t *testing.T) {
+	redisPort := "16386"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	groupSettings := func(group string, reserved int) Settings {
+		return Settings{
+			Type:          ClusterServiceRatelimit,
+			MaxHits:       10,
+			TimeWindow:    time.Minute,
+			Group:         group,
+			Parent:        "P",
+			ParentMaxHits: 5,
+			Reserved:      reserved,
+		}
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+
+	newLimiter := func(s Settings) limiter {
+		return newClusterLimitHierarchical(s, newClusterRateLimiterRedis(s, r, s.Group), r)
+	}
+
+	a := newLimiter(groupSettings("A", 3))
+	b := newLimiter(groupSettings("B", 0))
+
+	for i := 0; i < 5; i++ {
+		if !b.Allow("") {
+			t.Fatalf("failed to allow request %d of group B within the parent budget", i)
+		}
+	}
+
+	if b.Allow("") {
+		t.Error("failed to deny request of group B over the parent budget")
+	}
+
+	// group B has hits left, so the retry is computed from the parent
+	if retryAfter := b.(*clusterLimitHierarchical).RetryAfter(""); retryAfter < 50 {
+		t.Errorf("retry after not computed from the parent budget: %d", retryAfter)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !a.Allow("") {
+			t.Fatalf("failed to allow reserved request %d of group A", i)
+		}
+	}
+
+	if a.Allow("") {
+		t.Error("failed to deny request of group A over the reserved hits and the parent budget")
+	}
+}
+
+func Test_clusterLimitRedis_ActiveKeys(t *testing.T) {
+	redisPort := "16387"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	other := settings
+	other.Group = "AB"
+	newClusterRateLimiterRedis(other, r, other.Group).Allow("clientC")
+
+	c.Allow("clientA")
+	c.Allow("clientA")
+	c.Allow("clientB")
+
+	// pre-hashed keys of composite limiters may contain dots
+	c.AllowContext(withPreHashedKey(context.Background(), "tenant.route"), "tenant.route")
+
+	// the denied counter is not a set of hits
+	c.ring.Incr(context.Background(), c.prefixKey(getHashedKey("clientB"))+deniedKeySuffix)
+
+	keys, err := c.ActiveKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := make(map[string]int64)
+	for _, k := range keys {
+		hits[k.Key] = k.Hits
+	}
+
+	expected := map[string]int64{getHashedKey("clientA"): 2, getHashedKey("clientB"): 1, "tenant.route": 1}
+	if !reflect.DeepEqual(hits, expected) {
+		t.Errorf("unexpected active keys: %v, expected: %v", hits, expected)
+	}
+}
+
+func Test_clusterLimitRedis_SubSecondWindow(t *testing.T) {
+	redisPort := "16388"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    5,
+		TimeWindow: 200 * time.Millisecond,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	for i := 0; i < settings.MaxHits; i++ {
+		if !c.Allow("clientA") {
+			t.Fatalf("failed to allow request %d", i)
+		}
+	}
+
+	if c.Allow("clientA") {
+		t.Error("failed to deny request over the limit")
+	}
+
+	if d := c.DurationUntilAllowed(context.Background(), "clientA"); d <= 0 || d > settings.TimeWindow {
+		t.Errorf("unexpected duration until allowed: %v", d)
+	}
+
+	if c.RetryAfter("clientA") != 1 {
+		t.Errorf("unexpected retry after: %d", c.RetryAfter("clientA"))
+	}
+
+	ttl, err := c.ring.PTTL(context.Background(), c.prefixKey(getHashedKey("clientA"))).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl <= 0 || ttl > settings.TimeWindow+expireMargin {
+		t.Errorf("unexpected ttl of the key: %v", ttl)
+	}
+
+	time.Sleep(settings.TimeWindow + 50*time.Millisecond)
+	if !c.Allow("clientA") {
+		t.Error("failed to allow request after the time window")
+	}
+}
+
+func Test_clusterLimitRedis_MissingKey(t *testing.T) {
+	redisPort := "16389"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	m := &metricstest.MockMetrics{}
+	c.metrics = m
+
+	ctx := context.Background()
+	key := c.prefixKey(getHashedKey("clientA"))
+	c.Allow("clientA")
+	c.Allow("clientA")
+
+	// the key expires or is deleted between the queries
+	if err := c.ring.Del(ctx, key).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := c.allowCheckCard(ctx, key, 0, c.maxHits); err != nil || count != 0 {
+		t.Errorf("unexpected cardinality of a missing key: %d, %v", count, err)
+	}
+
+	if oldest, err := c.oldest(ctx, "clientA"); err != nil || !oldest.IsZero() {
+		t.Errorf("unexpected oldest hit of a missing key: %v, %v", oldest, err)
+	}
+
+	if _, err := c.deltaFrom(ctx, "clientA", time.Now()); err != nil {
+		t.Errorf("unexpected error for a missing key: %v", err)
+	}
+
+	if c.RetryAfter("clientA") != 1 {
+		t.Errorf("unexpected retry after for a missing key: %d", c.RetryAfter("clientA"))
+	}
+
+	if !c.Allow("clientA") {
+		t.Error("failed to allow request after the key was deleted")
+	}
+
+	m.WithMeasures(func(measures map[string][]time.Duration) {
+		for k := range measures {
+			if strings.Contains(k, "failure") {
+				t.Errorf("unexpected query failure: %s", k)
+			}
+		}
+	})
+}
+
+// failingZAdd fails the first n ZADD commands.
+type failingZAdd struct {
+	n int
+}
+
+func (h *failingZAdd) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == "zadd" && h.n > 0 {
+		h.n--
+		return ctx, errors.New("injected zadd failure")
+	}
+
+	return ctx, nil
+}
+
+func (*failingZAdd) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (*failingZAdd) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (*failingZAdd) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func Test_clusterLimitRedis_ZAddRetry(t *testing.T) {
+	redisPort := "16391"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	ctx := context.Background()
+	key := c.prefixKey(getHashedKey("clientA"))
+
+	c.ring.AddHook(&failingZAdd{n: 1})
+	if !c.Allow("clientA") {
+		t.Fatal("request not allowed")
+	}
+
+	if n, err := c.ring.ZCard(ctx, key).Result(); err != nil || n != 1 {
+		t.Errorf("hit not recorded after a retry: %d, %v", n, err)
+	}
+
+	// no retry after the deadline of the request context
+	c.ring.AddHook(&failingZAdd{n: 1})
+	dctx, dcancel := context.WithTimeout(ctx, c.zaddDelay/2)
+	defer dcancel()
+	if err := c.zadd(dctx, key, time.Now().UnixNano(), "late"); err == nil {
+		t.Error("unexpected retry after the deadline")
+	}
+}
+
+func Test_clusterLimitRedis_WeightedRetryAfter(t *testing.T) {
+	redisPort := "16392"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:                 ClusterClientRatelimit,
+		MaxHits:              4,
+		TimeWindow:           10 * time.Second,
+		Group:                "A",
+		RetryAfterMultiplier: 3,
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	for i := 0; i < settings.MaxHits; i++ {
+		c.Allow("clientA")
+	}
+
+	if ra := c.RetryAfter("clientA"); ra != 10 {
+		t.Errorf("unexpected retry after without denied requests: %d", ra)
+	}
+
+	// half of max hits over the limit
+	c.Allow("clientA")
+	c.Allow("clientA")
+	if ra := c.RetryAfter("clientA"); ra != 20 {
+		t.Errorf("unexpected weighted retry after: %d", ra)
+	}
+
+	// the denied requests are not counted without a multiplier
+	settings.RetryAfterMultiplier = 0
+	settings.Group = "B"
+	c = newClusterRateLimiterRedis(settings, r, settings.Group)
+	for i := 0; i < 2*settings.MaxHits; i++ {
+		c.Allow("clientA")
+	}
+
+	key := c.prefixKey(getHashedKey("clientA")) + deniedKeySuffix
+	if n, err := c.ring.Exists(context.Background(), key).Result(); err != nil || n != 0 {
+		t.Errorf("unexpected denied count: %d, %v", n, err)
+	}
+}
+
+func Test_clusterLimitRedis_RetryAfterScript(t *testing.T) {
+	redisPort := "16393"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    4,
+		TimeWindow: 5 * time.Second,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	c.Allow("clientA")
+	if ra := c.RetryAfter("clientA"); ra != 1 {
+		t.Errorf("unexpected retry after below the limit: %d", ra)
+	}
+
+	time.Sleep(time.Second)
+	for i := 1; i < settings.MaxHits; i++ {
+		c.Allow("clientA")
+	}
+
+	// a lower limit of the same group, e.g. after a route update,
+	// admits the next request after the expiry of the hit at rank 2
+	settings.MaxHits = 2
+	c = newClusterRateLimiterRedis(settings, r, settings.Group)
+	if ra := c.RetryAfter("clientA"); ra != 5 {
+		t.Errorf("unexpected retry after: %d", ra)
+	}
+}
+
+func Test_clusterLimitRedis_AllowN(t *testing.T) {
+	redisPort := "16394"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    5,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	ctx := context.Background()
+	if res := c.AllowNResultContext(ctx, "clientA", 3); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("unexpected result of the first request: %+v", res)
+	}
+
+	if res := c.AllowNResultContext(ctx, "clientA", 3); res.Allowed {
+		t.Error("request allowed over the limit")
+	}
+
+	if res := c.AllowNResultContext(ctx, "clientA", 2); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("unexpected result of the request up to the limit: %+v", res)
+	}
+
+	if c.Allow("clientA") {
+		t.Error("request allowed over the limit")
+	}
+
+	if o := c.Oldest("clientA"); o.IsZero() {
+		t.Error("failed to get the oldest hit")
+	}
+}
+
+func Test_clusterLimitRedis_AllowHashed(t *testing.T) {
+	redisPort := "16407"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	rl := &Ratelimit{settings: settings, impl: newClusterRateLimiterRedis(settings, r, settings.Group)}
+
+	ctx := context.Background()
+	key := getHashedKey("clientA|GET")
+	if res := rl.AllowHashed(ctx, key); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("unexpected result of the first request: %+v", res)
+	}
+
+	// the pre-hashed key is prefixed with the group, and not hashed
+	// again
+	if n, err := r.ring.ZCard(ctx, "ratelimit.A."+key).Result(); err != nil || n != 1 {
+		t.Errorf("unexpected hits of the prefixed key: %d, %v", n, err)
+	}
+
+	if n, err := r.ring.Exists(ctx, "ratelimit.A."+getHashedKey(key)).Result(); err != nil || n != 0 {
+		t.Errorf("unexpected key hashed twice: %d, %v", n, err)
+	}
+
+	// the clear text key shares the key space
+	if !rl.AllowContext(ctx, "clientA|GET") {
+		t.Error("request denied below the limit")
+	}
+
+	if rl.AllowHashed(ctx, key).Allowed {
+		t.Error("request allowed over the limit")
+	}
+}
+
+func Test_clusterLimitRedis_SpanParent(t *testing.T) {
+	redisPort := "16390"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	tracer := mocktracer.New()
+	settings := Settings{
+		Type:       ClusterServiceRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	reg := NewSwarmRegistry(nil, &RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}, Tracer: tracer}, settings)
+	defer reg.Close()
+
+	parent := tracer.StartSpan("proxy")
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(opentracing.ContextWithSpan(req.Context(), parent))
+
+	if _, retryAfter := reg.Check(req); retryAfter != 0 {
+		t.Fatalf("unexpected ratelimit: %d", retryAfter)
+	}
+
+	parent.Finish()
+
+	var found bool
+	parentID := parent.Context().(mocktracer.MockSpanContext).SpanID
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == allowCheckSpanName {
+			found = true
+			if span.ParentID != parentID {
+				t.Errorf("unexpected parent of %s: %d != %d", allowCheckSpanName, span.ParentID, parentID)
+			}
+		}
+	}
+
+	if !found {
+		t.Errorf("failed to find the span %s", allowCheckSpanName)
+	}
+}
+
+func TestConcurrencyLimitRedis(t *testing.T) {
+	redisPort := "16395"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newConcurrencyLimit("A", 2, 200*time.Millisecond, r)
+
+	ctx := context.Background()
+	release, ok := c.Acquire(ctx, "clientA")
+	if !ok {
+		t.Fatal("failed to acquire the first slot")
+	}
+
+	if _, ok := c.Acquire(ctx, "clientA"); !ok {
+		t.Fatal("failed to acquire the second slot")
+	}
+
+	if _, ok := c.Acquire(ctx, "clientA"); ok {
+		t.Fatal("acquired a slot over the limit")
+	}
+
+	if _, ok := c.Acquire(ctx, "clientB"); !ok {
+		t.Fatal("failed to acquire the slot of another client")
+	}
+
+	release()
+	release()
+	if _, ok := c.Acquire(ctx, "clientA"); !ok {
+		t.Fatal("failed to acquire the released slot")
+	}
+
+	if _, ok := c.Acquire(ctx, "clientA"); ok {
+		t.Fatal("release called twice released more than one slot")
+	}
+
+	// the slots not released expire after the ttl
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := c.Acquire(ctx, "clientA"); !ok {
+		t.Fatal("failed to acquire a slot after the expiry")
+	}
+}
+
+func Test_clusterLimitRedis_Batch(t *testing.T) {
+	redisPort := "16396"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    5,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{
+		Addrs:       []string{"127.0.0.1:" + redisPort},
+		BatchWindow: 50 * time.Millisecond,
+		BatchSize:   8,
+	})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	// the concurrent calls of the same key in a full batch must not
+	// be allowed over the limit
+	results := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() { results <- c.AllowContext(context.Background(), "clientA") }()
+	}
+
+	var allowed int
+	for i := 0; i < 8; i++ {
+		if <-results {
+			allowed++
+		}
+	}
+
+	if allowed != settings.MaxHits {
+		t.Errorf("unexpected number of allowed calls: %d", allowed)
+	}
+
+	if !c.AllowContext(context.Background(), "clientB") {
+		t.Error("call of another key denied")
+	}
+}
+
+func Test_clusterLimitRedis_Overrides(t *testing.T) {
+	redisPort := "16397"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{
+		Addrs:                    []string{"127.0.0.1:" + redisPort},
+		OverridesRefreshInterval: 10 * time.Millisecond,
+	})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	m := &metricstest.MockMetrics{}
+	c.metrics = m
+
+	ctx := context.Background()
+	if err := c.ring.HSet(ctx, "ratelimit.overrides.A", "premium", "4", "invalid", "foo").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first lookup starts the refresh of the overrides
+	c.limit("premium")
+	time.Sleep(100 * time.Millisecond)
+
+	for _, ti := range []struct {
+		key     string
+		allowed int
+	}{
+		{key: "premium", allowed: 4},
+		{key: "invalid", allowed: 2},
+		{key: "standard", allowed: 2},
+	} {
+		var allowed int
+		for i := 0; i < 6; i++ {
+			if c.Allow(ti.key) {
+				allowed++
+			}
+		}
+
+		if allowed != ti.allowed {
+			t.Errorf("unexpected number of allowed calls of %s: %d != %d", ti.key, allowed, ti.allowed)
+		}
+	}
+
+	m.WithCounters(func(counters map[string]int64) {
+		if counters["swarm.redis.override.hits"] != 6 {
+			t.Errorf("unexpected override hits: %d", counters["swarm.redis.override.hits"])
+		}
+	})
+}
+
+func Test_clusterLimitRedis_ExpireMargin(t *testing.T) {
+	redisPort := "16398"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+
+	for _, ti := range []struct {
+		window   time.Duration
+		margin   time.Duration
+		expected time.Duration
+	}{
+		{window: time.Hour, expected: time.Hour + expireMargin},
+		{window: time.Hour, margin: time.Second, expected: time.Hour + time.Second},
+		{window: time.Minute, margin: 500 * time.Millisecond, expected: time.Minute + 500*time.Millisecond},
+		{window: 200 * time.Millisecond, margin: 20 * time.Millisecond, expected: 220 * time.Millisecond},
+	} {
+		t.Run(fmt.Sprintf("%v+%v", ti.window, ti.margin), func(t *testing.T) {
+			settings := Settings{
+				Type:         ClusterClientRatelimit,
+				MaxHits:      10,
+				TimeWindow:   ti.window,
+				Group:        fmt.Sprintf("margin-%v-%v", ti.window, ti.margin),
+				ExpireMargin: ti.margin,
+			}
+
+			c := newClusterRateLimiterRedis(settings, r, settings.Group)
+			if !c.Allow("clientA") {
+				t.Fatal("failed to allow request")
+			}
+
+			ttl, err := c.ring.PTTL(context.Background(), c.prefixKey(getHashedKey("clientA"))).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the ttl passes while querying it
+			if ttl > ti.expected || ttl < ti.expected-10*time.Millisecond {
+				t.Errorf("unexpected ttl of the key: %v, expected: %v", ttl, ti.expected)
+			}
+		})
+	}
+}
+
+func Test_clusterLimitRedis_ResetTime(t *testing.T) {
+	redisPort := "16399"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "reset",
+	}
+
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	t.Run("empty key", func(t *testing.T) {
+		before := time.Now()
+		got := c.ResetTime("clientA")
+		if got.Before(before) || got.After(time.Now()) {
+			t.Errorf("unexpected reset time of an empty key: %v, expected now: %v", got, before)
+		}
+	})
+
+	t.Run("partially filled key", func(t *testing.T) {
+		first := time.Now()
+		for i := 0; i < 3; i++ {
+			if !c.Allow("clientB") {
+				t.Fatal("failed to allow request")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// the window of the first hit resets
+		got := c.ResetTime("clientB")
+		expected := first.Add(settings.TimeWindow)
+		if got.Before(expected) || got.After(expected.Add(10*time.Millisecond)) {
+			t.Errorf("unexpected reset time: %v, expected: %v", got, expected)
+		}
+	})
+}
+
+func Test_clusterLimitRedis_KillSwitch(t *testing.T) {
+	redisPort := "16400"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{
+		Addrs:                     []string{"127.0.0.1:" + redisPort},
+		KillSwitchRefreshInterval: 10 * time.Millisecond,
+	})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	m := &metricstest.MockMetrics{}
+	c.metrics = m
+
+	allowed := func() int {
+		var n int
+		for i := 0; i < 4; i++ {
+			if c.Allow("clientA") {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	// refreshes the state of the kill switch, and waits for it
+	refresh := func() {
+		time.Sleep(20 * time.Millisecond)
+		c.killSwitch.active()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx := context.Background()
+	if n := allowed(); n != 2 {
+		t.Errorf("unexpected number of allowed calls without kill switch: %d", n)
+	}
+
+	if err := c.ring.Set(ctx, "ratelimit.killswitch.A", "1", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh()
+	if n := allowed(); n != 4 {
+		t.Errorf("unexpected number of allowed calls with kill switch: %d", n)
+	}
+
+	m.WithCounters(func(counters map[string]int64) {
+		if counters["swarm.redis.killswitch.allows"] != 4 {
+			t.Errorf("unexpected kill switch allows: %d", counters["swarm.redis.killswitch.allows"])
+		}
+	})
+
+	if err := c.ring.Set(ctx, "ratelimit.killswitch.A", "0", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh()
+	if n := allowed(); n != 0 {
+		t.Errorf("unexpected number of allowed calls after the kill switch: %d", n)
+	}
+}
+
+func Test_serverClock_SkewedLocalClocks(t *testing.T) {
+	redisPort := "16401"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	r := newRing(&RedisOptions{
+		Addrs:         []string{"127.0.0.1:" + redisPort},
+		UseServerTime: true,
+	})
+	defer r.Close()
+
+	// instances with local clocks an hour ahead and behind
+	fast := newServerClock(r.ring, time.Hour)
+	fast.local = func() time.Time { return time.Now().Add(time.Hour) }
+	slow := newServerClock(r.ring, time.Hour)
+	slow.local = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	fast.start()
+	slow.start()
+
+	d := fast.adjust(fast.local()).Sub(slow.adjust(slow.local()))
+	if d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("the instances don't agree on the time: %v", d)
+	}
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+	if !c.Config().ServerTime {
+		t.Error("server time not enabled")
+	}
+
+	if !c.Allow("clientA") || !c.Allow("clientA") || c.Allow("clientA") {
+		t.Error("unexpected ratelimit with server time")
+	}
+}
+
+func Test_clusterLimitRedis_ExpiredMembers(t *testing.T) {
+	redisPort := "16402"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    1,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	// expired hits, that were not yet removed by Allow
+	ctx := context.Background()
+	key := c.prefixKey(hashedKey(ctx, "clientA"))
+	for i := 2; i < 4; i++ {
+		score := time.Now().Add(-time.Duration(i) * time.Minute).UnixNano()
+		if err := c.ring.ZAdd(ctx, key, &redis.Z{Member: score, Score: float64(score)}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if oldest := c.Oldest("clientA"); !oldest.IsZero() {
+		t.Errorf("unexpected oldest hit: %v", oldest)
+	}
+
+	if d := c.Delta("clientA"); d > 0 {
+		t.Errorf("unexpected delta: %v", d)
+	}
+
+	if s := c.RetryAfter("clientA"); s != 1 {
+		t.Errorf("unexpected retry after: %d", s)
+	}
+}
+
+func Test_clusterLimitMultiWindow(t *testing.T) {
+	redisPort := "16403"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Second,
+		Group:      "A",
+		Windows:    "3/1m",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterLimitMultiWindow(settings, newClusterRateLimiterRedis(settings, r, settings.Group), r).(*clusterLimitMultiWindow)
+
+	ctx := context.Background()
+	for i, expected := range []AllowResult{
+		{Allowed: true, Limit: 2, Remaining: 1, Count: 1},
+		{Allowed: true, Limit: 2, Remaining: 0, Count: 2},
+		{Allowed: false, Limit: 2, Window: time.Second},
+	} {
+		if result := c.AllowResultContext(ctx, "clientA"); result != expected {
+			t.Errorf("unexpected result of request %d: %+v", i+1, result)
+		}
+	}
+
+	// the burst window is reset, the sustained window denies
+	time.Sleep(1100 * time.Millisecond)
+	if result := c.AllowResultContext(ctx, "clientA"); !result.Allowed || result.Limit != 3 || result.Remaining != 0 {
+		t.Errorf("unexpected result after the burst window: %+v", result)
+	}
+
+	if result := c.AllowResultContext(ctx, "clientA"); result.Allowed || result.Window != time.Minute {
+		t.Errorf("unexpected result in the sustained window: %+v", result)
+	}
+
+	// the longest wait of the tripped windows
+	if s := c.RetryAfter("clientA"); s < 55 {
+		t.Errorf("unexpected retry after: %d", s)
+	}
+
+	if d := c.DurationUntilAllowed(ctx, "clientA"); d < 55*time.Second {
+		t.Errorf("unexpected duration until allowed: %v", d)
+	}
+
+	if cfg := c.Config(); cfg.Windows != "3/1m0s" {
+		t.Errorf("unexpected windows of the configuration: %s", cfg.Windows)
+	}
+}
+
+func Test_clusterLimitRedis_AllowIdempotent(t *testing.T) {
+	redisPort := "16404"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: time.Minute,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	ctx := context.Background()
+	for i, ti := range []struct {
+		token    string
+		expected AllowResult
+	}{
+		{"retry-1", AllowResult{Allowed: true, Limit: 2, Remaining: 1, Count: 1}},
+		{"retry-1", AllowResult{Allowed: true, Limit: 2, Remaining: 1, Count: 1}},
+		{"retry-2", AllowResult{Allowed: true, Limit: 2, Remaining: 0, Count: 2}},
+		{"retry-3", AllowResult{Allowed: false, Limit: 2}},
+		{"retry-1", AllowResult{Allowed: true, Limit: 2, Remaining: 0, Count: 2}},
+		{"retry-3", AllowResult{Allowed: false, Limit: 2}},
+	} {
+		if result := c.AllowIdempotentContext(ctx, "clientA", ti.token); result != ti.expected {
+			t.Errorf("unexpected result of request %d: %+v", i+1, result)
+		}
+	}
+
+	if n, err := r.ring.ZCard(ctx, c.prefixKey(getHashedKey("clientA"))).Result(); err != nil || n != 2 {
+		t.Errorf("unexpected number of hits: %d, %v", n, err)
+	}
+
+	// calls without token are counted every time
+	if result := c.AllowIdempotentContext(ctx, "clientB", ""); !result.Allowed || result.Count != 1 {
+		t.Errorf("unexpected result without token: %+v", result)
+	}
+
+	if result := c.AllowIdempotentContext(ctx, "clientB", ""); !result.Allowed || result.Count != 2 {
+		t.Errorf("unexpected result of the second call without token: %+v", result)
+	}
+}
+
+// countingHook counts the redis commands.
+type countingHook struct {
+	n int64
+}
+
+func (h *countingHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.n, 1)
+	return ctx, nil
+}
+
+func (*countingHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *countingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.n, int64(len(cmds)))
+	return ctx, nil
+}
+
+func (*countingHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func Test_clusterLimitRedis_RetryAfterCache(t *testing.T) {
+	redisPort := "16405"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	settings := Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    2,
+		TimeWindow: 10 * time.Second,
+		Group:      "A",
+	}
+
+	r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}, RetryAfterCacheTTL: time.Minute})
+	defer r.Close()
+	c := newClusterRateLimiterRedis(settings, r, settings.Group)
+
+	h := &countingHook{}
+	c.ring.AddHook(h)
+
+	if ra := c.RetryAfter("clientA"); ra != 1 {
+		t.Errorf("unexpected retry after without hits: %d", ra)
+	}
+
+	// the hits of the same instance invalidate the cached key
+	c.Allow("clientA")
+	c.Allow("clientA")
+	if ra := c.RetryAfter("clientA"); ra != 10 {
+		t.Errorf("unexpected retry after over the limit: %d", ra)
+	}
+
+	n := atomic.LoadInt64(&h.n)
+	if ra := c.RetryAfter("clientA"); ra != 10 {
+		t.Errorf("unexpected cached retry after: %d", ra)
+	}
+
+	if m := atomic.LoadInt64(&h.n); m != n {
+		t.Errorf("unexpected redis commands of a cached retry after: %d", m-n)
+	}
+}
+
+// BenchmarkRetryAfterDenialStorm measures the redis commands of a
+// client over the limit, that retries with every denied request.
+func BenchmarkRetryAfterDenialStorm(b *testing.B) {
+	redisPort := "16406"
+
+	cancel := startRedis(redisPort)
+	defer cancel()
+
+	for _, ttl := range []time.Duration{0, 200 * time.Millisecond} {
+		b.Run(fmt.Sprintf("cache ttl %s", ttl), func(b *testing.B) {
+			settings := Settings{
+				Type:       ClusterClientRatelimit,
+				MaxHits:    10,
+				TimeWindow: time.Minute,
+				Group:      fmt.Sprintf("storm%d", ttl),
+			}
+
+			r := newRing(&RedisOptions{Addrs: []string{"127.0.0.1:" + redisPort}, RetryAfterCacheTTL: ttl})
+			defer r.Close()
+			c := newClusterRateLimiterRedis(settings, r, settings.Group)
+			for i := 0; i < settings.MaxHits; i++ {
+				c.Allow("clientA")
+			}
+
+			h := &countingHook{}
+			c.ring.AddHook(h)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !c.Allow("clientA") {
+					c.RetryAfter("clientA")
+				}
+			}
+
+			b.ReportMetric(float64(atomic.LoadInt64(&h.n))/float64(b.N), "redis-cmds/op")
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
 	"github.com/zalando/skipper/net"
 )
@@ -20,12 +21,16 @@ const (
 // ratelimiters.
 type Registry struct {
 	sync.Mutex
-	defaults  Settings
-	global    Settings
-	lookup    map[Settings]*Ratelimit
-	swarm     Swarmer
-	redisRing *ring
-	quit      chan<- struct{}
+	defaults   Settings
+	global     Settings
+	lookup     map[Settings]*Ratelimit
+	groups     map[string]Settings
+	parents    map[string]Settings
+	swarm      Swarmer
+	redisRings *ringSet
+	inMemory   bool
+
+	concurrency map[concurrencyKey]*ConcurrencyLimit
 }
 
 // NewRegistry initializes a registry with the provided default settings.
@@ -44,15 +49,16 @@ func NewSwarmRegistry(swarm Swarmer, ro *RedisOptions, settings ...Settings) *Re
 		CleanInterval: DefaultCleanInterval,
 	}
 
-	q := make(chan struct{})
-
 	r := &Registry{
-		defaults:  defaults,
-		global:    defaults,
-		lookup:    make(map[Settings]*Ratelimit),
-		swarm:     swarm,
-		redisRing: newRing(ro, q),
-		quit:      q,
+		defaults:   defaults,
+		global:     defaults,
+		lookup:     make(map[Settings]*Ratelimit),
+		groups:     make(map[string]Settings),
+		parents:    make(map[string]Settings),
+		swarm:      swarm,
+		redisRings: newRingSet(ro),
+
+		concurrency: make(map[concurrencyKey]*ConcurrencyLimit),
 	}
 
 	if len(settings) > 0 {
@@ -62,24 +68,110 @@ func NewSwarmRegistry(swarm Swarmer, ro *RedisOptions, settings ...Settings) *Re
 	return r
 }
 
+// NewRedisRingRegistry initializes a registry with the provided
+// default settings, that uses an existing redis ring for the cluster
+// ratelimits, e.g. to share the connection pool with other clients of
+// the same redis. The redis ring is owned by the caller, and it is not
+// closed by Close. The optional RedisOptions are used only for the
+// ratelimit related fields, like Tracer or ZAddRetries, the connection
+// fields, Rings and GroupRings are ignored. The connection metrics are
+// updated only when ConnMetricsInterval is set.
+func NewRedisRingRegistry(client *redis.Ring, ro *RedisOptions, settings ...Settings) *Registry {
+	r := NewRegistry(settings...)
+	r.redisRings = newExternalRingSet(client, ro)
+	return r
+}
+
+// NewInMemoryRegistry initializes a registry with the provided default
+// settings, that calculates the cluster ratelimits in the memory of
+// the instance. It can be used by single instance deployments without
+// a swarm or redis, and the routes don't need to change their cluster
+// ratelimit filters.
+func NewInMemoryRegistry(settings ...Settings) *Registry {
+	r := NewRegistry(settings...)
+	r.inMemory = true
+	return r
+}
+
 // Close teardown Registry and dependent resources
 func (r *Registry) Close() {
-	close(r.quit)
+	if err := r.redisRings.Close(); err != nil {
+		log.Errorf("Failed to close redis ring: %v", err)
+	}
 }
 
 func (r *Registry) get(s Settings) *Ratelimit {
 	r.Lock()
 	defer r.Unlock()
 
+	if r.inMemory && (s.Type == ClusterServiceRatelimit || s.Type == ClusterClientRatelimit) {
+		s.InMemory = true
+	}
+
 	rl, ok := r.lookup[s]
 	if !ok {
-		rl = newRatelimit(s, r.swarm, r.redisRing)
+		r.checkGroup(s)
+		rl = newRatelimit(s, r.swarm, r.redisRings.get(s.Group))
+		if s.Parent != "" && (s.Type == ClusterServiceRatelimit || s.Type == ClusterClientRatelimit) {
+			rl.impl = newClusterLimitHierarchical(r.checkParent(s), rl.impl, r.redisRings.get(s.Parent))
+		} else if s.Windows != "" && (s.Type == ClusterServiceRatelimit || s.Type == ClusterClientRatelimit) {
+			rl.impl = newClusterLimitMultiWindow(s, rl.impl, r.redisRings.get(s.Group))
+		}
 		r.lookup[s] = rl
 	}
 
 	return rl
 }
 
+// checkGroup warns about cluster ratelimits of the same group created
+// with different settings. They share the same counters, so the
+// ratelimits are applied inconsistently, depending on which route
+// matched. It returns false in case of a mismatch.
+func (r *Registry) checkGroup(s Settings) bool {
+	if s.Group == "" || (s.Type != ClusterServiceRatelimit && s.Type != ClusterClientRatelimit) {
+		return true
+	}
+
+	known, ok := r.groups[s.Group]
+	if !ok {
+		r.groups[s.Group] = s
+		return true
+	}
+
+	if known.MaxHits != s.MaxHits || known.TimeWindow != s.TimeWindow {
+		log.Warnf(
+			"Cluster ratelimit group %s is used with different settings: %d/%s and %d/%s, the group shares the counters of both.",
+			s.Group, known.MaxHits, known.TimeWindow, s.MaxHits, s.TimeWindow,
+		)
+		return false
+	}
+
+	return true
+}
+
+// checkParent warns about hierarchical cluster ratelimits of the same
+// parent created with different parent budgets. The groups share the
+// counters of the parent, so it returns the settings with the parent
+// budget of the first group of the parent, to apply the same budget to
+// all the groups.
+func (r *Registry) checkParent(s Settings) Settings {
+	known, ok := r.parents[s.Parent]
+	if !ok {
+		r.parents[s.Parent] = s
+		return s
+	}
+
+	if known.ParentMaxHits != s.ParentMaxHits || known.TimeWindow != s.TimeWindow {
+		log.Warnf(
+			"Cluster ratelimit parent %s is used with different budgets: %d/%s of group %s and %d/%s of group %s, using the first one.",
+			s.Parent, known.ParentMaxHits, known.TimeWindow, known.Group, s.ParentMaxHits, s.TimeWindow, s.Group,
+		)
+	}
+
+	s.ParentMaxHits, s.TimeWindow = known.ParentMaxHits, known.TimeWindow
+	return s
+}
+
 // Get returns a Ratelimit instance for provided Settings
 func (r *Registry) Get(s Settings) *Ratelimit {
 	if s.Type == DisableRatelimit || s.Type == NoRatelimit {
@@ -88,6 +180,24 @@ func (r *Registry) Get(s Settings) *Ratelimit {
 	return r.get(s)
 }
 
+// ConcurrencyLimit returns the cluster concurrency limit of the group,
+// that allows max requests in flight per key, and drops the slots not
+// released after the ttl. It returns nil, when the registry has no
+// redis.
+func (r *Registry) ConcurrencyLimit(group string, max int, ttl time.Duration) *ConcurrencyLimit {
+	r.Lock()
+	defer r.Unlock()
+
+	k := concurrencyKey{group: group, max: max, ttl: ttl}
+	c, ok := r.concurrency[k]
+	if !ok {
+		c = newConcurrencyLimit(group, max, ttl, r.redisRings.get(group))
+		r.concurrency[k] = c
+	}
+
+	return c
+}
+
 // Check returns Settings used and the retry-after duration in case of
 // request is ratelimitted. Otherwise return the Settings and 0. It is
 // only used in the global ratelimit facility.
@@ -100,14 +210,18 @@ func (r *Registry) Check(req *http.Request) (Settings, int) {
 
 	rlimit := r.Get(s)
 
+	// the request context carries the tracing span of the proxy, and
+	// memoizes the hashed key for the calls of the request
+	ctx := WithHashedKeyMemo(req.Context())
+
 	switch s.Type {
 	case ClusterServiceRatelimit:
 		fallthrough
 	case ServiceRatelimit:
-		if rlimit.Allow("") {
+		if rlimit.AllowContext(ctx, "") {
 			return s, 0
 		}
-		return s, rlimit.RetryAfter("")
+		return s, rlimit.RetryAfterContext(ctx, "")
 
 	case LocalRatelimit:
 		log.Warning("LocalRatelimit is deprecated, please use ClientRatelimit instead")
@@ -116,8 +230,8 @@ func (r *Registry) Check(req *http.Request) (Settings, int) {
 		fallthrough
 	case ClientRatelimit:
 		ip := net.RemoteHost(req)
-		if !rlimit.Allow(ip.String()) {
-			return s, rlimit.RetryAfter(ip.String())
+		if !rlimit.AllowContext(ctx, ip.String()) {
+			return s, rlimit.RetryAfterContext(ctx, ip.String())
 		}
 	}
 
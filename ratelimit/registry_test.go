@@ -1,8 +1,16 @@
 package ratelimit
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/zalando/skipper/metrics"
+	"github.com/zalando/skipper/metrics/metricstest"
 )
 
 // no checks, used for race detector
@@ -42,3 +50,310 @@ func TestRegistry(t *testing.T) {
 		checkNotNil(t, rl)
 	})
 }
+
+func TestRegistryCheckGroup(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+
+	s := Settings{
+		Type:       ClusterServiceRatelimit,
+		Group:      "g",
+		MaxHits:    10,
+		TimeWindow: time.Second,
+	}
+
+	if !r.checkGroup(s) {
+		t.Error("unexpected mismatch for the first settings of a group")
+	}
+
+	same := s
+	same.Type = ClusterClientRatelimit
+	if !r.checkGroup(same) {
+		t.Error("unexpected mismatch for the same limits")
+	}
+
+	other := s
+	other.MaxHits = 20
+	if r.checkGroup(other) {
+		t.Error("failed to detect different max hits")
+	}
+
+	other = s
+	other.TimeWindow = time.Minute
+	if r.checkGroup(other) {
+		t.Error("failed to detect different time window")
+	}
+
+	other = s
+	other.Group = "other"
+	other.MaxHits = 20
+	if !r.checkGroup(other) {
+		t.Error("unexpected mismatch for a different group")
+	}
+
+	local := s
+	local.Type = ServiceRatelimit
+	local.MaxHits = 20
+	if !r.checkGroup(local) {
+		t.Error("unexpected mismatch for a local ratelimit")
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	defer func(m metrics.Metrics) { metrics.Default = m }(metrics.Default)
+	m := &metricstest.MockMetrics{}
+	metrics.Default = m
+
+	r := NewSwarmRegistry(nil, &RedisOptions{
+		Addrs:               []string{"127.0.0.1:0"},
+		ConnMetricsInterval: time.Hour,
+	})
+
+	r.Close()
+
+	select {
+	case <-r.redisRings.rings[0].done:
+	default:
+		t.Fatal("connection metrics goroutine was not stopped")
+	}
+
+	m.WithGauges(func(g map[string]float64) {
+		if _, ok := g["swarm.redis.totalconns"]; !ok {
+			t.Error("connection metrics were not updated on close")
+		}
+	})
+
+	// closing again is safe
+	r.Close()
+}
+
+func TestRingSet(t *testing.T) {
+	rs := newRingSet(&RedisOptions{
+		Addrs:      []string{"127.0.0.1:0"},
+		Rings:      [][]string{{"127.0.0.1:1"}, {"127.0.0.1:2", "127.0.0.1:3"}},
+		GroupRings: map[string]int{"large-tenant": 2, "invalid": 3},
+	})
+	defer rs.Close()
+
+	if len(rs.rings) != 3 {
+		t.Fatalf("unexpected number of rings: %d", len(rs.rings))
+	}
+
+	if rs.rings[2].metricsPrefix != "swarm.redis.ring2." {
+		t.Errorf("unexpected metrics prefix: %s", rs.rings[2].metricsPrefix)
+	}
+
+	if rs.get("large-tenant") != rs.rings[2] {
+		t.Error("assigned group is not mapped to its ring")
+	}
+
+	if _, ok := rs.groups["invalid"]; ok {
+		t.Error("invalid ring assignment was accepted")
+	}
+
+	used := make(map[*ring]bool)
+	for i := 0; i < 100; i++ {
+		group := fmt.Sprintf("group%d", i)
+		r := rs.get(group)
+		if rs.get(group) != r {
+			t.Fatalf("ring selection is not stable for %s", group)
+		}
+
+		used[r] = true
+	}
+
+	if len(used) != len(rs.rings) {
+		t.Errorf("groups are not distributed across all rings: %d", len(used))
+	}
+
+	var nilSet *ringSet
+	if nilSet.get("group") != nil {
+		t.Error("unexpected ring without redis options")
+	}
+}
+
+func TestRedisRingRegistry(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := NewRedisRingRegistry(client, &RedisOptions{ZAddRetries: 3})
+
+	rl := r.Get(Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Second,
+		Group:      "shared",
+	})
+
+	c, ok := rl.impl.(*clusterLimitRedis)
+	if !ok {
+		t.Fatalf("unexpected limiter: %T", rl.impl)
+	}
+
+	if c.ring != client || c.zaddRetries != 3 {
+		t.Error("redis ring or options of the caller not used")
+	}
+
+	r.Close()
+
+	select {
+	case <-r.redisRings.rings[0].done:
+	default:
+		t.Fatal("connection metrics goroutine was started")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("redis ring of the caller was closed by the registry: %v", err)
+	}
+}
+
+func TestRegistryConcurrencyLimit(t *testing.T) {
+	if c := NewRegistry().ConcurrencyLimit("groupA", 3, time.Minute); c != nil {
+		t.Error("concurrency limit created without redis")
+	}
+
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := NewRedisRingRegistry(client, nil)
+	defer r.Close()
+
+	c := r.ConcurrencyLimit("groupA", 3, time.Minute)
+	if c == nil || c.ring != client {
+		t.Fatal("failed to create the concurrency limit of the redis ring")
+	}
+
+	if r.ConcurrencyLimit("groupA", 3, time.Minute) != c {
+		t.Error("concurrency limit of the same settings not reused")
+	}
+
+	if r.ConcurrencyLimit("groupA", 3, 0).ttl != DefaultConcurrencyTTL {
+		t.Error("default ttl not applied")
+	}
+}
+
+func TestRegistryExpireMargin(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := NewRedisRingRegistry(client, nil)
+	defer r.Close()
+
+	for _, ti := range []struct {
+		margin   time.Duration
+		expected time.Duration
+	}{
+		{expected: expireMargin},
+		{margin: 20 * time.Millisecond, expected: 20 * time.Millisecond},
+		{margin: time.Second, expected: time.Second},
+	} {
+		rl := r.Get(Settings{
+			Type:         ClusterClientRatelimit,
+			MaxHits:      10,
+			TimeWindow:   200 * time.Millisecond,
+			Group:        "margin",
+			ExpireMargin: ti.margin,
+		})
+
+		if c := rl.impl.(*clusterLimitRedis); c.expireMargin != ti.expected {
+			t.Errorf("unexpected expire margin: %v != %v", c.expireMargin, ti.expected)
+		}
+	}
+}
+
+func TestRegistryParentBudget(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := NewRedisRingRegistry(client, nil)
+	defer r.Close()
+
+	get := func(group string, parentMaxHits int, window time.Duration) *clusterLimitHierarchical {
+		return r.Get(Settings{
+			Type:          ClusterServiceRatelimit,
+			MaxHits:       10,
+			TimeWindow:    window,
+			Group:         group,
+			Parent:        "api",
+			ParentMaxHits: parentMaxHits,
+		}).impl.(*clusterLimitHierarchical)
+	}
+
+	a := get("groupA", 100, time.Minute)
+	b := get("groupB", 50, time.Second)
+	for _, c := range []*clusterLimitHierarchical{a, b} {
+		if c.parent.maxHits != 100 || c.parent.window != time.Minute {
+			t.Errorf("unexpected parent budget of group %s: %d/%s", c.group, c.parent.maxHits, c.parent.window)
+		}
+	}
+
+	if b.window != time.Second {
+		t.Errorf("unexpected time window of the group: %s", b.window)
+	}
+}
+
+func TestRegistryConfigHandler(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	r := NewRedisRingRegistry(client, nil)
+	defer r.Close()
+
+	r.Get(Settings{
+		Type:       ClusterClientRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+		Group:      "config",
+	})
+
+	r.Get(Settings{
+		Type:       LocalRatelimit,
+		MaxHits:    10,
+		TimeWindow: time.Minute,
+	})
+
+	c, err := r.GroupConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Group != "config" || c.MaxHits != 10 || c.TimeWindow != time.Minute || c.ExpireMargin != expireMargin {
+		t.Errorf("unexpected config: %+v", c)
+	}
+
+	if c.Backend != RedisBackendRing || len(c.Shards) != 1 || c.Shards[0] != "127.0.0.1:0" {
+		t.Errorf("unexpected backend: %s %v", c.Backend, c.Shards)
+	}
+
+	if _, err := r.GroupConfig("unknown"); err == nil {
+		t.Error("failed to fail for an unknown group")
+	}
+
+	h := r.ConfigHandler()
+	for _, ti := range []struct {
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{{
+		query:          "?group=config",
+		expectedStatus: http.StatusOK,
+		expectedBody:   `"timeWindow":"1m0s"`,
+	}, {
+		query:          "",
+		expectedStatus: http.StatusOK,
+		expectedBody:   `[{"group":"config"`,
+	}, {
+		query:          "?group=unknown",
+		expectedStatus: http.StatusNotFound,
+	}} {
+		rsp := httptest.NewRecorder()
+		h.ServeHTTP(rsp, httptest.NewRequest("GET", "/ratelimit/config"+ti.query, nil))
+		if rsp.Code != ti.expectedStatus {
+			t.Errorf("unexpected status for %q: %d != %d", ti.query, rsp.Code, ti.expectedStatus)
+		}
+
+		if !strings.Contains(rsp.Body.String(), ti.expectedBody) {
+			t.Errorf("unexpected body for %q: %s", ti.query, rsp.Body.String())
+		}
+	}
+}
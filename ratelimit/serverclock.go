@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	serverClockRefreshInterval = 10 * time.Second
+	serverClockTimeout         = time.Second
+)
+
+// serverClock corrects the local time of the cluster ratelimits with
+// the offset to the clock of the redis shards, so the instances agree
+// on the scores of the hits and the boundaries of the time windows,
+// even when their local clocks are skewed. The offset is measured with
+// the TIME command, and the clock of the slowest shard is used, so all
+// the instances of a ring choose the same shard. The offset is
+// refreshed in the background, when it is older than the refresh
+// interval, so the lookup never waits for redis. When the time can't
+// be fetched, the last offset is kept.
+type serverClock struct {
+	ring     *redis.Ring
+	interval time.Duration
+	local    func() time.Time
+	once     sync.Once
+
+	mu         sync.Mutex
+	offset     time.Duration
+	updated    time.Time
+	refreshing bool
+}
+
+func newServerClock(r *redis.Ring, interval time.Duration) *serverClock {
+	return &serverClock{
+		ring:     r,
+		interval: interval,
+		local:    time.Now,
+	}
+}
+
+// start fetches the offset once synchronously, so the first calls
+// don't use the uncorrected local time.
+func (c *serverClock) start() {
+	if c == nil {
+		return
+	}
+
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.refreshing = true
+		c.mu.Unlock()
+		c.refresh()
+	})
+}
+
+// adjust corrects the local time t with the offset to the server
+// clock. It returns t, when the server clock is not configured.
+func (c *serverClock) adjust(t time.Time) time.Time {
+	if c == nil {
+		return t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.refreshing && c.local().Sub(c.updated) >= c.interval {
+		c.refreshing = true
+		go c.refresh()
+	}
+
+	return t.Add(c.offset)
+}
+
+// clockOffset returns the offset of the server time to the local
+// time, assuming that the server measured the time in the middle of
+// the roundtrip.
+func clockOffset(server, before, after time.Time) time.Duration {
+	return server.Sub(before.Add(after.Sub(before) / 2))
+}
+
+// refresh measures the offset to the clock of the slowest shard.
+func (c *serverClock) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), serverClockTimeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		offset time.Duration
+		found  bool
+	)
+
+	err := c.ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		before := c.local()
+		t, err := client.Time(ctx).Result()
+		if err != nil {
+			return err
+		}
+
+		o := clockOffset(t, before, c.local())
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !found || o < offset {
+			offset = o
+			found = true
+		}
+
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refreshing = false
+	c.updated = c.local()
+	if err != nil || !found {
+		log.Errorf("Failed to get the time of the redis shards, keeping the clock offset %v: %v", c.offset, err)
+		return
+	}
+
+	c.offset = offset
+}
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestClockOffset(t *testing.T) {
+	before := time.Unix(100, 0)
+	after := before.Add(20 * time.Millisecond)
+
+	// the local clock is an hour behind the server
+	server := before.Add(time.Hour + 10*time.Millisecond)
+	if o := clockOffset(server, before, after); o != time.Hour {
+		t.Errorf("unexpected clock offset: %v", o)
+	}
+}
+
+func TestServerClockFailure(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"redis0": "127.0.0.1:0"}})
+	defer client.Close()
+
+	c := newServerClock(client, time.Hour)
+	c.offset = time.Second
+
+	// the last offset is kept, when the time can't be fetched
+	c.start()
+	now := time.Now()
+	if adjusted := c.adjust(now); !adjusted.Equal(now.Add(time.Second)) {
+		t.Errorf("failed to keep the offset: %v", adjusted.Sub(now))
+	}
+
+	var nilClock *serverClock
+	if adjusted := nilClock.adjust(now); !adjusted.Equal(now) {
+		t.Error("unexpected adjustment without server clock")
+	}
+}
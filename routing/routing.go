@@ -239,6 +239,17 @@ type Route struct {
 	LBFadeInExponent float64
 }
 
+// PathTemplate returns the path pattern of the Path or the PathSubtree
+// predicate of the route, e.g. /users/:id, or an empty string, when the
+// route has neither.
+func (r *Route) PathTemplate() string {
+	if r.path != "" {
+		return r.path
+	}
+
+	return r.pathSubtree
+}
+
 // PostProcessor is an interface for custom post-processors applying changes
 // to the routes after they were created from their data representation and
 // before they were passed to the proxy.
@@ -13,9 +13,11 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	ot "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -524,6 +526,51 @@ type Options struct {
 	// RatelimitSettings contain global and host specific settings for the ratelimiters.
 	RatelimitSettings []ratelimit.Settings
 
+	// InMemoryClusterRatelimits calculates the cluster ratelimits in
+	// the memory of the instance instead of the swarm, for single
+	// instance deployments.
+	InMemoryClusterRatelimits bool
+
+	// RatelimitCostHeader is the header, that declares the cost of a
+	// request, counted as hits by the cluster ratelimits. It is
+	// disabled, when empty.
+	RatelimitCostHeader string
+
+	// RatelimitMaxCost clamps the cost declared by
+	// RatelimitCostHeader.
+	RatelimitMaxCost int
+
+	// RatelimitSoftLimit is the fraction of the max hits of the
+	// cluster ratelimit filters, after which the allowed requests get
+	// the X-RateLimit-Warning response header. It is disabled, when 0.
+	RatelimitSoftLimit float64
+
+	// RatelimitRetryAfterDate sets the Retry-After header of the
+	// responses ratelimited by the ratelimit filters as HTTP-date,
+	// instead of delta-seconds.
+	RatelimitRetryAfterDate bool
+
+	// RatelimitNormalizeKeys lowercases the keys of the ratelimit
+	// filters, and strips the surrounding whitespace and a trailing
+	// dot, before they are hashed.
+	RatelimitNormalizeKeys bool
+
+	// RatelimitBypassCIDRs are the networks, e.g. of health checkers
+	// and internal services, whose requests are not ratelimited by the
+	// ratelimit filters.
+	RatelimitBypassCIDRs []string
+
+	// RatelimitTrustedProxies is the number of the proxies in front
+	// of skipper, that append to the X-Forwarded-For header. It is
+	// used to find the client address checked against
+	// RatelimitBypassCIDRs.
+	RatelimitTrustedProxies int
+
+	// RatelimitBackendErrorStatus is the status code of the requests
+	// denied by the ratelimit filters, because the cluster ratelimit
+	// failed closed. Defaults to 503 Service Unavailable.
+	RatelimitBackendErrorStatus int
+
 	// EnableRouteLIFOMetrics enables metrics for the individual route LIFO queues, if any.
 	EnableRouteLIFOMetrics bool
 
@@ -621,6 +668,23 @@ type Options struct {
 	// OAuthTokeninfoTimeout sets timeout duration while calling oauth token service
 	OAuthTokeninfoTimeout time.Duration
 
+	// OAuthTokeninfoScopesIgnoreCase enables case-insensitive scope
+	// comparison in the auth.NewOAuthTokeninfo*Scope() filters.
+	OAuthTokeninfoScopesIgnoreCase bool
+
+	// OAuthTokeninfoUserKeys sets the prioritized list of keys in
+	// the tokeninfo response, whose first available value is logged
+	// as the user of the request. Defaults to "uid".
+	OAuthTokeninfoUserKeys []string
+
+	// OAuthTokenDenylistURL sets the URL of the denylist of revoked
+	// tokens, and enables the auth.NewOAuthTokenDenylist() filter.
+	OAuthTokenDenylistURL string
+
+	// OAuthTokenDenylistRefresh sets the refresh interval of the
+	// token denylist.
+	OAuthTokenDenylistRefresh time.Duration
+
 	// OAuth2SecretFile contains the filename with the encryption key for the
 	// authentication cookie and grant flow state stored in Secrets.
 	OAuth2SecretFile string
@@ -648,6 +712,123 @@ type Options struct {
 	// OAuthTokenintrospectionTimeout sets timeout duration while calling oauth tokenintrospection service
 	OAuthTokenintrospectionTimeout time.Duration
 
+	// OAuthBreakerFailures sets the number of consecutive failed
+	// calls to the tokeninfo or tokenintrospection endpoint, that
+	// open the circuit breaker. 0 disables the breaker.
+	OAuthBreakerFailures int
+
+	// OAuthBreakerWindow sets the interval, after which the failure
+	// counts of the closed breaker are cleared.
+	OAuthBreakerWindow time.Duration
+
+	// OAuthBreakerTimeout sets the duration of the open state of the
+	// breaker, before a probe call is allowed. Defaults to 10s.
+	OAuthBreakerTimeout time.Duration
+
+	// OAuthBreakerFailOpen, when set, passes requests without token
+	// validation while the breaker is open, instead of rejecting
+	// them.
+	OAuthBreakerFailOpen bool
+
+	// OAuthMaxInflight limits the concurrent calls to each tokeninfo
+	// or tokenintrospection endpoint. 0 means no limit.
+	OAuthMaxInflight int
+
+	// OAuthInflightMaxWait sets how long a call waits for a free
+	// slot, when OAuthMaxInflight is reached. 0 means the calls fail
+	// fast.
+	OAuthInflightMaxWait time.Duration
+
+	// OAuthInflightFailOpen, when set, passes requests without token
+	// validation, when no slot is available for the call, instead of
+	// rejecting them.
+	OAuthInflightFailOpen bool
+
+	// OAuthJWKSMaxResponseSize limits the size of the JWKS responses,
+	// that are used to validate tokens locally. Defaults to 1MiB.
+	OAuthJWKSMaxResponseSize int
+
+	// OAuthJWKSTimeout sets the timeout of the JWKS fetches. Defaults
+	// to 2s.
+	OAuthJWKSTimeout time.Duration
+
+	// OAuthMaxIdleConns limits the idle connections of the
+	// tokeninfo, tokenintrospection and webhook clients to all hosts.
+	// 0 means no limit.
+	OAuthMaxIdleConns int
+
+	// OAuthIdleConnTimeout sets how long the idle connections to the
+	// auth endpoints are kept open. Defaults to 90s.
+	OAuthIdleConnTimeout time.Duration
+
+	// OAuthDialTimeout sets the timeout of the new connections to the
+	// auth endpoints. Defaults to the timeout of the filters.
+	OAuthDialTimeout time.Duration
+
+	// OAuthTLSHandshakeTimeout sets the timeout of the TLS handshakes
+	// with the auth endpoints. Defaults to the timeout of the filters.
+	OAuthTLSHandshakeTimeout time.Duration
+
+	// OAuthForceHTTP2 attempts to use HTTP/2 for the TLS connections
+	// to the auth endpoints.
+	OAuthForceHTTP2 bool
+
+	// OAuthTokenintrospectionActiveField is the field of the
+	// tokenintrospection response, that tells whether the token is
+	// active. Defaults to "active".
+	OAuthTokenintrospectionActiveField string
+
+	// OAuthTokenintrospectionActiveValues are the values of the
+	// active field, that mark the token active. By default, the
+	// field has to be the boolean true.
+	OAuthTokenintrospectionActiveValues []string
+
+	// OAuthTokenintrospectionTokenStyle defines how the token is sent
+	// to the tokenintrospection endpoint, body or query. Defaults to
+	// body.
+	OAuthTokenintrospectionTokenStyle string
+
+	// OAuthTokenintrospectionCredentialStyle defines how the secure
+	// tokenintrospection filters send the client credentials,
+	// client_secret_basic or client_secret_post. Defaults to
+	// client_secret_basic.
+	OAuthTokenintrospectionCredentialStyle string
+
+	// OAuthTokenintrospectionNegativeCacheTTL enables caching the
+	// tokens, that the tokenintrospection endpoint reported
+	// inactive, for a short time. Disabled by default.
+	OAuthTokenintrospectionNegativeCacheTTL time.Duration
+
+	// OAuthTokenintrospectionClientSecretFile is the path to the file
+	// containing the client secret of the secure tokenintrospection
+	// filters, that don't set the secret. The file is reloaded every
+	// CredentialsUpdateInterval, to pick up rotated secrets.
+	OAuthTokenintrospectionClientSecretFile string
+
+	// OAuthTokenintrospectionClaimsPath is the dot separated path of
+	// the object in the tokenintrospection response, that contains
+	// the claims. Defaults to the top-level of the response.
+	OAuthTokenintrospectionClaimsPath string
+
+	// OAuthTokenintrospectionFreshnessSampleRate is the fraction of
+	// the requests with tokens, that the hybrid tokenintrospection
+	// filters validated locally, that are re-validated against the
+	// tokenintrospection endpoint, to reject revoked tokens before
+	// they expire. Disabled by default.
+	OAuthTokenintrospectionFreshnessSampleRate float64
+
+	// OAuthTokenintrospectionFreshnessInterval re-validates each
+	// locally validated token against the tokenintrospection
+	// endpoint at most this long after its last validation. Disabled
+	// by default.
+	OAuthTokenintrospectionFreshnessInterval time.Duration
+
+	// OAuthDPoPTrustForwardedProto makes the oauthDPoP filter take the
+	// scheme of the request URL, that the DPoP proofs are bound to,
+	// from the X-Forwarded-Proto header. Enable it only, when skipper
+	// runs behind proxies, that set the header.
+	OAuthDPoPTrustForwardedProto bool
+
 	// OAuth2AuthURLParameters the additional parameters to send to OAuth2 authorize and token endpoints.
 	OAuth2AuthURLParameters map[string]string
 
@@ -689,9 +870,27 @@ type Options struct {
 	// WebhookTimeout sets timeout duration while calling a custom webhook auth service
 	WebhookTimeout time.Duration
 
+	// OAuthPolicyTimeout sets the timeout of the calls of the
+	// oauthPolicy filter to the policy service. Defaults to 2s.
+	OAuthPolicyTimeout time.Duration
+
+	// OAuthPolicyCacheTTL sets how long the decisions of the policy
+	// service are cached per subject, resource and action. Defaults
+	// to 10s, a negative value disables the cache.
+	OAuthPolicyCacheTTL time.Duration
+
+	// OAuthPolicyFailOpen, when set, passes requests, when the policy
+	// service fails, instead of rejecting them.
+	OAuthPolicyFailOpen bool
+
 	// MaxAuditBody sets the maximum read size of the body read by the audit log filter
 	MaxAuditBody int
 
+	// AuditLogClaimValues enables logging the values of the claims
+	// checked by the auth filters in the audit log. By default only
+	// the claim keys are logged.
+	AuditLogClaimValues bool
+
 	// EnableSwarm enables skipper fleet communication, required by e.g.
 	// the cluster ratelimiter
 	EnableSwarm bool
@@ -702,6 +901,81 @@ type Options struct {
 	SwarmRedisPoolTimeout  time.Duration
 	SwarmRedisMinIdleConns int
 	SwarmRedisMaxIdleConns int
+	// SwarmRedisRings are additional redis rings, the cluster
+	// ratelimit groups are distributed across all rings
+	SwarmRedisRings [][]string
+	// SwarmRedisAddrTimeouts overrides the read and write timeouts
+	// of the redis shards by address
+	SwarmRedisAddrTimeouts map[string]ratelimit.RedisTimeouts
+	// SwarmRedisGroupRings assigns cluster ratelimit groups to
+	// redis rings, 0 is the ring of SwarmRedisURLs
+	SwarmRedisGroupRings map[string]int
+	// SwarmRedisTraceSample is the fraction of the cluster ratelimit
+	// calls, that create tracing spans for the redis queries
+	SwarmRedisTraceSample float64
+	// SwarmRedisTraceByKey samples the cluster ratelimit calls by
+	// the ratelimit key instead of randomly
+	SwarmRedisTraceByKey bool
+	// SwarmRedisSpanPrefix is prepended to the names of the tracing
+	// spans of the redis queries
+	SwarmRedisSpanPrefix string
+	// SwarmRedisSpanNames replaces the names of the tracing spans of
+	// the redis queries
+	SwarmRedisSpanNames map[string]string
+	// SwarmRedisTraceTags are static tags set on the tracing spans
+	// of the redis queries
+	SwarmRedisTraceTags map[string]string
+	// SwarmRedisZAddRetries is the number of retries of a failed
+	// ZADD, that records a hit of a cluster ratelimit
+	SwarmRedisZAddRetries int
+	// SwarmRedisZAddDelay is the delay before a ZADD retry
+	SwarmRedisZAddDelay time.Duration
+	// SwarmRedisTLS enables TLS for the connections to redis
+	SwarmRedisTLS bool
+	// SwarmRedisTLSMinVersion is the minimum TLS version of the
+	// connections to redis, 1.2 or 1.3
+	SwarmRedisTLSMinVersion string
+	// SwarmRedisTLSCipherSuites are the names of the allowed TLS 1.2
+	// cipher suites of the connections to redis
+	SwarmRedisTLSCipherSuites []string
+	// SwarmRedisGroupMetrics enables the allows and forbids counters
+	// of the cluster ratelimits per group
+	SwarmRedisGroupMetrics bool
+	// SwarmRedisBatchWindow enables batching the checks of the
+	// concurrent cluster ratelimit calls into a single redis
+	// pipeline, sent after the window
+	SwarmRedisBatchWindow time.Duration
+	// SwarmRedisBatchSize is the maximum number of checks of a batch
+	SwarmRedisBatchSize int
+	// SwarmRedisRetryAfterCacheTTL enables caching the result of the
+	// Retry-After query of the cluster ratelimits per key for the TTL
+	SwarmRedisRetryAfterCacheTTL time.Duration
+	// SwarmRedisOverridesRefreshInterval enables the per key max hits
+	// overrides of the cluster ratelimits, loaded from redis, and
+	// refreshed after the interval
+	SwarmRedisOverridesRefreshInterval time.Duration
+	// SwarmRedisKillSwitchRefreshInterval enables the kill switches
+	// of the cluster ratelimit groups, loaded from redis, and
+	// refreshed after the interval
+	SwarmRedisKillSwitchRefreshInterval time.Duration
+	// SwarmRedisLimitsFile is the path of a YAML file with the max
+	// hits and time windows of the cluster ratelimit groups, that
+	// replace the limits of the routes, watched for changes
+	SwarmRedisLimitsFile string
+	// SwarmRedisLimitsRefreshInterval enables the max hits and time
+	// windows of the cluster ratelimit groups, loaded from redis,
+	// and refreshed after the interval
+	SwarmRedisLimitsRefreshInterval time.Duration
+	// SwarmRedisUseServerTime makes the cluster ratelimits use the
+	// clock of the redis shards instead of the local clock
+	SwarmRedisUseServerTime bool
+	// SwarmRedisFailClosed makes the cluster ratelimits deny the
+	// requests, when redis fails, instead of allowing them
+	SwarmRedisFailClosed bool
+	// SwarmRedisDrainTimeout is the maximum time to wait for the
+	// in-flight cluster ratelimit calls, before closing the
+	// connections to redis
+	SwarmRedisDrainTimeout time.Duration
 	// swim based swarm
 	SwarmKubernetesNamespace          string
 	SwarmKubernetesLabelSelectorKey   string
@@ -1124,22 +1398,146 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 		tracer, _ = tracing.LoadTracingPlugin(o.PluginDirs, []string{"noop"})
 	}
 
+	authBreaker := auth.BreakerOptions{
+		Failures: o.OAuthBreakerFailures,
+		Window:   o.OAuthBreakerWindow,
+		Timeout:  o.OAuthBreakerTimeout,
+		FailOpen: o.OAuthBreakerFailOpen,
+	}
+
+	authConcurrency := auth.ConcurrencyOptions{
+		MaxInflight: o.OAuthMaxInflight,
+		MaxWait:     o.OAuthInflightMaxWait,
+		FailOpen:    o.OAuthInflightFailOpen,
+	}
+
+	authTransport := auth.TransportOptions{
+		MaxIdleConns:        o.OAuthMaxIdleConns,
+		IdleConnTimeout:     o.OAuthIdleConnTimeout,
+		DialTimeout:         o.OAuthDialTimeout,
+		TLSHandshakeTimeout: o.OAuthTLSHandshakeTimeout,
+		ForceHTTP2:          o.OAuthForceHTTP2,
+	}
+
 	if o.OAuthTokeninfoURL != "" {
 		tio := auth.TokeninfoOptions{
 			URL:          o.OAuthTokeninfoURL,
 			Timeout:      o.OAuthTokeninfoTimeout,
 			MaxIdleConns: o.IdleConnectionsPerHost,
 			Tracer:       tracer,
+
+			ScopesIgnoreCase: o.OAuthTokeninfoScopesIgnoreCase,
+			UserKeys:         o.OAuthTokeninfoUserKeys,
+			Breaker:          authBreaker,
+			Concurrency:      authConcurrency,
+			Transport:        authTransport,
 		}
 
 		o.CustomFilters = append(o.CustomFilters,
 			auth.NewOAuthTokeninfoAllScopeWithOptions(tio),
 			auth.NewOAuthTokeninfoAnyScopeWithOptions(tio),
+			auth.NewOAuthTokeninfoExactScopeWithOptions(tio),
 			auth.NewOAuthTokeninfoAllKVWithOptions(tio),
 			auth.NewOAuthTokeninfoAnyKVWithOptions(tio),
 		)
 	}
 
+	if o.OAuthTokenDenylistURL != "" {
+		denylist := auth.NewOAuthTokenDenylist(auth.DenylistOptions{
+			URL:             o.OAuthTokenDenylistURL,
+			RefreshInterval: o.OAuthTokenDenylistRefresh,
+			Timeout:         o.OAuthTokeninfoTimeout,
+		})
+		defer denylist.Close()
+
+		o.CustomFilters = append(o.CustomFilters, denylist)
+	}
+
+	var redisOptions *ratelimit.RedisOptions
+	if len(o.SwarmRedisURLs) > 0 {
+		redisOptions = &ratelimit.RedisOptions{
+			Addrs:               o.SwarmRedisURLs,
+			ReadTimeout:         o.SwarmRedisReadTimeout,
+			WriteTimeout:        o.SwarmRedisWriteTimeout,
+			PoolTimeout:         o.SwarmRedisPoolTimeout,
+			MinIdleConns:        o.SwarmRedisMinIdleConns,
+			MaxIdleConns:        o.SwarmRedisMaxIdleConns,
+			ConnMetricsInterval: o.redisConnMetricsInterval,
+			Tracer:              tracer,
+			Rings:               o.SwarmRedisRings,
+			GroupRings:          o.SwarmRedisGroupRings,
+			AddrTimeouts:        o.SwarmRedisAddrTimeouts,
+			TraceSampleRate:     o.SwarmRedisTraceSample,
+			TraceSampleByKey:    o.SwarmRedisTraceByKey,
+			TraceSpanPrefix:     o.SwarmRedisSpanPrefix,
+			TraceSpanNames:      o.SwarmRedisSpanNames,
+			TraceTags:           o.SwarmRedisTraceTags,
+			ZAddRetries:         o.SwarmRedisZAddRetries,
+			ZAddRetryDelay:      o.SwarmRedisZAddDelay,
+			EnableTLS:           o.SwarmRedisTLS,
+			TLSMinVersion:       o.SwarmRedisTLSMinVersion,
+			TLSCipherSuites:     o.SwarmRedisTLSCipherSuites,
+			GroupMetrics:        o.SwarmRedisGroupMetrics,
+			BatchWindow:         o.SwarmRedisBatchWindow,
+			BatchSize:           o.SwarmRedisBatchSize,
+			RetryAfterCacheTTL:  o.SwarmRedisRetryAfterCacheTTL,
+
+			OverridesRefreshInterval:  o.SwarmRedisOverridesRefreshInterval,
+			KillSwitchRefreshInterval: o.SwarmRedisKillSwitchRefreshInterval,
+			LimitsRefreshInterval:     o.SwarmRedisLimitsRefreshInterval,
+			UseServerTime:             o.SwarmRedisUseServerTime,
+			FailClosed:                o.SwarmRedisFailClosed,
+			DrainTimeout:              o.SwarmRedisDrainTimeout,
+		}
+
+		if _, err := redisOptions.TLSClientConfig(); err != nil {
+			return fmt.Errorf("invalid redis TLS configuration: %w", err)
+		}
+
+		if o.EnableSwarm && o.SwarmRedisLimitsFile != "" {
+			fileLimits := ratelimit.NewFileLimits(o.SwarmRedisLimitsFile, ratelimit.FileLimitsOptions{})
+			defer fileLimits.Close()
+			redisOptions.LimitsProvider = fileLimits
+		}
+	}
+
+	// the auth filters share a redis ring, that is created on first use
+	var authRedisRing func() *redis.Ring
+	if redisOptions != nil {
+		var (
+			once sync.Once
+			ring *redis.Ring
+		)
+		authRedisRing = func() *redis.Ring {
+			once.Do(func() { ring = ratelimit.NewRedisRing(redisOptions) })
+			return ring
+		}
+		defer func() {
+			once.Do(func() {})
+			if ring != nil {
+				ring.Close()
+			}
+		}()
+	}
+
+	tokenIPBinding := auth.NewOAuthTokenIPBinding(auth.TokenIPBindingOptions{RedisRing: authRedisRing})
+	defer tokenIPBinding.Close()
+
+	oidcNonces := auth.NewNonceCache(auth.NonceCacheOptions{RedisRing: authRedisRing})
+	defer oidcNonces.Close()
+	jwksOptions := auth.JWKSOptions{
+		MaxResponseSize: o.OAuthJWKSMaxResponseSize,
+		Timeout:         o.OAuthJWKSTimeout,
+	}
+
+	oidcOptions := auth.OidcOptions{NonceCache: oidcNonces, JWKS: jwksOptions}
+
+	subjectListOptions := auth.SubjectListOptions{RefreshInterval: o.CredentialsUpdateInterval}
+	subjectAllowlist := auth.NewOAuthSubjectAllowlist(subjectListOptions)
+	defer subjectAllowlist.Close()
+	subjectDenylist := auth.NewOAuthSubjectDenylist(subjectListOptions)
+	defer subjectDenylist.Close()
+
 	if o.SecretsRegistry == nil {
 		o.SecretsRegistry = secrets.NewRegistry()
 	}
@@ -1157,16 +1555,41 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 		Timeout:      o.OAuthTokenintrospectionTimeout,
 		MaxIdleConns: o.IdleConnectionsPerHost,
 		Tracer:       tracer,
+		Breaker:      authBreaker,
+		Concurrency:  authConcurrency,
+		Transport:    authTransport,
+		ActiveField:  o.OAuthTokenintrospectionActiveField,
+		ActiveValues: o.OAuthTokenintrospectionActiveValues,
+
+		TokenStyle:      o.OAuthTokenintrospectionTokenStyle,
+		CredentialStyle: o.OAuthTokenintrospectionCredentialStyle,
+
+		NegativeCacheTTL: o.OAuthTokenintrospectionNegativeCacheTTL,
+
+		ClientSecretFile: o.OAuthTokenintrospectionClientSecretFile,
+		SecretsProvider:  sp,
+
+		ClaimsPath: o.OAuthTokenintrospectionClaimsPath,
+		JWKS:       jwksOptions,
+
+		Freshness: auth.FreshnessOptions{
+			SampleRate: o.OAuthTokenintrospectionFreshnessSampleRate,
+			Interval:   o.OAuthTokenintrospectionFreshnessInterval,
+		},
 	}
 
 	who := auth.WebhookOptions{
 		Timeout:      o.WebhookTimeout,
 		MaxIdleConns: o.IdleConnectionsPerHost,
 		Tracer:       tracer,
+		Transport:    authTransport,
 	}
 
 	o.CustomFilters = append(o.CustomFilters,
-		logfilter.NewAuditLog(o.MaxAuditBody),
+		logfilter.NewAuditLogWithOptions(logfilter.AuditLogOptions{
+			MaxAuditBody: o.MaxAuditBody,
+			ClaimValues:  o.AuditLogClaimValues,
+		}),
 		auth.NewBearerInjector(sp),
 		auth.TokenintrospectionWithOptions(auth.NewOAuthTokenintrospectionAnyClaims, tio),
 		auth.TokenintrospectionWithOptions(auth.NewOAuthTokenintrospectionAllClaims, tio),
@@ -1176,11 +1599,37 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 		auth.TokenintrospectionWithOptions(auth.NewSecureOAuthTokenintrospectionAllClaims, tio),
 		auth.TokenintrospectionWithOptions(auth.NewSecureOAuthTokenintrospectionAnyKV, tio),
 		auth.TokenintrospectionWithOptions(auth.NewSecureOAuthTokenintrospectionAllKV, tio),
+		auth.TokenintrospectionWithOptions(auth.NewOAuthTokenintrospectionHybrid, tio),
+		auth.TokenintrospectionWithOptions(auth.NewSecureOAuthTokenintrospectionHybrid, tio),
 		auth.WebhookWithOptions(who),
-		auth.NewOAuthOidcUserInfos(o.OIDCSecretsFile, o.SecretsRegistry),
-		auth.NewOAuthOidcAnyClaims(o.OIDCSecretsFile, o.SecretsRegistry),
-		auth.NewOAuthOidcAllClaims(o.OIDCSecretsFile, o.SecretsRegistry),
+		auth.NewOAuthPolicy(auth.PolicyOptions{
+			Timeout:      o.OAuthPolicyTimeout,
+			MaxIdleConns: o.IdleConnectionsPerHost,
+			Tracer:       tracer,
+			CacheTTL:     o.OAuthPolicyCacheTTL,
+			FailOpen:     o.OAuthPolicyFailOpen,
+			Transport:    authTransport,
+		}),
+		auth.NewOAuthOidcUserInfosWithOptions(o.OIDCSecretsFile, o.SecretsRegistry, oidcOptions),
+		auth.NewOAuthOidcAnyClaimsWithOptions(o.OIDCSecretsFile, o.SecretsRegistry, oidcOptions),
+		auth.NewOAuthOidcAllClaimsWithOptions(o.OIDCSecretsFile, o.SecretsRegistry, oidcOptions),
 		auth.NewOIDCQueryClaimsFilter(),
+		auth.NewOAuthDPoPWithOptions(auth.DPoPOptions{TrustForwardedProto: o.OAuthDPoPTrustForwardedProto}),
+		tokenIPBinding,
+		auth.NewOAuthMaxTokenAge(),
+		auth.NewOAuthMaxTokenLifetime(),
+		auth.NewOAuthUserSpanTag(),
+		auth.NewOAuthTokenType(),
+		auth.NewOAuthAudience(),
+		auth.NewOAuthCertBinding(),
+		auth.NewOAuthClaimsTransform(),
+		auth.NewOAuthGrpcStatus(),
+		auth.NewOAuthReplaceAuthorization(),
+		auth.NewOAuthBypass(),
+		auth.NewOAuthProblemResponse(),
+		auth.NewOAuthDenyStatus(),
+		subjectAllowlist,
+		subjectDenylist,
 		apiusagemonitoring.NewApiUsageMonitoring(
 			o.ApiUsageMonitoringEnable,
 			o.ApiUsageMonitoringRealmKeys,
@@ -1190,20 +1639,11 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 	)
 
 	var swarmer ratelimit.Swarmer
-	var redisOptions *ratelimit.RedisOptions
+	var swarmRedisOptions *ratelimit.RedisOptions
 	if o.EnableSwarm {
-		if len(o.SwarmRedisURLs) > 0 {
+		if redisOptions != nil {
 			log.Infof("Redis based swarm with %d shards", len(o.SwarmRedisURLs))
-			redisOptions = &ratelimit.RedisOptions{
-				Addrs:               o.SwarmRedisURLs,
-				ReadTimeout:         o.SwarmRedisReadTimeout,
-				WriteTimeout:        o.SwarmRedisWriteTimeout,
-				PoolTimeout:         o.SwarmRedisPoolTimeout,
-				MinIdleConns:        o.SwarmRedisMinIdleConns,
-				MaxIdleConns:        o.SwarmRedisMaxIdleConns,
-				ConnMetricsInterval: o.redisConnMetricsInterval,
-				Tracer:              tracer,
-			}
+			swarmRedisOptions = redisOptions
 		} else {
 			log.Infof("Start swim based swarm")
 			swops := &swarm.Options{
@@ -1253,17 +1693,41 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 	var ratelimitRegistry *ratelimit.Registry
 	if o.EnableRatelimiters || len(o.RatelimitSettings) > 0 {
 		log.Infof("enabled ratelimiters %v: %v", o.EnableRatelimiters, o.RatelimitSettings)
-		ratelimitRegistry = ratelimit.NewSwarmRegistry(swarmer, redisOptions, o.RatelimitSettings...)
+		if o.InMemoryClusterRatelimits {
+			ratelimitRegistry = ratelimit.NewInMemoryRegistry(o.RatelimitSettings...)
+		} else {
+			ratelimitRegistry = ratelimit.NewSwarmRegistry(swarmer, swarmRedisOptions, o.RatelimitSettings...)
+		}
 		defer ratelimitRegistry.Close()
 
-		provider := ratelimitfilters.NewRatelimitProvider(ratelimitRegistry)
+		provider := ratelimitfilters.NewRatelimitProviderWithOptions(ratelimitRegistry, ratelimitfilters.ProviderOptions{
+			Cost: ratelimitfilters.CostOptions{
+				Header:  o.RatelimitCostHeader,
+				MaxCost: o.RatelimitMaxCost,
+			},
+			SoftLimit:      o.RatelimitSoftLimit,
+			RetryAfterDate: o.RatelimitRetryAfterDate,
+			NormalizeKeys:  o.RatelimitNormalizeKeys,
+			BypassCIDRs:    o.RatelimitBypassCIDRs,
+			TrustedProxies: o.RatelimitTrustedProxies,
+
+			BackendErrorStatus: o.RatelimitBackendErrorStatus,
+		})
 		o.CustomFilters = append(o.CustomFilters,
 			ratelimitfilters.NewClientRatelimit(provider),
 			ratelimitfilters.NewLocalRatelimit(provider),
 			ratelimitfilters.NewRatelimit(provider),
 			ratelimitfilters.NewClusterRateLimit(provider),
 			ratelimitfilters.NewClusterClientRateLimit(provider),
+			ratelimitfilters.NewClusterRateLimitDryRun(provider),
+			ratelimitfilters.NewClusterClientRateLimitDryRun(provider),
+			ratelimitfilters.NewClusterHierarchicalRateLimit(provider),
+			ratelimitfilters.NewClusterMultiWindowRateLimit(provider),
+			ratelimitfilters.NewClusterRequestDedupe(provider),
+			ratelimitfilters.NewClusterClientCertRatelimit(provider),
+			ratelimitfilters.NewClusterConcurrencyLimit(provider),
 			ratelimitfilters.NewDisableRatelimit(provider),
+			auth.NewAuthLockout(ratelimitRegistry),
 		)
 	}
 
@@ -1446,6 +1910,12 @@ func run(o Options, sig chan os.Signal, idleConnsCH chan struct{}) error {
 		mux.Handle("/debug/pprof", metricsHandler)
 		mux.Handle("/debug/pprof/", metricsHandler)
 
+		mux.Handle("/jwks/ready", auth.JWKSReadinessHandler())
+
+		if ratelimitRegistry != nil {
+			mux.Handle("/ratelimit/config", ratelimitRegistry.ConfigHandler())
+		}
+
 		log.Infof("support listener on %s", supportListener)
 		go func() {
 			if err := http.ListenAndServe(supportListener, mux); err != nil {